@@ -1,5 +1,6 @@
 // This is a utility application that polls /stats for all the producers
-// of the specified topic/channel and displays aggregate stats
+// of the specified topic/channel and displays aggregate stats, or with --top
+// the deepest topics of the cluster
 
 package main
 
@@ -10,6 +11,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -25,6 +27,8 @@ var (
 	showVersion        = flag.Bool("version", false, "print version")
 	topic              = flag.String("topic", "", "NSQ topic")
 	channel            = flag.String("channel", "", "NSQ channel")
+	top                = flag.Int("top", 0, "display the N deepest topics (of all the producers) instead of a topic/channel")
+	topicRegex         = flag.String("topic-regex", "", "only consider the topics matching this regular expression with --top")
 	interval           = flag.Duration("interval", 2*time.Second, "duration of time between polling/printing output")
 	httpConnectTimeout = flag.Duration("http-client-connect-timeout", 2*time.Second, "timeout for HTTP connect")
 	httpRequestTimeout = flag.Duration("http-client-request-timeout", 5*time.Second, "timeout for HTTP request")
@@ -120,6 +124,62 @@ func statLoop(interval time.Duration, connectTimeout time.Duration, requestTimeo
 	os.Exit(0)
 }
 
+// topLoop displays the n topics with the most messages queued at the topic and its
+// channels, each nsqd returns its n deepest so a topic spread thinly over many nodes
+// can be missed
+func topLoop(interval time.Duration, connectTimeout time.Duration, requestTimeout time.Duration,
+	n int, topicRegex string, nsqdHTTPAddrs []string, lookupdHTTPAddrs []string) {
+	ci := clusterinfo.New(nil, http_api.NewClient(nil, connectTimeout, requestTimeout))
+	for i := 0; !countNum.isSet || countNum.value >= i; i++ {
+		producers, err := ci.GetProducers(lookupdHTTPAddrs, nsqdHTTPAddrs)
+		if err != nil {
+			log.Fatalf("ERROR: failed to get producers - %s", err)
+		}
+
+		filter := clusterinfo.StatsFilter{TopicRegex: topicRegex, SortBy: "depth", Limit: n}
+		topicStats, _, err := ci.GetNSQDFilteredStats(producers, filter, false)
+		if err != nil {
+			log.Fatalf("ERROR: failed to get nsqd stats - %s", err)
+		}
+
+		topicMap := make(map[string]*clusterinfo.TopicStats)
+		var topics []*clusterinfo.TopicStats
+		for _, t := range topicStats {
+			ts, ok := topicMap[t.TopicName]
+			if !ok {
+				ts = &clusterinfo.TopicStats{TopicName: t.TopicName}
+				topicMap[t.TopicName] = ts
+				topics = append(topics, ts)
+			}
+			ts.Add(t)
+		}
+		totalDepth := func(t *clusterinfo.TopicStats) int64 {
+			depth := t.Depth
+			for _, c := range t.Channels {
+				depth += c.Depth
+			}
+			return depth
+		}
+		sort.SliceStable(topics, func(i, j int) bool {
+			return totalDepth(topics[i]) > totalDepth(topics[j])
+		})
+		if len(topics) > n {
+			topics = topics[:n]
+		}
+
+		fmt.Printf("%s\n", time.Now().Format(time.RFC3339))
+		fmt.Printf("%-40s %10s %10s %12s %8s\n", "topic", "total", "depth", "msgs", "channels")
+		for _, t := range topics {
+			fmt.Printf("%-40s %10d %10d %12d %8d\n",
+				t.TopicName, totalDepth(t), t.Depth, t.MessageCount, len(t.Channels))
+		}
+		fmt.Println()
+
+		time.Sleep(interval)
+	}
+	os.Exit(0)
+}
+
 func checkAddrs(addrs []string) error {
 	for _, a := range addrs {
 		if strings.HasPrefix(a, "http") {
@@ -137,7 +197,10 @@ func main() {
 		return
 	}
 
-	if *topic == "" || *channel == "" {
+	if *top < 0 {
+		log.Fatal("--top should be positive")
+	}
+	if *top == 0 && (*topic == "" || *channel == "") {
 		log.Fatal("--topic and --channel are required")
 	}
 
@@ -178,7 +241,11 @@ func main() {
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	go statLoop(intvl, connectTimeout, requestTimeout, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	if *top > 0 {
+		go topLoop(intvl, connectTimeout, requestTimeout, *top, *topicRegex, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	} else {
+		go statLoop(intvl, connectTimeout, requestTimeout, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	}
 
 	<-termChan
 }
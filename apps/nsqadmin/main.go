@@ -26,6 +26,7 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
 	flagSet.String("log-prefix", "[nsqadmin] ", "log message prefix")
+	flagSet.String("log-format", opts.LogFormat, "log format: text, or json (one object per line with the topic, channel, client... as fields)")
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
 	"sync"
@@ -25,7 +26,10 @@ type program struct {
 
 func main() {
 	prg := &program{}
-	if err := svc.Run(prg, syscall.SIGINT, syscall.SIGTERM); err != nil {
+	signals := append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, drainSignals...)
+	signals = append(signals, reloadSignals...)
+	signals = append(signals, upgradeSignals...)
+	if err := svc.Run(prg, signals...); err != nil {
 		logFatal("%s", err)
 	}
 }
@@ -43,24 +47,44 @@ func (p *program) Init(env svc.Environment) error {
 		os.Exit(0)
 	}
 
+	err := loadConfig(opts, flagSet)
+	if err != nil {
+		logFatal("%s", err)
+	}
+
+	// the flags are parsed again so that they still take precedence over the config file
+	opts.ConfigLoader = func() (*nsqd.Options, error) {
+		opts := nsqd.NewOptions()
+		flagSet := nsqdFlagSet(opts)
+		flagSet.Parse(os.Args[1:])
+		return opts, loadConfig(opts, flagSet)
+	}
+
+	nsqd, err := nsqd.New(opts)
+	if err != nil {
+		logFatal("failed to instantiate nsqd - %s", err)
+	}
+	p.nsqd = nsqd
+
+	return nil
+}
+
+// loadConfig resolves opts from the flags, the --config file and the defaults
+func loadConfig(opts *nsqd.Options, flagSet *flag.FlagSet) error {
 	var cfg config
 	configFile := flagSet.Lookup("config").Value.String()
 	if configFile != "" {
 		_, err := toml.DecodeFile(configFile, &cfg)
 		if err != nil {
-			logFatal("failed to load config file %s - %s", configFile, err)
+			return fmt.Errorf("failed to load config file %s - %s", configFile, err)
 		}
 	}
-	cfg.Validate()
-
-	options.Resolve(opts, flagSet, cfg)
-
-	nsqd, err := nsqd.New(opts)
+	err := cfg.Validate()
 	if err != nil {
-		logFatal("failed to instantiate nsqd - %s", err)
+		return err
 	}
-	p.nsqd = nsqd
 
+	options.Resolve(opts, flagSet, cfg)
 	return nil
 }
 
@@ -93,6 +117,31 @@ func (p *program) Stop() error {
 }
 
 func (p *program) Handle(s os.Signal) error {
+	for _, sig := range drainSignals {
+		if s == sig {
+			p.nsqd.Drain()
+			return nil
+		}
+	}
+	for _, sig := range reloadSignals {
+		if s == sig {
+			_, err := p.nsqd.ReloadConfig()
+			if err != nil {
+				logError("%s", err)
+			}
+			return nil
+		}
+	}
+	for _, sig := range upgradeSignals {
+		if s == sig {
+			err := p.nsqd.Upgrade()
+			if err != nil {
+				logError("%s", err)
+				return nil
+			}
+			return svc.ErrStop
+		}
+	}
 	return svc.ErrStop
 }
 
@@ -104,3 +153,8 @@ func (p *program) Context() context.Context {
 func logFatal(f string, args ...interface{}) {
 	lg.LogFatal("[nsqd] ", f, args...)
 }
+
+func logError(f string, args ...interface{}) {
+	logger := log.New(os.Stderr, "[nsqd] ", log.Ldate|log.Ltime|log.Lmicroseconds)
+	lg.Logf(logger, lg.ERROR, lg.ERROR, f, args...)
+}
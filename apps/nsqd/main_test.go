@@ -27,7 +27,10 @@ func TestConfigFlagParsing(t *testing.T) {
 	defer f.Close()
 	toml.NewDecoder(f).Decode(&cfg)
 	cfg["log_level"] = "debug"
-	cfg.Validate()
+	err = cfg.Validate()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
 
 	options.Resolve(opts, flagSet, cfg)
 	nsqd.New(opts)
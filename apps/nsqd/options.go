@@ -76,8 +76,8 @@ func (t *tlsMinVersionOption) String() string {
 
 type config map[string]interface{}
 
-// Validate settings in the config file, and fatal on errors
-func (cfg config) Validate() {
+// Validate settings in the config file
+func (cfg config) Validate() error {
 	// special validation/translation
 	if v, exists := cfg["tls_required"]; exists {
 		var t tlsRequiredOption
@@ -85,7 +85,7 @@ func (cfg config) Validate() {
 		if err == nil {
 			cfg["tls_required"] = t.String()
 		} else {
-			logFatal("failed parsing tls_required %+v", v)
+			return fmt.Errorf("failed parsing tls_required %+v", v)
 		}
 	}
 	if v, exists := cfg["tls_min_version"]; exists {
@@ -99,7 +99,7 @@ func (cfg config) Validate() {
 				delete(cfg, "tls_min_version")
 			}
 		} else {
-			logFatal("failed parsing tls_min_version %+v", v)
+			return fmt.Errorf("failed parsing tls_min_version %+v", v)
 		}
 	}
 	if v, exists := cfg["log_level"]; exists {
@@ -108,9 +108,10 @@ func (cfg config) Validate() {
 		if err == nil {
 			cfg["log_level"] = t
 		} else {
-			logFatal("failed parsing log_level %+v", v)
+			return fmt.Errorf("failed parsing log_level %+v", v)
 		}
 	}
+	return nil
 }
 
 func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
@@ -123,6 +124,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
 	flagSet.String("log-prefix", "[nsqd] ", "log message prefix")
+	flagSet.String("log-format", opts.LogFormat, "log format: text, or json (one object per line with the topic, channel, client... as fields)")
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
 	flagSet.Int64("node-id", opts.ID, "unique part for message IDs, (int) in range [0,1024) (default is hash of hostname)")
@@ -135,6 +137,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> or a full url to query auth server (may be given multiple times)")
 	flagSet.String("auth-http-request-method", opts.AuthHTTPRequestMethod, "HTTP method to use for auth server requests")
+	flagSet.String("peer-auth-secret", opts.PeerAuthSecret, "secret to AUTH with to the nsqd peers (--replica-tcp-address, MIGRATE targets) that require it")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.Int("broadcast-tcp-port", opts.BroadcastTCPPort, "TCP port that will be registered with lookupd (defaults to the TCP port that this nsqd is listening on)")
 	flagSet.Int("broadcast-http-port", opts.BroadcastHTTPPort, "HTTP port that will be registered with lookupd (defaults to the HTTP port that this nsqd is listening on)")
@@ -142,6 +145,8 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.Duration("http-client-connect-timeout", opts.HTTPClientConnectTimeout, "timeout for HTTP connect")
 	flagSet.Duration("http-client-request-timeout", opts.HTTPClientRequestTimeout, "timeout for HTTP request")
+	flagSet.Duration("upgrade-timeout", opts.UpgradeTimeout, "duration of time to wait for the new nsqd to start on upgrade, and between warnings while the new one waits for the previous one to exit (see SIGUSR2)")
+	flagSet.Duration("drain-timeout", opts.DrainTimeout, "duration after which a draining nsqd exits even if consumers have not emptied their channels, the rest is persisted (0 to wait)")
 
 	// diskqueue options
 	flagSet.String("data-path", opts.DataPath, "path to store disk-backed messages")
@@ -159,6 +164,36 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.Int64("spill-msg-threshold", opts.SpillMsgThreshold, "size in bytes above which PUB message bodies are spilled to files in the data path and streamed to consumers (0 to disable, older nsqd versions cannot read the queues of a node that spilled messages)")
+	flagSet.Int64("max-spill-msg-size", opts.MaxSpillMsgSize, "maximum size of a single spilled message in bytes")
+	flagSet.Duration("topic-idle-ttl", opts.TopicIdleTTL, "duration after which a topic without channels nor publishes is deleted (0 to disable)")
+	flagSet.Duration("channel-idle-ttl", opts.ChannelIdleTTL, "duration after which a channel without clients nor FINs is deleted (0 to disable)")
+	flagSet.String("auto-create", opts.AutoCreate, "topics and channels to create on first use by PUB and SUB: 'all', 'allowlist' (those matching --auto-create-*-regex) or 'none'")
+	autoCreateTopicRegexps := app.StringArray{}
+	flagSet.Var(&autoCreateTopicRegexps, "auto-create-topic-regex", "regular expression of the topic names to create on first use with --auto-create=allowlist (may be given multiple times)")
+	autoCreateChannelRegexps := app.StringArray{}
+	flagSet.Var(&autoCreateChannelRegexps, "auto-create-channel-regex", "regular expression of the channel names to create on first use with --auto-create=allowlist (may be given multiple times)")
+	flagSet.String("seed-file", opts.SeedFile, "path to a TOML or JSON file declaring the topics and channels to create at startup and on SIGHUP")
+	flagSet.String("seed-extra", opts.SeedExtra, "what to do with the topics and channels not declared in --seed-file: 'ignore', 'report' or 'delete'")
+
+	// tracing options
+	traceTopics := app.StringArray{}
+	flagSet.Var(&traceTopics, "trace-topic", "topic whose messages are all traced, see GET /trace (may be given multiple times)")
+	flagSet.Float64("trace-sample-rate", opts.TraceSampleRate, "fraction [0,1] of the messages of all topics to trace")
+	flagSet.Int("trace-buffer-size", opts.TraceBufferSize, "number of trace events to keep in memory")
+
+	// system events options
+	flagSet.String("events-topic", opts.EventsTopic, "topic to publish topic, channel and client events to as JSON (eg. _nsqd.events), clients can not publish to it, disabled if empty")
+
+	// rate history options
+	flagSet.Duration("stats-history", opts.StatsHistory, "duration of per-second message rates to keep for GET /stats (eg. 15m, about 14KB per topic and channel), disabled if 0")
+
+	// resource check options
+	flagSet.Float64("disk-usage-warn-percent", opts.DiskUsageWarnPercent, "disk usage percent of the --data-path filesystem at which nsqd is no longer ready (0 to disable)")
+	flagSet.Float64("disk-usage-critical-percent", opts.DiskUsageCriticalPercent, "disk usage percent of the --data-path filesystem at which publishes are rejected (0 to disable)")
+	flagSet.Int64("heap-warn-bytes", opts.HeapWarnBytes, "bytes of heap in use at which nsqd is no longer ready (0 to disable)")
+	flagSet.Int64("heap-critical-bytes", opts.HeapCriticalBytes, "bytes of heap in use at which publishes are rejected (0 to disable)")
+	flagSet.Duration("resource-check-interval", opts.ResourceCheckInterval, "duration between disk and heap usage checks")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -170,16 +205,35 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
 
 	// statsd integration options
-	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
+	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon (TCP for --statsd-format=graphite) for pushing stats")
 	flagSet.Duration("statsd-interval", opts.StatsdInterval, "duration between pushing to statsd")
 	flagSet.Bool("statsd-mem-stats", opts.StatsdMemStats, "toggle sending memory and GC stats to statsd")
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
 	flagSet.Int("statsd-udp-packet-size", opts.StatsdUDPPacketSize, "the size in bytes of statsd UDP packets")
 	flagSet.Bool("statsd-exclude-ephemeral", opts.StatsdExcludeEphemeral, "Skip ephemeral topics and channels when sending stats to statsd")
+	flagSet.String("statsd-format", opts.StatsdFormat, "format of the stats: 'statsd', 'dogstatsd' (topic, channel and node as tags, eg. with --statsd-prefix=nsq.) or 'graphite' (plaintext over TCP)")
+	statsdTopicRegexps := app.StringArray{}
+	flagSet.Var(&statsdTopicRegexps, "statsd-topic-regex", "regular expression of the topic names to send stats for, all if none (may be given multiple times)")
+	statsdExcludeMetrics := app.StringArray{}
+	flagSet.Var(&statsdExcludeMetrics, "statsd-exclude-metric", "prefix of the metric names not to send, eg. channel.e2e_processing_latency (may be given multiple times)")
+
+	// prometheus options
+	flagSet.Bool("prometheus-exclude-ephemeral", opts.PrometheusExcludeEphemeral, "skip ephemeral topics and channels in /metrics")
+	flagSet.Bool("prometheus-exclude-clients", opts.PrometheusExcludeClients, "skip the per-client series in /metrics")
+
+	// replication options
+	flagSet.String("replica-tcp-address", opts.ReplicaTCPAddress, "TCP <addr>:<port> of a replica nsqd to replicate messages and acks to")
+	replicateTopicRegexps := app.StringArray{}
+	flagSet.Var(&replicateTopicRegexps, "replicate-topic-regex", "regular expression of the (non-ephemeral) topic names to replicate with --replica-tcp-address (may be given multiple times)")
+	flagSet.String("replication-mode", opts.ReplicationMode, "wait for the replica to accept each message and ack before responding ('sync') or not ('async')")
+	flagSet.Bool("replica", opts.Replica, "run as a replica, holding replicated messages until the primary has been gone for --replica-takeover-timeout")
+	replicaPrimaryAddresses := app.StringArray{}
+	flagSet.Var(&replicaPrimaryAddresses, "replica-primary-address", "host or IP of the primary nsqd allowed to replicate to this --replica (may be given multiple times)")
+	flagSet.Duration("replica-takeover-timeout", opts.ReplicaTakeoverTimeout, "duration of time without a connection from the primary before a replica takes over")
 
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
-	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
+	flagSet.Var(&e2eProcessingLatencyPercentiles, "e2e-processing-latency-percentile", "message processing time percentiles (as float (0, 1.0]) to track, end to end, queue wait and handler (can be specified multiple times or comma separated '1.0,0.99,0.95', default none)")
 	flagSet.Duration("e2e-processing-latency-window-time", opts.E2EProcessingLatencyWindowTime, "calculate end to end latency quantiles for this duration of time (ie: 60s would only show quantile calculations from the past 60 seconds)")
 
 	// TLS config
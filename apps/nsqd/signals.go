@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals put nsqd into drain mode (see nsqd.Drain)
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals reload the --config file and reconcile the topics and channels
+// with the --seed-file (see nsqd.ReloadConfig)
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// upgradeSignals exec the nsqd binary again, hand it the listeners and exit (see nsqd.Upgrade)
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
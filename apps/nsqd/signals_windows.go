@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// drainSignals put nsqd into drain mode (see nsqd.Drain)
+var drainSignals = []os.Signal{}
+
+// reloadSignals reload the --config file and reconcile the topics and channels
+// with the --seed-file (see nsqd.ReloadConfig)
+var reloadSignals = []os.Signal{}
+
+// upgradeSignals exec the nsqd binary again, hand it the listeners and exit (see nsqd.Upgrade)
+var upgradeSignals = []os.Signal{}
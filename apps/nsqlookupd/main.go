@@ -25,6 +25,7 @@ func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
 	logLevel := opts.LogLevel
 	flagSet.Var(&logLevel, "log-level", "set log verbosity: debug, info, warn, error, or fatal")
 	flagSet.String("log-prefix", "[nsqlookupd] ", "log message prefix")
+	flagSet.String("log-format", opts.LogFormat, "log format: text, or json (one object per line with the topic, channel, client... as fields)")
 	flagSet.Bool("verbose", false, "[deprecated] has no effect, use --log-level")
 
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
@@ -81,7 +82,7 @@ func (p *program) Start() error {
 	options.Resolve(opts, flagSet, cfg)
 	nsqlookupd, err := nsqlookupd.New(opts)
 	if err != nil {
-		logFatal("failed to instantiate nsqlookupd", err)
+		logFatal("failed to instantiate nsqlookupd - %s", err)
 	}
 	p.nsqlookupd = nsqlookupd
 
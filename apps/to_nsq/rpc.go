@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/rpc"
+)
+
+// rpcClient sends requests with the RPC command and waits for their reply on
+// the (ephemeral) reply topic nsqd created for the connection
+type rpcClient struct {
+	conn       net.Conn
+	timeout    time.Duration
+	replyTopic string
+	sequence   int64
+}
+
+func newRPCClient(addr string, userAgent string, timeout time.Duration) (*rpcClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &rpcClient{
+		conn:    conn,
+		timeout: timeout,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(nsq.MagicV2)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cmd, err := nsq.Identify(map[string]interface{}{"user_agent": userAgent})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = c.exec(cmd)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// exec sends a command and reads its response, it must not be used once ready
+// to receive messages
+func (c *rpcClient) exec(cmd *nsq.Command) error {
+	_, err := cmd.WriteTo(c.conn)
+	if err != nil {
+		return err
+	}
+	frameType, data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if frameType == nsq.FrameTypeError {
+		return fmt.Errorf("%s failed - %s", cmd.Name, data)
+	}
+	return nil
+}
+
+func (c *rpcClient) readFrame() (int32, []byte, error) {
+	resp, err := nsq.ReadResponse(c.conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	return nsq.UnpackResponse(resp)
+}
+
+// Request publishes body to topic and returns the body of the reply
+func (c *rpcClient) Request(topic string, body []byte) ([]byte, error) {
+	c.sequence++
+	correlationID := strconv.FormatInt(c.sequence, 10)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	cmd := &nsq.Command{
+		Name:   []byte("RPC"),
+		Params: [][]byte{[]byte(topic), []byte(correlationID)},
+		Body:   body,
+	}
+	_, err := cmd.WriteTo(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		frameType, data, err := c.readFrame()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, errors.New("timed out waiting for reply")
+			}
+			return nil, err
+		}
+
+		switch frameType {
+		case nsq.FrameTypeError:
+			return nil, fmt.Errorf("RPC failed - %s", data)
+		case nsq.FrameTypeResponse:
+			if bytes.Equal(data, []byte("_heartbeat_")) {
+				_, err = nsq.Nop().WriteTo(c.conn)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if c.replyTopic == "" {
+				// the first RPC responds with the reply topic to subscribe to
+				c.replyTopic = string(data)
+				err = c.subscribe()
+				if err != nil {
+					return nil, err
+				}
+			}
+		case nsq.FrameTypeMessage:
+			msg, err := nsq.DecodeMessage(data)
+			if err != nil {
+				return nil, err
+			}
+			_, err = nsq.Finish(msg.ID).WriteTo(c.conn)
+			if err != nil {
+				return nil, err
+			}
+			_, replyCorrelationID, replyBody, err := rpc.Decode(msg.Body)
+			if err != nil {
+				return nil, err
+			}
+			// skip late replies to requests that timed out
+			if replyCorrelationID == correlationID {
+				return replyBody, nil
+			}
+		}
+	}
+}
+
+func (c *rpcClient) subscribe() error {
+	err := c.exec(nsq.Subscribe(c.replyTopic, "to_nsq#ephemeral"))
+	if err != nil {
+		return err
+	}
+	_, err = nsq.Ready(1).WriteTo(c.conn)
+	return err
+}
+
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
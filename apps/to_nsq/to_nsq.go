@@ -24,6 +24,9 @@ var (
 	topic     = flag.String("topic", "", "NSQ topic to publish to")
 	delimiter = flag.String("delimiter", "\n", "character to split input from stdin")
 
+	rpcMode    = flag.Bool("rpc", false, "send each message as an RPC request and write its reply to stdout")
+	rpcTimeout = flag.Duration("rpc-timeout", 10*time.Second, "duration to wait for the reply to an RPC request")
+
 	destNsqdTCPAddrs = app.StringArray{}
 )
 
@@ -52,18 +55,53 @@ func main() {
 
 	cfg.UserAgent = fmt.Sprintf("to_nsq/%s go-nsq/%s", version.Binary, nsq.VERSION)
 
-	// make the producers
-	producers := make(map[string]*nsq.Producer)
-	for _, addr := range destNsqdTCPAddrs {
-		producer, err := nsq.NewProducer(addr, cfg)
-		if err != nil {
-			log.Fatalf("failed to create nsq.Producer - %s", err)
-		}
-		producers[addr] = producer
+	if len(destNsqdTCPAddrs) == 0 {
+		log.Fatal("--nsqd-tcp-address required")
 	}
 
-	if len(producers) == 0 {
-		log.Fatal("--nsqd-tcp-address required")
+	var publish func(line []byte) error
+	var stop func()
+	if *rpcMode {
+		if len(destNsqdTCPAddrs) != 1 {
+			log.Fatal("--rpc requires a single --nsqd-tcp-address")
+		}
+		client, err := newRPCClient(destNsqdTCPAddrs[0], cfg.UserAgent, *rpcTimeout)
+		if err != nil {
+			log.Fatalf("failed to connect to nsqd - %s", err)
+		}
+		publish = func(line []byte) error {
+			reply, err := client.Request(*topic, line)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(os.Stdout, "%s\n", reply)
+			return err
+		}
+		stop = func() { client.Close() }
+	} else {
+		// make the producers
+		producers := make(map[string]*nsq.Producer)
+		for _, addr := range destNsqdTCPAddrs {
+			producer, err := nsq.NewProducer(addr, cfg)
+			if err != nil {
+				log.Fatalf("failed to create nsq.Producer - %s", err)
+			}
+			producers[addr] = producer
+		}
+		publish = func(line []byte) error {
+			for _, producer := range producers {
+				err := producer.Publish(*topic, line)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		stop = func() {
+			for _, producer := range producers {
+				producer.Stop()
+			}
+		}
 	}
 
 	throttleEnabled := *rate >= 1
@@ -98,10 +136,10 @@ func main() {
 				if currentBalance <= 0 {
 					time.Sleep(interval)
 				}
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(r, delim, publish)
 				atomic.AddInt64(&balance, -1)
 			} else {
-				err = readAndPublish(r, delim, producers)
+				err = readAndPublish(r, delim, publish)
 			}
 			if err != nil {
 				if err != io.EOF {
@@ -118,14 +156,12 @@ func main() {
 	case <-stopChan:
 	}
 
-	for _, producer := range producers {
-		producer.Stop()
-	}
+	stop()
 }
 
 // readAndPublish reads to the delim from r and publishes the bytes
-// to the map of producers.
-func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Producer) error {
+// with the publish func.
+func readAndPublish(r *bufio.Reader, delim byte, publish func([]byte) error) error {
 	line, readErr := r.ReadBytes(delim)
 
 	if len(line) > 0 {
@@ -137,11 +173,9 @@ func readAndPublish(r *bufio.Reader, delim byte, producers map[string]*nsq.Produ
 		return readErr
 	}
 
-	for _, producer := range producers {
-		err := producer.Publish(*topic, line)
-		if err != nil {
-			return err
-		}
+	err := publish(line)
+	if err != nil {
+		return err
 	}
 
 	return readErr
@@ -68,6 +68,27 @@ func (c *ClusterInfo) GetVersion(addr string) (semver.Version, error) {
 	return semver.Parse(resp.Version)
 }
 
+// GetNSQDResources returns the readiness and resource usage nsqd reports in /info,
+// nil for an nsqd that does not check its resources
+func (c *ClusterInfo) GetNSQDResources(addr string) (*NodeResources, error) {
+	endpoint := fmt.Sprintf("http://%s/info", addr)
+	c.logf("CI: querying nsqd %s", endpoint)
+
+	var resp struct {
+		Ready     bool           `json:"ready"`
+		Resources *NodeResources `json:"resources"`
+	}
+	err := c.client.GETV1(endpoint, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Resources == nil {
+		return nil, nil
+	}
+	resp.Resources.Ready = resp.Ready
+	return resp.Resources, nil
+}
+
 // GetLookupdTopics returns a []string containing a union of all the topics
 // from all the given nsqlookupd
 func (c *ClusterInfo) GetLookupdTopics(lookupdHTTPAddrs []string) ([]string, error) {
@@ -536,15 +557,65 @@ func (c *ClusterInfo) GetNSQDTopicProducers(topic string, nsqdHTTPAddrs []string
 func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	selectedTopic string, selectedChannel string,
 	includeClients bool) ([]*TopicStats, map[string]*ChannelStats, error) {
+	topicStatsList, channelStatsMap, _, err := c.getNSQDStats(producers, selectedTopic, selectedChannel,
+		StatsFilter{}, includeClients)
+	return topicStatsList, channelStatsMap, err
+}
+
+// StatsFilter selects, orders and pages the topics of each nsqd for GetNSQDFilteredStats
+type StatsFilter struct {
+	TopicRegex string
+	SortBy     string // name (default), depth or rate
+	Offset     int
+	Limit      int // 0 for no limit
+}
+
+func (f StatsFilter) query() string {
+	v := url.Values{}
+	if f.TopicRegex != "" {
+		v.Set("topic_regex", f.TopicRegex)
+	}
+	if f.SortBy != "" {
+		v.Set("sort", f.SortBy)
+	}
+	if f.Offset > 0 {
+		v.Set("offset", strconv.Itoa(f.Offset))
+	}
+	if f.Limit > 0 {
+		v.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "&" + v.Encode()
+}
+
+// GetNSQDFilteredStats returns the topic stats of the given Producers selected by
+// filter, in the order of each nsqd, and the number of topics matching the filter
+// summed over the Producers
+//
+// the offset and limit apply to each nsqd, so with more than one Producer the result
+// is the union of their pages
+func (c *ClusterInfo) GetNSQDFilteredStats(producers Producers, filter StatsFilter,
+	includeClients bool) ([]*TopicStats, int, error) {
+	topicStatsList, _, total, err := c.getNSQDStats(producers, "", "", filter, includeClients)
+	return topicStatsList, total, err
+}
+
+func (c *ClusterInfo) getNSQDStats(producers Producers,
+	selectedTopic string, selectedChannel string, filter StatsFilter,
+	includeClients bool) ([]*TopicStats, map[string]*ChannelStats, int, error) {
 	var lock sync.Mutex
 	var wg sync.WaitGroup
 	var topicStatsList TopicStatsList
+	var totalTopics int
 	var errs []error
 
 	channelStatsMap := make(map[string]*ChannelStats)
 
 	type respType struct {
-		Topics []*TopicStats `json:"topics"`
+		Topics      []*TopicStats `json:"topics"`
+		TotalTopics int           `json:"total_topics"`
 	}
 
 	for _, p := range producers {
@@ -560,10 +631,12 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 				if selectedChannel != "" {
 					endpoint += "&channel=" + url.QueryEscape(selectedChannel)
 				}
+				endpoint += "&history=true"
 			}
 			if !includeClients {
 				endpoint += "&include_clients=false"
 			}
+			endpoint += filter.query()
 
 			c.logf("CI: querying nsqd %s", endpoint)
 
@@ -578,6 +651,7 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 
 			lock.Lock()
 			defer lock.Unlock()
+			totalTopics += resp.TotalTopics
 			for _, topic := range resp.Topics {
 				topic.Node = addr
 				topic.Hostname = p.Hostname
@@ -616,15 +690,16 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	wg.Wait()
 
 	if len(errs) == len(producers) {
-		return nil, nil, fmt.Errorf("failed to query any nsqd: %s", ErrList(errs))
+		return nil, nil, 0, fmt.Errorf("failed to query any nsqd: %s", ErrList(errs))
 	}
 
-	sort.Sort(TopicStatsByHost{topicStatsList})
+	// stable to keep the order of each nsqd
+	sort.Stable(TopicStatsByHost{topicStatsList})
 
 	if len(errs) > 0 {
-		return topicStatsList, channelStatsMap, ErrList(errs)
+		return topicStatsList, channelStatsMap, totalTopics, ErrList(errs)
 	}
-	return topicStatsList, channelStatsMap, nil
+	return topicStatsList, channelStatsMap, totalTopics, nil
 }
 
 // TombstoneNodeForTopic tombstones the given node for the given topic on all the given nsqlookupd
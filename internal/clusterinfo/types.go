@@ -35,6 +35,18 @@ type Producer struct {
 	OutOfDate        bool           `json:"out_of_date"`
 }
 
+// NodeResources is the disk and heap usage of an nsqd as of its last check
+type NodeResources struct {
+	Ready            bool     `json:"ready"`
+	Level            string   `json:"level"`
+	Reasons          []string `json:"reasons"`
+	DiskLevel        string   `json:"disk_level"`
+	DiskUsagePercent float64  `json:"disk_usage_percent"`
+	DiskFreeBytes    uint64   `json:"disk_free_bytes"`
+	HeapLevel        string   `json:"heap_level"`
+	HeapInuseBytes   uint64   `json:"heap_inuse_bytes"`
+}
+
 // UnmarshalJSON implements json.Unmarshaler and postprocesses of ProducerTopics and VersionObj
 func (p *Producer) UnmarshalJSON(b []byte) error {
 	var r struct {
@@ -103,6 +115,10 @@ type TopicStats struct {
 	Channels     []*ChannelStats `json:"channels"`
 	Paused       bool            `json:"paused"`
 
+	ValidationFailureCount uint64 `json:"validation_failure_count"`
+
+	Rates *Rates `json:"rates"`
+
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
 
@@ -112,9 +128,11 @@ func (t *TopicStats) Add(a *TopicStats) {
 	t.MemoryDepth += a.MemoryDepth
 	t.BackendDepth += a.BackendDepth
 	t.MessageCount += a.MessageCount
+	t.ValidationFailureCount += a.ValidationFailureCount
 	if a.Paused {
 		t.Paused = a.Paused
 	}
+	t.Rates = addRates(t.Rates, a.Rates)
 	for _, aChannelStats := range a.Channels {
 		found := false
 		for _, channelStats := range t.Channels {
@@ -157,7 +175,15 @@ type ChannelStats struct {
 	Clients       []*ClientStats  `json:"clients"`
 	Paused        bool            `json:"paused"`
 
+	OldestMessageTimestamp  int64   `json:"oldest_message_timestamp"`
+	OldestInFlightTimestamp int64   `json:"oldest_in_flight_timestamp"`
+	LagSeconds              float64 `json:"lag_seconds"`
+
+	Rates *Rates `json:"rates"`
+
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
+	QueueWaitLatency     *quantile.E2eProcessingLatencyAggregate `json:"queue_wait_latency"`
+	HandlerLatency       *quantile.E2eProcessingLatencyAggregate `json:"handler_latency"`
 }
 
 func (c *ChannelStats) Add(a *ChannelStats) {
@@ -174,6 +200,12 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	if a.Paused {
 		c.Paused = a.Paused
 	}
+	c.OldestMessageTimestamp = oldestTimestamp(c.OldestMessageTimestamp, a.OldestMessageTimestamp)
+	c.OldestInFlightTimestamp = oldestTimestamp(c.OldestInFlightTimestamp, a.OldestInFlightTimestamp)
+	if a.LagSeconds > c.LagSeconds {
+		c.LagSeconds = a.LagSeconds
+	}
+	c.Rates = addRates(c.Rates, a.Rates)
 	c.NodeStats = append(c.NodeStats, a)
 	sort.Sort(ChannelStatsByHost{c.NodeStats})
 	if c.E2eProcessingLatency == nil {
@@ -184,10 +216,92 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 		}
 	}
 	c.E2eProcessingLatency.Add(a.E2eProcessingLatency)
+	c.QueueWaitLatency = addLatency(c.QueueWaitLatency, a.QueueWaitLatency, c)
+	c.HandlerLatency = addLatency(c.HandlerLatency, a.HandlerLatency, c)
 	c.Clients = append(c.Clients, a.Clients...)
 	sort.Sort(ClientsByHost{c.Clients})
 }
 
+// addLatency merges the latency percentiles of a node into the aggregate of the channel
+func addLatency(agg *quantile.E2eProcessingLatencyAggregate, a *quantile.E2eProcessingLatencyAggregate,
+	c *ChannelStats) *quantile.E2eProcessingLatencyAggregate {
+	if agg == nil {
+		agg = &quantile.E2eProcessingLatencyAggregate{
+			Addr:    c.Node,
+			Topic:   c.TopicName,
+			Channel: c.ChannelName,
+		}
+	}
+	if a != nil {
+		agg.Add(a)
+	}
+	return agg
+}
+
+// Rates are the messages per second reported by nsqd with --stats-history
+type Rates struct {
+	Publish float64 `json:"publish"`
+	Deliver float64 `json:"deliver"`
+	Finish  float64 `json:"finish"`
+	Requeue float64 `json:"requeue"`
+
+	History *RatesHistory `json:"history"`
+}
+
+// RatesHistory is the number of messages of each second, oldest first
+type RatesHistory struct {
+	Publish []uint32 `json:"publish"`
+	Deliver []uint32 `json:"deliver"`
+	Finish  []uint32 `json:"finish"`
+	Requeue []uint32 `json:"requeue"`
+}
+
+// addRates sums the rates of a node into the aggregate, the histories of nodes that
+// have been up for different times are aligned on the most recent second
+func addRates(agg *Rates, a *Rates) *Rates {
+	if a == nil {
+		return agg
+	}
+	if agg == nil {
+		agg = &Rates{}
+	}
+	agg.Publish += a.Publish
+	agg.Deliver += a.Deliver
+	agg.Finish += a.Finish
+	agg.Requeue += a.Requeue
+	if a.History != nil {
+		if agg.History == nil {
+			agg.History = &RatesHistory{}
+		}
+		agg.History.Publish = addSeries(agg.History.Publish, a.History.Publish)
+		agg.History.Deliver = addSeries(agg.History.Deliver, a.History.Deliver)
+		agg.History.Finish = addSeries(agg.History.Finish, a.History.Finish)
+		agg.History.Requeue = addSeries(agg.History.Requeue, a.History.Requeue)
+	}
+	return agg
+}
+
+func addSeries(agg []uint32, a []uint32) []uint32 {
+	if len(a) > len(agg) {
+		agg, a = a, agg
+	}
+	sum := make([]uint32, len(agg))
+	copy(sum, agg)
+	offset := len(agg) - len(a)
+	for i, v := range a {
+		sum[offset+i] += v
+	}
+	return sum
+}
+
+// oldestTimestamp returns the smaller non-zero timestamp
+func oldestTimestamp(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
 type ClientStats struct {
 	Node              string        `json:"node"`
 	RemoteAddress     string        `json:"remote_address"`
@@ -209,6 +323,9 @@ type ClientStats struct {
 	AuthIdentity      string        `json:"auth_identity"`
 	AuthIdentityURL   string        `json:"auth_identity_url"`
 
+	QueueWaitLatency *quantile.E2eProcessingLatencyAggregate `json:"queue_wait_latency"`
+	HandlerLatency   *quantile.E2eProcessingLatencyAggregate `json:"handler_latency"`
+
 	TLS                           bool   `json:"tls"`
 	CipherSuite                   string `json:"tls_cipher_suite"`
 	TLSVersion                    string `json:"tls_version"`
@@ -28,6 +28,7 @@ func (l *DirLock) Lock() error {
 	l.f = f
 	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
 	if err != nil {
+		f.Close()
 		return fmt.Errorf("cannot flock directory %s - %s (possibly in use by another instance of nsqd)", l.dir, err)
 	}
 	return nil
@@ -0,0 +1,503 @@
+// Package jsonschema validates JSON documents against a JSON Schema.
+//
+// It implements the validation keywords of JSON Schema (draft 7) that describe
+// the shape of a document:
+//
+//	type, enum, const, properties, required, additionalProperties, items,
+//	minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+//	minLength, maxLength, pattern, allOf, anyOf, oneOf, not
+//
+// The other validation keywords of JSON Schema (eg. $ref, format, patternProperties,
+// uniqueItems, if/then/else) are not supported and fail compilation so that a schema
+// is never less strict than it reads. Annotations (eg. title, description, $schema)
+// and unknown keywords are ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	// false schema, no document is valid
+	never bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+
+	items    *Schema
+	minItems *int
+	maxItems *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// Compile parses a JSON Schema
+func Compile(data []byte) (*Schema, error) {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return compile(v, "")
+}
+
+// Validate returns an error describing the first violation of the schema by a document
+func (s *Schema) Validate(data []byte) error {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return fmt.Errorf("invalid JSON - %s", err)
+	}
+	return s.validate(v, "")
+}
+
+var validTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// the validation keywords of JSON Schema (draft 7 and later) that are not implemented
+var unsupportedKeywords = []string{
+	"$ref", "$dynamicRef", "$recursiveRef",
+	"multipleOf", "format", "contentEncoding", "contentMediaType",
+	"additionalItems", "prefixItems", "uniqueItems", "contains", "minContains", "maxContains",
+	"unevaluatedItems",
+	"patternProperties", "propertyNames", "minProperties", "maxProperties",
+	"dependencies", "dependentRequired", "dependentSchemas", "unevaluatedProperties",
+	"if", "then", "else",
+}
+
+func compile(v interface{}, path string) (*Schema, error) {
+	switch v := v.(type) {
+	case bool:
+		return &Schema{never: !v}, nil
+	case map[string]interface{}:
+		return compileObject(v, path)
+	}
+	return nil, fmt.Errorf("%s: schema must be an object or a boolean", pointer(path))
+}
+
+func compileObject(m map[string]interface{}, path string) (*Schema, error) {
+	var err error
+	s := &Schema{}
+
+	for _, keyword := range unsupportedKeywords {
+		if _, ok := m[keyword]; ok {
+			return nil, fmt.Errorf("%s: %s is not supported", pointer(path), keyword)
+		}
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: type must be a string or an array of strings", pointer(path))
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: type must be a string or an array of strings", pointer(path))
+	}
+	for _, name := range s.types {
+		if !validTypes[name] {
+			return nil, fmt.Errorf("%s: invalid type %q", pointer(path), name)
+		}
+	}
+
+	if v, ok := m["enum"]; ok {
+		enum, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: enum must be an array", pointer(path))
+		}
+		s.enum = enum
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if v, ok := m["properties"]; ok {
+		properties, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: properties must be an object", pointer(path))
+		}
+		s.properties = make(map[string]*Schema, len(properties))
+		for name, property := range properties {
+			s.properties[name], err = compile(property, path+"/properties/"+name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := m["required"]; ok {
+		required, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: required must be an array of strings", pointer(path))
+		}
+		for _, name := range required {
+			name, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: required must be an array of strings", pointer(path))
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if v, ok := m["additionalProperties"]; ok {
+		s.additionalProperties, err = compile(v, path+"/additionalProperties")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := m["items"]; ok {
+		s.items, err = compile(v, path+"/items")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.minItems, err = compileInt(m, "minItems", path); err != nil {
+		return nil, err
+	}
+	if s.maxItems, err = compileInt(m, "maxItems", path); err != nil {
+		return nil, err
+	}
+
+	if s.minimum, err = compileNumber(m, "minimum", path); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = compileNumber(m, "maximum", path); err != nil {
+		return nil, err
+	}
+	if s.exclusiveMinimum, err = compileNumber(m, "exclusiveMinimum", path); err != nil {
+		return nil, err
+	}
+	if s.exclusiveMaximum, err = compileNumber(m, "exclusiveMaximum", path); err != nil {
+		return nil, err
+	}
+
+	if s.minLength, err = compileInt(m, "minLength", path); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = compileInt(m, "maxLength", path); err != nil {
+		return nil, err
+	}
+	if v, ok := m["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: pattern must be a string", pointer(path))
+		}
+		s.pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern - %s", pointer(path), err)
+		}
+	}
+
+	if s.allOf, err = compileList(m, "allOf", path); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = compileList(m, "anyOf", path); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = compileList(m, "oneOf", path); err != nil {
+		return nil, err
+	}
+	if v, ok := m["not"]; ok {
+		s.not, err = compile(v, path+"/not")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func compileNumber(m map[string]interface{}, keyword string, path string) (*float64, error) {
+	v, ok := m[keyword]
+	if !ok {
+		return nil, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a number", pointer(path), keyword)
+	}
+	return &n, nil
+}
+
+func compileInt(m map[string]interface{}, keyword string, path string) (*int, error) {
+	n, err := compileNumber(m, keyword, path)
+	if n == nil || err != nil {
+		return nil, err
+	}
+	if *n < 0 || *n != math.Trunc(*n) {
+		return nil, fmt.Errorf("%s: %s must be a non-negative integer", pointer(path), keyword)
+	}
+	i := int(*n)
+	return &i, nil
+}
+
+func compileList(m map[string]interface{}, keyword string, path string) ([]*Schema, error) {
+	v, ok := m[keyword]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s: %s must be a non-empty array", pointer(path), keyword)
+	}
+	schemas := make([]*Schema, 0, len(list))
+	for i, v := range list {
+		s, err := compile(v, path+"/"+keyword+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+func (s *Schema) validate(v interface{}, path string) error {
+	if s.never {
+		return fmt.Errorf("%s: not allowed", pointer(path))
+	}
+
+	if len(s.types) > 0 {
+		matched := false
+		for _, name := range s.types {
+			if hasType(v, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", pointer(path), typeNames(s.types), typeOf(v))
+		}
+	}
+
+	if s.enum != nil {
+		matched := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(v, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: not one of the enumerated values", pointer(path))
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(v, s.constant) {
+		return fmt.Errorf("%s: not equal to the constant value", pointer(path))
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		err := s.validateObject(v, path)
+		if err != nil {
+			return err
+		}
+	case []interface{}:
+		err := s.validateArray(v, path)
+		if err != nil {
+			return err
+		}
+	case float64:
+		err := s.validateNumber(v, path)
+		if err != nil {
+			return err
+		}
+	case string:
+		err := s.validateString(v, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range s.allOf {
+		err := sub.validate(v, path)
+		if err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any of the schemas of anyOf", pointer(path))
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of the schemas of oneOf", pointer(path), matched)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fmt.Errorf("%s: matches the schema of not", pointer(path))
+	}
+
+	return nil
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, path string) error {
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", pointer(path), name)
+		}
+	}
+
+	// validate in a stable order so that the reported violation is too
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := s.properties[name]
+		if !ok {
+			property = s.additionalProperties
+		}
+		if property == nil {
+			continue
+		}
+		err := property.validate(m[name], path+"/"+name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(a []interface{}, path string) error {
+	if s.minItems != nil && len(a) < *s.minItems {
+		return fmt.Errorf("%s: expected at least %d items, got %d", pointer(path), *s.minItems, len(a))
+	}
+	if s.maxItems != nil && len(a) > *s.maxItems {
+		return fmt.Errorf("%s: expected at most %d items, got %d", pointer(path), *s.maxItems, len(a))
+	}
+	if s.items != nil {
+		for i, item := range a {
+			err := s.items.validate(item, path+"/"+strconv.Itoa(i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(n float64, path string) error {
+	if s.minimum != nil && n < *s.minimum {
+		return fmt.Errorf("%s: %v is less than %v", pointer(path), n, *s.minimum)
+	}
+	if s.maximum != nil && n > *s.maximum {
+		return fmt.Errorf("%s: %v is greater than %v", pointer(path), n, *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+		return fmt.Errorf("%s: %v is not greater than %v", pointer(path), n, *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+		return fmt.Errorf("%s: %v is not less than %v", pointer(path), n, *s.exclusiveMaximum)
+	}
+	return nil
+}
+
+func (s *Schema) validateString(str string, path string) error {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		return fmt.Errorf("%s: expected at least %d characters, got %d", pointer(path), *s.minLength, length)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return fmt.Errorf("%s: expected at most %d characters, got %d", pointer(path), *s.maxLength, length)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return fmt.Errorf("%s: does not match pattern %q", pointer(path), s.pattern)
+	}
+	return nil
+}
+
+func hasType(v interface{}, name string) bool {
+	switch name {
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return typeOf(v) == name
+}
+
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return "unknown"
+}
+
+func typeNames(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+// pointer returns the JSON Pointer of a path, "/" being the root of the document
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
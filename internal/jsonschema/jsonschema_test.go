@@ -0,0 +1,78 @@
+package jsonschema
+
+import (
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id", "items"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["new", "paid"]},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"items": {"type": "string", "maxLength": 8}
+		}
+	},
+	"additionalProperties": false
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Compile([]byte(orderSchema))
+	test.Nil(t, err)
+
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{`{"id": 1, "items": ["a"]}`, ""},
+		{`{"id": 1, "status": "paid", "email": "a@b", "items": ["a", "b"]}`, ""},
+		{`[]`, "/: expected object, got array"},
+		{`{"items": ["a"]}`, `/: missing required property "id"`},
+		{`{"id": 1.5, "items": ["a"]}`, "/id: expected integer, got number"},
+		{`{"id": 0, "items": ["a"]}`, "/id: 0 is less than 1"},
+		{`{"id": 1, "status": "lost", "items": ["a"]}`, "/status: not one of the enumerated values"},
+		{`{"id": 1, "email": "nope", "items": ["a"]}`, `/email: does not match pattern "^[^@]+@[^@]+$"`},
+		{`{"id": 1, "items": []}`, "/items: expected at least 1 items, got 0"},
+		{`{"id": 1, "items": ["a", "too long!"]}`, "/items/1: expected at most 8 characters, got 9"},
+		{`{"id": 1, "items": ["a"], "extra": true}`, "/extra: not allowed"},
+		{`{"id": 1,`, "invalid JSON - unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		err := s.Validate([]byte(tt.doc))
+		if tt.err == "" {
+			test.Nil(t, err)
+			continue
+		}
+		test.NotNil(t, err)
+		test.Equal(t, tt.err, err.Error())
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		schema string
+		err    string
+	}{
+		{`"object"`, "/: schema must be an object or a boolean"},
+		{`{"type": "thing"}`, `/: invalid type "thing"`},
+		{`{"properties": {"a": {"$ref": "#/definitions/a"}}}`, "/properties/a: $ref is not supported"},
+		{`{"type": "string", "format": "email"}`, "/: format is not supported"},
+		{`{"patternProperties": {"^a": {"type": "string"}}}`, "/: patternProperties is not supported"},
+		{`{"items": {"uniqueItems": true}}`, "/items: uniqueItems is not supported"},
+		{`{"if": {"required": ["a"]}, "then": {"required": ["b"]}}`, "/: if is not supported"},
+		{`{"minLength": -1}`, "/: minLength must be a non-negative integer"},
+		{`{"pattern": "("}`, "/: invalid pattern - error parsing regexp: missing closing ): `(`"},
+		{`{"anyOf": []}`, "/: anyOf must be a non-empty array"},
+	}
+	for _, tt := range tests {
+		_, err := Compile([]byte(tt.schema))
+		test.NotNil(t, err)
+		test.Equal(t, tt.err, err.Error())
+	}
+}
@@ -0,0 +1,84 @@
+package lg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// log formats, see --log-format
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+func ValidateFormat(format string) error {
+	if format != TextFormat && format != JSONFormat {
+		return fmt.Errorf("invalid log format '%s' (%s, %s)", format, TextFormat, JSONFormat)
+	}
+	return nil
+}
+
+// Entry is a log line as written by JSONLogger
+type Entry struct {
+	Time          string `json:"time"`
+	Level         string `json:"level"`
+	App           string `json:"app"`
+	Component     string `json:"component,omitempty"`
+	Topic         string `json:"topic,omitempty"`
+	Channel       string `json:"channel,omitempty"`
+	Client        string `json:"client,omitempty"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Msg           string `json:"msg"`
+}
+
+// JSONLogger writes one JSON object per line, with the Fields passed to LogFieldsf
+type JSONLogger struct {
+	w   io.Writer
+	app string
+}
+
+func NewJSONLogger(w io.Writer, app string) *JSONLogger {
+	return &JSONLogger{w: w, app: app}
+}
+
+// Output writes a line formatted by Logf, ie. "LEVEL: message", that has no fields
+func (l *JSONLogger) Output(maxdepth int, s string) error {
+	e := Entry{Msg: s}
+	for _, lvl := range []LogLevel{DEBUG, INFO, WARN, ERROR, FATAL} {
+		prefix := lvl.String() + ": "
+		if strings.HasPrefix(s, prefix) {
+			e.Level = strings.ToLower(lvl.String())
+			e.Msg = s[len(prefix):]
+			break
+		}
+	}
+	return l.write(e)
+}
+
+func (l *JSONLogger) OutputFields(maxdepth int, lvl LogLevel, fields Fields, s string) error {
+	return l.write(Entry{
+		Level:         strings.ToLower(lvl.String()),
+		Component:     fields.Component,
+		Topic:         fields.Topic,
+		Channel:       fields.Channel,
+		Client:        fields.Client,
+		RemoteAddress: fields.RemoteAddress,
+		URL:           fields.URL,
+		Msg:           s,
+	})
+}
+
+func (l *JSONLogger) write(e Entry) error {
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	e.App = l.app
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
@@ -73,10 +73,44 @@ func ParseLogLevel(levelstr string) (LogLevel, error) {
 	return 0, fmt.Errorf("invalid log level '%s' (debug, info, warn, error, fatal)", levelstr)
 }
 
+// Fields are the context of a log line, ie. the component that logs it and the topic,
+// channel, client, peer or URL it is about. They are also part of the message as text
+// (eg. "TOPIC(orders): closing") for the loggers that are not a FieldsLogger.
+type Fields struct {
+	Component     string
+	Topic         string
+	Channel       string
+	Client        string
+	RemoteAddress string
+	URL           string
+}
+
+// FieldsLogger is a Logger that writes the level and the fields of a log line on their own
+type FieldsLogger interface {
+	Logger
+	OutputFields(maxdepth int, lvl LogLevel, fields Fields, s string) error
+}
+
 func Logf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, f string, args ...interface{}) {
 	if cfgLevel > msgLevel {
 		return
 	}
+	if fl, ok := logger.(FieldsLogger); ok {
+		fl.OutputFields(3, msgLevel, Fields{}, fmt.Sprintf(f, args...))
+		return
+	}
+	logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
+}
+
+// LogFieldsf is Logf for a message that comes with its Fields
+func LogFieldsf(logger Logger, cfgLevel LogLevel, msgLevel LogLevel, fields Fields, f string, args ...interface{}) {
+	if cfgLevel > msgLevel {
+		return
+	}
+	if fl, ok := logger.(FieldsLogger); ok {
+		fl.OutputFields(3, msgLevel, fields, fmt.Sprintf(f, args...))
+		return
+	}
 	logger.Output(3, fmt.Sprintf(msgLevel.String()+": "+f, args...))
 }
 
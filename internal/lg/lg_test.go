@@ -1,6 +1,8 @@
 package lg
 
 import (
+	"bytes"
+	"encoding/json"
 	"testing"
 
 	"github.com/nsqio/nsq/internal/test"
@@ -39,3 +41,62 @@ func TestLogging(t *testing.T) {
 	}
 	test.Equal(t, 5, logger.Count)
 }
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, "nsqd")
+	LogFieldsf(logger, INFO, INFO, Fields{Component: "TOPIC", Topic: "orders"}, "TOPIC(%s): created", "orders")
+	LogFieldsf(logger, INFO, INFO, Fields{Component: "PROTOCOL", Client: "127.0.0.1:4242", RemoteAddress: "127.0.0.1:4242"},
+		"PROTOCOL(V2): [%s] exiting ioloop", "127.0.0.1:4242")
+	Logf(logger, INFO, WARN, "NSQ: %s", "bye")
+	LogFieldsf(logger, INFO, DEBUG, Fields{Component: "TOPIC", Topic: "orders"}, "TOPIC(%s): filtered", "orders")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	test.Equal(t, 3, len(lines))
+
+	var entries []Entry
+	for _, line := range lines {
+		var e Entry
+		err := json.Unmarshal(line, &e)
+		test.Nil(t, err)
+		test.Equal(t, true, e.Time != "")
+		test.Equal(t, "nsqd", e.App)
+		e.Time = ""
+		e.App = ""
+		entries = append(entries, e)
+	}
+	test.Equal(t, Entry{Level: "info", Component: "TOPIC", Topic: "orders", Msg: "TOPIC(orders): created"}, entries[0])
+	test.Equal(t, Entry{Level: "info", Component: "PROTOCOL", Client: "127.0.0.1:4242", RemoteAddress: "127.0.0.1:4242",
+		Msg: "PROTOCOL(V2): [127.0.0.1:4242] exiting ioloop"}, entries[1])
+	// the text of messages logged without fields is not parsed for them
+	test.Equal(t, Entry{Level: "warning", Msg: "NSQ: bye"}, entries[2])
+
+	// the loggers that do not take fields get the text only
+	buf.Reset()
+	err := NewJSONLogger(&buf, "nsqd").Output(2, "ERROR: TOPIC(orders): failed")
+	test.Nil(t, err)
+	var e Entry
+	err = json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &e)
+	test.Nil(t, err)
+	test.Equal(t, "error", e.Level)
+	test.Equal(t, "", e.Topic)
+	test.Equal(t, "TOPIC(orders): failed", e.Msg)
+
+	test.Nil(t, ValidateFormat(JSONFormat))
+	test.NotNil(t, ValidateFormat("xml"))
+}
+
+type textLogger struct {
+	lines []string
+}
+
+func (l *textLogger) Output(maxdepth int, s string) error {
+	l.lines = append(l.lines, s)
+	return nil
+}
+
+func TestLogFieldsfText(t *testing.T) {
+	logger := &textLogger{}
+	LogFieldsf(logger, INFO, ERROR, Fields{Component: "TOPIC", Topic: "orders"}, "TOPIC(%s): failed", "orders")
+	test.Equal(t, []string{"ERROR: TOPIC(orders): failed"}, logger.lines)
+}
@@ -4,6 +4,9 @@ import (
 	"regexp"
 )
 
+// MaxNameLength is the maximum length of a topic or channel name
+const MaxNameLength = 64
+
 var validTopicChannelNameRegex = regexp.MustCompile(`^[.a-zA-Z0-9_-]+(#ephemeral)?$`)
 
 // IsValidTopicName checks a topic name for correctness
@@ -17,7 +20,7 @@ func IsValidChannelName(name string) bool {
 }
 
 func isValidName(name string) bool {
-	if len(name) > 64 || len(name) < 1 {
+	if len(name) > MaxNameLength || len(name) < 1 {
 		return false
 	}
 	return validTopicChannelNameRegex.MatchString(name)
@@ -0,0 +1,59 @@
+// Package rpc implements the envelope of request/reply (RPC) messages.
+//
+// The body of a message published with the RPC command carries the topic to
+// reply to and a correlation ID ahead of the request:
+//
+//	[ 2-byte reply_to size ][ reply_to ][ 2-byte correlation_id size ][ correlation_id ][ N-byte body ]
+//
+// Replies are published (with PUB) to the reply_to topic in the same format
+// with an empty reply_to, the correlation ID being that of the request.
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Encode returns the envelope of body
+func Encode(replyTo string, correlationID string, body []byte) ([]byte, error) {
+	if len(replyTo) > math.MaxUint16 || len(correlationID) > math.MaxUint16 {
+		return nil, errors.New("reply_to or correlation_id too long")
+	}
+
+	buf := make([]byte, 2+len(replyTo)+2+len(correlationID)+len(body))
+	n := 0
+	binary.BigEndian.PutUint16(buf[n:], uint16(len(replyTo)))
+	n += 2
+	n += copy(buf[n:], replyTo)
+	binary.BigEndian.PutUint16(buf[n:], uint16(len(correlationID)))
+	n += 2
+	n += copy(buf[n:], correlationID)
+	copy(buf[n:], body)
+	return buf, nil
+}
+
+// Decode splits an envelope into the topic to reply to, the correlation ID and the body
+func Decode(data []byte) (replyTo string, correlationID string, body []byte, err error) {
+	replyTo, data, err = readString(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	correlationID, data, err = readString(data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return replyTo, correlationID, data, nil
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("invalid envelope")
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < size {
+		return "", nil, errors.New("invalid envelope")
+	}
+	return string(data[:size]), data[size:], nil
+}
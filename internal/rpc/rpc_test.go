@@ -0,0 +1,21 @@
+package rpc
+
+import (
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data, err := Encode("reply_topic", "42", []byte("body"))
+	test.Nil(t, err)
+
+	replyTo, correlationID, body, err := Decode(data)
+	test.Nil(t, err)
+	test.Equal(t, "reply_topic", replyTo)
+	test.Equal(t, "42", correlationID)
+	test.Equal(t, []byte("body"), body)
+
+	_, _, _, err = Decode(data[:5])
+	test.NotNil(t, err)
+}
@@ -3,38 +3,76 @@ package statsd
 import (
 	"fmt"
 	"io"
+	"strings"
+	"time"
 )
 
+// the line formats a Client can write
+const (
+	FormatStatsd    = "statsd"
+	FormatDogStatsd = "dogstatsd"
+	FormatGraphite  = "graphite"
+)
+
+// Tag is a DogStatsD tag, the other formats ignore them
+type Tag struct {
+	Key   string
+	Value string
+}
+
 type Client struct {
 	w      io.Writer
 	prefix string
+	format string
 }
 
 func NewClient(w io.Writer, prefix string) *Client {
+	return NewFormatClient(w, prefix, FormatStatsd)
+}
+
+// NewFormatClient returns a Client writing lines in the given format, graphite
+// plaintext has no metric types so counters are sent as the count itself
+func NewFormatClient(w io.Writer, prefix string, format string) *Client {
 	return &Client{
 		w:      w,
 		prefix: prefix,
+		format: format,
 	}
 }
 
-func (c *Client) Incr(stat string, count int64) error {
-	return c.send(stat, "%d|c", count)
+func (c *Client) Incr(stat string, count int64, tags ...Tag) error {
+	return c.send(stat, "c", count, tags)
 }
 
-func (c *Client) Decr(stat string, count int64) error {
-	return c.send(stat, "%d|c", -count)
+func (c *Client) Decr(stat string, count int64, tags ...Tag) error {
+	return c.send(stat, "c", -count, tags)
 }
 
-func (c *Client) Timing(stat string, delta int64) error {
-	return c.send(stat, "%d|ms", delta)
+func (c *Client) Timing(stat string, delta int64, tags ...Tag) error {
+	return c.send(stat, "ms", delta, tags)
 }
 
-func (c *Client) Gauge(stat string, value int64) error {
-	return c.send(stat, "%d|g", value)
+func (c *Client) Gauge(stat string, value int64, tags ...Tag) error {
+	return c.send(stat, "g", value, tags)
 }
 
-func (c *Client) send(stat string, format string, value int64) error {
-	format = fmt.Sprintf("%s%s:%s\n", c.prefix, stat, format)
-	_, err := fmt.Fprintf(c.w, format, value)
+func (c *Client) send(stat string, typ string, value int64, tags []Tag) error {
+	var err error
+	switch c.format {
+	case FormatGraphite:
+		_, err = fmt.Fprintf(c.w, "%s%s %d %d\n", c.prefix, stat, value, time.Now().Unix())
+	case FormatDogStatsd:
+		var t string
+		if len(tags) > 0 {
+			pairs := make([]string, len(tags))
+			for i, tag := range tags {
+				pairs[i] = tag.Key + ":" + tag.Value
+			}
+			t = "|#" + strings.Join(pairs, ",")
+		}
+		_, err = fmt.Fprintf(c.w, "%s%s:%d|%s%s\n", c.prefix, stat, value, typ, t)
+	default:
+		_, err = fmt.Fprintf(c.w, "%s%s:%d|%s\n", c.prefix, stat, value, typ)
+	}
 	return err
 }
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -357,6 +358,11 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps h
 func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
 	node := ps.ByName("node")
 
 	producers, err := s.ci.GetProducers(s.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.nsqadmin.getOpts().NSQDHTTPAddresses)
@@ -375,11 +381,37 @@ func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps ht
 		return nil, http_api.Err{404, "NODE_NOT_FOUND"}
 	}
 
-	topicStats, _, err := s.ci.GetNSQDStats(clusterinfo.Producers{producer}, "", "", true)
+	var filter clusterinfo.StatsFilter
+	filter.TopicRegex, _ = reqParams.Get("topic_regex")
+	filter.SortBy, _ = reqParams.Get("sort")
+	if v, _ := reqParams.Get("offset"); v != "" {
+		filter.Offset, err = strconv.Atoi(v)
+		if err != nil || filter.Offset < 0 {
+			return nil, http_api.Err{400, "INVALID_OFFSET"}
+		}
+	}
+	if v, _ := reqParams.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 0 {
+			return nil, http_api.Err{400, "INVALID_LIMIT"}
+		}
+	}
+
+	topicStats, totalTopics, err := s.ci.GetNSQDFilteredStats(clusterinfo.Producers{producer}, filter, true)
 	if err != nil {
 		s.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
 		return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
 	}
+	// older nsqd do not report total_topics
+	if totalTopics < filter.Offset+len(topicStats) {
+		totalTopics = filter.Offset + len(topicStats)
+	}
+
+	resources, err := s.ci.GetNSQDResources(producer.HTTPAddress())
+	if err != nil {
+		s.nsqadmin.logf(LOG_WARN, "failed to get nsqd resources - %s", err)
+		messages = append(messages, err.Error())
+	}
 
 	var totalClients int64
 	var totalMessages int64
@@ -391,16 +423,20 @@ func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps ht
 	}
 
 	return struct {
-		Node          string                    `json:"node"`
-		TopicStats    []*clusterinfo.TopicStats `json:"topics"`
-		TotalMessages int64                     `json:"total_messages"`
-		TotalClients  int64                     `json:"total_clients"`
-		Message       string                    `json:"message"`
+		Node          string                     `json:"node"`
+		TopicStats    []*clusterinfo.TopicStats  `json:"topics"`
+		TotalTopics   int                        `json:"total_topics"`
+		TotalMessages int64                      `json:"total_messages"`
+		TotalClients  int64                      `json:"total_clients"`
+		Resources     *clusterinfo.NodeResources `json:"resources"`
+		Message       string                     `json:"message"`
 	}{
 		Node:          node,
 		TopicStats:    topicStats,
+		TotalTopics:   totalTopics,
 		TotalMessages: totalMessages,
 		TotalClients:  totalClients,
+		Resources:     resources,
 		Message:       maybeWarnMsg(messages),
 	}, nil
 }
@@ -718,7 +754,7 @@ func (s *httpServer) graphiteHandler(w http.ResponseWriter, req *http.Request, p
 	query := fmt.Sprintf("/render?%s", params.Encode())
 	url := s.nsqadmin.getOpts().GraphiteURL + query
 
-	s.nsqadmin.logf(LOG_INFO, "GRAPHITE: %s", url)
+	s.nsqadmin.logFields(LOG_INFO, lg.Fields{Component: "GRAPHITE", URL: url}, "GRAPHITE: %s", url)
 
 	var response []struct {
 		Target     string       `json:"target"`
@@ -18,3 +18,18 @@ func (n *NSQAdmin) logf(level lg.LogLevel, f string, args ...interface{}) {
 	opts := n.getOpts()
 	lg.Logf(opts.Logger, opts.LogLevel, level, f, args...)
 }
+
+// logFields logs a message along with the component or URL it is about, the message
+// itself is expected to carry that context for the text log format
+func (n *NSQAdmin) logFields(level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
+	opts := n.getOpts()
+	lg.LogFieldsf(opts.Logger, opts.LogLevel, level, fields, f, args...)
+}
+
+// componentLogf returns the lg.AppLogFunc of the servers shared with the other apps
+// (see http_api.Serve)
+func (n *NSQAdmin) componentLogf(component string) lg.AppLogFunc {
+	return func(level lg.LogLevel, f string, args ...interface{}) {
+		n.logFields(level, lg.Fields{Component: component}, f, args...)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"sync/atomic"
 
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -32,8 +33,15 @@ type NSQAdmin struct {
 }
 
 func New(opts *Options) (*NSQAdmin, error) {
+	if err := lg.ValidateFormat(opts.LogFormat); err != nil {
+		return nil, err
+	}
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		if opts.LogFormat == lg.JSONFormat {
+			opts.Logger = lg.NewJSONLogger(os.Stderr, "nsqadmin")
+		} else {
+			opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		}
 	}
 
 	n := &NSQAdmin{
@@ -179,7 +187,7 @@ func (n *NSQAdmin) Main() error {
 
 	httpServer := NewHTTPServer(n)
 	n.waitGroup.Wrap(func() {
-		exitFunc(http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.logf))
+		exitFunc(http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.componentLogf("HTTP")))
 	})
 	n.waitGroup.Wrap(n.handleAdminActions)
 
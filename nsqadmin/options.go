@@ -9,6 +9,7 @@ import (
 type Options struct {
 	LogLevel  lg.LogLevel `flag:"log-level"`
 	LogPrefix string      `flag:"log-prefix"`
+	LogFormat string      `flag:"log-format"`
 	Logger    Logger
 
 	HTTPAddress string `flag:"http-address"`
@@ -48,6 +49,7 @@ func NewOptions() *Options {
 	return &Options{
 		LogPrefix:                "[nsqadmin] ",
 		LogLevel:                 lg.INFO,
+		LogFormat:                lg.TextFormat,
 		HTTPAddress:              "0.0.0.0:4171",
 		BasePath:                 "/",
 		StatsdPrefix:             "nsq.%s",
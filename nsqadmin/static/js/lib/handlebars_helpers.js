@@ -234,6 +234,25 @@ Handlebars.registerHelper('nanotohuman', function(n) {
     return s;
 });
 
+Handlebars.registerHelper('secondstohuman', function(n) {
+    return Handlebars.helpers.nanotohuman(Math.round(n * 1000) * 1000000);
+});
+
+Handlebars.registerHelper('bytestohuman', function(n) {
+    var units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+    var i = 0;
+    n = n || 0;
+    while (n >= 1024 && i < units.length - 1) {
+        n = n / 1024;
+        i++;
+    }
+    return round(n, 1) + units[i];
+});
+
+Handlebars.registerHelper('round', function(n, places) {
+    return round(n || 0, places);
+});
+
 Handlebars.registerHelper('sparkline', function(typ, node, ns1, ns2, key) {
     var q = {
         'colorList': genColorList(typ, key),
@@ -290,6 +309,25 @@ Handlebars.registerHelper('rate', function(typ, node, ns1, ns2) {
     return genTargets(typ, node, ns1, ns2, 'message_count')[0];
 });
 
+// rates reported by nsqd --stats-history, drawn inline when graphite is not configured
+Handlebars.registerHelper('rate_history', function(rates, key) {
+    var rate = Handlebars.Utils.escapeExpression(rates[key].toFixed(2) + '/s');
+    var series = rates['history'] ? rates['history'][key] : null;
+    if (!series || series.length < 2) {
+        return new Handlebars.SafeString(rate);
+    }
+    var width = 120;
+    var height = 20;
+    var max = Math.max.apply(null, series) || 1;
+    var points = _.map(series, function(v, i) {
+        var x = i * width / (series.length - 1);
+        var y = height - v * (height - 1) / max;
+        return x.toFixed(1) + ',' + y.toFixed(1);
+    });
+    return new Handlebars.SafeString(rate + '<br><svg width="' + width + '" height="' + height + '">' +
+        '<polyline fill="none" stroke="black" stroke-width="1" points="' + points.join(' ') + '"/></svg>');
+});
+
 Handlebars.registerPartial('error', require('../views/error.hbs'));
 Handlebars.registerPartial('warning', require('../views/warning.hbs'));
 
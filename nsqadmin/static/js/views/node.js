@@ -1,8 +1,14 @@
+var _ = require('underscore');
+var $ = require('jquery');
+
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
 
 var BaseView = require('./base');
 
+// the query parameters passed on to nsqd /stats to select, order and page the topics
+var FILTER_PARAMS = ['topic_regex', 'sort', 'limit', 'offset'];
+
 var NodeView = BaseView.extend({
     className: 'node container-fluid',
 
@@ -11,13 +17,50 @@ var NodeView = BaseView.extend({
     initialize: function() {
         BaseView.prototype.initialize.apply(this, arguments);
         this.listenTo(AppState, 'change:graph_interval', this.render);
-        this.model.fetch()
+        this.filter = this.parseFilter();
+        this.model.fetch({'data': this.filter})
             .done(function(data) {
                 this.template = require('./node.hbs');
-                this.render({'message': data['message']});
+                this.render(_.extend({'message': data['message']}, this.pages(data['total_topics'])));
             }.bind(this))
             .fail(this.handleViewError.bind(this))
             .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
+    },
+
+    parseFilter: function() {
+        var qp = _.object(_.compact(_.map(window.location.search.slice(1).split('&'),
+            function(item) {
+                if (!item) {
+                    return false;
+                }
+                return _.map(item.split('='), function(s) {
+                    return decodeURIComponent(s.replace(/\+/g, ' '));
+                });
+            })));
+        return _.pick(_.pick(qp, FILTER_PARAMS), function(v) { return v !== ''; });
+    },
+
+    pages: function(total) {
+        var limit = parseInt(this.filter['limit'], 10) || 0;
+        var offset = parseInt(this.filter['offset'], 10) || 0;
+        if (!limit) {
+            return {};
+        }
+        var url = function(o) {
+            return AppState.basePath('/nodes/' + encodeURIComponent(this.model.get('name'))) +
+                '?' + $.param(_.extend({}, this.filter, {'offset': o}));
+        }.bind(this);
+        return {
+            'paged': true,
+            'prev_page': offset > 0 ? url(Math.max(offset - limit, 0)) : null,
+            'next_page': offset + limit < total ? url(offset + limit) : null
+        };
+    },
+
+    postRender: function() {
+        _.each(this.filter, function(v, k) {
+            this.$('.topic-filter [name=' + k + ']').val(v);
+        }, this);
     }
 });
 
@@ -0,0 +1,151 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// --auto-create policies, ie. which topics and channels PUB, SUB and /pub create on
+// first use. Ephemeral topics and channels are always created as they go away on their
+// own and /topic/create and /channel/create create them regardless.
+const (
+	// create any topic or channel
+	AutoCreateAll = "all"
+	// only create the topics and channels matching --auto-create-topic-regex
+	// and --auto-create-channel-regex
+	AutoCreateAllowlist = "allowlist"
+	// never create topics or channels
+	AutoCreateNone = "none"
+)
+
+var (
+	errTopicNotFound   = errors.New("topic does not exist")
+	errChannelNotFound = errors.New("channel does not exist")
+)
+
+// topicNotFoundError fails a multi-topic publish to a topic the policy does not create
+type topicNotFoundError struct {
+	name string
+}
+
+func (e *topicNotFoundError) Error() string {
+	return fmt.Sprintf("topic %q does not exist", e.name)
+}
+
+type autoCreatePolicy struct {
+	mode           string
+	topicRegexps   []*regexp.Regexp
+	channelRegexps []*regexp.Regexp
+}
+
+func newAutoCreatePolicy(opts *Options) (*autoCreatePolicy, error) {
+	p := &autoCreatePolicy{mode: opts.AutoCreate}
+	switch p.mode {
+	case AutoCreateAll, AutoCreateNone:
+		return p, nil
+	case AutoCreateAllowlist:
+	default:
+		return nil, fmt.Errorf("--auto-create must be %s, %s or %s",
+			AutoCreateAll, AutoCreateAllowlist, AutoCreateNone)
+	}
+
+	var err error
+	p.topicRegexps, err = compileRegexps(opts.AutoCreateTopicRegexps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --auto-create-topic-regex %s", err)
+	}
+	p.channelRegexps, err = compileRegexps(opts.AutoCreateChannelRegexps)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --auto-create-channel-regex %s", err)
+	}
+	return p, nil
+}
+
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%q - %s", expr, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func (p *autoCreatePolicy) allow(name string, regexps []*regexp.Regexp) bool {
+	if p.mode == AutoCreateAll || strings.HasSuffix(name, "#ephemeral") {
+		return true
+	}
+	if p.mode == AutoCreateNone {
+		return false
+	}
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NSQD) getAutoCreatePolicy() *autoCreatePolicy {
+	return n.autoCreate.Load().(*autoCreatePolicy)
+}
+
+// getOrAutoCreateTopic gets a topic, creating it only if the --auto-create policy allows
+// it, for the topics clients use implicitly (as opposed to through /topic/create).
+// The reply topics of RPC are only created by the RPC of their client, a late reply
+// must not recreate the reply topic of a client that is gone.
+func (n *NSQD) getOrAutoCreateTopic(topicName string) (*Topic, error) {
+	p := n.getAutoCreatePolicy()
+	if p.allow(topicName, p.topicRegexps) && !isReplyTopic(topicName) {
+		return n.GetTopic(topicName), nil
+	}
+	topic, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, errTopicNotFound
+	}
+	return topic, nil
+}
+
+// checkAutoCreateTopics returns a *topicNotFoundError for the first topic
+// that does not exist and that the --auto-create policy does not create
+func (n *NSQD) checkAutoCreateTopics(topicNames []string) error {
+	p := n.getAutoCreatePolicy()
+	for _, name := range topicNames {
+		if p.allow(name, p.topicRegexps) && !isReplyTopic(name) {
+			continue
+		}
+		if _, err := n.GetExistingTopic(name); err != nil {
+			return &topicNotFoundError{name}
+		}
+	}
+	return nil
+}
+
+// getOrAutoCreateChannel gets a channel, creating it only if the --auto-create policy allows it
+func (t *Topic) getOrAutoCreateChannel(channelName string) (*Channel, error) {
+	p := t.nsqd.getAutoCreatePolicy()
+	if p.allow(channelName, p.channelRegexps) {
+		return t.GetChannel(channelName), nil
+	}
+	channel, err := t.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, errChannelNotFound
+	}
+	return channel, nil
+}
+
+func topicNotFoundErr(cmd string, topicName string) error {
+	return protocol.NewClientErr(errTopicNotFound, "E_TOPIC_NOT_FOUND",
+		fmt.Sprintf("%s topic %q does not exist", cmd, topicName))
+}
+
+func channelNotFoundErr(cmd string, topicName string, channelName string) error {
+	return protocol.NewClientErr(errChannelNotFound, "E_CHANNEL_NOT_FOUND",
+		fmt.Sprintf("%s channel %q of topic %q does not exist", cmd, channelName, topicName))
+}
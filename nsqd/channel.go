@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,7 +13,6 @@ import (
 
 	"github.com/nsqio/go-diskqueue"
 
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/pqueue"
 	"github.com/nsqio/nsq/internal/quantile"
 )
@@ -38,8 +38,13 @@ type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	requeueCount uint64
 	messageCount uint64
+	deliverCount uint64
+	finishCount  uint64
 	timeoutCount uint64
 
+	// time (in ns) of the last client connection or FIN (see idle.go)
+	lastActivity int64
+
 	sync.RWMutex
 
 	topicName string
@@ -56,11 +61,16 @@ type Channel struct {
 	clients        map[int64]Consumer
 	paused         int32
 	ephemeral      bool
+	replicated     bool // of a topic that is replicated (see replication.go)
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
+	queueWaitStream            *quantile.Quantile // publish to first delivery
+	handlerLatencyStream       *quantile.Quantile // delivery to FIN
+	queueAges                  *queueAges
+	rateHistory                *rateHistory
 
 	// TODO: these can be DRYd up
 	deferredMessages map[MessageID]*pqueue.Item
@@ -69,6 +79,11 @@ type Channel struct {
 	inFlightMessages map[MessageID]*Message
 	inFlightPQ       inFlightPqueue
 	inFlightMutex    sync.Mutex
+
+	// spilled messages waiting for a consumer that accepts them (see spill.go),
+	// guarded by the channel lock
+	heldSpills     []*Message
+	heldSpillCount int64
 }
 
 // NewChannel creates a new instance of the Channel type and returns a pointer
@@ -83,27 +98,23 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 		deleteCallback: deleteCallback,
 		nsqd:           nsqd,
 		ephemeral:      strings.HasSuffix(channelName, "#ephemeral"),
+		lastActivity:   time.Now().UnixNano(),
 	}
 	// avoid mem-queue if size == 0 for more consistent ordering
 	if nsqd.getOpts().MemQueueSize > 0 || c.ephemeral {
 		c.memoryMsgChan = make(chan *Message, nsqd.getOpts().MemQueueSize)
 	}
-	if len(nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
-		c.e2eProcessingLatencyStream = quantile.New(
-			nsqd.getOpts().E2EProcessingLatencyWindowTime,
-			nsqd.getOpts().E2EProcessingLatencyPercentiles,
-		)
-	}
+	c.e2eProcessingLatencyStream = newLatencyStream(nsqd.getOpts())
+	c.queueWaitStream = newLatencyStream(nsqd.getOpts())
+	c.handlerLatencyStream = newLatencyStream(nsqd.getOpts())
+	c.rateHistory = newRateHistory(nsqd.getOpts())
 
 	c.initPQ()
 
 	if c.ephemeral {
 		c.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
+		dqLogf := nsqd.diskQueueLogf(topicName, channelName)
 		// backend names, for uniqueness, automatically include the topic...
 		backendName := getBackendName(topicName, channelName)
 		c.backend = diskqueue.New(
@@ -117,6 +128,7 @@ func NewChannel(topicName string, channelName string, nsqd *NSQD,
 			dqLogf,
 		)
 	}
+	c.queueAges = newQueueAges(c.backend.Depth())
 
 	c.nsqd.Notify(c, !c.ephemeral)
 
@@ -152,22 +164,37 @@ func (c *Channel) Close() error {
 	return c.exit(false)
 }
 
+// deleteIfIdle deletes the channel only if it has been idle (see idleFor) for at
+// least ttl, a client can not join it in between as AddClient waits for exitMutex
+func (c *Channel) deleteIfIdle(ttl time.Duration) error {
+	c.exitMutex.Lock()
+	defer c.exitMutex.Unlock()
+	if c.idleFor(time.Now()) < ttl {
+		return errNotIdle
+	}
+	return c.exitLocked(true)
+}
+
 func (c *Channel) exit(deleted bool) error {
 	c.exitMutex.Lock()
 	defer c.exitMutex.Unlock()
+	return c.exitLocked(deleted)
+}
 
+// exitLocked expects the caller to hold exitMutex
+func (c *Channel) exitLocked(deleted bool) error {
 	if !atomic.CompareAndSwapInt32(&c.exitFlag, 0, 1) {
 		return errors.New("exiting")
 	}
 
 	if deleted {
-		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): deleting", c.name)
+		c.logf(LOG_INFO, "deleting")
 
 		// since we are explicitly deleting a channel (not just at system exit time)
 		// de-register this from the lookupd
 		c.nsqd.Notify(c, !c.ephemeral)
 	} else {
-		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): closing", c.name)
+		c.logf(LOG_INFO, "closing")
 	}
 
 	// this forceably closes client connections
@@ -206,6 +233,10 @@ func (c *Channel) Empty() error {
 	}
 
 finish:
+	c.heldSpills = nil
+	atomic.StoreInt64(&c.heldSpillCount, 0)
+	c.queueAges.reset()
+	os.RemoveAll(c.spillDir())
 	return c.backend.Empty()
 }
 
@@ -213,8 +244,8 @@ finish:
 // it does not drain inflight/deferred because it is only called in Close()
 func (c *Channel) flush() error {
 	if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
-		c.nsqd.logf(LOG_INFO, "CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
-			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
+		c.logf(LOG_INFO, "flushing %d memory %d in-flight %d deferred messages to backend",
+			len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
 	for {
@@ -249,11 +280,20 @@ finish:
 	}
 	c.deferredMutex.Unlock()
 
+	c.Lock()
+	for _, msg := range c.heldSpills {
+		err := writeMessageToBackend(msg, c.backend)
+		if err != nil {
+			c.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+		}
+	}
+	c.Unlock()
+
 	return nil
 }
 
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return int64(len(c.memoryMsgChan)) + c.backend.Depth() + atomic.LoadInt64(&c.heldSpillCount)
 }
 
 func (c *Channel) Pause() error {
@@ -267,8 +307,10 @@ func (c *Channel) UnPause() error {
 func (c *Channel) doPause(pause bool) error {
 	if pause {
 		atomic.StoreInt32(&c.paused, 1)
+		c.nsqd.emitEvent(SystemEvent{Type: EventChannelPaused, Topic: c.topicName, Channel: c.name})
 	} else {
 		atomic.StoreInt32(&c.paused, 0)
+		c.nsqd.emitEvent(SystemEvent{Type: EventChannelUnpaused, Topic: c.topicName, Channel: c.name})
 	}
 
 	c.RLock()
@@ -294,31 +336,90 @@ func (c *Channel) PutMessage(m *Message) error {
 	if c.Exiting() {
 		return errors.New("exiting")
 	}
+	if c.nsqd.IsReplica() {
+		// hold the message (as deferred) until the replica takes over
+		atomic.AddUint64(&c.messageCount, 1)
+		return c.StartDeferredTimeout(m, 0)
+	}
+	id, attempts := m.ID, m.Attempts
 	err := c.put(m)
 	if err != nil {
 		return err
 	}
 	atomic.AddUint64(&c.messageCount, 1)
+	c.trace(TraceChannelPut, 0, id, attempts)
 	return nil
 }
 
 func (c *Channel) put(m *Message) error {
+	// counted first as a consumer may take the message as soon as it is queued
+	ts := m.Timestamp
+	c.queueAges.add(ts)
 	select {
 	case c.memoryMsgChan <- m:
 	default:
+		if c.ephemeral {
+			// the backend of an ephemeral channel discards the message
+			c.queueAges.remove(ts)
+		}
 		err := writeMessageToBackend(m, c.backend)
 		c.nsqd.SetHealth(err)
 		if err != nil {
-			c.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
-				c.name, err)
+			c.queueAges.remove(ts)
+			c.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 			return err
 		}
 	}
 	return nil
 }
 
+// putMessagesAtomically queues a batch of messages (eg. migrated with their
+// channel, with their remaining deferral) so that either all of them are queued or
+// none are: they are first all added to the deferred queue, which unlike writes to
+// the backend can not fail part way through, then the ones due are released in order
+func (c *Channel) putMessagesAtomically(msgs []*Message) error {
+	now := time.Now().UnixNano()
+	err := c.deferMessages(msgs, now)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.messageCount, uint64(len(msgs)))
+	for _, m := range msgs {
+		c.trace(TraceChannelPut, 0, m.ID, m.Attempts)
+	}
+	c.processDeferredQueue(now + int64(len(msgs)))
+	return nil
+}
+
+func (c *Channel) deferMessages(msgs []*Message, now int64) error {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return errors.New("exiting")
+	}
+
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+	seen := make(map[MessageID]struct{}, len(msgs))
+	for _, m := range msgs {
+		_, dup := seen[m.ID]
+		if _, ok := c.deferredMessages[m.ID]; ok || dup {
+			return fmt.Errorf("ID %s already deferred", m.ID)
+		}
+		seen[m.ID] = struct{}{}
+	}
+	for i, m := range msgs {
+		// in order of the batch
+		item := &pqueue.Item{Value: m, Priority: now + int64(i) + int64(m.deferred)}
+		c.deferredMessages[m.ID] = item
+		heap.Push(&c.deferredPQ, item)
+	}
+	return nil
+}
+
 func (c *Channel) PutMessageDeferred(msg *Message, timeout time.Duration) {
 	atomic.AddUint64(&c.messageCount, 1)
+	c.trace(TraceChannelPut, 0, msg.ID, msg.Attempts)
 	c.StartDeferredTimeout(msg, timeout)
 }
 
@@ -338,11 +439,13 @@ func (c *Channel) TouchMessage(clientID int64, id MessageID, clientMsgTimeout ti
 	}
 
 	msg.pri = newTimeout.UnixNano()
+	attempts := msg.Attempts
 	err = c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	c.trace(TraceTouch, clientID, id, attempts)
 	return nil
 }
 
@@ -353,12 +456,31 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	atomic.AddUint64(&c.finishCount, 1)
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
+		c.handlerLatencyStream.Insert(msg.deliveryTS.UnixNano())
+		if client := c.clientV2(clientID); client != nil && client.queueWaitStream != nil {
+			client.handlerLatencyStream.Insert(msg.deliveryTS.UnixNano())
+		}
 	}
+	if msg.isSpilled() {
+		c.removeSpill(msg)
+	}
+	c.touch()
+	c.replicateFinish(id)
+	c.trace(TraceFinish, clientID, msg.ID, msg.Attempts)
 	return nil
 }
 
+// clientV2 returns the TCP consumer clientID, nil if it is not one
+func (c *Channel) clientV2(clientID int64) *clientV2 {
+	c.RLock()
+	client, _ := c.clients[clientID].(*clientV2)
+	c.RUnlock()
+	return client
+}
+
 // RequeueMessage requeues a message based on `time.Duration`, ie:
 //
 // `timeoutMs` == 0 - requeue a message immediately
@@ -373,6 +495,7 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	}
 	c.removeFromInFlightPQ(msg)
 	atomic.AddUint64(&c.requeueCount, 1)
+	c.trace(TraceRequeue, clientID, msg.ID, msg.Attempts)
 
 	if timeout == 0 {
 		c.exitMutex.RLock()
@@ -414,7 +537,15 @@ func (c *Channel) AddClient(clientID int64, client Consumer) error {
 
 	c.Lock()
 	c.clients[clientID] = client
+	var held []*Message
+	if acceptsLargeMessages(client) {
+		held = c.heldSpills
+		c.heldSpills = nil
+		atomic.StoreInt64(&c.heldSpillCount, 0)
+	}
 	c.Unlock()
+	c.touch()
+	c.releaseSpills(held)
 	return nil
 }
 
@@ -438,6 +569,7 @@ func (c *Channel) RemoveClient(clientID int64) {
 	delete(c.clients, clientID)
 	numClients := len(c.clients)
 	c.Unlock()
+	c.touch()
 
 	if numClients == 0 && c.ephemeral {
 		go c.deleter.Do(func() { c.deleteCallback(c) })
@@ -449,11 +581,20 @@ func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout tim
 	msg.clientID = clientID
 	msg.deliveryTS = now
 	msg.pri = now.Add(timeout).UnixNano()
+	id, attempts := msg.ID, msg.Attempts
+	if attempts == 1 && c.queueWaitStream != nil {
+		c.queueWaitStream.Insert(msg.Timestamp)
+		if client := c.clientV2(clientID); client != nil && client.queueWaitStream != nil {
+			client.queueWaitStream.Insert(msg.Timestamp)
+		}
+	}
 	err := c.pushInFlightMessage(msg)
 	if err != nil {
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	atomic.AddUint64(&c.deliverCount, 1)
+	c.trace(TraceDeliver, clientID, id, attempts)
 	return nil
 }
 
@@ -552,7 +693,8 @@ func (c *Channel) processDeferredQueue(t int64) bool {
 	c.exitMutex.RLock()
 	defer c.exitMutex.RUnlock()
 
-	if c.Exiting() {
+	// a replica holds its messages until it takes over
+	if c.Exiting() || c.nsqd.IsReplica() {
 		return false
 	}
 
@@ -609,6 +751,7 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		if ok {
 			client.TimedOutMessage()
 		}
+		c.trace(TraceTimeout, msg.clientID, msg.ID, msg.Attempts)
 		c.put(msg)
 	}
 
@@ -13,6 +13,7 @@ import (
 
 	"github.com/golang/snappy"
 	"github.com/nsqio/nsq/internal/auth"
+	"github.com/nsqio/nsq/internal/quantile"
 )
 
 const defaultBufferSize = 16 * 1024
@@ -39,6 +40,7 @@ type identifyDataV2 struct {
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
+	LargeMessages       bool   `json:"large_messages"`
 }
 
 type identifyEvent struct {
@@ -75,6 +77,10 @@ type ClientV2Stats struct {
 
 	PubCounts []PubCount `json:"pub_counts,omitempty"`
 
+	// publish to first delivery and delivery to FIN of the messages sent to a consumer
+	QueueWaitLatency *quantile.Result `json:"queue_wait_latency,omitempty"`
+	HandlerLatency   *quantile.Result `json:"handler_latency,omitempty"`
+
 	TLS                           bool   `json:"tls"`
 	CipherSuite                   string `json:"tls_cipher_suite"`
 	TLSVersion                    string `json:"tls_version"`
@@ -130,6 +136,9 @@ type clientV2 struct {
 
 	pubCounts map[string]uint64
 
+	queueWaitStream      *quantile.Quantile
+	handlerLatencyStream *quantile.Quantile
+
 	writeLock sync.RWMutex
 	metaLock  sync.RWMutex
 
@@ -164,6 +173,13 @@ type clientV2 struct {
 	ClientID string
 	Hostname string
 
+	// set when this is the connection of a primary nsqd (see REPL)
+	isPrimary bool
+
+	// the ephemeral topic that replies to the RPC requests of this connection are
+	// published to, it is deleted when the connection closes
+	replyTopic string
+
 	SampleRate int32
 
 	IdentifyEventChan chan identifyEvent
@@ -173,6 +189,9 @@ type clientV2 struct {
 	Snappy  int32
 	Deflate int32
 
+	// set when the client accepts spilled messages (see spill.go)
+	LargeMessages int32
+
 	// re-usable buffer for reading the 4-byte lengths off the wire
 	lenBuf   [4]byte
 	lenSlice []byte
@@ -218,6 +237,9 @@ func newClientV2(id int64, conn net.Conn, nsqd *NSQD) *clientV2 {
 		HeartbeatInterval: nsqd.getOpts().ClientTimeout / 2,
 
 		pubCounts: make(map[string]uint64),
+
+		queueWaitStream:      newLatencyStream(nsqd.getOpts()),
+		handlerLatencyStream: newLatencyStream(nsqd.getOpts()),
 	}
 	c.lenSlice = c.lenBuf[:]
 	return c
@@ -327,6 +349,10 @@ func (c *clientV2) Stats(topicName string) ClientStats {
 		AuthIdentityURL: identityURL,
 		PubCounts:       pubCounts,
 	}
+	if c.queueWaitStream != nil && atomic.LoadInt32(&c.State) == stateSubscribed {
+		stats.QueueWaitLatency = c.queueWaitStream.Result()
+		stats.HandlerLatency = c.handlerLatencyStream.Result()
+	}
 	if stats.TLS {
 		p := prettyConnectionState{c.tlsConn.ConnectionState()}
 		stats.CipherSuite = p.GetCipherSuite()
@@ -657,7 +683,7 @@ func (c *clientV2) QueryAuthd() error {
 
 	authState, err := auth.QueryAnyAuthd(c.nsqd.getOpts().AuthHTTPAddresses,
 		remoteIP, tlsEnabled, commonName, c.AuthSecret,
-		c.nsqd.clientTLSConfig,
+		c.nsqd.clientTLSConfig.Load().(*tls.Config),
 		c.nsqd.getOpts().HTTPClientConnectTimeout,
 		c.nsqd.getOpts().HTTPClientRequestTimeout,
 		c.nsqd.getOpts().AuthHTTPRequestMethod,
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package nsqd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func diskUsage(path string) (uint64, uint64, error) {
+	return 0, 0, fmt.Errorf("disk usage is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,164 @@
+package nsqd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// DrainStatus describes the progress of an nsqd that is draining
+//
+// Depth and InFlightCount are of the channels with consumers, the deferred messages
+// and the messages of channels without consumers are persisted on exit rather than
+// waited for.
+type DrainStatus struct {
+	Draining          bool  `json:"draining"`
+	Depth             int64 `json:"depth"`
+	InFlightCount     int64 `json:"in_flight_count"`
+	DeferredCount     int64 `json:"deferred_count"`
+	ConsumerlessDepth int64 `json:"consumerless_depth"`
+	ChannelCount      int   `json:"channel_count"`
+}
+
+// Remaining returns the number of messages that still need to be consumed
+func (s DrainStatus) Remaining() int64 {
+	return s.Depth + s.InFlightCount
+}
+
+// Drain puts nsqd into drain mode.
+//
+// All topics and channels are unregistered from nsqlookupd, new publishes are rejected
+// and existing consumers continue to be served until every channel they consume from
+// is empty (or --drain-timeout), at which point nsqd initiates a clean shutdown (see
+// Context()).
+func (n *NSQD) Drain() {
+	if atomic.LoadInt32(&n.isExiting) == 1 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&n.isDraining, 0, 1) {
+		return
+	}
+
+	n.logComponentf(LOG_INFO, "NSQ", "draining")
+
+	select {
+	case n.drainNotificationChan <- struct{}{}:
+	default:
+	}
+
+	n.waitGroup.Wrap(n.drainLoop)
+}
+
+// IsDraining returns a boolean indicating if nsqd is in drain mode
+func (n *NSQD) IsDraining() bool {
+	return atomic.LoadInt32(&n.isDraining) == 1
+}
+
+// GetDrainStatus returns the number of messages left across all channels
+func (n *NSQD) GetDrainStatus() DrainStatus {
+	status := DrainStatus{
+		Draining: n.IsDraining(),
+	}
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	for _, t := range topics {
+		t.RLock()
+		channels := make([]*Channel, 0, len(t.channelMap))
+		for _, c := range t.channelMap {
+			channels = append(channels, c)
+		}
+		t.RUnlock()
+
+		// messages published to a topic without consumers have nowhere to go
+		consumed := false
+		for _, c := range channels {
+			c.RLock()
+			consumers := len(c.clients)
+			c.RUnlock()
+			c.inFlightMutex.Lock()
+			inflight := len(c.inFlightMessages)
+			c.inFlightMutex.Unlock()
+			c.deferredMutex.Lock()
+			deferred := len(c.deferredMessages)
+			c.deferredMutex.Unlock()
+
+			if consumers > 0 {
+				consumed = true
+				status.Depth += c.Depth()
+			} else {
+				status.ConsumerlessDepth += c.Depth()
+			}
+			status.InFlightCount += int64(inflight)
+			status.DeferredCount += int64(deferred)
+			status.ChannelCount++
+		}
+		if consumed {
+			status.Depth += t.Depth()
+		} else {
+			status.ConsumerlessDepth += t.Depth()
+		}
+	}
+
+	return status
+}
+
+// drainLoop waits for all consumed channels to be empty (or --drain-timeout) and
+// then cancels the context that main() is waiting on
+func (n *NSQD) drainLoop() {
+	var lastRemaining int64 = -1
+	start := time.Now()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		status := n.GetDrainStatus()
+		remaining := status.Remaining()
+		if remaining == 0 {
+			n.logComponentf(LOG_INFO, "NSQ", "drain complete, exiting (persisting def: %d consumerless: %d)",
+				status.DeferredCount, status.ConsumerlessDepth)
+			n.ctxCancel()
+			return
+		}
+		if timeout := n.getOpts().DrainTimeout; timeout > 0 && time.Since(start) >= timeout {
+			n.logComponentf(LOG_WARN, "NSQ", "drain timed out after %s, exiting with %d messages remaining (depth: %d inflt: %d def: %d consumerless: %d)",
+				timeout, remaining, status.Depth, status.InFlightCount, status.DeferredCount, status.ConsumerlessDepth)
+			n.ctxCancel()
+			return
+		}
+		if remaining != lastRemaining {
+			n.logComponentf(LOG_INFO, "NSQ", "draining %d messages (depth: %d inflt: %d def: %d consumerless: %d) across %d channels",
+				remaining, status.Depth, status.InFlightCount, status.DeferredCount, status.ConsumerlessDepth, status.ChannelCount)
+			lastRemaining = remaining
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// unregisterCommands builds the commands to remove every topic and channel
+// of this nsqd from nsqlookupd
+func (n *NSQD) unregisterCommands() []*nsq.Command {
+	var commands []*nsq.Command
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			commands = append(commands, nsq.UnRegister(channel.topicName, channel.name))
+		}
+		topic.RUnlock()
+		commands = append(commands, nsq.UnRegister(topic.name, ""))
+	}
+	n.RUnlock()
+	return commands
+}
@@ -0,0 +1,133 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// system events published as JSON to --events-topic
+const (
+	EventTopicCreated       = "topic_created"
+	EventTopicDeleted       = "topic_deleted"
+	EventTopicPaused        = "topic_paused"
+	EventTopicUnpaused      = "topic_unpaused"
+	EventChannelCreated     = "channel_created"
+	EventChannelDeleted     = "channel_deleted"
+	EventChannelPaused      = "channel_paused"
+	EventChannelUnpaused    = "channel_unpaused"
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventAuthFailed         = "auth_failed"
+)
+
+// events are dropped rather than slow down nsqd when the events topic can not keep up
+const eventChanSize = 1024
+
+type SystemEvent struct {
+	Type             string `json:"type"`
+	Timestamp        int64  `json:"timestamp"`
+	BroadcastAddress string `json:"broadcast_address"`
+	Topic            string `json:"topic,omitempty"`
+	Channel          string `json:"channel,omitempty"`
+	ClientID         string `json:"client_id,omitempty"`
+	Hostname         string `json:"hostname,omitempty"`
+	RemoteAddress    string `json:"remote_address,omitempty"`
+	Reason           string `json:"reason,omitempty"`
+}
+
+// emitEvent queues e to be published to --events-topic, it never blocks as it is
+// called with the locks of topics and channels held. The topics and channels
+// restored from the metadata at startup are not reported.
+func (n *NSQD) emitEvent(e SystemEvent) {
+	opts := n.getOpts()
+	if opts.EventsTopic == "" || atomic.LoadInt32(&n.isLoading) == 1 {
+		return
+	}
+	e.Timestamp = time.Now().UnixNano()
+	e.BroadcastAddress = opts.BroadcastAddress
+	select {
+	case n.eventChan <- e:
+	default:
+		n.logComponentf(LOG_WARN, "EVENTS", "dropped %s event, %s can not keep up", e.Type, opts.EventsTopic)
+	}
+}
+
+// isEventsTopic returns true if topicName is --events-topic, which only nsqd publishes to
+func (n *NSQD) isEventsTopic(topicName string) bool {
+	eventsTopic := n.getOpts().EventsTopic
+	return eventsTopic != "" && topicName == eventsTopic
+}
+
+func eventsTopicErr(cmd string, topicName string) error {
+	return protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+		fmt.Sprintf("%s topic %q is reserved for nsqd events", cmd, topicName))
+}
+
+// notifyEvent emits the creation or deletion of the topic or channel passed to Notify
+func (n *NSQD) notifyEvent(v interface{}) {
+	switch v := v.(type) {
+	case *Channel:
+		eventType := EventChannelCreated
+		if v.Exiting() {
+			eventType = EventChannelDeleted
+		}
+		n.emitEvent(SystemEvent{Type: eventType, Topic: v.topicName, Channel: v.name})
+	case *Topic:
+		eventType := EventTopicCreated
+		if v.Exiting() {
+			eventType = EventTopicDeleted
+		}
+		n.emitEvent(SystemEvent{Type: eventType, Topic: v.name})
+	}
+}
+
+func (c *clientV2) emitEvent(eventType string, reason string) {
+	c.metaLock.RLock()
+	e := SystemEvent{
+		Type:          eventType,
+		ClientID:      c.ClientID,
+		Hostname:      c.Hostname,
+		RemoteAddress: c.String(),
+		Reason:        reason,
+	}
+	c.metaLock.RUnlock()
+	c.nsqd.emitEvent(e)
+}
+
+func (n *NSQD) eventLoop() {
+	for {
+		select {
+		case e := <-n.eventChan:
+			topicName := n.getOpts().EventsTopic
+			if topicName == "" {
+				continue
+			}
+			body, err := json.Marshal(e)
+			if err != nil {
+				n.logComponentf(LOG_ERROR, "EVENTS", "failed to marshal %s event - %s", e.Type, err)
+				continue
+			}
+			if atomic.LoadInt32(&n.isExiting) == 1 {
+				continue
+			}
+			topic, err := n.getOrAutoCreateTopic(topicName)
+			if err != nil {
+				n.logComponentf(LOG_ERROR, "EVENTS", "failed to publish %s event - topic %s does not exist", e.Type, topicName)
+				continue
+			}
+			err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+			if err != nil {
+				n.logComponentf(LOG_ERROR, "EVENTS", "failed to publish %s event - %s", e.Type, err)
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logComponentf(LOG_INFO, "EVENTS", "closing")
+}
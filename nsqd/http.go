@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
 	"reflect"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strconv"
@@ -55,12 +57,17 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	}
 
 	router.Handle("GET", "/ping", http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Handle("GET", "/ready", http_api.Decorate(s.readyHandler, log, http_api.PlainText))
 	router.Handle("GET", "/info", http_api.Decorate(s.doInfo, log, http_api.V1))
 
 	// v1 negotiate
 	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))
+	router.Handle("POST", "/mtpub", http_api.Decorate(s.doMTPUB, http_api.V1))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	router.Handle("GET", "/stats/stream", http_api.Decorate(s.doStatsStream, log))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, log, http_api.PlainText))
+	router.Handle("GET", "/trace", http_api.Decorate(s.doTrace, log))
 
 	// only v1
 	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
@@ -68,13 +75,25 @@ func newHTTPServer(nsqd *NSQD, tlsEnabled bool, tlsRequired bool) *httpServer {
 	router.Handle("POST", "/topic/empty", http_api.Decorate(s.doEmptyTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/pause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
 	router.Handle("POST", "/topic/unpause", http_api.Decorate(s.doPauseTopic, log, http_api.V1))
+	router.Handle("POST", "/topic/migrate", http_api.Decorate(s.doMigrateTopic, log, http_api.V1))
+	router.Handle("GET", "/topic/schema", http_api.Decorate(s.doGetTopicSchema, log, http_api.V1))
+	router.Handle("POST", "/topic/schema", http_api.Decorate(s.doSetTopicSchema, log, http_api.V1))
+	router.Handle("POST", "/topic/schema/delete", http_api.Decorate(s.doDeleteTopicSchema, log, http_api.V1))
+	router.Handle("GET", "/topic/routes", http_api.Decorate(s.doGetTopicRoutes, log, http_api.V1))
+	router.Handle("POST", "/topic/route", http_api.Decorate(s.doSetTopicRoute, log, http_api.V1))
+	router.Handle("POST", "/topic/route/delete", http_api.Decorate(s.doDeleteTopicRoute, log, http_api.V1))
 	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/push", http_api.Decorate(s.doPushChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/push/delete", http_api.Decorate(s.doDeletePushChannel, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("POST", "/config/reload", http_api.Decorate(s.doConfigReload, log, http_api.V1))
+	router.Handle("GET", "/drain", http_api.Decorate(s.doDrain, log, http_api.V1))
+	router.Handle("POST", "/drain", http_api.Decorate(s.doDrain, log, http_api.V1))
 
 	// debug
 	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
@@ -127,6 +146,31 @@ func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request, ps ht
 	return health, nil
 }
 
+// readyHandler tells load balancers and orchestrators whether to send traffic to
+// nsqd, /ping only tells whether it is alive
+func (s *httpServer) readyHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if err := s.nsqd.checkReady(); err != nil {
+		return nil, http_api.Err{503, "NOT_READY - " + err.Error()}
+	}
+	return "OK", nil
+}
+
+// checkPublish rejects a publish with a 503 when nsqd does not accept messages
+// from clients, while the resources are critical the client should retry once
+// the next check had a chance to find them recovered
+func (s *httpServer) checkPublish(w http.ResponseWriter) error {
+	err := s.nsqd.checkPublish()
+	if err == nil {
+		return nil
+	}
+	perr := err.(*publishError)
+	if perr.Code == "RESOURCES_CRITICAL" {
+		retryAfter := int(math.Ceil(s.nsqd.getOpts().ResourceCheckInterval.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	return http_api.Err{503, perr.Code}
+}
+
 func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -142,16 +186,18 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 	}
 
 	return struct {
-		Version              string        `json:"version"`
-		BroadcastAddress     string        `json:"broadcast_address"`
-		Hostname             string        `json:"hostname"`
-		HTTPPort             int           `json:"http_port"`
-		TCPPort              int           `json:"tcp_port"`
-		StartTime            int64         `json:"start_time"`
-		MaxHeartBeatInterval time.Duration `json:"max_heartbeat_interval"`
-		MaxOutBufferSize     int64         `json:"max_output_buffer_size"`
-		MaxOutBufferTimeout  time.Duration `json:"max_output_buffer_timeout"`
-		MaxDeflateLevel      int           `json:"max_deflate_level"`
+		Version              string         `json:"version"`
+		BroadcastAddress     string         `json:"broadcast_address"`
+		Hostname             string         `json:"hostname"`
+		HTTPPort             int            `json:"http_port"`
+		TCPPort              int            `json:"tcp_port"`
+		StartTime            int64          `json:"start_time"`
+		MaxHeartBeatInterval time.Duration  `json:"max_heartbeat_interval"`
+		MaxOutBufferSize     int64          `json:"max_output_buffer_size"`
+		MaxOutBufferTimeout  time.Duration  `json:"max_output_buffer_timeout"`
+		MaxDeflateLevel      int            `json:"max_deflate_level"`
+		Ready                bool           `json:"ready"`
+		Resources            ResourceStatus `json:"resources"`
 	}{
 		Version:              version.Binary,
 		BroadcastAddress:     s.nsqd.getOpts().BroadcastAddress,
@@ -163,6 +209,8 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 		MaxOutBufferSize:     s.nsqd.getOpts().MaxOutputBufferSize,
 		MaxOutBufferTimeout:  s.nsqd.getOpts().MaxOutputBufferTimeout,
 		MaxDeflateLevel:      s.nsqd.getOpts().MaxDeflateLevel,
+		Ready:                s.nsqd.checkReady() == nil,
+		Resources:            s.nsqd.GetResourceStatus(),
 	}, nil
 }
 
@@ -202,30 +250,52 @@ func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, e
 	if !protocol.IsValidTopicName(topicName) {
 		return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
 	}
+	if s.nsqd.isEventsTopic(topicName) {
+		return nil, nil, http_api.Err{403, "EVENTS_TOPIC"}
+	}
+
+	topic, err := s.nsqd.getOrAutoCreateTopic(topicName)
+	if err != nil {
+		return nil, nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
 
-	return reqParams, s.nsqd.GetTopic(topicName), nil
+	return reqParams, topic, nil
 }
 
 func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	// TODO: one day I'd really like to just error on chunked requests
 	// to be able to fail "too big" requests before we even read
 
-	if req.ContentLength > s.nsqd.getOpts().MaxMsgSize {
+	// only bodies of a known length are spilled, chunked requests
+	// are limited to --max-msg-size
+	spill := s.nsqd.shouldSpill(req.URL.Query().Get("topic"), req.ContentLength)
+	if spill && req.ContentLength > s.nsqd.getOpts().MaxSpillMsgSize {
 		return nil, http_api.Err{413, "MSG_TOO_BIG"}
 	}
-
-	// add 1 so that it's greater than our max when we test for it
-	// (LimitReader returns a "fake" EOF)
-	readMax := s.nsqd.getOpts().MaxMsgSize + 1
-	body, err := io.ReadAll(io.LimitReader(req.Body, readMax))
-	if err != nil {
-		return nil, http_api.Err{500, "INTERNAL_ERROR"}
-	}
-	if int64(len(body)) == readMax {
+	if !spill && req.ContentLength > s.nsqd.getOpts().MaxMsgSize {
 		return nil, http_api.Err{413, "MSG_TOO_BIG"}
 	}
-	if len(body) == 0 {
-		return nil, http_api.Err{400, "MSG_EMPTY"}
+
+	var body []byte
+	var err error
+	if !spill {
+		// add 1 so that it's greater than our max when we test for it
+		// (LimitReader returns a "fake" EOF)
+		readMax := s.nsqd.getOpts().MaxMsgSize + 1
+		body, err = io.ReadAll(io.LimitReader(req.Body, readMax))
+		if err != nil {
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		if int64(len(body)) == readMax {
+			return nil, http_api.Err{413, "MSG_TOO_BIG"}
+		}
+		if len(body) == 0 {
+			return nil, http_api.Err{400, "MSG_EMPTY"}
+		}
+	}
+
+	if err := s.checkPublish(w); err != nil {
+		return nil, err
 	}
 
 	reqParams, topic, err := s.getTopicFromQuery(req)
@@ -246,11 +316,26 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 
+	if spill {
+		msg, err := topic.spillMessage(req.Body, req.ContentLength)
+		if err != nil {
+			s.nsqd.logf(LOG_ERROR, "failed to spill message body - %s", err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+		msg.deferred = deferred
+		err = topic.PutMessage(msg)
+		if err != nil {
+			topic.removeSpill(msg)
+			return nil, http_api.Err{503, "EXITING"}
+		}
+		return "OK", nil
+	}
+
 	msg := NewMessage(topic.GenerateID(), body)
 	msg.deferred = deferred
-	err = topic.PutMessage(msg)
+	err = topic.publishMessages([]*Message{msg})
 	if err != nil {
-		return nil, http_api.Err{503, "EXITING"}
+		return nil, validationHTTPErr(err)
 	}
 
 	return "OK", nil
@@ -267,6 +352,10 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, http_api.Err{413, "BODY_TOO_BIG"}
 	}
 
+	if err := s.checkPublish(w); err != nil {
+		return nil, err
+	}
+
 	reqParams, topic, err := s.getTopicFromQuery(req)
 	if err != nil {
 		return nil, err
@@ -326,17 +415,131 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		}
 	}
 
-	err = topic.PutMessages(msgs)
+	err = topic.publishMessages(msgs)
+	if err != nil {
+		return nil, validationHTTPErr(err)
+	}
+
+	return "OK", nil
+}
+
+// doMTPUB publishes messages to multiple topics, either all of them are queued or none
+// are. The body has a "<topic> <message>" line per message, or the format of an MTPUB
+// command with binary=true
+func (s *httpServer) doMTPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var bodies map[string][][]byte
+
+	if req.ContentLength > s.nsqd.getOpts().MaxBodySize {
+		return nil, http_api.Err{413, "BODY_TOO_BIG"}
+	}
+
+	if err := s.checkPublish(w); err != nil {
+		return nil, err
+	}
+
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	binaryMode := false
+	if vals, ok := reqParams["binary"]; ok {
+		if binaryMode, ok = boolParams[vals[0]]; !ok {
+			return nil, http_api.Err{400, "INVALID_ARG_BINARY"}
+		}
+	}
+	if binaryMode {
+		tmp := make([]byte, 4)
+		bodies, err = readMTPUB(req.Body, tmp,
+			s.nsqd.getOpts().MaxMsgSize, s.nsqd.getOpts().MaxBodySize)
+		if err != nil {
+			fatalErr := err.(*protocol.FatalClientErr)
+			switch {
+			case fatalErr.ParentErr == errMessageTooBig:
+				return nil, http_api.Err{413, "MSG_TOO_BIG"}
+			case fatalErr.Code == "E_BAD_TOPIC":
+				return nil, http_api.Err{400, "INVALID_TOPIC"}
+			}
+			return nil, http_api.Err{400, fatalErr.Code[2:]}
+		}
+	} else {
+		bodies = make(map[string][][]byte)
+		// add 1 so that it's greater than our max when we test for it
+		// (LimitReader returns a "fake" EOF)
+		readMax := s.nsqd.getOpts().MaxBodySize + 1
+		rdr := bufio.NewReader(io.LimitReader(req.Body, readMax))
+		total := 0
+		for exit := false; !exit; {
+			var line []byte
+			line, err = rdr.ReadBytes('\n')
+			if err != nil {
+				if err != io.EOF {
+					return nil, http_api.Err{500, "INTERNAL_ERROR"}
+				}
+				exit = true
+			}
+			total += len(line)
+			if int64(total) == readMax {
+				return nil, http_api.Err{413, "BODY_TOO_BIG"}
+			}
+
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			if len(line) == 0 {
+				continue
+			}
+
+			i := bytes.IndexByte(line, ' ')
+			if i == -1 || i == len(line)-1 {
+				return nil, http_api.Err{400, "MSG_EMPTY"}
+			}
+			topicName, body := string(line[:i]), line[i+1:]
+			if !protocol.IsValidTopicName(topicName) {
+				return nil, http_api.Err{400, "INVALID_TOPIC"}
+			}
+			if int64(len(body)) > s.nsqd.getOpts().MaxMsgSize {
+				return nil, http_api.Err{413, "MSG_TOO_BIG"}
+			}
+			bodies[topicName] = append(bodies[topicName], body)
+		}
+		if len(bodies) == 0 {
+			return nil, http_api.Err{400, "MSG_EMPTY"}
+		}
+	}
+
+	for topicName := range bodies {
+		if s.nsqd.isEventsTopic(topicName) {
+			return nil, http_api.Err{403, "EVENTS_TOPIC"}
+		}
+	}
+
+	err = s.nsqd.PutMultiTopicMessages(bodies)
 	if err != nil {
-		return nil, http_api.Err{503, "EXITING"}
+		return nil, validationHTTPErr(err)
 	}
 
 	return "OK", nil
 }
 
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, http_api.Err{400, "INVALID_TOPIC"}
+	}
+
+	// explicit creation is not subject to the --auto-create policy
+	s.nsqd.GetTopic(topicName)
+	return nil, nil
 }
 
 func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -423,6 +626,201 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 	return nil, nil
 }
 
+func (s *httpServer) getExistingTopicFromReq(req *http.Request) (*http_api.ReqParams, *Topic, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	return reqParams, topic, nil
+}
+
+func (s *httpServer) doGetTopicSchema(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, rejectTopic := topic.Schema()
+	if schema == nil {
+		return nil, http_api.Err{404, "SCHEMA_NOT_FOUND"}
+	}
+	return struct {
+		Schema      json.RawMessage `json:"schema"`
+		RejectTopic string          `json:"reject_topic,omitempty"`
+	}{schema, rejectTopic}, nil
+}
+
+// doSetTopicSchema sets the JSON Schema (the request body) that messages published
+// to the topic are validated against
+func (s *httpServer) doSetTopicSchema(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rejectTopic, _ := reqParams.Get("reject_topic")
+	if rejectTopic != "" && (!protocol.IsValidTopicName(rejectTopic) || rejectTopic == topic.name) {
+		return nil, http_api.Err{400, "INVALID_REJECT_TOPIC"}
+	}
+	if rejectTopic != "" && s.nsqd.checkAutoCreateTopics([]string{rejectTopic}) != nil {
+		return nil, http_api.Err{404, "REJECT_TOPIC_NOT_FOUND"}
+	}
+
+	err = topic.SetSchema(reqParams.Body, rejectTopic)
+	if err != nil {
+		s.nsqd.logf(LOG_WARN, "invalid schema for topic %s - %s", topic.name, err)
+		return nil, http_api.Err{400, "INVALID_SCHEMA"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteTopicSchema(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = topic.RemoveSchema()
+	if err != nil {
+		return nil, http_api.Err{404, "SCHEMA_NOT_FOUND"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doGetTopicRoutes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := topic.Routes()
+	if routes == nil {
+		routes = []RouteRule{}
+	}
+	return struct {
+		Routes []RouteRule `json:"routes"`
+	}{routes}, nil
+}
+
+// doSetTopicRoute copies the messages of the topic that match a predicate on a JSON field
+// to the target topic, value is parsed as JSON or taken as a string when it is not valid JSON
+func (s *httpServer) doSetTopicRoute(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var rule RouteRule
+	rule.Target, err = reqParams.Get("target")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TARGET"}
+	}
+	if !protocol.IsValidTopicName(rule.Target) {
+		return nil, http_api.Err{400, "INVALID_TARGET"}
+	}
+	rule.Field, _ = reqParams.Get("field")
+	rule.Op, _ = reqParams.Get("op")
+	if v, err := reqParams.Get("value"); err == nil {
+		if json.Valid([]byte(v)) {
+			rule.Value = json.RawMessage(v)
+		} else {
+			rule.Value, _ = json.Marshal(v)
+		}
+	}
+
+	err = s.nsqd.SetRoute(topic, rule)
+	if err == errRouteLoop {
+		return nil, http_api.Err{400, "ROUTE_LOOP"}
+	}
+	if err == errTopicNotFound {
+		return nil, http_api.Err{404, "TARGET_NOT_FOUND"}
+	}
+	if err != nil {
+		s.nsqd.logf(LOG_WARN, "invalid route for topic %s - %s", topic.name, err)
+		return nil, http_api.Err{400, "INVALID_ROUTE"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteTopicRoute(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, err := s.getExistingTopicFromReq(req)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := reqParams.Get("target")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TARGET"}
+	}
+
+	err = s.nsqd.RemoveRoute(topic, target)
+	if err != nil {
+		return nil, http_api.Err{404, "ROUTE_NOT_FOUND"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doMigrateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+
+	addr, err := reqParams.Get("nsqd_tcp_address")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_NSQD_TCP_ADDRESS"}
+	}
+
+	topic, err := s.nsqd.GetExistingTopic(topicName)
+	if err != nil {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	stats, err := topic.Migrate(addr)
+	if err == errMigrateSpilled {
+		return nil, http_api.Err{400, "SPILLED_MESSAGES"}
+	}
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to migrate topic %s to %s - %s", topicName, addr, err)
+		return nil, http_api.Err{502, "MIGRATE_FAILED"}
+	}
+
+	return stats, nil
+}
+
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
@@ -494,6 +892,122 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	return nil, nil
 }
 
+func (s *httpServer) doPushChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := PushConfig{
+		Concurrency: 1,
+		Timeout:     s.nsqd.getOpts().HTTPClientRequestTimeout,
+		Backoff:     time.Second,
+		MaxBackoff:  10 * time.Minute,
+	}
+
+	cfg.URL, err = reqParams.Get("url")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_URL"}
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, http_api.Err{400, "INVALID_URL"}
+	}
+
+	if v, err := reqParams.Get("concurrency"); err == nil {
+		cfg.Concurrency, err = strconv.Atoi(v)
+		if err != nil || cfg.Concurrency < 1 || int64(cfg.Concurrency) > s.nsqd.getOpts().MaxRdyCount {
+			return nil, http_api.Err{400, "INVALID_CONCURRENCY"}
+		}
+	}
+
+	if v, err := reqParams.Get("timeout"); err == nil {
+		cfg.Timeout, err = time.ParseDuration(v)
+		if err != nil || cfg.Timeout <= 0 || cfg.Timeout > s.nsqd.getOpts().MaxMsgTimeout {
+			return nil, http_api.Err{400, "INVALID_TIMEOUT"}
+		}
+	}
+
+	if v, err := reqParams.Get("max_attempts"); err == nil {
+		maxAttempts, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_MAX_ATTEMPTS"}
+		}
+		cfg.MaxAttempts = uint16(maxAttempts)
+	}
+
+	if v, err := reqParams.Get("backoff"); err == nil {
+		cfg.Backoff, err = time.ParseDuration(v)
+		if err != nil || cfg.Backoff < 0 {
+			return nil, http_api.Err{400, "INVALID_BACKOFF"}
+		}
+	}
+
+	if v, err := reqParams.Get("max_backoff"); err == nil {
+		cfg.MaxBackoff, err = time.ParseDuration(v)
+		if err != nil || cfg.MaxBackoff < 0 {
+			return nil, http_api.Err{400, "INVALID_MAX_BACKOFF"}
+		}
+	}
+	if cfg.MaxBackoff > s.nsqd.getOpts().MaxReqTimeout {
+		cfg.MaxBackoff = s.nsqd.getOpts().MaxReqTimeout
+	}
+
+	// header=<name>:<value> (may be given multiple times)
+	headers, _ := reqParams.GetAll("header")
+	for _, h := range headers {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, http_api.Err{400, "INVALID_HEADER"}
+		}
+		if cfg.Headers == nil {
+			cfg.Headers = make(map[string]string)
+		}
+		cfg.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	channel := topic.GetChannel(channelName)
+	err = channel.AddPushSubscription(cfg)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	// pro-actively persist metadata so in case of process failure
+	// nsqd won't suddenly lose the push subscription
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
+func (s *httpServer) doDeletePushChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pushURL, err := reqParams.Get("url")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_URL"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	err = channel.RemovePushSubscription(pushURL)
+	if err != nil {
+		return nil, http_api.Err{404, "PUSH_SUBSCRIPTION_NOT_FOUND"}
+	}
+
+	s.nsqd.Lock()
+	s.nsqd.PersistMetadata()
+	s.nsqd.Unlock()
+	return nil, nil
+}
+
 func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
@@ -501,22 +1015,23 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 		return nil, http_api.Err{400, "INVALID_REQUEST"}
 	}
 	formatString, _ := reqParams.Get("format")
-	topicName, _ := reqParams.Get("topic")
-	channelName, _ := reqParams.Get("channel")
-	includeClientsParam, _ := reqParams.Get("include_clients")
 	includeMemParam, _ := reqParams.Get("include_mem")
+	historyParam, _ := reqParams.Get("history")
 	jsonFormat := formatString == "json"
 
-	includeClients, ok := boolParams[includeClientsParam]
-	if !ok {
-		includeClients = true
-	}
 	includeMem, ok := boolParams[includeMemParam]
 	if !ok {
 		includeMem = true
 	}
+	filter, err := statsFilterFromParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
 
-	stats := s.nsqd.GetStats(topicName, channelName, includeClients)
+	stats := s.nsqd.GetFilteredStats(filter)
+	if boolParams[historyParam] {
+		s.nsqd.addRateHistory(stats.Topics)
+	}
 	health := s.nsqd.GetHealth()
 	startTime := s.nsqd.GetStartTime()
 	uptime := time.Since(startTime)
@@ -532,13 +1047,136 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 
 	// TODO: should producer stats be hung off topics?
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    *memStats     `json:"memory,omitempty"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats.Topics, ms, stats.Producers}, nil
+		Version     string        `json:"version"`
+		Health      string        `json:"health"`
+		StartTime   int64         `json:"start_time"`
+		Topics      []TopicStats  `json:"topics"`
+		Memory      *memStats     `json:"memory,omitempty"`
+		Producers   []ClientStats `json:"producers"`
+		TotalTopics int           `json:"total_topics"`
+	}{version.Binary, health, startTime.Unix(), stats.Topics, ms, stats.Producers, stats.TotalTopics}, nil
+}
+
+// statsFilterFromParams reads the topic and channel filters, the order and the page
+// of /stats and /stats/stream, &top=N is &sort=depth&limit=N
+func statsFilterFromParams(reqParams *http_api.ReqParams) (StatsFilter, error) {
+	var f StatsFilter
+	var err error
+
+	f.Topic, _ = reqParams.Get("topic")
+	f.Channel, _ = reqParams.Get("channel")
+	f.TopicPrefix, _ = reqParams.Get("topic_prefix")
+	f.ChannelPrefix, _ = reqParams.Get("channel_prefix")
+	if v, _ := reqParams.Get("topic_regex"); v != "" {
+		f.TopicRegexp, err = regexp.Compile(v)
+		if err != nil {
+			return f, http_api.Err{400, "INVALID_TOPIC_REGEX"}
+		}
+	}
+	if v, _ := reqParams.Get("channel_regex"); v != "" {
+		f.ChannelRegexp, err = regexp.Compile(v)
+		if err != nil {
+			return f, http_api.Err{400, "INVALID_CHANNEL_REGEX"}
+		}
+	}
+
+	includeClientsParam, _ := reqParams.Get("include_clients")
+	includeClients, ok := boolParams[includeClientsParam]
+	if !ok {
+		includeClients = true
+	}
+	f.IncludeClients = includeClients
+
+	f.SortBy, _ = reqParams.Get("sort")
+	switch f.SortBy {
+	case "", SortByName, SortByDepth, SortByRate:
+	default:
+		return f, http_api.Err{400, "INVALID_SORT"}
+	}
+	if v, err := reqParams.Get("offset"); err == nil {
+		f.Offset, err = strconv.Atoi(v)
+		if err != nil || f.Offset < 0 {
+			return f, http_api.Err{400, "INVALID_OFFSET"}
+		}
+	}
+	if v, err := reqParams.Get("limit"); err == nil {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 0 {
+			return f, http_api.Err{400, "INVALID_LIMIT"}
+		}
+	}
+	if v, err := reqParams.Get("top"); err == nil {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit <= 0 {
+			return f, http_api.Err{400, "INVALID_TOP"}
+		}
+		f.SortBy = SortByDepth
+	}
+	return f, nil
+}
+
+// doStatsStream sends the stats as Server-Sent Events, a "snapshot" event with the
+// same JSON as GET /stats?format=json then a "delta" event every &interval= (1s by
+// default) with only what changed
+func (s *httpServer) doStatsStream(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		err = http_api.Err{400, "INVALID_REQUEST"}
+		http_api.RespondV1(w, 400, err)
+		return nil, err
+	}
+	filter, err := statsFilterFromParams(reqParams)
+	if err != nil {
+		http_api.RespondV1(w, err.(http_api.Err).Code, err)
+		return nil, err
+	}
+
+	interval := time.Second
+	if intervalParam, err := reqParams.Get("interval"); err == nil {
+		interval, err = time.ParseDuration(intervalParam)
+		if err != nil || interval < 100*time.Millisecond {
+			err := http_api.Err{400, "INVALID_INTERVAL"}
+			http_api.RespondV1(w, 400, err)
+			return nil, err
+		}
+	}
+
+	// the connections with the same filter and interval share the deltas
+	feed, snapshot, events, err := s.nsqd.subscribeStats(req.URL.Query().Encode(), filter, interval)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to compute stats delta - %s", err)
+		http_api.RespondV1(w, 500, http_api.Err{500, "INTERNAL_ERROR"})
+		return nil, nil
+	}
+	defer s.nsqd.unsubscribeStats(feed, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+
+	event := snapshot
+	for {
+		if _, err := w.Write(event); err != nil {
+			return nil, nil
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		var ok bool
+		select {
+		case event, ok = <-events:
+			if !ok {
+				return nil, nil
+			}
+		case <-req.Context().Done():
+			return nil, nil
+		case <-s.nsqd.exitChan:
+			return nil, nil
+		}
+	}
 }
 
 func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
@@ -566,6 +1204,8 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 
 	if len(stats.Topics) == 0 {
 		fmt.Fprintf(w, "\nTopics: None\n")
+	} else if len(stats.Topics) < stats.TotalTopics {
+		fmt.Fprintf(w, "\nTopics (%d of %d):", len(stats.Topics), stats.TotalTopics)
 	} else {
 		fmt.Fprintf(w, "\nTopics:")
 	}
@@ -585,13 +1225,16 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 			t.MessageCount,
 			t.E2eProcessingLatency,
 		)
+		if t.ValidationFailureCount > 0 {
+			fmt.Fprintf(w, "      schema validation failures: %d\n", t.ValidationFailureCount)
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
 			} else {
 				pausedPrefix = "      "
 			}
-			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d lag: %-8s e2e%%: %s\n",
 				pausedPrefix,
 				c.ChannelName,
 				c.Depth,
@@ -601,11 +1244,15 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 				c.RequeueCount,
 				c.TimeoutCount,
 				c.MessageCount,
+				time.Duration(c.LagSeconds*float64(time.Second)).Truncate(time.Millisecond),
 				c.E2eProcessingLatency,
 			)
 			for _, client := range c.Clients {
 				fmt.Fprintf(w, "        %s\n", client)
 			}
+			for _, push := range c.PushSubscriptions {
+				fmt.Fprintf(w, "        %s\n", push)
+			}
 		}
 	}
 
@@ -621,6 +1268,80 @@ func (s *httpServer) printStats(stats Stats, ms *memStats, health string, startT
 	return buf.Bytes()
 }
 
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	opts := s.nsqd.getOpts()
+	stats := s.nsqd.GetStats("", "", !opts.PrometheusExcludeClients)
+
+	pw := newPromWriter()
+	writePrometheusStats(pw, stats, opts.PrometheusExcludeEphemeral)
+	var buf bytes.Buffer
+	pw.WriteTo(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return buf.Bytes(), nil
+}
+
+// doTrace responds with the buffered events of a message (?id=, optionally limited to
+// a topic with &topic=) or streams the events of a topic as newline delimited JSON
+// (?topic=), starting with the buffered ones
+func (s *httpServer) doTrace(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		err = http_api.Err{400, "INVALID_REQUEST"}
+		http_api.RespondV1(w, 400, err)
+		return nil, err
+	}
+
+	if id, err := reqParams.Get("id"); err == nil {
+		topicName, _ := reqParams.Get("topic")
+		if len(id) != MsgIDLength {
+			err := http_api.Err{400, "INVALID_ID"}
+			http_api.RespondV1(w, 400, err)
+			return nil, err
+		}
+		http_api.RespondV1(w, 200, struct {
+			Events []TraceEvent `json:"events"`
+		}{s.nsqd.tracer.messageEvents(id, topicName)})
+		return nil, nil
+	}
+
+	topicName, err := reqParams.Get("topic")
+	if err != nil {
+		err := http_api.Err{400, "MISSING_ARG_ID_OR_TOPIC"}
+		http_api.RespondV1(w, 400, err)
+		return nil, err
+	}
+
+	events, ch := s.nsqd.tracer.subscribe(topicName)
+	defer s.nsqd.tracer.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return nil, nil
+		}
+	}
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case e := <-ch:
+			if err := enc.Encode(e); err != nil {
+				return nil, nil
+			}
+		case <-req.Context().Done():
+			return nil, nil
+		case <-s.nsqd.exitChan:
+			return nil, nil
+		}
+	}
+}
+
 func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	opt := ps.ByName("opt")
 
@@ -665,6 +1386,29 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 	return v, nil
 }
 
+func (s *httpServer) doConfigReload(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.nsqd.getOpts().ConfigLoader == nil {
+		return nil, http_api.Err{400, "NO_CONFIG"}
+	}
+	result, err := s.nsqd.ReloadConfig()
+	if result == nil {
+		s.nsqd.logf(LOG_ERROR, "failed to reload config - %s", err)
+		return nil, http_api.Err{400, "INVALID_CONFIG"}
+	}
+	if err != nil {
+		s.nsqd.logf(LOG_ERROR, "failed to seed - %s", err)
+		return nil, http_api.Err{500, "SEED_FAILED"}
+	}
+	return result, nil
+}
+
+func (s *httpServer) doDrain(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if req.Method == "POST" {
+		s.nsqd.Drain()
+	}
+	return s.nsqd.GetDrainStatus(), nil
+}
+
 func getOptByCfgName(opts interface{}, name string) (interface{}, bool) {
 	val := reflect.ValueOf(opts).Elem()
 	typ := val.Type()
@@ -1,18 +1,23 @@
 package nsqd
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -59,6 +64,39 @@ func TestHTTPpub(t *testing.T) {
 	test.Equal(t, int64(1), topic.Depth())
 }
 
+func TestHTTPpubAutoCreateNone(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AutoCreate = AutoCreateNone
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_auto_create" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+	test.Equal(t, `{"message":"TOPIC_NOT_FOUND"}`, string(body))
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+
+	createURL := fmt.Sprintf("http://%s/topic/create?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(createURL, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+}
+
 func TestHTTPpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -112,6 +150,62 @@ func TestHTTPmpub(t *testing.T) {
 	test.Equal(t, int64(4), topic.Depth())
 }
 
+func TestHTTPmtpub(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	buf := bytes.NewBufferString("test_http_mtpub_event event\ntest_http_mtpub_audit audit of event\n")
+	url := fmt.Sprintf("http://%s/mtpub", httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+
+	topic, err := nsqd.GetExistingTopic("test_http_mtpub_event")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic.Depth())
+	topic, err = nsqd.GetExistingTopic("test_http_mtpub_audit")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic.Depth())
+
+	buf = bytes.NewBufferString("test_http_mtpub_event event\nbad/topic audit of event\n")
+	resp, err = http.Post(url, "application/octet-stream", buf)
+	test.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_TOPIC"}`, string(body))
+
+	topic, err = nsqd.GetExistingTopic("test_http_mtpub_event")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic.Depth())
+
+	// a truncated binary body is malformed rather than too big
+	buf = bytes.NewBuffer([]byte{0, 0, 0, 1, 0})
+	resp, err = http.Post(url+"?binary=true", "application/octet-stream", buf)
+	test.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"BAD_BODY"}`, string(body))
+
+	buf = &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, int32(1))
+	binary.Write(buf, binary.BigEndian, int16(len("test_http_mtpub_event")))
+	buf.WriteString("test_http_mtpub_event")
+	binary.Write(buf, binary.BigEndian, int32(opts.MaxMsgSize+1))
+	resp, err = http.Post(url+"?binary=true", "application/octet-stream", buf)
+	test.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+	test.Equal(t, `{"message":"MSG_TOO_BIG"}`, string(body))
+}
+
 func TestHTTPmpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -602,6 +696,319 @@ func TestHTTPgetStatusText(t *testing.T) {
 	test.NotNil(t, body)
 }
 
+func TestHTTPstatsRates(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.StatsHistory = 15 * time.Minute
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("rates")
+	channel := topic.GetChannel("ch")
+	topic.sampleRates()
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+	for i := 0; i < 4; i++ {
+		msg := <-channel.memoryMsgChan
+		channel.StartInFlightTimeout(msg, 1, time.Minute)
+		channel.FinishMessage(1, msg.ID)
+	}
+	topic.sampleRates()
+
+	getStats := func(query string) ChannelStats {
+		resp, err := http.Get(fmt.Sprintf("http://%s/stats?format=json&topic=rates%s", httpAddr, query))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		var body struct {
+			Topics []TopicStats `json:"topics"`
+		}
+		test.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		test.Equal(t, 1, len(body.Topics))
+		test.NotNil(t, body.Topics[0].Rates)
+		return body.Topics[0].Channels[0]
+	}
+
+	sum := func(series []uint32) int {
+		var n int
+		for _, v := range series {
+			n += int(v)
+		}
+		return n
+	}
+
+	cs := getStats("")
+	test.NotNil(t, cs.Rates)
+	test.Equal(t, true, cs.Rates.Publish > 0)
+	test.Equal(t, true, cs.Rates.Finish > 0)
+	test.Equal(t, true, cs.Rates.History == nil)
+
+	cs = getStats("&history=true")
+	test.Equal(t, 10, sum(cs.Rates.History.Publish))
+	test.Equal(t, 4, sum(cs.Rates.History.Deliver))
+	test.Equal(t, 4, sum(cs.Rates.History.Finish))
+	test.Equal(t, 0, sum(cs.Rates.History.Requeue))
+}
+
+func TestHTTPstatsStream(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("stream")
+	topic.GetChannel("ch1")
+	topic.GetChannel("ch2")
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/stats/stream?topic=stream&interval=100ms", httpAddr))
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() (string, []byte) {
+		var event string
+		var data []byte
+		for {
+			line, err := r.ReadString('\n')
+			test.Nil(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = []byte(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}
+
+	event, data := readEvent()
+	test.Equal(t, "snapshot", event)
+	var snapshot struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	test.Nil(t, json.Unmarshal(data, &snapshot))
+	test.Equal(t, 1, len(snapshot.Topics))
+	test.Equal(t, 2, len(snapshot.Topics[0].Channels))
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	topic.DeleteExistingChannel("ch2")
+
+	// the changes can be split across deltas
+	var removed []RemovedChannel
+	var depth int64
+	for len(removed) == 0 || depth == 0 {
+		event, data = readEvent()
+		test.Equal(t, "delta", event)
+		var delta StatsDelta
+		test.Nil(t, json.Unmarshal(data, &delta))
+		test.Equal(t, "", delta.Health)
+		test.Equal(t, 0, len(delta.Producers))
+		removed = append(removed, delta.RemovedChannels...)
+		for _, ts := range delta.Topics {
+			for _, cs := range ts.Channels {
+				test.Equal(t, "ch1", cs.ChannelName)
+				depth = cs.Depth
+			}
+		}
+	}
+	test.Equal(t, []RemovedChannel{{"stream", "ch2"}}, removed)
+	test.Equal(t, int64(1), depth)
+
+	nsqd.DeleteExistingTopic("stream")
+	event, data = readEvent()
+	test.Equal(t, "delta", event)
+	var delta StatsDelta
+	test.Nil(t, json.Unmarshal(data, &delta))
+	test.Equal(t, []string{"stream"}, delta.RemovedTopics)
+}
+
+func TestHTTPstatsStreamShared(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("stream")
+
+	url := fmt.Sprintf("http://%s/stats/stream?topic=stream&interval=100ms", httpAddr)
+	var bodies []io.Closer
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(url)
+		test.Nil(t, err)
+		test.Equal(t, 200, resp.StatusCode)
+		bodies = append(bodies, resp.Body)
+	}
+
+	nsqd.statsFeedsMutex.Lock()
+	test.Equal(t, 1, len(nsqd.statsFeeds))
+	for _, f := range nsqd.statsFeeds {
+		f.Lock()
+		test.Equal(t, 2, len(f.subscribers))
+		f.Unlock()
+	}
+	nsqd.statsFeedsMutex.Unlock()
+
+	// the feed stops with its last connection
+	for _, body := range bodies {
+		body.Close()
+	}
+	for i := 0; ; i++ {
+		nsqd.statsFeedsMutex.Lock()
+		n := len(nsqd.statsFeeds)
+		nsqd.statsFeedsMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("stats feed still running")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHTTPmetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("metrics")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	nsqd.GetTopic("metrics#ephemeral")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{"client_id": "consumer\"1\""}, frameTypeResponse)
+	sub(t, conn, "metrics", "ch")
+
+	getMetrics := func() string {
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", httpAddr))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		test.Equal(t, 200, resp.StatusCode)
+		test.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+		return string(body)
+	}
+
+	body := getMetrics()
+	for _, line := range []string{
+		"# TYPE nsq_topic_depth gauge",
+		`nsq_topic_messages_total{topic="metrics"} 1`,
+		`nsq_topic_depth{topic="metrics#ephemeral"} 0`,
+		"# TYPE nsq_channel_requeues_total counter",
+		`nsq_channel_depth{topic="metrics",channel="ch"} 1`,
+		`nsq_channel_clients{topic="metrics",channel="ch"} 1`,
+		`nsq_client_ready_count{topic="metrics",channel="ch",client_id="consumer\"1\"",`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+	test.Equal(t, 1, strings.Count(body, "# TYPE nsq_topic_depth gauge"))
+
+	newOpts := *opts
+	newOpts.PrometheusExcludeEphemeral = true
+	newOpts.PrometheusExcludeClients = true
+	nsqd.swapOpts(&newOpts)
+
+	body = getMetrics()
+	test.Equal(t, true, strings.Contains(body, `nsq_channel_clients{topic="metrics",channel="ch"} 1`))
+	test.Equal(t, false, strings.Contains(body, "#ephemeral"))
+	test.Equal(t, false, strings.Contains(body, "nsq_client_"))
+}
+
+func TestHTTPtrace(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TraceTopics = []string{"trace"}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, map[string]interface{}{"client_id": "tracer"}, frameTypeResponse)
+	sub(t, conn, "trace", "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	topic := nsqd.GetTopic("trace")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	untraced := nsqd.GetTopic("untraced")
+	untracedMsg := NewMessage(untraced.GenerateID(), []byte("test body"))
+	untraced.PutMessage(untracedMsg)
+
+	resp, _ := nsq.ReadResponse(conn)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msg, _ := decodeMessage(data)
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	getTrace := func(id MessageID, topicName string) []TraceEvent {
+		resp, err := http.Get(fmt.Sprintf("http://%s/trace?id=%s&topic=%s", httpAddr, id[:], topicName))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Events []TraceEvent `json:"events"`
+		}
+		test.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Events
+	}
+
+	var events []TraceEvent
+	for i := 0; i < 100; i++ {
+		events = getTrace(msg.ID, "trace")
+		if len(events) == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 4, len(events))
+	for i, event := range []string{TracePublish, TraceChannelPut, TraceDeliver, TraceFinish} {
+		test.Equal(t, event, events[i].Event)
+		test.Equal(t, string(msg.ID[:]), events[i].ID)
+		test.Equal(t, "trace", events[i].Topic)
+	}
+	test.Equal(t, "ch", events[2].Channel)
+	test.Equal(t, uint16(1), events[2].Attempts)
+	test.Equal(t, conn.LocalAddr().String(), events[2].Client)
+	test.Equal(t, 0, len(getTrace(untracedMsg.ID, "untraced")))
+
+	resp2, err := http.Get(fmt.Sprintf("http://%s/trace", httpAddr))
+	test.Nil(t, err)
+	resp2.Body.Close()
+	test.Equal(t, 400, resp2.StatusCode)
+
+	stream, err := http.Get(fmt.Sprintf("http://%s/trace?topic=trace", httpAddr))
+	test.Nil(t, err)
+	defer stream.Body.Close()
+	test.Equal(t, "application/x-ndjson", stream.Header.Get("Content-Type"))
+	dec := json.NewDecoder(stream.Body)
+	for i := 0; i < 4; i++ {
+		var e TraceEvent
+		test.Nil(t, dec.Decode(&e))
+		test.Equal(t, events[i].Event, e.Event)
+	}
+	next := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(next)
+	var e TraceEvent
+	test.Nil(t, dec.Decode(&e))
+	test.Equal(t, TracePublish, e.Event)
+	test.Equal(t, string(next.ID[:]), e.ID)
+}
+
 func TestHTTPconfig(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -659,6 +1066,58 @@ func TestHTTPconfig(t *testing.T) {
 	test.Equal(t, 400, resp.StatusCode)
 }
 
+func TestHTTPconfigReload(t *testing.T) {
+	dataPath, err := os.MkdirTemp("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	newOpts := func() *Options {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.TCPAddress = "127.0.0.1:0"
+		opts.HTTPAddress = "127.0.0.1:0"
+		opts.HTTPSAddress = "127.0.0.1:0"
+		opts.DataPath = dataPath
+		return opts
+	}
+
+	var config *Options
+	opts := newOpts()
+	opts.ConfigLoader = func() (*Options, error) {
+		return config, nil
+	}
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	config = newOpts()
+	config.MaxMsgSize = 2 * opts.MaxMsgSize
+	config.MaxRdyCount = 10
+	config.AutoCreate = AutoCreateNone
+
+	url := fmt.Sprintf("http://%s/config/reload", httpAddr)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"reloaded":["auto-create","max-rdy-count"],"restart_required":["max-msg-size"]}`, string(body))
+	test.Equal(t, int64(10), nsqd.getOpts().MaxRdyCount)
+	test.Equal(t, opts.MaxMsgSize, nsqd.getOpts().MaxMsgSize)
+	test.Equal(t, AutoCreateNone, nsqd.getAutoCreatePolicy().mode)
+
+	config = newOpts()
+	config.AutoCreate = "sometimes"
+
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_CONFIG"}`, string(body))
+	test.Equal(t, int64(10), nsqd.getOpts().MaxRdyCount)
+	test.Equal(t, AutoCreateNone, nsqd.getAutoCreatePolicy().mode)
+}
+
 func TestHTTPerrors(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -895,6 +1354,483 @@ func TestInfo(t *testing.T) {
 	test.Equal(t, version.Binary, info.Version)
 }
 
+func TestHTTPMigrateTopic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	tcpAddr2, _, nsqd2 := mustStartNSQD(opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer nsqd2.Exit()
+
+	topicName := "test_http_migrate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	msg.Timestamp = time.Now().Add(-time.Hour).UnixNano()
+	msg.Attempts = 3
+	channel.PutMessage(msg)
+	deferredMsg := NewMessage(topic.GenerateID(), []byte("test deferred body"))
+	channel.PutMessageDeferred(deferredMsg, time.Hour)
+
+	topic.Pause()
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test topic body")))
+
+	url := fmt.Sprintf("http://%s/topic/migrate?topic=%s&nsqd_tcp_address=%s", httpAddr, topicName, tcpAddr2)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var stats MigrateStats
+	err = json.Unmarshal(body, &stats)
+	test.Nil(t, err)
+	test.Equal(t, 1, stats.MessageCount)
+	test.Equal(t, 2, stats.ChannelCounts["ch"])
+
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, true, topic.IsPaused())
+
+	topic2, err := nsqd2.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	channel2, err := topic2.GetExistingChannel("ch")
+	test.Nil(t, err)
+
+	channel2.deferredMutex.Lock()
+	item, ok := channel2.deferredMessages[deferredMsg.ID]
+	channel2.deferredMutex.Unlock()
+	test.Equal(t, true, ok)
+	test.Equal(t, deferredMsg.Body, item.Value.(*Message).Body)
+
+	msgOut := <-channel2.memoryMsgChan
+	test.Equal(t, msg.ID, msgOut.ID)
+	test.Equal(t, msg.Timestamp, msgOut.Timestamp)
+	test.Equal(t, msg.Attempts, msgOut.Attempts)
+	test.Equal(t, msg.Body, msgOut.Body)
+
+	// the topic backlog was published to nsqd2's topic and fanned out to its channel
+	msgOut = <-channel2.memoryMsgChan
+	test.Equal(t, []byte("test topic body"), msgOut.Body)
+}
+
+func TestMigrateTopicTLSAuth(t *testing.T) {
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("secret") != "peer secret" || r.Form.Get("tls") != "true" {
+			fmt.Fprint(w, `{"ttl":10, "authorizations":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"ttl":10, "authorizations":
+			[{"topic":".*", "channels":[".*"], "permissions":["publish"]}]}`)
+	}))
+	defer authd.Close()
+	addr, err := url.Parse(authd.URL)
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TLSRootCAFile = "./test/certs/ca.pem"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	opts2.TLSCert = "./test/certs/server.pem"
+	opts2.TLSKey = "./test/certs/server.key"
+	opts2.TLSRequired = TLSRequiredExceptHTTP
+	opts2.AuthHTTPAddresses = []string{addr.Host}
+	opts2.AuthHTTPRequestMethod = "get"
+	tcpAddr2, _, nsqd2 := mustStartNSQD(opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer nsqd2.Exit()
+
+	topicName := "test_migrate_tls" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	// the peer requires AUTH
+	_, err = topic.Migrate(tcpAddr2.String())
+	test.NotNil(t, err)
+	test.Equal(t, int64(1), topic.Depth())
+
+	newOpts := *opts
+	newOpts.PeerAuthSecret = "peer secret"
+	nsqd.swapOpts(&newOpts)
+	stats, err := topic.Migrate(tcpAddr2.String())
+	test.Nil(t, err)
+	test.Equal(t, 1, stats.MessageCount)
+
+	topic2, err := nsqd2.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic2.Depth())
+}
+
+func TestMigrateTopicTLSClientCert(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TLSCert = "./test/certs/client.pem"
+	opts.TLSKey = "./test/certs/client.key"
+	opts.TLSRootCAFile = "./test/certs/ca.pem"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// the peer only accepts clients with a certificate signed by its CA
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	opts2.TLSCert = "./test/certs/server.pem"
+	opts2.TLSKey = "./test/certs/server.key"
+	opts2.TLSRootCAFile = "./test/certs/ca.pem"
+	opts2.TLSClientAuthPolicy = "require-verify"
+	tcpAddr2, _, nsqd2 := mustStartNSQD(opts2)
+	defer os.RemoveAll(opts2.DataPath)
+	defer nsqd2.Exit()
+
+	topicName := "test_migrate_tls_cert" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	stats, err := topic.Migrate(tcpAddr2.String())
+	test.Nil(t, err)
+	test.Equal(t, 1, stats.MessageCount)
+
+	topic2, err := nsqd2.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic2.Depth())
+}
+
+func TestHTTPTopicSchema(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_topic_schema" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	schemaURL := fmt.Sprintf("http://%s/topic/schema?topic=%s", httpAddr, topicName)
+	pubURL := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+
+	post := func(url string, body string) (int, string) {
+		resp, err := http.Post(url, "application/json", bytes.NewBufferString(body))
+		test.Nil(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := post(schemaURL, `{"type": "thing"}`)
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"INVALID_SCHEMA"}`, body)
+
+	schema := `{"type": "object", "required": ["id"]}`
+	code, _ = post(schemaURL, schema)
+	test.Equal(t, 200, code)
+
+	resp, err := http.Get(schemaURL)
+	test.Nil(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"schema":{"type":"object","required":["id"]}}`, string(data))
+
+	code, body = post(pubURL, `{"id": 1}`)
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK", body)
+	code, body = post(pubURL, `{"name": "no id"}`)
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"BAD_MESSAGE_SCHEMA"}`, body)
+	test.Equal(t, int64(1), topic.Depth())
+
+	// invalid messages are routed to the reject topic
+	code, _ = post(schemaURL+"&reject_topic="+topicName+"_rejects", schema)
+	test.Equal(t, 200, code)
+	code, body = post(pubURL, `{"name": "no id"}`)
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK", body)
+	test.Equal(t, int64(1), topic.Depth())
+	rejectTopic, err := nsqd.GetExistingTopic(topicName + "_rejects")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), rejectTopic.Depth())
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, uint64(2), stats.Topics[0].ValidationFailureCount)
+
+	m := nsqd.GetMetadata(false)
+	for _, topicData := range m.Topics {
+		if topicData.Name == topicName {
+			test.Equal(t, schema, string(topicData.Schema))
+			test.Equal(t, topicName+"_rejects", topicData.RejectTopic)
+		}
+	}
+
+	code, _ = post(fmt.Sprintf("http://%s/topic/schema/delete?topic=%s", httpAddr, topicName), "")
+	test.Equal(t, 200, code)
+	code, body = post(pubURL, `{"name": "no id"}`)
+	test.Equal(t, 200, code)
+	test.Equal(t, int64(2), topic.Depth())
+}
+
+func TestHTTPTopicRoutes(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_topic_routes" + strconv.Itoa(int(time.Now().Unix()))
+	// messages are routed when published, without channels and while paused
+	topic := nsqd.GetTopic(topicName)
+	topic.Pause()
+	targetName := topicName + ".high_value"
+
+	post := func(url string) (int, string) {
+		resp, err := http.Post(url, "application/octet-stream", nil)
+		test.Nil(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := post(fmt.Sprintf("http://%s/topic/route?topic=%s&target=%s&field=total&op=between&value=1",
+		httpAddr, topicName, targetName))
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"INVALID_ROUTE"}`, body)
+
+	code, _ = post(fmt.Sprintf("http://%s/topic/route?topic=%s&target=%s&field=total&op=gte&value=100",
+		httpAddr, topicName, targetName))
+	test.Equal(t, 200, code)
+
+	// the target cannot route back to the topic
+	code, body = post(fmt.Sprintf("http://%s/topic/route?topic=%s&target=%s&field=total&op=exists",
+		httpAddr, targetName, topicName))
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"ROUTE_LOOP"}`, body)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/topic/routes?topic=%s", httpAddr, topicName))
+	test.Nil(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"routes":[{"target":"`+targetName+`","field":"total","op":"gte","value":100}]}`, string(data))
+
+	for _, body := range []string{`{"total": 50}`, `{"total": 150}`, `not json`} {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+	}
+
+	target, err := nsqd.GetExistingTopic(targetName)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), target.Depth())
+	msg := <-target.memoryMsgChan
+	test.Equal(t, []byte(`{"total": 150}`), msg.Body)
+
+	m := nsqd.GetMetadata(false)
+	for _, topicData := range m.Topics {
+		if topicData.Name == topicName {
+			test.Equal(t, 1, len(topicData.Routes))
+			test.Equal(t, targetName, topicData.Routes[0].Target)
+		}
+	}
+
+	url := fmt.Sprintf("http://%s/topic/route/delete?topic=%s&target=%s", httpAddr, topicName, targetName)
+	code, _ = post(url)
+	test.Equal(t, 200, code)
+	code, _ = post(url)
+	test.Equal(t, 404, code)
+}
+
+func TestHTTPPushChannel(t *testing.T) {
+	type pushed struct {
+		attempts string
+		header   string
+		body     string
+	}
+	pushedChan := make(chan pushed, 2)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushedChan <- pushed{r.Header.Get("X-NSQ-Attempts"), r.Header.Get("X-Test"), string(body)}
+		// fail the first attempt
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer srv.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_push" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	params := url.Values{}
+	params.Set("topic", topicName)
+	params.Set("channel", "ch")
+	params.Set("url", srv.URL)
+	params.Set("backoff", "10ms")
+	params.Set("header", "X-Test: foo")
+	endpoint := fmt.Sprintf("http://%s/channel/push?%s", httpAddr, params.Encode())
+	resp, err := http.Post(endpoint, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	test.Equal(t, pushed{"1", "foo", "test body"}, <-pushedChan)
+	test.Equal(t, pushed{"2", "foo", "test body"}, <-pushedChan)
+
+	var stats PushStats
+	for i := 0; i < 100; i++ {
+		stats = nsqd.GetStats(topicName, "ch", false).Topics[0].Channels[0].PushSubscriptions[0]
+		if stats.FinishCount == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, srv.URL, stats.URL)
+	test.Equal(t, uint64(2), stats.MessageCount)
+	test.Equal(t, uint64(1), stats.RequeueCount)
+	test.Equal(t, uint64(1), stats.FinishCount)
+	test.Equal(t, int64(0), stats.InFlightCount)
+
+	cfgs := nsqd.GetMetadata(false).Topics[0].Channels[0].PushSubscriptions
+	test.Equal(t, 1, len(cfgs))
+	test.Equal(t, srv.URL, cfgs[0].URL)
+	test.Equal(t, "foo", cfgs[0].Headers["X-Test"])
+
+	params.Del("header")
+	endpoint = fmt.Sprintf("http://%s/channel/push/delete?%s", httpAddr, params.Encode())
+	resp, err = http.Post(endpoint, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	test.Equal(t, 0, len(nsqd.GetStats(topicName, "ch", false).Topics[0].Channels[0].PushSubscriptions))
+
+	resp, err = http.Post(endpoint, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 404, resp.StatusCode)
+	resp.Body.Close()
+}
+
+func TestHTTPDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_drain" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	url := fmt.Sprintf("http://%s/drain", httpAddr)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var status DrainStatus
+	err = json.Unmarshal(body, &status)
+	test.Nil(t, err)
+	test.Equal(t, true, status.Draining)
+	// the channel has no consumers, its message is persisted rather than waited for
+	test.Equal(t, int64(0), status.Depth)
+	test.Equal(t, int64(1), status.ConsumerlessDepth)
+	test.Equal(t, 1, status.ChannelCount)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	test.Equal(t, 503, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, `{"message":"DRAINING"}`, string(body))
+}
+
+func TestHTTPready(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", httpAddr, path))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	pub := func() (*http.Response, string) {
+		url := fmt.Sprintf("http://%s/pub?topic=test_http_ready", httpAddr)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	setThresholds := func(warn int64, critical int64) {
+		o := *nsqd.getOpts()
+		o.HeapWarnBytes = warn
+		o.HeapCriticalBytes = critical
+		nsqd.swapOpts(&o)
+		nsqd.updateResources()
+	}
+
+	code, body := get("/ready")
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK", body)
+
+	// not ready, but still accepting publishes
+	setThresholds(1, 0)
+	code, body = get("/ready")
+	test.Equal(t, 503, code)
+	test.Equal(t, true, strings.HasPrefix(body, "NOT_READY - nsqd resources are warning - heap in use"))
+	code, _ = get("/ping")
+	test.Equal(t, 200, code)
+	resp, body := pub()
+	test.Equal(t, 200, resp.StatusCode)
+
+	setThresholds(0, 1)
+	resp, body = pub()
+	test.Equal(t, 503, resp.StatusCode)
+	test.Equal(t, `{"message":"RESOURCES_CRITICAL"}`, body)
+	test.Equal(t, "5", resp.Header.Get("Retry-After"))
+
+	var info struct {
+		Ready     bool           `json:"ready"`
+		Resources ResourceStatus `json:"resources"`
+	}
+	code, body = get("/info")
+	test.Equal(t, 200, code)
+	test.Nil(t, json.Unmarshal([]byte(body), &info))
+	test.Equal(t, false, info.Ready)
+	test.Equal(t, ResourceCritical, info.Resources.Level)
+	test.Equal(t, ResourceCritical, info.Resources.HeapLevel)
+	test.Equal(t, ResourceOK, info.Resources.DiskLevel)
+
+	setThresholds(0, 0)
+	code, _ = get("/ready")
+	test.Equal(t, 200, code)
+	resp, _ = pub()
+	test.Equal(t, 200, resp.StatusCode)
+}
+
 func BenchmarkHTTPpub(b *testing.B) {
 	var wg sync.WaitGroup
 	b.StopTimer()
@@ -0,0 +1,159 @@
+package nsqd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// errNotIdle is returned when a topic or channel was no longer idle by the time
+// it was to be deleted
+var errNotIdle = errors.New("not idle")
+
+// AuditEvent describes a change nsqd made on its own, it is passed to Options.AuditHook
+type AuditEvent struct {
+	Time    time.Time
+	Action  string
+	Topic   string
+	Channel string
+	Reason  string
+}
+
+func (n *NSQD) audit(e AuditEvent) {
+	hook := n.getOpts().AuditHook
+	if hook != nil {
+		hook(e)
+	}
+}
+
+func (t *Topic) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+// idleFor returns for how long the topic had no channels and no publishes
+func (t *Topic) idleFor(now time.Time) time.Duration {
+	t.RLock()
+	numChannels := len(t.channelMap)
+	t.RUnlock()
+	if numChannels > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+}
+
+func (c *Channel) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// idleFor returns for how long the channel had no clients and no FINs
+func (c *Channel) idleFor(now time.Time) time.Duration {
+	c.RLock()
+	numClients := len(c.clients)
+	c.RUnlock()
+	if numClients > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+// idleScanInterval returns how often idleLoop looks for idle topics and
+// channels, 0 if neither --topic-idle-ttl nor --channel-idle-ttl is set
+func idleScanInterval(opts *Options) time.Duration {
+	ttl := opts.TopicIdleTTL
+	if ttl <= 0 || (opts.ChannelIdleTTL > 0 && opts.ChannelIdleTTL < ttl) {
+		ttl = opts.ChannelIdleTTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	interval := ttl / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// idleLoop deletes the channels idle for longer than --channel-idle-ttl and
+// the topics idle for longer than --topic-idle-ttl
+func (n *NSQD) idleLoop() {
+	ticker := time.NewTicker(idleScanInterval(n.getOpts()))
+	for {
+		select {
+		case <-ticker.C:
+			n.deleteIdle()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logComponentf(LOG_INFO, "IDLE", "closing")
+	ticker.Stop()
+}
+
+func (n *NSQD) deleteIdle() {
+	// a replica holds the messages of the primary until it takes over, they
+	// are expected to have no consumers
+	if n.IsReplica() || atomic.LoadInt32(&n.isLoading) == 1 {
+		return
+	}
+
+	opts := n.getOpts()
+	now := time.Now()
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	for _, t := range topics {
+		if opts.ChannelIdleTTL > 0 {
+			t.RLock()
+			channels := make([]*Channel, 0, len(t.channelMap))
+			for _, c := range t.channelMap {
+				channels = append(channels, c)
+			}
+			t.RUnlock()
+
+			for _, c := range channels {
+				idle := c.idleFor(now)
+				if idle < opts.ChannelIdleTTL {
+					continue
+				}
+				// checked again along with the delete as a client may have joined since
+				if t.deleteIdleChannel(c.name, opts.ChannelIdleTTL) != nil {
+					continue
+				}
+				n.logComponentf(LOG_INFO, "IDLE", "deleted channel %s:%s idle for %s", t.name, c.name, idle)
+				n.audit(AuditEvent{
+					Time:    now,
+					Action:  "delete_channel",
+					Topic:   t.name,
+					Channel: c.name,
+					Reason:  "idle for " + idle.String(),
+				})
+			}
+		}
+
+		// the events topic is expected to be idle until something happens
+		if opts.TopicIdleTTL > 0 && !n.isEventsTopic(t.name) {
+			idle := t.idleFor(now)
+			if idle < opts.TopicIdleTTL {
+				continue
+			}
+			// checked again along with the delete as it may have been published to since
+			if n.deleteIdleTopic(t.name, opts.TopicIdleTTL) != nil {
+				continue
+			}
+			n.logComponentf(LOG_INFO, "IDLE", "deleted topic %s idle for %s", t.name, idle)
+			n.audit(AuditEvent{
+				Time:   now,
+				Action: "delete_topic",
+				Topic:  t.name,
+				Reason: "idle for " + idle.String(),
+			})
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package nsqd
+
+import (
+	"sync"
+	"time"
+)
+
+// queueAges counts the messages in the memory and backend queues of a channel by
+// the second they were published, so that the age of the oldest one is known
+// without reading the queues
+type queueAges struct {
+	sync.Mutex
+	counts map[int64]int64
+	oldest int64 // the smallest key of counts, 0 if empty
+
+	// the messages found in the backend at startup, their timestamps are only
+	// known as they are read (oldest first) so the last one read stands for them
+	unknown     int64
+	unknownHead int64
+}
+
+func newQueueAges(backendDepth int64) *queueAges {
+	return &queueAges{
+		counts:  make(map[int64]int64),
+		unknown: backendDepth,
+	}
+}
+
+func (q *queueAges) add(ts int64) {
+	sec := ts / int64(time.Second)
+	q.Lock()
+	q.counts[sec]++
+	if q.oldest == 0 || sec < q.oldest {
+		q.oldest = sec
+	}
+	q.Unlock()
+}
+
+func (q *queueAges) remove(ts int64) {
+	sec := ts / int64(time.Second)
+	q.Lock()
+	defer q.Unlock()
+	n, ok := q.counts[sec]
+	if !ok {
+		if q.unknown > 0 {
+			q.unknown--
+			q.unknownHead = ts
+			if q.unknown == 0 {
+				q.unknownHead = 0
+			}
+		}
+		return
+	}
+	if n > 1 {
+		q.counts[sec] = n - 1
+		return
+	}
+	delete(q.counts, sec)
+	if sec == q.oldest {
+		q.oldest = 0
+		for s := range q.counts {
+			if q.oldest == 0 || s < q.oldest {
+				q.oldest = s
+			}
+		}
+	}
+}
+
+func (q *queueAges) reset() {
+	q.Lock()
+	q.counts = make(map[int64]int64)
+	q.oldest = 0
+	q.unknown = 0
+	q.unknownHead = 0
+	q.Unlock()
+}
+
+// oldestTimestamp returns the timestamp (in ns, to the second) of the oldest queued
+// message, 0 if there is none
+func (q *queueAges) oldestTimestamp() int64 {
+	q.Lock()
+	defer q.Unlock()
+	oldest := q.oldest * int64(time.Second)
+	if q.unknownHead != 0 && (oldest == 0 || q.unknownHead < oldest) {
+		oldest = q.unknownHead
+	}
+	return oldest
+}
+
+// dequeued must be called for every message taken off the memory or backend queue
+func (c *Channel) dequeued(msg *Message) {
+	c.queueAges.remove(msg.Timestamp)
+}
+
+// oldestInFlightTimestamp returns the timestamp of the oldest message in flight, 0
+// if there is none
+func (c *Channel) oldestInFlightTimestamp() int64 {
+	var oldest int64
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		if oldest == 0 || msg.Timestamp < oldest {
+			oldest = msg.Timestamp
+		}
+	}
+	c.inFlightMutex.Unlock()
+	return oldest
+}
+
+// lagSeconds returns the age of the oldest message not yet finished, queued or in flight
+func lagSeconds(now time.Time, timestamps ...int64) float64 {
+	var oldest int64
+	for _, ts := range timestamps {
+		if ts != 0 && (oldest == 0 || ts < oldest) {
+			oldest = ts
+		}
+	}
+	if oldest == 0 {
+		return 0
+	}
+	lag := now.Sub(time.Unix(0, oldest)).Seconds()
+	if lag < 0 {
+		return 0
+	}
+	return lag
+}
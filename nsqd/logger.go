@@ -1,6 +1,7 @@
 package nsqd
 
 import (
+	"github.com/nsqio/go-diskqueue"
 	"github.com/nsqio/nsq/internal/lg"
 )
 
@@ -18,3 +19,65 @@ func (n *NSQD) logf(level lg.LogLevel, f string, args ...interface{}) {
 	opts := n.getOpts()
 	lg.Logf(opts.Logger, opts.LogLevel, level, f, args...)
 }
+
+// logFields logs a message along with the component, topic, channel or client it is
+// about, the message itself is expected to carry that context for the text log format
+func (n *NSQD) logFields(level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
+	opts := n.getOpts()
+	lg.LogFieldsf(opts.Logger, opts.LogLevel, level, fields, f, args...)
+}
+
+// logComponentf logs a message prefixed by the component it is about, eg. "SEED: "
+func (n *NSQD) logComponentf(level lg.LogLevel, component string, f string, args ...interface{}) {
+	n.logFields(level, lg.Fields{Component: component}, component+": "+f, args...)
+}
+
+// componentLogf returns the lg.AppLogFunc of the servers shared with the other apps
+// (see protocol.TCPServer and http_api.Serve)
+func (n *NSQD) componentLogf(component string) lg.AppLogFunc {
+	return func(level lg.LogLevel, f string, args ...interface{}) {
+		n.logFields(level, lg.Fields{Component: component}, f, args...)
+	}
+}
+
+// logPeerf logs a message prefixed by the component and the address of the peer
+// it is about, eg. "LOOKUPD(127.0.0.1:4160): "
+func (n *NSQD) logPeerf(level lg.LogLevel, component string, addr string, f string, args ...interface{}) {
+	n.logFields(level, lg.Fields{Component: component, RemoteAddress: addr},
+		component+"(%s): "+f, append([]interface{}{addr}, args...)...)
+}
+
+// logf logs a message prefixed by "TOPIC(name): "
+func (t *Topic) logf(level lg.LogLevel, f string, args ...interface{}) {
+	t.nsqd.logFields(level, lg.Fields{Component: "TOPIC", Topic: t.name},
+		"TOPIC(%s): "+f, append([]interface{}{t.name}, args...)...)
+}
+
+// logf logs a message prefixed by "CHANNEL(name): "
+func (c *Channel) logf(level lg.LogLevel, f string, args ...interface{}) {
+	c.nsqd.logFields(level, lg.Fields{Component: "CHANNEL", Topic: c.topicName, Channel: c.name},
+		"CHANNEL(%s): "+f, append([]interface{}{c.name}, args...)...)
+}
+
+// logClientf logs a message prefixed by "PROTOCOL(V2): [client] "
+func (p *protocolV2) logClientf(level lg.LogLevel, client *clientV2, f string, args ...interface{}) {
+	addr := client.String()
+	p.nsqd.logFields(level, lg.Fields{Component: "PROTOCOL", Client: addr, RemoteAddress: addr},
+		"PROTOCOL(V2): [%s] "+f, append([]interface{}{addr}, args...)...)
+}
+
+// diskQueueLogf returns the logf of the diskqueue of a topic or (if channelName is
+// not empty) of a channel, its messages are prefixed by "DISKQUEUE(name): "
+func (n *NSQD) diskQueueLogf(topicName string, channelName string) diskqueue.AppLogFunc {
+	fields := lg.Fields{Component: "DISKQUEUE", Topic: topicName, Channel: channelName}
+	return func(level diskqueue.LogLevel, f string, args ...interface{}) {
+		n.logFields(lg.LogLevel(level), fields, f, args...)
+	}
+}
+
+// logf logs a message prefixed by "PUSH(url): "
+func (p *pushConsumer) logf(level lg.LogLevel, f string, args ...interface{}) {
+	c := p.channel
+	c.nsqd.logFields(level, lg.Fields{Component: "PUSH", Topic: c.topicName, Channel: c.name, URL: p.cfg.URL},
+		"PUSH(%s): "+f, append([]interface{}{p.cfg.URL}, args...)...)
+}
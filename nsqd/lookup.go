@@ -29,46 +29,36 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 
 		resp, err := lp.Command(cmd)
 		if err != nil {
-			n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lp, cmd, err)
+			n.logPeerf(LOG_ERROR, "LOOKUPD", lp.String(), "%s - %s", cmd, err)
 			return
 		} else if bytes.Equal(resp, []byte("E_INVALID")) {
-			n.logf(LOG_INFO, "LOOKUPD(%s): lookupd returned %s", lp, resp)
+			n.logPeerf(LOG_INFO, "LOOKUPD", lp.String(), "lookupd returned %s", resp)
 			lp.Close()
 			return
 		}
 
 		err = json.Unmarshal(resp, &lp.Info)
 		if err != nil {
-			n.logf(LOG_ERROR, "LOOKUPD(%s): parsing response - %s", lp, resp)
+			n.logPeerf(LOG_ERROR, "LOOKUPD", lp.String(), "parsing response - %s", resp)
 			lp.Close()
 			return
 		}
-		n.logf(LOG_INFO, "LOOKUPD(%s): peer info %+v", lp, lp.Info)
+		n.logPeerf(LOG_INFO, "LOOKUPD", lp.String(), "peer info %+v", lp.Info)
 		if lp.Info.BroadcastAddress == "" {
-			n.logf(LOG_ERROR, "LOOKUPD(%s): no broadcast address", lp)
+			n.logPeerf(LOG_ERROR, "LOOKUPD", lp.String(), "no broadcast address")
 		}
 
-		// build all the commands first so we exit the lock(s) as fast as possible
-		var commands []*nsq.Command
-		n.RLock()
-		for _, topic := range n.topicMap {
-			topic.RLock()
-			if len(topic.channelMap) == 0 {
-				commands = append(commands, nsq.Register(topic.name, ""))
-			} else {
-				for _, channel := range topic.channelMap {
-					commands = append(commands, nsq.Register(channel.topicName, channel.name))
-				}
-			}
-			topic.RUnlock()
+		// a draining nsqd, or a replica, should not be discoverable
+		if n.IsDraining() || n.IsReplica() {
+			return
 		}
-		n.RUnlock()
 
+		commands := n.registerCommands()
 		for _, cmd := range commands {
-			n.logf(LOG_INFO, "LOOKUPD(%s): %s", lp, cmd)
+			n.logPeerf(LOG_INFO, "LOOKUPD", lp.String(), "%s", cmd)
 			_, err := lp.Command(cmd)
 			if err != nil {
-				n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lp, cmd, err)
+				n.logPeerf(LOG_ERROR, "LOOKUPD", lp.String(), "%s - %s", cmd, err)
 				return
 			}
 		}
@@ -95,7 +85,7 @@ func (n *NSQD) lookupLoop() {
 				if in(host, lookupAddrs) {
 					continue
 				}
-				n.logf(LOG_INFO, "LOOKUP(%s): adding peer", host)
+				n.logPeerf(LOG_INFO, "LOOKUP", host, "adding peer")
 				lookupPeer := newLookupPeer(host, n.getOpts().MaxBodySize, n.logf,
 					connectCallback(n, hostname))
 				lookupPeer.Command(nil) // start the connection
@@ -110,11 +100,11 @@ func (n *NSQD) lookupLoop() {
 		case <-ticker.C:
 			// send a heartbeat and read a response (read detects closed conns)
 			for _, lookupPeer := range lookupPeers {
-				n.logf(LOG_DEBUG, "LOOKUPD(%s): sending heartbeat", lookupPeer)
+				n.logPeerf(LOG_DEBUG, "LOOKUPD", lookupPeer.String(), "sending heartbeat")
 				cmd := nsq.Ping()
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+					n.logPeerf(LOG_ERROR, "LOOKUPD", lookupPeer.String(), "%s - %s", cmd, err)
 				}
 			}
 		case val := <-n.notifyChan:
@@ -142,11 +132,40 @@ func (n *NSQD) lookupLoop() {
 				}
 			}
 
+			if (n.IsDraining() || n.IsReplica()) && bytes.Equal(cmd.Name, []byte("REGISTER")) {
+				// do not register new topics/channels while draining or a replica
+				continue
+			}
+
 			for _, lookupPeer := range lookupPeers {
-				n.logf(LOG_INFO, "LOOKUPD(%s): %s %s", lookupPeer, branch, cmd)
+				n.logPeerf(LOG_INFO, "LOOKUPD", lookupPeer.String(), "%s %s", branch, cmd)
 				_, err := lookupPeer.Command(cmd)
 				if err != nil {
-					n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+					n.logPeerf(LOG_ERROR, "LOOKUPD", lookupPeer.String(), "%s - %s", cmd, err)
+				}
+			}
+		case <-n.drainNotificationChan:
+			commands := n.unregisterCommands()
+			for _, lookupPeer := range lookupPeers {
+				for _, cmd := range commands {
+					n.logPeerf(LOG_INFO, "LOOKUPD", lookupPeer.String(), "drain %s", cmd)
+					_, err := lookupPeer.Command(cmd)
+					if err != nil {
+						n.logPeerf(LOG_ERROR, "LOOKUPD", lookupPeer.String(), "%s - %s", cmd, err)
+						break
+					}
+				}
+			}
+		case <-n.promoteNotificationChan:
+			commands := n.registerCommands()
+			for _, lookupPeer := range lookupPeers {
+				for _, cmd := range commands {
+					n.logPeerf(LOG_INFO, "LOOKUPD", lookupPeer.String(), "takeover %s", cmd)
+					_, err := lookupPeer.Command(cmd)
+					if err != nil {
+						n.logPeerf(LOG_ERROR, "LOOKUPD", lookupPeer.String(), "%s - %s", cmd, err)
+						break
+					}
 				}
 			}
 		case <-n.optsNotificationChan:
@@ -158,7 +177,7 @@ func (n *NSQD) lookupLoop() {
 					tmpAddrs = append(tmpAddrs, lp.addr)
 					continue
 				}
-				n.logf(LOG_INFO, "LOOKUP(%s): removing peer", lp)
+				n.logPeerf(LOG_INFO, "LOOKUP", lp.String(), "removing peer")
 				lp.Close()
 			}
 			lookupPeers = tmpPeers
@@ -170,7 +189,28 @@ func (n *NSQD) lookupLoop() {
 	}
 
 exit:
-	n.logf(LOG_INFO, "LOOKUP: closing")
+	n.logComponentf(LOG_INFO, "LOOKUP", "closing")
+}
+
+// registerCommands builds the commands to add every topic and channel
+// of this nsqd to nsqlookupd
+func (n *NSQD) registerCommands() []*nsq.Command {
+	// build all the commands first so we exit the lock(s) as fast as possible
+	var commands []*nsq.Command
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		if len(topic.channelMap) == 0 {
+			commands = append(commands, nsq.Register(topic.name, ""))
+		} else {
+			for _, channel := range topic.channelMap {
+				commands = append(commands, nsq.Register(channel.topicName, channel.name))
+			}
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+	return commands
 }
 
 func in(s string, lst []string) bool {
@@ -26,6 +26,9 @@ type Message struct {
 	pri        int64
 	index      int
 	deferred   time.Duration
+
+	// the body is in a spill file (see spill.go)
+	spilled bool
 }
 
 func NewMessage(id MessageID, body []byte) *Message {
@@ -89,9 +92,31 @@ func decodeMessage(b []byte) (*Message, error) {
 	return &msg, nil
 }
 
+// spilledRecord prefixes the backend record of a spilled message, a message record
+// cannot start with it as timestamps are positive. Versions of nsqd that predate it
+// misparse these records, the metadata of an nsqd that wrote any is marked with
+// backendFormatSpill (see spill.go).
+const spilledRecord = 0xff
+
+// decodeBackendMessage decodes a message record read from a BackendQueue
+func decodeBackendMessage(b []byte) (*Message, error) {
+	if len(b) == 0 || b[0] != spilledRecord {
+		return decodeMessage(b)
+	}
+	msg, err := decodeMessage(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	msg.spilled = true
+	return msg, nil
+}
+
 func writeMessageToBackend(msg *Message, bq BackendQueue) error {
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
+	if msg.spilled {
+		buf.WriteByte(spilledRecord)
+	}
 	_, err := msg.WriteTo(buf)
 	if err != nil {
 		return err
@@ -0,0 +1,449 @@
+package nsqd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/pqueue"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+var errMigrateSpilled = errors.New("topics with spilled messages cannot be migrated")
+
+// the deferred duration (in ms) that prefixes every message in a MIGRATE body
+const migrateHeaderLength = 8
+
+// the bytes a message takes in a MIGRATE body on top of its body
+const peerMessageOverhead = 4 + migrateHeaderLength + minValidMsgLength
+
+// maxPeerBodySize is the largest body of a MIGRATE or REPL PUB command, batches are
+// split to stay within --max-body-size but a single message has more framing than
+// when it was published
+func maxPeerBodySize(opts *Options) int64 {
+	return opts.MaxBodySize + 4 + peerMessageOverhead
+}
+
+// MigrateStats describes the messages streamed to another nsqd by Topic.Migrate
+type MigrateStats struct {
+	MessageCount  int            `json:"message_count"`
+	ChannelCounts map[string]int `json:"channel_counts"`
+}
+
+// Migrate streams the backlog of this topic, and of each of its channels (including
+// deferred messages), to the nsqd listening for TCP clients at addr.
+//
+// Message IDs, timestamps and attempts are preserved. The topic and its channels are
+// paused while their backlog is being moved. Messages that are in-flight to consumers
+// are not migrated, nor are topics with spilled messages (see spill.go).
+func (t *Topic) Migrate(addr string) (MigrateStats, error) {
+	stats := MigrateStats{
+		ChannelCounts: make(map[string]int),
+	}
+
+	if t.hasSpills() {
+		return stats, errMigrateSpilled
+	}
+
+	m, err := t.nsqd.dialPeer(addr)
+	if err != nil {
+		return stats, err
+	}
+	defer m.Close()
+
+	t.logf(LOG_INFO, "migrating to %s", addr)
+
+	// stop messagePump from moving messages to channels
+	if !t.IsPaused() {
+		t.Pause()
+		defer t.UnPause()
+	}
+
+	stats.MessageCount, err = m.migrateQueue(t.name, "", t.memoryMsgChan, t.backend, nil)
+	if err != nil {
+		return stats, err
+	}
+
+	t.RLock()
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.RUnlock()
+
+	for _, c := range channels {
+		count, err := m.migrateChannel(c)
+		stats.ChannelCounts[c.name] = count
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	t.logf(LOG_INFO, "migrated %d messages to %s", stats.MessageCount, addr)
+
+	return stats, nil
+}
+
+// peerConn is a connection to the TCP protocol of another nsqd that is
+// used to send it commands that carry messages (MIGRATE and REPL)
+type peerConn struct {
+	net.Conn
+
+	maxBatchSize int64
+	timeout      time.Duration
+}
+
+// dialPeer connects to another nsqd, upgrading the connection to TLS when the
+// peer supports it and authenticating with --peer-auth-secret when it requires it
+func (n *NSQD) dialPeer(addr string) (*peerConn, error) {
+	opts := n.getOpts()
+	conn, err := net.DialTimeout("tcp", addr, opts.HTTPClientConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// leave room for one more message so that a batch never exceeds MaxBodySize
+	maxMessageSize := peerMessageOverhead + opts.MaxMsgSize
+	m := &peerConn{
+		Conn:         conn,
+		maxBatchSize: opts.MaxBodySize - 4 - maxMessageSize,
+		timeout:      opts.HTTPClientRequestTimeout,
+	}
+	err = m.identify(addr, n.peerTLSConfig(addr), opts.PeerAuthSecret)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// peerTLSConfig returns the TLS config to connect to a peer with, presenting
+// the --tls-cert of this nsqd to peers that require client certificates
+func (n *NSQD) peerTLSConfig(addr string) *tls.Config {
+	tlsConfig := n.clientTLSConfig.Load().(*tls.Config).Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil && tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	// n.tlsConfig only defers to the current (reloadable) server config
+	if serverTLSConfig, ok := n.serverTLSConfig.Load().(*tls.Config); ok {
+		tlsConfig.Certificates = serverTLSConfig.Certificates
+	}
+	return tlsConfig
+}
+
+func (m *peerConn) identify(addr string, tlsConfig *tls.Config, authSecret string) error {
+	m.SetDeadline(time.Now().Add(m.timeout))
+	_, err := m.Write(nsq.MagicV2)
+	if err != nil {
+		return err
+	}
+
+	cmd, err := nsq.Identify(map[string]interface{}{
+		"client_id":           "nsqd",
+		"feature_negotiation": true,
+		"tls_v1":              true,
+		"user_agent":          "nsqd/" + version.Binary,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := m.execResponse(cmd)
+	if err != nil {
+		return err
+	}
+	resp := struct {
+		TLSv1        bool `json:"tls_v1"`
+		AuthRequired bool `json:"auth_required"`
+	}{}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to parse IDENTIFY response from %s - %s", addr, err)
+	}
+
+	if resp.TLSv1 {
+		tlsConn := tls.Client(m.Conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+		m.Conn = tlsConn
+		// the peer acknowledges the upgrade over TLS
+		_, err = m.readResponse(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.AuthRequired {
+		if authSecret == "" {
+			return fmt.Errorf("%s requires AUTH, set --peer-auth-secret", addr)
+		}
+		cmd, err := nsq.Auth(authSecret)
+		if err != nil {
+			return err
+		}
+		_, err = m.execResponse(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *peerConn) migrateChannel(c *Channel) (int, error) {
+	// stop consumers from receiving messages
+	if !c.IsPaused() {
+		c.Pause()
+		defer c.UnPause()
+	}
+
+	count, err := m.migrateQueue(c.topicName, c.name, c.memoryMsgChan, c.backend, c.dequeued)
+	if err != nil {
+		return count, err
+	}
+
+	items := c.takeDeferredMessages()
+	now := time.Now().UnixNano()
+	for len(items) > 0 {
+		var batch []*Message
+		var batchSize int64
+		for len(items) > 0 {
+			msg := items[0].Value.(*Message)
+			msg.deferred = 0
+			if items[0].Priority > now {
+				msg.deferred = time.Duration(items[0].Priority - now)
+			}
+			size := migrateMessageSize(msg)
+			if len(batch) > 0 && batchSize+size > m.maxBatchSize {
+				break
+			}
+			batch = append(batch, msg)
+			batchSize += size
+			items = items[1:]
+		}
+
+		err := m.send(c.topicName, c.name, batch)
+		if err != nil {
+			// put the remaining deferred messages back
+			for _, msg := range batch {
+				c.StartDeferredTimeout(msg, msg.deferred)
+			}
+			for _, item := range items {
+				c.StartDeferredTimeout(item.Value.(*Message), time.Duration(item.Priority-now))
+			}
+			return count, err
+		}
+		count += len(batch)
+	}
+
+	return count, nil
+}
+
+// migrateQueue sends the messages that are in the memory and backend queues
+// (messages that are added while migrating are left alone), sent is called for
+// each message sent if not nil
+func (m *peerConn) migrateQueue(topicName string, channelName string,
+	memoryMsgChan chan *Message, backend BackendQueue, sent func(*Message)) (int, error) {
+	var count int
+	depth := int64(len(memoryMsgChan)) + backend.Depth()
+	for {
+		batch, err := readBatch(memoryMsgChan, backend, depth-int64(count), m.maxBatchSize)
+		if len(batch) == 0 {
+			return count, err
+		}
+
+		err = m.send(topicName, channelName, batch)
+		if err != nil {
+			// persist whatever we could not send
+			for _, msg := range batch {
+				writeMessageToBackend(msg, backend)
+			}
+			return count, err
+		}
+		if sent != nil {
+			for _, msg := range batch {
+				sent(msg)
+			}
+		}
+		count += len(batch)
+	}
+}
+
+// send writes a MIGRATE command and waits for the response
+func (m *peerConn) send(topicName string, channelName string, msgs []*Message) error {
+	for _, msg := range msgs {
+		// spilled while migrating
+		if msg.isSpilled() {
+			return errMigrateSpilled
+		}
+	}
+	params := [][]byte{[]byte(topicName)}
+	if channelName != "" {
+		params = append(params, []byte(channelName))
+	}
+	return m.exec(&nsq.Command{Name: []byte("MIGRATE"), Params: params, Body: encodePeerMessages(msgs)})
+}
+
+// exec writes a command and waits for its response
+func (m *peerConn) exec(cmd *nsq.Command) error {
+	_, err := m.execResponse(cmd)
+	return err
+}
+
+// execResponse writes a command and returns its response
+func (m *peerConn) execResponse(cmd *nsq.Command) ([]byte, error) {
+	m.SetDeadline(time.Now().Add(m.timeout))
+	_, err := cmd.WriteTo(m)
+	if err != nil {
+		return nil, err
+	}
+	return m.readResponse(cmd)
+}
+
+// readResponse returns the next response to a command
+func (m *peerConn) readResponse(cmd *nsq.Command) ([]byte, error) {
+	for {
+		resp, err := nsq.ReadResponse(m)
+		if err != nil {
+			return nil, err
+		}
+		frameType, data, err := nsq.UnpackResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		if frameType == frameTypeError {
+			return nil, newPeerErr(cmd, data)
+		}
+		if bytes.Equal(data, heartbeatBytes) {
+			_, err = nsq.Nop().WriteTo(m)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return data, nil
+	}
+}
+
+// encodePeerMessages returns the body of a MIGRATE (or REPL PUB) command
+//
+//	[ 4-byte num messages ]
+//	[ 4-byte message #1 size ][ 8-byte deferred ms ][ N-byte message #1 ]
+//	...
+func encodePeerMessages(msgs []*Message) []byte {
+	var buf bytes.Buffer
+	var tmp [migrateHeaderLength]byte
+
+	binary.BigEndian.PutUint32(tmp[:4], uint32(len(msgs)))
+	buf.Write(tmp[:4])
+	for _, msg := range msgs {
+		// the size does not include the 4-byte size itself
+		binary.BigEndian.PutUint32(tmp[:4], uint32(migrateMessageSize(msg)-4))
+		buf.Write(tmp[:4])
+		binary.BigEndian.PutUint64(tmp[:], uint64(msg.deferred/time.Millisecond))
+		buf.Write(tmp[:])
+		msg.WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+func migrateMessageSize(msg *Message) int64 {
+	return int64(peerMessageOverhead + len(msg.Body))
+}
+
+// peerBatches splits msgs in batches whose encoded messages take at most maxSize
+// bytes, a message larger than that is a batch of its own
+func peerBatches(msgs []*Message, maxSize int64) [][]*Message {
+	var batches [][]*Message
+	var size int64
+	start := 0
+	for i, msg := range msgs {
+		msgSize := migrateMessageSize(msg)
+		if i > start && size+msgSize > maxSize {
+			batches = append(batches, msgs[start:i])
+			start = i
+			size = 0
+		}
+		size += msgSize
+	}
+	if start < len(msgs) {
+		batches = append(batches, msgs[start:])
+	}
+	return batches
+}
+
+// peerErr is an error response of the nsqd a peerConn is connected to
+type peerErr struct {
+	cmd  string
+	code string
+	msg  string
+}
+
+func newPeerErr(cmd *nsq.Command, data []byte) *peerErr {
+	e := &peerErr{cmd: string(cmd.Name), msg: string(data)}
+	if i := bytes.IndexByte(data, ' '); i > 0 {
+		e.code = string(data[:i])
+	}
+	return e
+}
+
+func (e *peerErr) Error() string {
+	return fmt.Sprintf("%s failed - %s", e.cmd, e.msg)
+}
+
+// readBatch removes up to max messages from the memory and backend queues
+// until either they are both empty or the batch reaches maxSize bytes
+func readBatch(memoryMsgChan chan *Message, backend BackendQueue, max int64, maxSize int64) ([]*Message, error) {
+	var batch []*Message
+	var size int64
+
+	for int64(len(batch)) < max {
+		var msg *Message
+		select {
+		case msg = <-memoryMsgChan:
+		default:
+		}
+
+		if msg == nil {
+			if backend.Depth() == 0 {
+				return batch, nil
+			}
+			select {
+			case b := <-backend.ReadChan():
+				var err error
+				msg, err = decodeBackendMessage(b)
+				if err != nil {
+					return batch, err
+				}
+			case <-time.After(100 * time.Millisecond):
+				// the backend depth is updated asynchronously
+				continue
+			}
+		}
+
+		batch = append(batch, msg)
+		size += migrateMessageSize(msg)
+		if size >= maxSize {
+			break
+		}
+	}
+	return batch, nil
+}
+
+// takeDeferredMessages removes and returns all deferred messages
+func (c *Channel) takeDeferredMessages() []*pqueue.Item {
+	c.deferredMutex.Lock()
+	items := make([]*pqueue.Item, 0, len(c.deferredMessages))
+	for _, item := range c.deferredMessages {
+		items = append(items, item)
+	}
+	c.deferredMessages = make(map[MessageID]*pqueue.Item)
+	c.deferredPQ = pqueue.New(cap(c.deferredPQ))
+	c.deferredMutex.Unlock()
+	return items
+}
@@ -0,0 +1,269 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// PutMultiTopicMessages writes messages to multiple topics (the bodies of each topic
+// in order) so that either all of them are queued or none are.
+//
+// The topics are locked in order of name for the duration of the writes, when a
+// write fails the messages already written are rolled back by having the
+// messagePump of their topic drop them (it waits for the lock to do so). The
+// IDs of the rolled back messages are persisted in the metadata so that those
+// written to disk are still dropped after a restart.
+func (n *NSQD) PutMultiTopicMessages(bodies map[string][][]byte) error {
+	names := make([]string, 0, len(bodies))
+	for name := range bodies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err := n.checkAutoCreateTopics(names)
+	if err != nil {
+		return err
+	}
+
+	topics := make([]*Topic, 0, len(names))
+	batches := make([][]*Message, 0, len(names))
+	for _, name := range names {
+		topic := n.GetTopic(name)
+		msgs := make([]*Message, 0, len(bodies[name]))
+		for _, body := range bodies[name] {
+			msgs = append(msgs, NewMessage(topic.GenerateID(), body))
+		}
+		// invalid messages are not routed to a reject topic, they fail the whole batch
+		err := topic.checkMessages(msgs)
+		if err != nil {
+			return err
+		}
+		topics = append(topics, topic)
+		batches = append(batches, msgs)
+	}
+
+	return n.putMessagesAtomically(topics, batches)
+}
+
+// putMessagesAtomically puts a batch of messages on each of the topics (distinct
+// and in order of name) so that either all of them are queued or none are
+func (n *NSQD) putMessagesAtomically(topics []*Topic, batches [][]*Message) error {
+	for i, topic := range topics {
+		err := topic.replicateMessages(batches[i])
+		if err != nil {
+			for k := 0; k < i; k++ {
+				topics[k].dropReplicated(batches[k])
+			}
+			return err
+		}
+	}
+
+	aborted, err := putMultiTopicMessages(topics, batches)
+	if err != nil {
+		for k, topic := range topics {
+			topic.dropReplicated(batches[k])
+		}
+		if aborted {
+			n.Lock()
+			perr := n.PersistMetadata()
+			if perr != nil {
+				n.logf(LOG_ERROR, "failed to persist metadata - %s", perr)
+			}
+			n.Unlock()
+		}
+		return err
+	}
+
+	for i, topic := range topics {
+		messageTotalBytes := 0
+		for _, m := range batches[i] {
+			messageTotalBytes += len(m.Body)
+		}
+		atomic.AddUint64(&topic.messageBytes, uint64(messageTotalBytes))
+		atomic.AddUint64(&topic.messageCount, uint64(len(batches[i])))
+	}
+	for i, topic := range topics {
+		for _, m := range batches[i] {
+			topic.routeMessage(m)
+		}
+	}
+	return nil
+}
+
+// putMultiTopicMessages puts the batches on the topics under their locks, it returns
+// true when messages had to be rolled back
+func putMultiTopicMessages(topics []*Topic, batches [][]*Message) (bool, error) {
+	for _, topic := range topics {
+		atomic.AddInt32(&topic.pendingMTPUBs, 1)
+		topic.Lock()
+	}
+	defer func() {
+		for _, topic := range topics {
+			topic.Unlock()
+			atomic.AddInt32(&topic.pendingMTPUBs, -1)
+		}
+	}()
+
+	for _, topic := range topics {
+		if topic.Exiting() {
+			return false, fmt.Errorf("topic %s exiting", topic.name)
+		}
+	}
+
+	for i, topic := range topics {
+		for j, m := range batches[i] {
+			err := topic.put(m)
+			if err != nil {
+				for k := 0; k < i; k++ {
+					topics[k].abortMessages(messageIDs(batches[k]))
+				}
+				topic.abortMessages(messageIDs(batches[i][:j]))
+				return true, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// abortMessages has the messagePump drop messages that were put on the topic,
+// this expects the caller to hold the topic lock
+func (t *Topic) abortMessages(ids []MessageID) {
+	if len(ids) == 0 {
+		return
+	}
+	t.addAborted(ids)
+	t.logf(LOG_WARN, "rolled back %d messages", len(ids))
+}
+
+func (t *Topic) addAborted(ids []MessageID) {
+	t.abortedMutex.Lock()
+	for _, id := range ids {
+		t.abortedMsgs[id] = struct{}{}
+	}
+	atomic.StoreInt32(&t.abortedCount, int32(len(t.abortedMsgs)))
+	t.abortedMutex.Unlock()
+}
+
+// abortedIDs returns the IDs of the rolled back messages not dropped yet, as
+// persisted in the metadata
+func (t *Topic) abortedIDs() []string {
+	if atomic.LoadInt32(&t.abortedCount) == 0 {
+		return nil
+	}
+	t.abortedMutex.Lock()
+	defer t.abortedMutex.Unlock()
+	ids := make([]string, 0, len(t.abortedMsgs))
+	for id := range t.abortedMsgs {
+		ids = append(ids, string(id[:]))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func messageIDs(msgs []*Message) []MessageID {
+	ids := make([]MessageID, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// dropAborted returns true if the message was rolled back (see abortMessages)
+func (t *Topic) dropAborted(msg *Message) bool {
+	// wait for a multi-topic publish in progress to complete, the messages it
+	// rolls back are aborted before it stops being pending
+	if atomic.LoadInt32(&t.pendingMTPUBs) > 0 {
+		t.RLock()
+		t.RUnlock()
+	}
+
+	if atomic.LoadInt32(&t.abortedCount) == 0 {
+		return false
+	}
+	t.abortedMutex.Lock()
+	defer t.abortedMutex.Unlock()
+	_, ok := t.abortedMsgs[msg.ID]
+	if ok {
+		delete(t.abortedMsgs, msg.ID)
+		atomic.StoreInt32(&t.abortedCount, int32(len(t.abortedMsgs)))
+	}
+	return ok
+}
+
+// errMessageTooBig is the parent of the readMTPUB error for a message over
+// --max-msg-size, the other errors are malformed bodies
+var errMessageTooBig = errors.New("message too big")
+
+// readMTPUB reads the body of an MTPUB command, it returns the message bodies by topic
+//
+//	[ 4-byte num messages ]
+//	[ 2-byte topic name size ][ N-byte topic name ][ 4-byte message size ][ N-byte message ]
+//	...
+func readMTPUB(r io.Reader, tmp []byte, maxMessageSize int64, maxBodySize int64) (map[string][][]byte, error) {
+	numMessages, err := readLen(r, tmp)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MTPUB failed to read message count")
+	}
+
+	// 4 == total num, 2 + 1 == topic name size + min 1, 4 + 1 == message size + min 1
+	maxMessages := (maxBodySize - 4) / 8
+	if numMessages <= 0 || int64(numMessages) > maxMessages {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
+			fmt.Sprintf("MTPUB invalid message count %d", numMessages))
+	}
+
+	bodies := make(map[string][][]byte)
+	for i := int32(0); i < numMessages; i++ {
+		_, err := io.ReadFull(r, tmp[:2])
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
+				fmt.Sprintf("MTPUB failed to read message(%d) topic name size", i))
+		}
+		topicNameSize := int(tmp[0])<<8 | int(tmp[1])
+		if topicNameSize > protocol.MaxNameLength {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+				fmt.Sprintf("MTPUB invalid message(%d) topic name size %d", i, topicNameSize))
+		}
+		topicName := make([]byte, topicNameSize)
+		_, err = io.ReadFull(r, topicName)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
+				fmt.Sprintf("MTPUB failed to read message(%d) topic name", i))
+		}
+		if !protocol.IsValidTopicName(string(topicName)) {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+				fmt.Sprintf("MTPUB topic name %q is not valid", topicName))
+		}
+
+		messageSize, err := readLen(r, tmp)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
+				fmt.Sprintf("MTPUB failed to read message(%d) body size", i))
+		}
+
+		if messageSize <= 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("MTPUB invalid message(%d) body size %d", i, messageSize))
+		}
+
+		if int64(messageSize) > maxMessageSize {
+			return nil, protocol.NewFatalClientErr(errMessageTooBig, "E_BAD_MESSAGE",
+				fmt.Sprintf("MTPUB message too big %d > %d", messageSize, maxMessageSize))
+		}
+
+		msgBody := make([]byte, messageSize)
+		_, err = io.ReadFull(r, msgBody)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MTPUB failed to read message body")
+		}
+
+		bodies[string(topicName)] = append(bodies[string(topicName)], msgBody)
+	}
+
+	return bodies, nil
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +21,7 @@ import (
 	"github.com/nsqio/nsq/internal/clusterinfo"
 	"github.com/nsqio/nsq/internal/dirlock"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/statsd"
 	"github.com/nsqio/nsq/internal/util"
@@ -47,14 +49,33 @@ type NSQD struct {
 
 	opts atomic.Value
 
-	dl        *dirlock.DirLock
-	isLoading int32
-	isExiting int32
-	errValue  atomic.Value
-	startTime time.Time
+	dl         *dirlock.DirLock
+	isLoading  int32
+	isExiting  int32
+	isDraining int32
+	isReplica  int32
+	errValue   atomic.Value
+	resources  atomic.Value // *ResourceStatus
+	startTime  time.Time
+
+	// the format of the records in the backend queues (see spill.go)
+	backendFormat int32
 
 	topicMap map[string]*Topic
 
+	// serializes changes to routes and their loop checks
+	routeMutex sync.Mutex
+
+	autoCreate atomic.Value // *autoCreatePolicy
+
+	tracer *tracer
+
+	eventChan chan SystemEvent
+
+	// the GET /stats/stream feeds, by query (see stats_stream.go)
+	statsFeedsMutex sync.Mutex
+	statsFeeds      map[string]*statsFeed
+
 	lookupPeers atomic.Value
 
 	tcpServer       *tcpServer
@@ -62,14 +83,33 @@ type NSQD struct {
 	httpListener    net.Listener
 	httpsListener   net.Listener
 	tlsConfig       *tls.Config
-	clientTLSConfig *tls.Config
+	serverTLSConfig atomic.Value // *tls.Config
+	clientTLSConfig atomic.Value // *tls.Config
+
+	// the options as last given to New or Reload (see reload.go)
+	configOpts  Options
+	reloadMutex sync.Mutex
 
 	poolSize int
 
-	notifyChan           chan interface{}
-	optsNotificationChan chan struct{}
-	exitChan             chan int
-	waitGroup            util.WaitGroupWrapper
+	notifyChan              chan interface{}
+	optsNotificationChan    chan struct{}
+	drainNotificationChan   chan struct{}
+	promoteNotificationChan chan struct{}
+	exitChan                chan int
+	waitGroup               util.WaitGroupWrapper
+
+	// primary: commands waiting to be sent to the replica
+	replicationChan chan *replicationOp
+	replicateTopics []*regexp.Regexp
+	// primary: why the replica refused it, if it did
+	fenced atomic.Value // string
+	// replica: the primary it accepts REPL commands from
+	primaryMutex sync.Mutex
+	replicaOf    string
+	// replica: number of connections from a primary
+	primaryConnCount      int32
+	primaryConnUpdateChan chan struct{}
 
 	ci *clusterinfo.ClusterInfo
 }
@@ -82,17 +122,29 @@ func New(opts *Options) (*NSQD, error) {
 		cwd, _ := os.Getwd()
 		dataPath = cwd
 	}
+	if err := lg.ValidateFormat(opts.LogFormat); err != nil {
+		return nil, err
+	}
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		if opts.LogFormat == lg.JSONFormat {
+			opts.Logger = lg.NewJSONLogger(os.Stderr, "nsqd")
+		} else {
+			opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		}
 	}
 
 	n := &NSQD{
-		startTime:            time.Now(),
-		topicMap:             make(map[string]*Topic),
-		exitChan:             make(chan int),
-		notifyChan:           make(chan interface{}),
-		optsNotificationChan: make(chan struct{}, 1),
-		dl:                   dirlock.New(dataPath),
+		startTime:               time.Now(),
+		topicMap:                make(map[string]*Topic),
+		exitChan:                make(chan int),
+		notifyChan:              make(chan interface{}),
+		eventChan:               make(chan SystemEvent, eventChanSize),
+		statsFeeds:              make(map[string]*statsFeed),
+		optsNotificationChan:    make(chan struct{}, 1),
+		drainNotificationChan:   make(chan struct{}, 1),
+		promoteNotificationChan: make(chan struct{}, 1),
+		primaryConnUpdateChan:   make(chan struct{}, 1),
+		dl:                      dirlock.New(dataPath),
 	}
 	n.ctx, n.ctxCancel = context.WithCancel(context.Background())
 	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
@@ -102,24 +154,36 @@ func New(opts *Options) (*NSQD, error) {
 
 	n.swapOpts(opts)
 	n.errValue.Store(errStore{})
+	n.resources.Store(&ResourceStatus{
+		Level:     ResourceOK,
+		DiskLevel: ResourceOK,
+		HeapLevel: ResourceOK,
+	})
 
-	err = n.dl.Lock()
+	// an nsqd started by Upgrade locks the data path once it has the listeners
+	up, err := inheritUpgrade()
 	if err != nil {
-		return nil, fmt.Errorf("failed to lock data-path: %v", err)
+		return nil, err
 	}
-
-	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
-		return nil, errors.New("--max-deflate-level must be [1,9]")
+	if up == nil {
+		err = n.dl.Lock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock data-path: %v", err)
+		}
 	}
 
-	if opts.ID < 0 || opts.ID >= 1024 {
-		return nil, errors.New("--node-id must be [0,1024)")
-	}
+	// keep the options as given to compare them with the ones to Reload()
+	n.configOpts = *opts
 
 	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
 		opts.TLSRequired = TLSRequired
 	}
 
+	err = validateOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	tlsConfig, err := buildTLSConfig(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build TLS config - %s", err)
@@ -127,44 +191,67 @@ func New(opts *Options) (*NSQD, error) {
 	if tlsConfig == nil && opts.TLSRequired != TLSNotRequired {
 		return nil, errors.New("cannot require TLS client connections without TLS key and cert")
 	}
-	n.tlsConfig = tlsConfig
+	if tlsConfig != nil {
+		// the TLS config is looked up for each connection so that Reload() can swap it
+		n.serverTLSConfig.Store(tlsConfig)
+		n.tlsConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return n.serverTLSConfig.Load().(*tls.Config), nil
+			},
+		}
+	}
 
 	clientTLSConfig, err := buildClientTLSConfig(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build client TLS config - %s", err)
 	}
-	n.clientTLSConfig = clientTLSConfig
+	n.clientTLSConfig.Store(clientTLSConfig)
 
-	if opts.AuthHTTPRequestMethod != "post" && opts.AuthHTTPRequestMethod != "get" {
-		return nil, errors.New("--auth-http-request-method must be post or get")
+	if opts.Replica {
+		n.isReplica = 1
 	}
+	if opts.ReplicaTCPAddress != "" {
+		n.replicationChan = make(chan *replicationOp, opts.MemQueueSize)
+		n.replicateTopics, _ = compileRegexps(opts.ReplicateTopicRegexps)
+	}
+	n.fenced.Store("")
 
-	for _, v := range opts.E2EProcessingLatencyPercentiles {
-		if v <= 0 || v > 1 {
-			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
-		}
+	autoCreate, err := newAutoCreatePolicy(opts)
+	if err != nil {
+		return nil, err
 	}
+	n.autoCreate.Store(autoCreate)
+
+	n.tracer = newTracer(opts.TraceBufferSize)
 
 	n.logf(LOG_INFO, version.String("nsqd"))
-	n.logf(LOG_INFO, "ID: %d", opts.ID)
+	n.logComponentf(LOG_INFO, "ID", "%d", opts.ID)
 
 	n.tcpServer = &tcpServer{nsqd: n}
-	n.tcpListener, err = net.Listen(util.TypeOfAddr(opts.TCPAddress), opts.TCPAddress)
+	n.tcpListener, err = up.listen("tcp", opts.TCPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", opts.TCPAddress, err)
 	}
 	if opts.HTTPAddress != "" {
-		n.httpListener, err = net.Listen(util.TypeOfAddr(opts.HTTPAddress), opts.HTTPAddress)
+		n.httpListener, err = up.listen("http", opts.HTTPAddress)
 		if err != nil {
 			return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
 		}
 	}
 	if n.tlsConfig != nil && opts.HTTPSAddress != "" {
-		n.httpsListener, err = tls.Listen("tcp", opts.HTTPSAddress, n.tlsConfig)
+		// wrapped in TLS by Main so that Upgrade can hand over the TCP listener
+		n.httpsListener, err = up.listen("https", opts.HTTPSAddress)
 		if err != nil {
 			return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPSAddress, err)
 		}
 	}
+	if up != nil {
+		n.logComponentf(LOG_INFO, "UPGRADE", "waiting for the previous nsqd to release %s", dataPath)
+		err = up.takeOver(n.dl, opts.UpgradeTimeout, n.componentLogf("UPGRADE"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock data-path: %v", err)
+		}
+	}
 	if opts.BroadcastHTTPPort == 0 {
 		tcpAddr, ok := n.RealHTTPAddr().(*net.TCPAddr)
 		if ok {
@@ -192,6 +279,104 @@ func New(opts *Options) (*NSQD, error) {
 	return n, nil
 }
 
+// validateOptions checks the options New and Reload cannot do without
+func validateOptions(opts *Options) error {
+	if opts.MaxDeflateLevel < 1 || opts.MaxDeflateLevel > 9 {
+		return errors.New("--max-deflate-level must be [1,9]")
+	}
+
+	if opts.ID < 0 || opts.ID >= 1024 {
+		return errors.New("--node-id must be [0,1024)")
+	}
+
+	if opts.AuthHTTPRequestMethod != "post" && opts.AuthHTTPRequestMethod != "get" {
+		return errors.New("--auth-http-request-method must be post or get")
+	}
+
+	if opts.ReplicationMode != "sync" && opts.ReplicationMode != "async" {
+		return errors.New("--replication-mode must be sync or async")
+	}
+
+	if opts.Replica && opts.ReplicaTCPAddress != "" {
+		return errors.New("cannot use --replica-tcp-address with --replica")
+	}
+	if opts.Replica && len(opts.ReplicaPrimaryAddresses) == 0 {
+		return errors.New("--replica requires at least one --replica-primary-address")
+	}
+	if opts.ReplicaTCPAddress != "" && len(opts.ReplicateTopicRegexps) == 0 {
+		return errors.New("--replica-tcp-address requires at least one --replicate-topic-regex")
+	}
+	if _, err := compileRegexps(opts.ReplicateTopicRegexps); err != nil {
+		return fmt.Errorf("invalid --replicate-topic-regex %s", err)
+	}
+
+	if opts.SeedExtra != SeedExtraIgnore && opts.SeedExtra != SeedExtraReport && opts.SeedExtra != SeedExtraDelete {
+		return errors.New("--seed-extra must be ignore, report or delete")
+	}
+
+	if opts.SpillMsgThreshold > opts.MaxMsgSize {
+		return errors.New("--spill-msg-threshold must not be greater than --max-msg-size")
+	}
+	if opts.SpillMsgThreshold > 0 && opts.MaxSpillMsgSize <= opts.SpillMsgThreshold {
+		return errors.New("--max-spill-msg-size must be greater than --spill-msg-threshold")
+	}
+	if opts.MaxSpillMsgSize > maxSpillMsgSize {
+		return fmt.Errorf("--max-spill-msg-size must be <= %d", maxSpillMsgSize)
+	}
+
+	if opts.TraceSampleRate < 0 || opts.TraceSampleRate > 1 {
+		return errors.New("--trace-sample-rate must be [0,1]")
+	}
+	if opts.TraceBufferSize < 0 {
+		return errors.New("--trace-buffer-size must be >= 0")
+	}
+
+	if opts.DrainTimeout < 0 {
+		return errors.New("--drain-timeout must be >= 0")
+	}
+
+	if opts.StatsHistory < 0 {
+		return errors.New("--stats-history must be >= 0")
+	}
+
+	if opts.DiskUsageWarnPercent < 0 || opts.DiskUsageWarnPercent > 100 {
+		return errors.New("--disk-usage-warn-percent must be [0,100]")
+	}
+	if opts.DiskUsageCriticalPercent < 0 || opts.DiskUsageCriticalPercent > 100 {
+		return errors.New("--disk-usage-critical-percent must be [0,100]")
+	}
+	if opts.HeapWarnBytes < 0 {
+		return errors.New("--heap-warn-bytes must be >= 0")
+	}
+	if opts.HeapCriticalBytes < 0 {
+		return errors.New("--heap-critical-bytes must be >= 0")
+	}
+	if opts.ResourceCheckInterval <= 0 {
+		return errors.New("--resource-check-interval must be > 0")
+	}
+
+	switch opts.StatsdFormat {
+	case statsd.FormatStatsd, statsd.FormatDogStatsd, statsd.FormatGraphite:
+	default:
+		return fmt.Errorf("--statsd-format must be %s, %s or %s",
+			statsd.FormatStatsd, statsd.FormatDogStatsd, statsd.FormatGraphite)
+	}
+	if _, err := compileRegexps(opts.StatsdTopicRegexps); err != nil {
+		return fmt.Errorf("invalid --statsd-topic-regex %s", err)
+	}
+
+	if opts.EventsTopic != "" && !protocol.IsValidTopicName(opts.EventsTopic) {
+		return fmt.Errorf("--events-topic %q is not a valid topic name", opts.EventsTopic)
+	}
+
+	for _, v := range opts.E2EProcessingLatencyPercentiles {
+		if v <= 0 || v > 1 {
+			return fmt.Errorf("invalid E2E processing latency percentile: %v", v)
+		}
+	}
+	return nil
+}
+
 func (n *NSQD) getOpts() *Options {
 	return n.opts.Load().(*Options)
 }
@@ -250,6 +435,45 @@ func (n *NSQD) GetHealth() string {
 	return "OK"
 }
 
+// publishError is why nsqd does not accept messages from clients, Code is
+// the reason reported to them
+type publishError struct {
+	Code string
+	msg  string
+}
+
+func (e *publishError) Error() string {
+	return e.msg
+}
+
+// publishErr is the (non-fatal) error of a client publish nsqd did not accept, the
+// code of a *publishError tells the client why, eg. to retry a RESOURCES_CRITICAL
+// one later, "E_PUB_FAILED PUB failed RESOURCES_CRITICAL - nsqd resources are ..."
+func publishErr(cmd string, err error) error {
+	if perr, ok := err.(*publishError); ok {
+		return protocol.NewClientErr(nil, "E_"+cmd+"_FAILED",
+			fmt.Sprintf("%s failed %s - %s", cmd, perr.Code, perr.msg))
+	}
+	return protocol.NewClientErr(nil, "E_"+cmd+"_FAILED", fmt.Sprintf("%s failed - %s", cmd, err))
+}
+
+// checkPublish returns a *publishError when nsqd does not accept messages from clients
+func (n *NSQD) checkPublish() error {
+	if n.IsDraining() {
+		return &publishError{"DRAINING", "nsqd is draining"}
+	}
+	if n.IsReplica() {
+		return &publishError{"REPLICA", "nsqd is a replica"}
+	}
+	if reason := n.fencedReason(); reason != "" {
+		return &publishError{"FENCED", "nsqd was fenced by its replica - " + reason}
+	}
+	if err := n.resourceError(ResourceCritical); err != nil {
+		return &publishError{"RESOURCES_CRITICAL", err.Error()}
+	}
+	return nil
+}
+
 func (n *NSQD) GetStartTime() time.Time {
 	return n.startTime
 }
@@ -267,26 +491,39 @@ func (n *NSQD) Main() error {
 	}
 
 	n.waitGroup.Wrap(func() {
-		exitFunc(protocol.TCPServer(n.tcpListener, n.tcpServer, n.logf))
+		exitFunc(protocol.TCPServer(n.tcpListener, n.tcpServer, n.componentLogf("TCP")))
 	})
 	if n.httpListener != nil {
 		httpServer := newHTTPServer(n, false, n.getOpts().TLSRequired == TLSRequired)
 		n.waitGroup.Wrap(func() {
-			exitFunc(http_api.Serve(n.httpListener, httpServer, "HTTP", n.logf))
+			exitFunc(http_api.Serve(n.httpListener, httpServer, "HTTP", n.componentLogf("HTTP")))
 		})
 	}
 	if n.httpsListener != nil {
 		httpsServer := newHTTPServer(n, true, true)
 		n.waitGroup.Wrap(func() {
-			exitFunc(http_api.Serve(n.httpsListener, httpsServer, "HTTPS", n.logf))
+			exitFunc(http_api.Serve(tls.NewListener(n.httpsListener, n.tlsConfig), httpsServer, "HTTPS", n.componentLogf("HTTPS")))
 		})
 	}
 
 	n.waitGroup.Wrap(n.queueScanLoop)
 	n.waitGroup.Wrap(n.lookupLoop)
-	if n.getOpts().StatsdAddress != "" {
-		n.waitGroup.Wrap(n.statsdLoop)
+	n.waitGroup.Wrap(n.eventLoop)
+	if n.getOpts().StatsHistory >= time.Second {
+		n.waitGroup.Wrap(n.rateLoop)
+	}
+	n.waitGroup.Wrap(n.statsdLoop)
+	if n.replicationChan != nil {
+		n.waitGroup.Wrap(n.replicationLoop)
+	}
+	if n.IsReplica() {
+		n.waitGroup.Wrap(n.replicaLoop)
 	}
+	if idleScanInterval(n.getOpts()) > 0 {
+		n.waitGroup.Wrap(n.idleLoop)
+	}
+	n.updateResources()
+	n.waitGroup.Wrap(n.resourceLoop)
 
 	err := <-exitCh
 	return err
@@ -294,21 +531,27 @@ func (n *NSQD) Main() error {
 
 // Metadata is the collection of persistent information about the current NSQD.
 type Metadata struct {
-	Topics  []TopicMetadata `json:"topics"`
-	Version string          `json:"version"`
+	Topics        []TopicMetadata `json:"topics"`
+	Version       string          `json:"version"`
+	BackendFormat int32           `json:"backend_format,omitempty"`
 }
 
 // TopicMetadata is the collection of persistent information about a topic.
 type TopicMetadata struct {
-	Name     string            `json:"name"`
-	Paused   bool              `json:"paused"`
-	Channels []ChannelMetadata `json:"channels"`
+	Name        string            `json:"name"`
+	Paused      bool              `json:"paused"`
+	Schema      json.RawMessage   `json:"schema,omitempty"`
+	RejectTopic string            `json:"reject_topic,omitempty"`
+	Routes      []RouteRule       `json:"routes,omitempty"`
+	Aborted     []string          `json:"aborted,omitempty"`
+	Channels    []ChannelMetadata `json:"channels"`
 }
 
 // ChannelMetadata is the collection of persistent information about a channel.
 type ChannelMetadata struct {
-	Name   string `json:"name"`
-	Paused bool   `json:"paused"`
+	Name              string       `json:"name"`
+	Paused            bool         `json:"paused"`
+	PushSubscriptions []PushConfig `json:"push_subscriptions,omitempty"`
 }
 
 func newMetadataFile(opts *Options) string {
@@ -339,7 +582,17 @@ func writeSyncFile(fn string, data []byte) error {
 	return err
 }
 
+// LoadMetadata restores the topics and channels persisted in the data path,
+// then reconciles them with the --seed-file
 func (n *NSQD) LoadMetadata() error {
+	err := n.loadMetadata()
+	if err != nil {
+		return err
+	}
+	return n.Seed()
+}
+
+func (n *NSQD) loadMetadata() error {
 	atomic.StoreInt32(&n.isLoading, 1)
 	defer atomic.StoreInt32(&n.isLoading, 0)
 
@@ -358,6 +611,11 @@ func (n *NSQD) LoadMetadata() error {
 	if err != nil {
 		return fmt.Errorf("failed to parse metadata in %s - %s", fn, err)
 	}
+	if m.BackendFormat > backendFormatSpill {
+		return fmt.Errorf("metadata in %s has backend_format %d, this nsqd supports up to %d",
+			fn, m.BackendFormat, backendFormatSpill)
+	}
+	atomic.StoreInt32(&n.backendFormat, m.BackendFormat)
 
 	for _, t := range m.Topics {
 		if !protocol.IsValidTopicName(t.Name) {
@@ -368,6 +626,25 @@ func (n *NSQD) LoadMetadata() error {
 		if t.Paused {
 			topic.Pause()
 		}
+		// only messages on disk survive a restart
+		if len(t.Aborted) > 0 && topic.backend.Depth() > 0 {
+			ids := make([]MessageID, 0, len(t.Aborted))
+			for _, abortedID := range t.Aborted {
+				var id MessageID
+				if len(abortedID) != len(id) {
+					continue
+				}
+				copy(id[:], abortedID)
+				ids = append(ids, id)
+			}
+			topic.addAborted(ids)
+		}
+		if t.Schema != nil {
+			err := topic.SetSchema(t.Schema, t.RejectTopic)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to set schema of topic %s - %s", t.Name, err)
+			}
+		}
 		for _, c := range t.Channels {
 			if !protocol.IsValidChannelName(c.Name) {
 				n.logf(LOG_WARN, "skipping creation of invalid channel %s", c.Name)
@@ -377,9 +654,38 @@ func (n *NSQD) LoadMetadata() error {
 			if c.Paused {
 				channel.Pause()
 			}
+			if n.IsReplica() {
+				err := channel.holdBackend()
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to hold the messages of channel %s - %s", c.Name, err)
+				}
+			}
+			for _, cfg := range c.PushSubscriptions {
+				err := channel.AddPushSubscription(cfg)
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to push channel %s to %s - %s", c.Name, cfg.URL, err)
+				}
+			}
 		}
 		topic.Start()
 	}
+
+	// routes are set once all the topics exist (their targets
+	// that were not in the metadata are started here)
+	for _, t := range m.Topics {
+		topic, err := n.GetExistingTopic(t.Name)
+		if err != nil {
+			continue
+		}
+		for _, rule := range t.Routes {
+			err := n.SetRoute(topic, rule)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to route topic %s to %s - %s", t.Name, rule.Target, err)
+				continue
+			}
+			n.GetTopic(rule.Target).Start()
+		}
+	}
 	return nil
 }
 
@@ -388,7 +694,8 @@ func (n *NSQD) LoadMetadata() error {
 // are not saved to disk.
 func (n *NSQD) GetMetadata(ephemeral bool) *Metadata {
 	meta := &Metadata{
-		Version: version.Binary,
+		Version:       version.Binary,
+		BackendFormat: atomic.LoadInt32(&n.backendFormat),
 	}
 	for _, topic := range n.topicMap {
 		if topic.ephemeral && !ephemeral {
@@ -398,14 +705,18 @@ func (n *NSQD) GetMetadata(ephemeral bool) *Metadata {
 			Name:   topic.name,
 			Paused: topic.IsPaused(),
 		}
+		topicData.Schema, topicData.RejectTopic = topic.Schema()
+		topicData.Routes = topic.Routes()
+		topicData.Aborted = topic.abortedIDs()
 		topic.Lock()
 		for _, channel := range topic.channelMap {
 			if channel.ephemeral {
 				continue
 			}
 			topicData.Channels = append(topicData.Channels, ChannelMetadata{
-				Name:   channel.name,
-				Paused: channel.IsPaused(),
+				Name:              channel.name,
+				Paused:            channel.IsPaused(),
+				PushSubscriptions: channel.PushSubscriptions(),
 			})
 		}
 		topic.Unlock()
@@ -418,7 +729,7 @@ func (n *NSQD) PersistMetadata() error {
 	// persist metadata about what topics/channels we have, across restarts
 	fileName := newMetadataFile(n.getOpts())
 
-	n.logf(LOG_INFO, "NSQ: persisting topic/channel metadata to %s", fileName)
+	n.logComponentf(LOG_INFO, "NSQ", "persisting topic/channel metadata to %s", fileName)
 
 	data, err := json.Marshal(n.GetMetadata(false))
 	if err != nil {
@@ -465,17 +776,17 @@ func (n *NSQD) Exit() {
 	if err != nil {
 		n.logf(LOG_ERROR, "failed to persist metadata - %s", err)
 	}
-	n.logf(LOG_INFO, "NSQ: closing topics")
+	n.logComponentf(LOG_INFO, "NSQ", "closing topics")
 	for _, topic := range n.topicMap {
 		topic.Close()
 	}
 	n.Unlock()
 
-	n.logf(LOG_INFO, "NSQ: stopping subsystems")
+	n.logComponentf(LOG_INFO, "NSQ", "stopping subsystems")
 	close(n.exitChan)
 	n.waitGroup.Wait()
 	n.dl.Unlock()
-	n.logf(LOG_INFO, "NSQ: bye")
+	n.logComponentf(LOG_INFO, "NSQ", "bye")
 	n.ctxCancel()
 }
 
@@ -502,10 +813,11 @@ func (n *NSQD) GetTopic(topicName string) *Topic {
 	}
 	t = NewTopic(topicName, n, deleteCallback)
 	n.topicMap[topicName] = t
+	n.bindRoutes(t)
 
 	n.Unlock()
 
-	n.logf(LOG_INFO, "TOPIC(%s): created", t.name)
+	t.logf(LOG_INFO, "created")
 	// topic is created but messagePump not yet started
 
 	// if this topic was created while loading metadata at startup don't do any further initialization
@@ -550,6 +862,18 @@ func (n *NSQD) GetExistingTopic(topicName string) (*Topic, error) {
 
 // DeleteExistingTopic removes a topic only if it exists
 func (n *NSQD) DeleteExistingTopic(topicName string) error {
+	return n.deleteExistingTopic(topicName, (*Topic).Delete)
+}
+
+// deleteIdleTopic removes a topic only if it exists and is still idle for at
+// least ttl, errNotIdle otherwise
+func (n *NSQD) deleteIdleTopic(topicName string, ttl time.Duration) error {
+	return n.deleteExistingTopic(topicName, func(t *Topic) error {
+		return t.deleteIfIdle(ttl)
+	})
+}
+
+func (n *NSQD) deleteExistingTopic(topicName string, del func(*Topic) error) error {
 	n.RLock()
 	topic, ok := n.topicMap[topicName]
 	if !ok {
@@ -564,12 +888,18 @@ func (n *NSQD) DeleteExistingTopic(topicName string) error {
 	// we do this before removing the topic from map below (with no lock)
 	// so that any incoming writes will error and not create a new topic
 	// to enforce ordering
-	topic.Delete()
+	if err := del(topic); err == errNotIdle {
+		return err
+	}
 
 	n.Lock()
 	delete(n.topicMap, topicName)
 	n.Unlock()
 
+	if topic.replicated {
+		n.replicate(replicationCommand("DELETE", topicName), false)
+	}
+
 	return nil
 }
 
@@ -578,6 +908,7 @@ func (n *NSQD) Notify(v interface{}, persist bool) {
 	// should not persist metadata while loading it.
 	// nsqd will call `PersistMetadata` it after loading
 	loading := atomic.LoadInt32(&n.isLoading) == 1
+	n.notifyEvent(v)
 	n.waitGroup.Wrap(func() {
 		// by selecting on exitChan we guarantee that
 		// we do not block exit, see issue #123
@@ -721,7 +1052,7 @@ func (n *NSQD) queueScanLoop() {
 	}
 
 exit:
-	n.logf(LOG_INFO, "QUEUESCAN: closing")
+	n.logComponentf(LOG_INFO, "QUEUESCAN", "closing")
 	close(closeCh)
 	workTicker.Stop()
 	refreshTicker.Stop()
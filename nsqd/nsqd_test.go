@@ -1,17 +1,22 @@
 package nsqd
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/test"
 	"github.com/nsqio/nsq/nsqlookupd"
@@ -205,6 +210,96 @@ func TestEphemeralTopicsAndChannels(t *testing.T) {
 	<-doneExitChan
 }
 
+func TestIdleTopicsAndChannels(t *testing.T) {
+	var mu sync.Mutex
+	var events []AuditEvent
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ChannelIdleTTL = 100 * time.Millisecond
+	opts.TopicIdleTTL = 200 * time.Millisecond
+	opts.AuditHook = func(e AuditEvent) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "idle_topic" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	idleChannel := topic.GetChannel("idle")
+	usedChannel := topic.GetChannel("used")
+	client := newClientV2(0, nil, nsqd)
+	err := usedChannel.AddClient(client.ID, client)
+	test.Nil(t, err)
+
+	time.Sleep(150 * time.Millisecond)
+
+	_, err = topic.GetExistingChannel(idleChannel.name)
+	test.NotNil(t, err)
+	_, err = topic.GetExistingChannel(usedChannel.name)
+	test.Nil(t, err)
+
+	usedChannel.RemoveClient(client.ID)
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	test.Equal(t, 3, len(events))
+	test.Equal(t, "delete_channel", events[0].Action)
+	test.Equal(t, "idle", events[0].Channel)
+	test.Equal(t, "delete_channel", events[1].Action)
+	test.Equal(t, "used", events[1].Channel)
+	test.Equal(t, "delete_topic", events[2].Action)
+	test.Equal(t, topicName, events[2].Topic)
+}
+
+func TestDeleteIdleRechecks(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "idle_recheck" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	time.Sleep(50 * time.Millisecond)
+
+	// a client joined after the channel was found idle
+	test.Equal(t, true, channel.idleFor(time.Now()) >= 50*time.Millisecond)
+	client := newClientV2(0, nil, nsqd)
+	test.Nil(t, channel.AddClient(client.ID, client))
+	test.Equal(t, errNotIdle, topic.deleteIdleChannel("ch", 50*time.Millisecond))
+	_, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, false, channel.Exiting())
+
+	channel.RemoveClient(client.ID)
+	time.Sleep(50 * time.Millisecond)
+	test.Nil(t, topic.deleteIdleChannel("ch", 50*time.Millisecond))
+	_, err = topic.GetExistingChannel("ch")
+	test.NotNil(t, err)
+
+	// a message was published after the topic was found idle
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, true, topic.idleFor(time.Now()) >= 50*time.Millisecond)
+	test.Nil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body"))))
+	test.Equal(t, errNotIdle, nsqd.deleteIdleTopic(topicName, 50*time.Millisecond))
+	test.Equal(t, int64(1), topic.Depth())
+
+	time.Sleep(50 * time.Millisecond)
+	test.Nil(t, nsqd.deleteIdleTopic(topicName, 50*time.Millisecond))
+	_, err = nsqd.GetExistingTopic(topicName)
+	test.NotNil(t, err)
+	test.NotNil(t, topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body"))))
+}
+
 func TestPauseMetadata(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -240,6 +335,109 @@ func TestPauseMetadata(t *testing.T) {
 	test.Equal(t, false, isPaused(nsqd, 0, 0))
 }
 
+func TestMetadataBackendFormat(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// queues written by a newer nsqd are not read
+	err := os.WriteFile(newMetadataFile(opts),
+		[]byte(`{"topics": [], "version": "1.3.0", "backend_format": 2}`), 0600)
+	test.Nil(t, err)
+	err = nsqd.LoadMetadata()
+	test.NotNil(t, err)
+
+	err = os.WriteFile(newMetadataFile(opts),
+		[]byte(`{"topics": [], "version": "1.3.0", "backend_format": 1}`), 0600)
+	test.Nil(t, err)
+	err = nsqd.LoadMetadata()
+	test.Nil(t, err)
+	test.Equal(t, int32(backendFormatSpill), nsqd.GetMetadata(false).BackendFormat)
+}
+
+func TestSeed(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tmpDir, err := os.MkdirTemp("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	opts.DataPath = tmpDir
+	opts.SeedFile = filepath.Join(tmpDir, "seed.toml")
+	opts.SeedExtra = SeedExtraDelete
+	err = os.WriteFile(opts.SeedFile, []byte(`
+[[topics]]
+name = "orders"
+schema = '{"type": "object"}'
+
+[[topics.channels]]
+name = "archive"
+paused = true
+
+[[topics.channels]]
+name = "billing"
+
+[[topics]]
+name = "audit"
+paused = true
+`), 0600)
+	test.Nil(t, err)
+
+	_, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("extra")
+	nsqd.GetTopic("orders").GetChannel("old")
+
+	err = nsqd.LoadMetadata()
+	test.Nil(t, err)
+
+	orders, err := nsqd.GetExistingTopic("orders")
+	test.Nil(t, err)
+	schema, _ := orders.Schema()
+	test.Equal(t, `{"type":"object"}`, string(schema))
+	archive, err := orders.GetExistingChannel("archive")
+	test.Nil(t, err)
+	test.Equal(t, true, archive.IsPaused())
+	_, err = orders.GetExistingChannel("billing")
+	test.Nil(t, err)
+	_, err = orders.GetExistingChannel("old")
+	test.NotNil(t, err)
+	audit, err := nsqd.GetExistingTopic("audit")
+	test.Nil(t, err)
+	test.Equal(t, true, audit.IsPaused())
+	_, err = nsqd.GetExistingTopic("extra")
+	test.NotNil(t, err)
+
+	// reconciling again applies the changes of the file
+	newOpts := *opts
+	newOpts.SeedFile = filepath.Join(tmpDir, "seed.json")
+	newOpts.SeedExtra = SeedExtraReport
+	nsqd.swapOpts(&newOpts)
+	err = os.WriteFile(newOpts.SeedFile,
+		[]byte(`{"topics": [{"name": "orders", "schema": {"type": "object"}, "channels": [{"name": "archive", "paused": false}]}]}`), 0600)
+	test.Nil(t, err)
+	// the same schema, however it was formatted, is not set again
+	err = orders.SetSchema([]byte(`{ "type": "object" }`), "")
+	test.Nil(t, err)
+	prevSchema := orders.getSchema()
+
+	err = nsqd.Seed()
+	test.Nil(t, err)
+	test.Equal(t, true, orders.getSchema() == prevSchema)
+	test.Equal(t, false, archive.IsPaused())
+	_, err = orders.GetExistingChannel("billing")
+	test.Nil(t, err)
+	_, err = nsqd.GetExistingTopic("audit")
+	test.Nil(t, err)
+
+	err = os.WriteFile(newOpts.SeedFile, []byte(`{"topics": [{"name": "bad topic"}]}`), 0600)
+	test.Nil(t, err)
+	err = nsqd.Seed()
+	test.NotNil(t, err)
+}
+
 func mustStartNSQLookupd(opts *nsqlookupd.Options) (net.Addr, net.Addr, *nsqlookupd.NSQLookupd) {
 	opts.TCPAddress = "127.0.0.1:0"
 	opts.HTTPAddress = "127.0.0.1:0"
@@ -278,6 +476,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts := NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd1.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -295,6 +494,7 @@ func TestReconfigure(t *testing.T) {
 
 	newOpts = NewOptions()
 	newOpts.Logger = opts.Logger
+	newOpts.DataPath = opts.DataPath
 	newOpts.NSQLookupdTCPAddresses = []string{lookupd2.RealTCPAddr().String(), lookupd3.RealTCPAddr().String()}
 	nsqd.swapOpts(newOpts)
 	nsqd.triggerOptsNotification()
@@ -316,6 +516,110 @@ func TestReconfigure(t *testing.T) {
 	test.Equal(t, newOpts.NSQLookupdTCPAddresses, lookupPeers)
 }
 
+func TestSystemEvents(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EventsTopic = "_nsqd.events"
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	events := nsqd.GetTopic("_nsqd.events").GetChannel("audit")
+
+	topic := nsqd.GetTopic("events")
+	channel := topic.GetChannel("ch")
+	topic.Pause()
+	channel.Pause()
+
+	expect := func(expected ...SystemEvent) {
+		t.Helper()
+		for _, e := range expected {
+			var got SystemEvent
+			select {
+			case msg := <-events.memoryMsgChan:
+				test.Nil(t, json.Unmarshal(msg.Body, &got))
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %s event", e.Type)
+			}
+			test.Equal(t, e.Type, got.Type)
+			test.Equal(t, e.Topic, got.Topic)
+			test.Equal(t, e.Channel, got.Channel)
+			test.Equal(t, e.RemoteAddress, got.RemoteAddress)
+			test.Equal(t, nsqd.getOpts().BroadcastAddress, got.BroadcastAddress)
+			if e.ClientID != "" {
+				test.Equal(t, e.ClientID, got.ClientID)
+			}
+		}
+	}
+
+	expect(
+		SystemEvent{Type: EventTopicCreated, Topic: "_nsqd.events"},
+		SystemEvent{Type: EventChannelCreated, Topic: "_nsqd.events", Channel: "audit"},
+		SystemEvent{Type: EventTopicCreated, Topic: "events"},
+		SystemEvent{Type: EventChannelCreated, Topic: "events", Channel: "ch"},
+		SystemEvent{Type: EventTopicPaused, Topic: "events"},
+		SystemEvent{Type: EventChannelPaused, Topic: "events", Channel: "ch"},
+	)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, map[string]interface{}{"client_id": "audited"}, frameTypeResponse)
+	conn.Close()
+	expect(
+		SystemEvent{Type: EventClientConnected, RemoteAddress: conn.LocalAddr().String()},
+		SystemEvent{Type: EventClientDisconnected, ClientID: "audited", RemoteAddress: conn.LocalAddr().String()},
+	)
+
+	topic.DeleteExistingChannel("ch")
+	nsqd.DeleteExistingTopic("events")
+	expect(
+		SystemEvent{Type: EventChannelDeleted, Topic: "events", Channel: "ch"},
+		SystemEvent{Type: EventTopicDeleted, Topic: "events"},
+	)
+}
+
+func TestEventsTopicReserved(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.EventsTopic = "_nsqd.events"
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.GetTopic("_nsqd.events")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	nsq.Publish("_nsqd.events", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_BAD_TOPIC PUB topic "_nsqd.events" is reserved for nsqd events`)
+
+	url := fmt.Sprintf("http://%s/pub?topic=_nsqd.events", httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 403, resp.StatusCode)
+
+	// the events topic is neither deleted when idle nor when it is not seeded
+	newOpts := *opts
+	newOpts.TopicIdleTTL = time.Nanosecond
+	nsqd.swapOpts(&newOpts)
+	nsqd.GetTopic("idle")
+	nsqd.deleteIdle()
+	_, err = nsqd.GetExistingTopic("idle")
+	test.NotNil(t, err)
+	_, err = nsqd.GetExistingTopic("_nsqd.events")
+	test.Nil(t, err)
+
+	nsqd.GetTopic("extra")
+	nsqd.seedExtra(map[string]*SeedTopic{}, SeedExtraDelete)
+	_, err = nsqd.GetExistingTopic("extra")
+	test.NotNil(t, err)
+	_, err = nsqd.GetExistingTopic("_nsqd.events")
+	test.Nil(t, err)
+}
+
 func TestCluster(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -418,6 +722,7 @@ func TestCluster(t *testing.T) {
 func TestSetHealth(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = t.TempDir()
 	nsqd, err := New(opts)
 	test.Nil(t, err)
 	defer nsqd.Exit()
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/statsd"
 )
 
 type Options struct {
@@ -17,8 +18,12 @@ type Options struct {
 	ID        int64       `flag:"node-id" cfg:"id"`
 	LogLevel  lg.LogLevel `flag:"log-level"`
 	LogPrefix string      `flag:"log-prefix"`
+	LogFormat string      `flag:"log-format"`
 	Logger    Logger
 
+	// ConfigLoader returns the options to Reload on SIGHUP and POST /config/reload
+	ConfigLoader func() (*Options, error)
+
 	TCPAddress               string        `flag:"tcp-address"`
 	HTTPAddress              string        `flag:"http-address"`
 	HTTPSAddress             string        `flag:"https-address"`
@@ -28,8 +33,11 @@ type Options struct {
 	NSQLookupdTCPAddresses   []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	AuthHTTPRequestMethod    string        `flag:"auth-http-request-method" cfg:"auth_http_request_method"`
+	PeerAuthSecret           string        `flag:"peer-auth-secret" cfg:"peer_auth_secret"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
+	UpgradeTimeout           time.Duration `flag:"upgrade-timeout"`
+	DrainTimeout             time.Duration `flag:"drain-timeout"`
 
 	// diskqueue options
 	DataPath        string        `flag:"data-path"`
@@ -52,6 +60,42 @@ type Options struct {
 	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
 	ClientTimeout time.Duration
 
+	// large messages (see spill.go)
+	SpillMsgThreshold int64 `flag:"spill-msg-threshold"`
+	MaxSpillMsgSize   int64 `flag:"max-spill-msg-size"`
+
+	// idle topic and channel cleanup (see idle.go)
+	TopicIdleTTL   time.Duration `flag:"topic-idle-ttl"`
+	ChannelIdleTTL time.Duration `flag:"channel-idle-ttl"`
+	AuditHook      func(AuditEvent)
+
+	// topic and channel auto-creation (see autocreate.go)
+	AutoCreate               string   `flag:"auto-create"`
+	AutoCreateTopicRegexps   []string `flag:"auto-create-topic-regex" cfg:"auto_create_topic_regexes"`
+	AutoCreateChannelRegexps []string `flag:"auto-create-channel-regex" cfg:"auto_create_channel_regexes"`
+
+	// declarative topics and channels (see seed.go)
+	SeedFile  string `flag:"seed-file"`
+	SeedExtra string `flag:"seed-extra"`
+
+	// message lifecycle tracing (see trace.go)
+	TraceTopics     []string `flag:"trace-topic" cfg:"trace_topics"`
+	TraceSampleRate float64  `flag:"trace-sample-rate"`
+	TraceBufferSize int      `flag:"trace-buffer-size"`
+
+	// system events (see events.go)
+	EventsTopic string `flag:"events-topic"`
+
+	// per-second message rates (see rates.go)
+	StatsHistory time.Duration `flag:"stats-history"`
+
+	// disk and heap usage checks, 0 disables a threshold (see resources.go)
+	DiskUsageWarnPercent     float64       `flag:"disk-usage-warn-percent"`
+	DiskUsageCriticalPercent float64       `flag:"disk-usage-critical-percent"`
+	HeapWarnBytes            int64         `flag:"heap-warn-bytes"`
+	HeapCriticalBytes        int64         `flag:"heap-critical-bytes"`
+	ResourceCheckInterval    time.Duration `flag:"resource-check-interval"`
+
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
 	MaxRdyCount            int64         `flag:"max-rdy-count"`
@@ -68,6 +112,21 @@ type Options struct {
 	StatsdMemStats         bool          `flag:"statsd-mem-stats"`
 	StatsdUDPPacketSize    int           `flag:"statsd-udp-packet-size"`
 	StatsdExcludeEphemeral bool          `flag:"statsd-exclude-ephemeral"`
+	StatsdFormat           string        `flag:"statsd-format"`
+	StatsdTopicRegexps     []string      `flag:"statsd-topic-regex" cfg:"statsd_topic_regexes"`
+	StatsdExcludeMetrics   []string      `flag:"statsd-exclude-metric" cfg:"statsd_exclude_metrics"`
+
+	// prometheus /metrics (see prometheus.go)
+	PrometheusExcludeEphemeral bool `flag:"prometheus-exclude-ephemeral"`
+	PrometheusExcludeClients   bool `flag:"prometheus-exclude-clients"`
+
+	// replication
+	ReplicaTCPAddress       string        `flag:"replica-tcp-address"`
+	ReplicateTopicRegexps   []string      `flag:"replicate-topic-regex" cfg:"replicate_topic_regexes"`
+	ReplicationMode         string        `flag:"replication-mode"`
+	Replica                 bool          `flag:"replica"`
+	ReplicaPrimaryAddresses []string      `flag:"replica-primary-address" cfg:"replica_primary_addresses"`
+	ReplicaTakeoverTimeout  time.Duration `flag:"replica-takeover-timeout"`
 
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
@@ -101,6 +160,7 @@ func NewOptions() *Options {
 		ID:        defaultID,
 		LogPrefix: "[nsqd] ",
 		LogLevel:  lg.INFO,
+		LogFormat: lg.TextFormat,
 
 		TCPAddress:        "0.0.0.0:4150",
 		HTTPAddress:       "0.0.0.0:4151",
@@ -115,6 +175,7 @@ func NewOptions() *Options {
 
 		HTTPClientConnectTimeout: 2 * time.Second,
 		HTTPClientRequestTimeout: 5 * time.Second,
+		UpgradeTimeout:           time.Minute,
 
 		MemQueueSize:    10000,
 		MaxBytesPerFile: 100 * 1024 * 1024,
@@ -134,6 +195,17 @@ func NewOptions() *Options {
 		MaxReqTimeout: 1 * time.Hour,
 		ClientTimeout: 60 * time.Second,
 
+		MaxSpillMsgSize: 512 * 1024 * 1024,
+
+		AutoCreate: AutoCreateAll,
+
+		SeedExtra: SeedExtraIgnore,
+
+		TraceTopics:     make([]string, 0),
+		TraceBufferSize: 10000,
+
+		ResourceCheckInterval: 5 * time.Second,
+
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
 		MaxOutputBufferSize:    64 * 1024,
@@ -142,10 +214,18 @@ func NewOptions() *Options {
 		OutputBufferTimeout:    250 * time.Millisecond,
 		MaxChannelConsumers:    0,
 
-		StatsdPrefix:        "nsq.%s",
-		StatsdInterval:      60 * time.Second,
-		StatsdMemStats:      true,
-		StatsdUDPPacketSize: 508,
+		StatsdPrefix:         "nsq.%s",
+		StatsdInterval:       60 * time.Second,
+		StatsdMemStats:       true,
+		StatsdUDPPacketSize:  508,
+		StatsdFormat:         statsd.FormatStatsd,
+		StatsdTopicRegexps:   make([]string, 0),
+		StatsdExcludeMetrics: make([]string, 0),
+
+		ReplicateTopicRegexps:   make([]string, 0),
+		ReplicaPrimaryAddresses: make([]string, 0),
+		ReplicationMode:         "async",
+		ReplicaTakeoverTimeout:  10 * time.Second,
 
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
@@ -0,0 +1,170 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/quantile"
+)
+
+// promWriter renders metrics in the Prometheus text exposition format, the samples
+// are grouped by metric as the format requires
+type promWriter struct {
+	metrics []*promMetric
+	index   map[string]*promMetric
+}
+
+type promMetric struct {
+	name    string
+	typ     string
+	help    string
+	samples bytes.Buffer
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func newPromWriter() *promWriter {
+	return &promWriter{index: make(map[string]*promMetric)}
+}
+
+// add adds a sample to the metric name, labels are given as name, value pairs
+func (w *promWriter) add(name string, typ string, help string, value float64, labels ...string) {
+	m, ok := w.index[name]
+	if !ok {
+		m = &promMetric{name: name, typ: typ, help: help}
+		w.metrics = append(w.metrics, m)
+		w.index[name] = m
+	}
+
+	m.samples.WriteString(name)
+	if len(labels) > 0 {
+		m.samples.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.samples.WriteByte(',')
+			}
+			fmt.Fprintf(&m.samples, `%s="%s"`, labels[i], promLabelEscaper.Replace(labels[i+1]))
+		}
+		m.samples.WriteByte('}')
+	}
+	m.samples.WriteByte(' ')
+	m.samples.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.samples.WriteByte('\n')
+}
+
+func (w *promWriter) counter(name string, help string, value uint64, labels ...string) {
+	w.add(name, "counter", help, float64(value), labels...)
+}
+
+func (w *promWriter) gauge(name string, help string, value int64, labels ...string) {
+	w.add(name, "gauge", help, float64(value), labels...)
+}
+
+func (w *promWriter) flag(name string, help string, value bool, labels ...string) {
+	var v int64
+	if value {
+		v = 1
+	}
+	w.gauge(name, help, v, labels...)
+}
+
+// latency adds latency percentiles (in seconds) and their sample count, name is eg.
+// "nsq_channel_e2e_processing_latency"
+func (w *promWriter) latency(name string, help string, r *quantile.Result, labels ...string) {
+	if r == nil || len(r.Percentiles) == 0 {
+		return
+	}
+	for _, item := range r.Percentiles {
+		w.add(name+"_seconds", "gauge",
+			help+" percentiles over --e2e-processing-latency-window-time",
+			item["value"]/1e9,
+			append(labels, "quantile", strconv.FormatFloat(item["quantile"], 'g', -1, 64))...)
+	}
+	w.gauge(name+"_samples", "number of latency samples the percentiles are computed from",
+		int64(r.Count), labels...)
+}
+
+func (w *promWriter) WriteTo(out io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	for _, m := range w.metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.typ)
+		buf.Write(m.samples.Bytes())
+	}
+	return buf.WriteTo(out)
+}
+
+// writePrometheusStats renders GetStats as Prometheus metrics
+func writePrometheusStats(w *promWriter, stats Stats, excludeEphemeral bool) {
+	for _, t := range stats.Topics {
+		if excludeEphemeral && strings.HasSuffix(t.TopicName, "#ephemeral") {
+			continue
+		}
+		tl := []string{"topic", t.TopicName}
+		w.gauge("nsq_topic_depth", "messages in memory and on disk", t.Depth, tl...)
+		w.gauge("nsq_topic_backend_depth", "messages on disk", t.BackendDepth, tl...)
+		w.counter("nsq_topic_messages_total", "messages published", t.MessageCount, tl...)
+		w.counter("nsq_topic_message_bytes_total", "bytes published", t.MessageBytes, tl...)
+		w.counter("nsq_topic_validation_failures_total", "messages rejected by the topic schema", t.ValidationFailureCount, tl...)
+		w.flag("nsq_topic_paused", "1 if the topic is paused", t.Paused, tl...)
+		w.latency("nsq_topic_e2e_processing_latency", "end to end processing latency", t.E2eProcessingLatency, tl...)
+
+		for _, c := range t.Channels {
+			if excludeEphemeral && strings.HasSuffix(c.ChannelName, "#ephemeral") {
+				continue
+			}
+			cl := []string{"topic", t.TopicName, "channel", c.ChannelName}
+			w.gauge("nsq_channel_depth", "messages in memory and on disk", c.Depth, cl...)
+			w.gauge("nsq_channel_backend_depth", "messages on disk", c.BackendDepth, cl...)
+			w.gauge("nsq_channel_in_flight_messages", "messages sent to clients and not yet finished", int64(c.InFlightCount), cl...)
+			w.gauge("nsq_channel_deferred_messages", "messages deferred or requeued with a delay", int64(c.DeferredCount), cl...)
+			w.counter("nsq_channel_messages_total", "messages received by the channel", c.MessageCount, cl...)
+			w.counter("nsq_channel_requeues_total", "messages requeued", c.RequeueCount, cl...)
+			w.counter("nsq_channel_timeouts_total", "messages that timed out in flight", c.TimeoutCount, cl...)
+			w.gauge("nsq_channel_clients", "connected consumers", int64(c.ClientCount), cl...)
+			w.flag("nsq_channel_paused", "1 if the channel is paused", c.Paused, cl...)
+			w.add("nsq_channel_lag_seconds", "gauge", "age of the oldest message queued or in flight", c.LagSeconds, cl...)
+			w.latency("nsq_channel_e2e_processing_latency", "end to end processing latency", c.E2eProcessingLatency, cl...)
+			w.latency("nsq_channel_queue_wait_latency", "publish to first delivery latency", c.QueueWaitLatency, cl...)
+			w.latency("nsq_channel_handler_latency", "delivery to FIN latency", c.HandlerLatency, cl...)
+
+			for _, client := range c.Clients {
+				s, ok := client.(ClientV2Stats)
+				if !ok {
+					continue
+				}
+				l := append(cl, "client_id", s.ClientID, "hostname", s.Hostname, "remote_address", s.RemoteAddress)
+				w.gauge("nsq_client_ready_count", "RDY count of the consumer", s.ReadyCount, l...)
+				w.gauge("nsq_client_in_flight_messages", "messages in flight to the consumer", s.InFlightCount, l...)
+				w.counter("nsq_client_messages_total", "messages sent to the consumer", s.MessageCount, l...)
+				w.counter("nsq_client_finishes_total", "messages finished by the consumer", s.FinishCount, l...)
+				w.counter("nsq_client_requeues_total", "messages requeued by the consumer", s.RequeueCount, l...)
+			}
+
+			for _, p := range c.PushSubscriptions {
+				l := append(cl, "url", p.URL)
+				w.gauge("nsq_push_in_flight_messages", "messages in flight to the push subscription", p.InFlightCount, l...)
+				w.counter("nsq_push_messages_total", "messages sent to the push subscription", p.MessageCount, l...)
+				w.counter("nsq_push_finishes_total", "messages accepted by the push subscription", p.FinishCount, l...)
+				w.counter("nsq_push_requeues_total", "messages requeued for the push subscription", p.RequeueCount, l...)
+			}
+		}
+	}
+
+	for _, producer := range stats.Producers {
+		s, ok := producer.(ClientV2Stats)
+		if !ok {
+			continue
+		}
+		for _, pc := range s.PubCounts {
+			if excludeEphemeral && strings.HasSuffix(pc.Topic, "#ephemeral") {
+				continue
+			}
+			w.counter("nsq_producer_messages_total", "messages published by the producer",
+				pc.Count, "topic", pc.Topic, "client_id", s.ClientID, "hostname", s.Hostname, "remote_address", s.RemoteAddress)
+		}
+	}
+}
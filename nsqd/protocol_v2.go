@@ -2,18 +2,22 @@ package nsqd
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/rpc"
 	"github.com/nsqio/nsq/internal/version"
 )
 
@@ -27,6 +31,14 @@ var separatorBytes = []byte(" ")
 var heartbeatBytes = []byte("_heartbeat_")
 var okBytes = []byte("OK")
 
+// the prefix of the reply topics of RPC, only the connection owning a reply topic
+// may SUB to it
+const replyTopicPrefix = "_reply."
+
+func isReplyTopic(name string) bool {
+	return strings.HasPrefix(name, replyTopicPrefix)
+}
+
 type protocolV2 struct {
 	nsqd *NSQD
 }
@@ -42,6 +54,7 @@ func (p *protocolV2) IOLoop(c protocol.Client) error {
 	var zeroTime time.Time
 
 	client := c.(*clientV2)
+	client.emitEvent(EventClientConnected, "")
 
 	// synchronize the startup of messagePump in order
 	// to guarantee that it gets a chance to initialize
@@ -79,7 +92,7 @@ func (p *protocolV2) IOLoop(c protocol.Client) error {
 		}
 		params := bytes.Split(line, separatorBytes)
 
-		p.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] %s", client, params)
+		p.logClientf(LOG_DEBUG, client, "%s", params)
 
 		var response []byte
 		response, err = p.Exec(client, params)
@@ -112,17 +125,30 @@ func (p *protocolV2) IOLoop(c protocol.Client) error {
 		}
 	}
 
-	p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting ioloop", client)
+	p.logClientf(LOG_INFO, client, "exiting ioloop")
+	client.emitEvent(EventClientDisconnected, "")
 	close(client.ExitChan)
 	if client.Channel != nil {
 		client.Channel.RemoveClient(client.ID)
 	}
+	if client.isPrimary {
+		p.nsqd.addPrimaryConn(-1)
+	}
+	if client.replyTopic != "" {
+		// the topic is already gone if the client subscribed to it
+		// with an ephemeral channel
+		p.nsqd.DeleteExistingTopic(client.replyTopic)
+	}
 
 	return err
 }
 
 func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
-	p.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
+	if msg.isSpilled() {
+		return p.SendSpilledMessage(client, msg)
+	}
+
+	p.logClientf(LOG_DEBUG, client, "writing msg(%s) - %s", msg.ID, msg.Body)
 
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
@@ -184,6 +210,8 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.PUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB")):
 		return p.MPUB(client, params)
+	case bytes.Equal(params[0], []byte("MTPUB")):
+		return p.MTPUB(client, params)
 	case bytes.Equal(params[0], []byte("DPUB")):
 		return p.DPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
@@ -196,6 +224,12 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.CLS(client, params)
 	case bytes.Equal(params[0], []byte("AUTH")):
 		return p.AUTH(client, params)
+	case bytes.Equal(params[0], []byte("RPC")):
+		return p.RPC(client, params)
+	case bytes.Equal(params[0], []byte("MIGRATE")):
+		return p.MIGRATE(client, params)
+	case bytes.Equal(params[0], []byte("REPL")):
+		return p.REPL(client, params)
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -301,13 +335,18 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				goto exit
 			}
 		case b := <-backendMsgChan:
+			msg, err := decodeBackendMessage(b)
+			if err != nil {
+				p.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				continue
+			}
+			subChannel.dequeued(msg)
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
 				continue
 			}
-
-			msg, err := decodeMessage(b)
-			if err != nil {
-				p.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+			if msg.isSpilled() && !client.acceptsLargeMessages() {
+				// leave it to a consumer that accepts large messages
+				subChannel.holdSpill(msg)
 				continue
 			}
 			msg.Attempts++
@@ -320,9 +359,14 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			}
 			flushed = false
 		case msg := <-memoryMsgChan:
+			subChannel.dequeued(msg)
 			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
 				continue
 			}
+			if msg.isSpilled() && !client.acceptsLargeMessages() {
+				subChannel.holdSpill(msg)
+				continue
+			}
 			msg.Attempts++
 
 			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
@@ -338,11 +382,11 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	}
 
 exit:
-	p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
+	p.logClientf(LOG_INFO, client, "exiting messagePump")
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
 	if err != nil {
-		p.nsqd.logf(LOG_ERROR, "PROTOCOL(V2): [%s] messagePump error - %s", client, err)
+		p.logClientf(LOG_ERROR, client, "messagePump error - %s", err)
 	}
 }
 
@@ -381,7 +425,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
 	}
 
-	p.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): [%s] %+v", client, identifyData)
+	p.logClientf(LOG_DEBUG, client, "%+v", identifyData)
 
 	err = client.Identify(identifyData)
 	if err != nil {
@@ -403,6 +447,11 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		deflateLevel = max
 	}
 	snappy := p.nsqd.getOpts().SnappyEnabled && identifyData.Snappy
+	largeMessages := p.nsqd.getOpts().SpillMsgThreshold > 0 && identifyData.LargeMessages
+	var maxSpillMsgSize int64
+	if p.nsqd.getOpts().SpillMsgThreshold > 0 {
+		maxSpillMsgSize = p.nsqd.getOpts().MaxSpillMsgSize
+	}
 
 	if deflate && snappy {
 		return nil, protocol.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
@@ -422,6 +471,8 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
 		OutputBufferTimeout int64  `json:"output_buffer_timeout"`
+		LargeMessages       bool   `json:"large_messages"`
+		MaxSpillMsgSize     int64  `json:"max_spill_msg_size,omitempty"`
 	}{
 		MaxRdyCount:         p.nsqd.getOpts().MaxRdyCount,
 		Version:             version.Binary,
@@ -436,6 +487,8 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		AuthRequired:        p.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
 		OutputBufferTimeout: int64(client.OutputBufferTimeout / time.Millisecond),
+		LargeMessages:       largeMessages,
+		MaxSpillMsgSize:     maxSpillMsgSize,
 	})
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -446,8 +499,12 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
 	}
 
+	if largeMessages {
+		atomic.StoreInt32(&client.LargeMessages, 1)
+	}
+
 	if tlsv1 {
-		p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] upgrading connection to TLS", client)
+		p.logClientf(LOG_INFO, client, "upgrading connection to TLS")
 		err = client.UpgradeTLS()
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -460,7 +517,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 	}
 
 	if snappy {
-		p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] upgrading connection to snappy", client)
+		p.logClientf(LOG_INFO, client, "upgrading connection to snappy")
 		err = client.UpgradeSnappy()
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -473,7 +530,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 	}
 
 	if deflate {
-		p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] upgrading connection to deflate (level %d)", client, deflateLevel)
+		p.logClientf(LOG_INFO, client, "upgrading connection to deflate (level %d)", deflateLevel)
 		err = client.UpgradeDeflate(deflateLevel)
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
@@ -528,11 +585,13 @@ func (p *protocolV2) AUTH(client *clientV2, params [][]byte) ([]byte, error) {
 
 	if err := client.Auth(string(body)); err != nil {
 		// we don't want to leak errors contacting the auth server to untrusted clients
-		p.nsqd.logf(LOG_WARN, "PROTOCOL(V2): [%s] AUTH failed %s", client, err)
+		p.logClientf(LOG_WARN, client, "AUTH failed %s", err)
+		client.emitEvent(EventAuthFailed, "E_AUTH_FAILED")
 		return nil, protocol.NewFatalClientErr(err, "E_AUTH_FAILED", "AUTH failed")
 	}
 
 	if !client.HasAuthorizations() {
+		client.emitEvent(EventAuthFailed, "E_UNAUTHORIZED")
 		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED", "AUTH no authorizations found")
 	}
 
@@ -569,10 +628,13 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 		ok, err := client.IsAuthorized(topicName, channelName)
 		if err != nil {
 			// we don't want to leak errors contacting the auth server to untrusted clients
-			p.nsqd.logf(LOG_WARN, "PROTOCOL(V2): [%s] AUTH failed %s", client, err)
+			p.logClientf(LOG_WARN, client, "AUTH failed %s", err)
+			client.emitEvent(EventAuthFailed, "E_AUTH_FAILED")
 			return protocol.NewFatalClientErr(nil, "E_AUTH_FAILED", "AUTH failed")
 		}
 		if !ok {
+			client.emitEvent(EventAuthFailed,
+				fmt.Sprintf("E_UNAUTHORIZED %s on %q %q", cmd, topicName, channelName))
 			return protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
 				fmt.Sprintf("AUTH failed for %s on %q %q", cmd, topicName, channelName))
 		}
@@ -605,6 +667,11 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("SUB channel name %q is not valid", channelName))
 	}
 
+	if isReplyTopic(topicName) && topicName != client.replyTopic {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("SUB topic %q is the reply topic of another client", topicName))
+	}
+
 	if err := p.CheckAuth(client, "SUB", topicName, channelName); err != nil {
 		return nil, err
 	}
@@ -614,8 +681,21 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	// Avoid adding a client to an ephemeral channel / topic which has started exiting.
 	var channel *Channel
 	for i := 1; ; i++ {
-		topic := p.nsqd.GetTopic(topicName)
-		channel = topic.GetChannel(channelName)
+		var topic *Topic
+		var err error
+		if topicName == client.replyTopic {
+			// recreated in case it was deleted along with its last channel
+			topic = p.nsqd.GetTopic(topicName)
+		} else {
+			topic, err = p.nsqd.getOrAutoCreateTopic(topicName)
+			if err != nil {
+				return nil, topicNotFoundErr("SUB", topicName)
+			}
+		}
+		channel, err = topic.getOrAutoCreateChannel(channelName)
+		if err != nil {
+			return nil, channelNotFoundErr("SUB", topicName, channelName)
+		}
 		if err := channel.AddClient(client.ID, client); err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_SUB_FAILED", "SUB failed "+err.Error())
 		}
@@ -643,9 +723,7 @@ func (p *protocolV2) RDY(client *clientV2, params [][]byte) ([]byte, error) {
 
 	if state == stateClosing {
 		// just ignore ready changes on a closing channel
-		p.nsqd.logf(LOG_INFO,
-			"PROTOCOL(V2): [%s] ignoring RDY after CLS in state ClientStateV2Closing",
-			client)
+		p.logClientf(LOG_INFO, client, "ignoring RDY after CLS in state ClientStateV2Closing")
 		return nil, nil
 	}
 
@@ -732,8 +810,8 @@ func (p *protocolV2) REQ(client *clientV2, params [][]byte) ([]byte, error) {
 		clampedTimeout = maxReqTimeout
 	}
 	if clampedTimeout != timeoutDuration {
-		p.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] REQ timeout %d out of range 0-%d. Setting to %d",
-			client, timeoutDuration, maxReqTimeout, clampedTimeout)
+		p.logClientf(LOG_INFO, client, "REQ timeout %d out of range 0-%d. Setting to %d",
+			timeoutDuration, maxReqTimeout, clampedTimeout)
 		timeoutDuration = clampedTimeout
 	}
 
@@ -774,6 +852,9 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("PUB topic name %q is not valid", topicName))
 	}
+	if p.nsqd.isEventsTopic(topicName) {
+		return nil, eventsTopicErr("PUB", topicName)
+	}
 
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
@@ -785,6 +866,10 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("PUB invalid message body size %d", bodyLen))
 	}
 
+	if p.nsqd.shouldSpill(topicName, int64(bodyLen)) {
+		return p.spilledPUB(client, topicName, bodyLen)
+	}
+
 	if int64(bodyLen) > p.nsqd.getOpts().MaxMsgSize {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
 			fmt.Sprintf("PUB message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
@@ -800,10 +885,58 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
-	topic := p.nsqd.GetTopic(topicName)
+	if err := p.nsqd.checkPublish(); err != nil {
+		return nil, publishErr("PUB", err)
+	}
+
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err != nil {
+		return nil, topicNotFoundErr("PUB", topicName)
+	}
 	msg := NewMessage(topic.GenerateID(), messageBody)
+	err = topic.publishMessages([]*Message{msg})
+	if err != nil {
+		return nil, validationErr("PUB", err)
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return okBytes, nil
+}
+
+// spilledPUB streams the body of a PUB to a spill file instead of reading it in memory
+func (p *protocolV2) spilledPUB(client *clientV2, topicName string, bodyLen int32) ([]byte, error) {
+	if int64(bodyLen) > p.nsqd.getOpts().MaxSpillMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("PUB message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxSpillMsgSize))
+	}
+
+	if err := p.CheckAuth(client, "PUB", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err == nil {
+		err = p.nsqd.checkPublish()
+	}
+	if err != nil {
+		_, readErr := io.CopyN(io.Discard, client.Reader, int64(bodyLen))
+		if readErr != nil {
+			return nil, protocol.NewFatalClientErr(readErr, "E_BAD_MESSAGE", "PUB failed to read message body")
+		}
+		if err == errTopicNotFound {
+			return nil, topicNotFoundErr("PUB", topicName)
+		}
+		return nil, publishErr("PUB", err)
+	}
+
+	msg, err := topic.spillMessage(client.Reader, int64(bodyLen))
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed to spill message body")
+	}
 	err = topic.PutMessage(msg)
 	if err != nil {
+		topic.removeSpill(msg)
 		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
 	}
 
@@ -824,13 +957,14 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name %q is not valid", topicName))
 	}
+	if p.nsqd.isEventsTopic(topicName) {
+		return nil, eventsTopicErr("MPUB", topicName)
+	}
 
 	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
 		return nil, err
 	}
 
-	topic := p.nsqd.GetTopic(topicName)
-
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read body size")
@@ -846,18 +980,34 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("MPUB body too big %d > %d", bodyLen, p.nsqd.getOpts().MaxBodySize))
 	}
 
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err == nil {
+		err = p.nsqd.checkPublish()
+	}
+	if err != nil {
+		// discard the body so that the client can retry on this connection
+		_, discardErr := io.CopyN(io.Discard, client.Reader, int64(bodyLen))
+		if discardErr != nil {
+			return nil, protocol.NewFatalClientErr(discardErr, "E_BAD_BODY", "MPUB failed to read body")
+		}
+		if err == errTopicNotFound {
+			return nil, topicNotFoundErr("MPUB", topicName)
+		}
+		return nil, publishErr("MPUB", err)
+	}
+
 	messages, err := readMPUB(client.Reader, client.lenSlice, topic,
 		p.nsqd.getOpts().MaxMsgSize, p.nsqd.getOpts().MaxBodySize)
 	if err != nil {
 		return nil, err
 	}
 
-	// if we've made it this far we've validated all the input,
-	// the only possible error is that the topic is exiting during
+	// if we've made it this far we've validated all the input but the schema,
+	// the other possible error is that the topic is exiting during
 	// this next call (and no messages will be queued in that case)
-	err = topic.PutMessages(messages)
+	err = topic.publishMessages(messages)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
+		return nil, validationErr("MPUB", err)
 	}
 
 	client.PublishedMessage(topicName, uint64(len(messages)))
@@ -865,6 +1015,61 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	return okBytes, nil
 }
 
+// MTPUB publishes messages to multiple topics, either all of them are queued or none are
+func (p *protocolV2) MTPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MTPUB failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MTPUB invalid body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.nsqd.getOpts().MaxBodySize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MTPUB body too big %d > %d", bodyLen, p.nsqd.getOpts().MaxBodySize))
+	}
+
+	if err := p.nsqd.checkPublish(); err != nil {
+		// discard the body so that the client can retry on this connection
+		_, discardErr := io.CopyN(io.Discard, client.Reader, int64(bodyLen))
+		if discardErr != nil {
+			return nil, protocol.NewFatalClientErr(discardErr, "E_BAD_BODY", "MTPUB failed to read body")
+		}
+		return nil, publishErr("MTPUB", err)
+	}
+
+	bodies, err := readMTPUB(client.Reader, client.lenSlice,
+		p.nsqd.getOpts().MaxMsgSize, p.nsqd.getOpts().MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	for topicName := range bodies {
+		if p.nsqd.isEventsTopic(topicName) {
+			return nil, eventsTopicErr("MTPUB", topicName)
+		}
+		if err := p.CheckAuth(client, "MTPUB", topicName, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	err = p.nsqd.PutMultiTopicMessages(bodies)
+	if err != nil {
+		return nil, validationErr("MTPUB", err)
+	}
+
+	for topicName, topicBodies := range bodies {
+		client.PublishedMessage(topicName, uint64(len(topicBodies)))
+	}
+
+	return okBytes, nil
+}
+
 func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	var err error
 
@@ -877,6 +1082,9 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("DPUB topic name %q is not valid", topicName))
 	}
+	if p.nsqd.isEventsTopic(topicName) {
+		return nil, eventsTopicErr("DPUB", topicName)
+	}
 
 	timeoutMs, err := protocol.ByteToBase10(params[2])
 	if err != nil {
@@ -916,12 +1124,19 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
-	topic := p.nsqd.GetTopic(topicName)
+	if err := p.nsqd.checkPublish(); err != nil {
+		return nil, publishErr("DPUB", err)
+	}
+
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err != nil {
+		return nil, topicNotFoundErr("DPUB", topicName)
+	}
 	msg := NewMessage(topic.GenerateID(), messageBody)
 	msg.deferred = timeoutDuration
-	err = topic.PutMessage(msg)
+	err = topic.publishMessages([]*Message{msg})
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+		return nil, validationErr("DPUB", err)
 	}
 
 	client.PublishedMessage(topicName, 1)
@@ -929,6 +1144,322 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	return okBytes, nil
 }
 
+// RPC publishes a request with the reply topic of this connection and a correlation
+// ID (see internal/rpc), it responds with the name of the reply topic
+func (p *protocolV2) RPC(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if len(params) < 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "RPC insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("RPC topic name %q is not valid", topicName))
+	}
+	if p.nsqd.isEventsTopic(topicName) {
+		return nil, eventsTopicErr("RPC", topicName)
+	}
+
+	correlationID := string(params[2])
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "RPC failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("RPC invalid message body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.nsqd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("RPC message too big %d > %d", bodyLen, p.nsqd.getOpts().MaxMsgSize))
+	}
+
+	messageBody := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, messageBody)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "RPC failed to read message body")
+	}
+
+	if err := p.CheckAuth(client, "RPC", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	if err := p.nsqd.checkPublish(); err != nil {
+		return nil, publishErr("RPC", err)
+	}
+
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err != nil {
+		return nil, topicNotFoundErr("RPC", topicName)
+	}
+	// the envelope (see internal/rpc) is not JSON
+	if s, _ := topic.Schema(); s != nil {
+		return nil, protocol.NewClientErr(nil, "E_BAD_MESSAGE_SCHEMA",
+			fmt.Sprintf("RPC topic %q has a schema, RPC messages can not match it", topicName))
+	}
+
+	if client.replyTopic == "" {
+		// the suffix is random so that the reply topic can't be guessed
+		b := make([]byte, 16)
+		if _, err := crand.Read(b); err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_RPC_FAILED", "RPC failed "+err.Error())
+		}
+		client.replyTopic = replyTopicPrefix + hex.EncodeToString(b) + "#ephemeral"
+	}
+	// (re)create the reply topic in case it was deleted along with its last channel
+	p.nsqd.GetTopic(client.replyTopic)
+
+	messageBody, err = rpc.Encode(client.replyTopic, correlationID, messageBody)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "RPC "+err.Error())
+	}
+	if int64(len(messageBody)) > p.nsqd.getOpts().MaxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("RPC message too big %d > %d", len(messageBody), p.nsqd.getOpts().MaxMsgSize))
+	}
+
+	// validated (should the schema have been set since) and routed like a PUB
+	msg := NewMessage(topic.GenerateID(), messageBody)
+	err = topic.publishMessages([]*Message{msg})
+	if err != nil {
+		return nil, validationErr("RPC", err)
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return []byte(client.replyTopic), nil
+}
+
+func (p *protocolV2) MIGRATE(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "MIGRATE insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("MIGRATE topic name %q is not valid", topicName))
+	}
+	if p.nsqd.isEventsTopic(topicName) {
+		return nil, eventsTopicErr("MIGRATE", topicName)
+	}
+
+	var channelName string
+	if len(params) > 2 {
+		channelName = string(params[2])
+		if !protocol.IsValidChannelName(channelName) {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
+				fmt.Sprintf("MIGRATE channel name %q is not valid", channelName))
+		}
+	}
+
+	if err := p.CheckAuth(client, "MIGRATE", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MIGRATE failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MIGRATE invalid body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > maxPeerBodySize(p.nsqd.getOpts()) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("MIGRATE body too big %d > %d", bodyLen, maxPeerBodySize(p.nsqd.getOpts())))
+	}
+
+	if err := p.nsqd.checkPublish(); err != nil {
+		// discard the body so that the client can retry on this connection
+		_, discardErr := io.CopyN(io.Discard, client.Reader, int64(bodyLen))
+		if discardErr != nil {
+			return nil, protocol.NewFatalClientErr(discardErr, "E_BAD_BODY", "MIGRATE failed to read body")
+		}
+		return nil, publishErr("MIGRATE", err)
+	}
+
+	messages, err := readPeerMessages("MIGRATE", client.Reader, client.lenSlice,
+		p.nsqd.getOpts().MaxMsgSize, maxPeerBodySize(p.nsqd.getOpts()))
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := p.nsqd.getOrAutoCreateTopic(topicName)
+	if err != nil {
+		return nil, topicNotFoundErr("MIGRATE", topicName)
+	}
+	if channelName == "" {
+		// the backlog of a topic is validated and routed as if it was published here
+		err = topic.publishMessages(messages)
+		if err != nil {
+			return nil, validationErr("MIGRATE", err)
+		}
+	} else {
+		channel, err := topic.getOrAutoCreateChannel(channelName)
+		if err != nil {
+			return nil, channelNotFoundErr("MIGRATE", topicName, channelName)
+		}
+		err = topic.checkMessages(messages)
+		if err != nil {
+			return nil, validationErr("MIGRATE", err)
+		}
+		// a batch applied in part would be duplicated when the peer retries it
+		err = channel.putMessagesAtomically(messages)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_MIGRATE_FAILED", "MIGRATE failed - "+err.Error())
+		}
+	}
+
+	client.PublishedMessage(topicName, uint64(len(messages)))
+
+	return okBytes, nil
+}
+
+// REPL applies a change made on a primary nsqd to this replica (see replication.go)
+func (p *protocolV2) REPL(client *clientV2, params [][]byte) ([]byte, error) {
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REPL insufficient number of parameters")
+	}
+
+	// a primary that connects after the takeover must not change this nsqd
+	if !p.nsqd.IsReplica() {
+		return nil, protocol.NewFatalClientErr(nil, replErrNotReplica, "REPL failed nsqd is not a replica")
+	}
+
+	op := string(params[1])
+	if !client.isPrimary {
+		if !p.nsqd.isAllowedPrimary(client.RemoteAddr()) {
+			return nil, protocol.NewFatalClientErr(nil, replErrNotAllowed,
+				fmt.Sprintf("REPL failed %s is not a --replica-primary-address", client.RemoteAddr()))
+		}
+		// the first command identifies the primary
+		if op != "PING" || len(params) < 3 {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REPL PING <primary> must come first")
+		}
+		if !p.nsqd.acceptPrimary(string(params[2])) {
+			return nil, protocol.NewFatalClientErr(nil, replErrOtherPrimary,
+				fmt.Sprintf("REPL failed nsqd is the replica of another primary than %s", params[2]))
+		}
+		client.isPrimary = true
+		p.nsqd.addPrimaryConn(1)
+	}
+
+	if op == "PING" {
+		return okBytes, nil
+	}
+
+	if len(params) < 3 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+			fmt.Sprintf("REPL %s insufficient number of parameters", op))
+	}
+
+	topicName := string(params[2])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("REPL %s topic name %q is not valid", op, topicName))
+	}
+
+	var channelName string
+	if len(params) > 3 {
+		channelName = string(params[3])
+		if !protocol.IsValidChannelName(channelName) {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL",
+				fmt.Sprintf("REPL %s channel name %q is not valid", op, channelName))
+		}
+	}
+
+	if err := p.CheckAuth(client, "REPL", topicName, channelName); err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "PUB":
+		bodyLen, err := readLen(client.Reader, client.lenSlice)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "REPL PUB failed to read body size")
+		}
+
+		if bodyLen <= 0 || int64(bodyLen) > maxPeerBodySize(p.nsqd.getOpts()) {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+				fmt.Sprintf("REPL PUB invalid body size %d", bodyLen))
+		}
+
+		messages, err := readPeerMessages("REPL PUB", client.Reader, client.lenSlice,
+			p.nsqd.getOpts().MaxMsgSize, maxPeerBodySize(p.nsqd.getOpts()))
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.nsqd.GetTopic(topicName).putReplicated(messages)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_REPL_FAILED", "REPL PUB failed "+err.Error())
+		}
+	case "FIN":
+		if len(params) < 5 {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REPL FIN insufficient number of parameters")
+		}
+		id, err := getMessageID(params[4])
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+		}
+		topic, err := p.nsqd.GetExistingTopic(topicName)
+		if err != nil {
+			break
+		}
+		channel, err := topic.GetExistingChannel(channelName)
+		if err != nil {
+			break
+		}
+		channel.finishReplicated(*id)
+	case "DROP":
+		if len(params) < 4 {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REPL DROP insufficient number of parameters")
+		}
+		ids := make([]MessageID, 0, len(params)-3)
+		for _, param := range params[3:] {
+			id, err := getMessageID(param)
+			if err != nil {
+				return nil, protocol.NewFatalClientErr(nil, "E_INVALID", err.Error())
+			}
+			ids = append(ids, *id)
+		}
+		topic, err := p.nsqd.GetExistingTopic(topicName)
+		if err != nil {
+			break
+		}
+		topic.dropReplicatedIDs(ids)
+	case "CHANNEL":
+		if channelName == "" {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "REPL CHANNEL insufficient number of parameters")
+		}
+		p.nsqd.GetTopic(topicName).GetChannel(channelName)
+	case "DELETE":
+		if channelName == "" {
+			p.nsqd.DeleteExistingTopic(topicName)
+			break
+		}
+		topic, err := p.nsqd.GetExistingTopic(topicName)
+		if err != nil {
+			break
+		}
+		topic.DeleteExistingChannel(channelName)
+	default:
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid REPL command %s", op))
+	}
+
+	return okBytes, nil
+}
+
 func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
@@ -999,6 +1530,58 @@ func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBo
 	return messages, nil
 }
 
+// readPeerMessages reads the body of a MIGRATE (or REPL PUB) command, messages encoded
+// with their ID, timestamp, attempts and remaining deferred time (see encodePeerMessages)
+func readPeerMessages(cmd string, r io.Reader, tmp []byte, maxMessageSize int64, maxBodySize int64) ([]*Message, error) {
+	numMessages, err := readLen(r, tmp)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", cmd+" failed to read message count")
+	}
+
+	maxMessages := (maxBodySize - 4) / (4 + migrateHeaderLength + minValidMsgLength)
+	if numMessages <= 0 || int64(numMessages) > maxMessages {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
+			fmt.Sprintf("%s invalid message count %d", cmd, numMessages))
+	}
+
+	messages := make([]*Message, 0, numMessages)
+	for i := int32(0); i < numMessages; i++ {
+		messageSize, err := readLen(r, tmp)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s failed to read message(%d) size", cmd, i))
+		}
+
+		bodySize := int64(messageSize) - migrateHeaderLength - minValidMsgLength
+		if bodySize <= 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s invalid message(%d) size %d", cmd, i, messageSize))
+		}
+
+		if bodySize > maxMessageSize {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+				fmt.Sprintf("%s message too big %d > %d", cmd, bodySize, maxMessageSize))
+		}
+
+		buf := make([]byte, messageSize)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", cmd+" failed to read message")
+		}
+
+		msg, err := decodeMessage(buf[migrateHeaderLength:])
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", cmd+" failed to decode message")
+		}
+		deferredMs := binary.BigEndian.Uint64(buf[:migrateHeaderLength])
+		msg.deferred = time.Duration(deferredMs) * time.Millisecond
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
 // validate and cast the bytes on the wire to a message ID
 func getMessageID(p []byte) (*MessageID, error) {
 	if len(p) != MsgIDLength {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -27,6 +29,7 @@ import (
 	"github.com/golang/snappy"
 	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/protocol"
+	"github.com/nsqio/nsq/internal/rpc"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -561,6 +564,366 @@ func TestSizeLimits(t *testing.T) {
 	test.Equal(t, "E_BAD_MESSAGE MPUB message too big 101 > 100", string(data))
 }
 
+func TestMTPUB(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	topicNames := []string{"test_mtpub_event", "test_mtpub_audit", "test_mtpub_event"}
+	body := new(bytes.Buffer)
+	binary.Write(body, binary.BigEndian, int32(len(topicNames)))
+	for _, topicName := range topicNames {
+		binary.Write(body, binary.BigEndian, int16(len(topicName)))
+		body.WriteString(topicName)
+		binary.Write(body, binary.BigEndian, int32(len("test body")))
+		body.WriteString("test body")
+	}
+	cmd := &nsq.Command{Name: []byte("MTPUB"), Body: body.Bytes()}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	topic, err := nsqd.GetExistingTopic("test_mtpub_event")
+	test.Nil(t, err)
+	test.Equal(t, int64(2), topic.Depth())
+	topic, err = nsqd.GetExistingTopic("test_mtpub_audit")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), topic.Depth())
+
+	// an invalid topic name fails the whole batch
+	body.Reset()
+	binary.Write(body, binary.BigEndian, int32(1))
+	binary.Write(body, binary.BigEndian, int16(len("bad topic")))
+	body.WriteString("bad topic")
+	binary.Write(body, binary.BigEndian, int32(len("test body")))
+	body.WriteString("test body")
+	cmd = &nsq.Command{Name: []byte("MTPUB"), Body: body.Bytes()}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_BAD_TOPIC MTPUB topic name "bad topic" is not valid`)
+
+	// as does a topic name size over the maximum, before it is read
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	body.Reset()
+	binary.Write(body, binary.BigEndian, int32(1))
+	binary.Write(body, binary.BigEndian, uint16(65535))
+	cmd = &nsq.Command{Name: []byte("MTPUB"), Body: body.Bytes()}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_BAD_TOPIC MTPUB invalid message(0) topic name size 65535")
+}
+
+func TestPubSchema(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_pub_schema" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	err := topic.SetSchema([]byte(`{"type": "object", "required": ["id"]}`), "")
+	test.Nil(t, err)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	nsq.Publish(topicName, []byte(`{"name": "no id"}`)).WriteTo(conn)
+	readValidate(t, conn, frameTypeError,
+		`E_BAD_MESSAGE_SCHEMA PUB message does not match schema - /: missing required property "id"`)
+
+	// the connection is still usable
+	nsq.Publish(topicName, []byte(`{"id": 1}`)).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte(`{"id": 2}`), []byte(`[]`)})
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeError,
+		"E_BAD_MESSAGE_SCHEMA MPUB message does not match schema - /: expected object, got array")
+
+	test.Equal(t, int64(1), topic.Depth())
+	test.Equal(t, uint64(2), atomic.LoadUint64(&topic.validationFailureCount))
+}
+
+func TestSpilledMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.SpillMsgThreshold = 1024
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_spill" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	data := identify(t, conn, map[string]interface{}{"large_messages": true}, frameTypeResponse)
+	r := struct {
+		LargeMessages   bool  `json:"large_messages"`
+		MaxSpillMsgSize int64 `json:"max_spill_msg_size"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.LargeMessages)
+	test.Equal(t, opts.MaxSpillMsgSize, r.MaxSpillMsgSize)
+	sub(t, conn, topicName, "ch")
+
+	body := make([]byte, 2*opts.MaxMsgSize)
+	rand.Read(body)
+	nsq.Publish(topicName, body).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, body, msg.Body)
+
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	test.Nil(t, err)
+	spillFile := filepath.Join(channel.spillDir(), spillFileName(msg.ID))
+	_, err = os.Stat(spillFile)
+	test.Nil(t, err)
+
+	_, err = nsq.Finish(nsq.MessageID(msg.ID)).WriteTo(conn)
+	test.Nil(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = os.Stat(spillFile)
+	test.Equal(t, true, os.IsNotExist(err))
+	files, _ := os.ReadDir(nsqd.GetTopic(topicName).spillDir())
+	test.Equal(t, 0, len(files))
+
+	// bodies above --max-spill-msg-size are still rejected
+	newOpts := *opts
+	newOpts.MaxSpillMsgSize = 2048
+	nsqd.swapOpts(&newOpts)
+	nsq.Publish(topicName, make([]byte, 4096)).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_BAD_MESSAGE PUB message too big 4096 > 2048")
+}
+
+func TestSpilledMessagesHeld(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.SpillMsgThreshold = 1024
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_spill_held" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	body := make([]byte, 2048)
+	rand.Read(body)
+	nsq.Publish(topicName, body).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	// the metadata is marked before the first spilled record can be written
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int32(backendFormatSpill), m.BackendFormat)
+
+	// the consumer does not accept large messages, the channel holds on to it
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	test.Nil(t, err)
+	for i := 0; i < 100 && atomic.LoadInt64(&channel.heldSpillCount) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), atomic.LoadInt64(&channel.heldSpillCount))
+	test.Equal(t, int64(1), channel.Depth())
+
+	// it is released to the next consumer that accepts large messages
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		channel.RLock()
+		numClients := len(channel.clients)
+		channel.RUnlock()
+		if numClients == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	identify(t, conn2, map[string]interface{}{"large_messages": true}, frameTypeResponse)
+	sub(t, conn2, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn2)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msg, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, body, msg.Body)
+	test.Equal(t, int64(0), atomic.LoadInt64(&channel.heldSpillCount))
+}
+
+func TestAutoCreateAllowlist(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AutoCreate = AutoCreateAllowlist
+	opts.AutoCreateTopicRegexps = []string{`^orders\.`}
+	opts.AutoCreateChannelRegexps = []string{`^archive$`}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	nsq.Publish("payments", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_TOPIC_NOT_FOUND PUB topic "payments" does not exist`)
+	_, err = nsqd.GetExistingTopic("payments")
+	test.NotNil(t, err)
+
+	nsq.Publish("orders.new", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	// ephemeral topics and channels are always created
+	nsq.Publish("payments#ephemeral", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	nsq.Subscribe("orders.new", "archiv").WriteTo(conn)
+	readValidate(t, conn, frameTypeError,
+		`E_CHANNEL_NOT_FOUND SUB channel "archiv" of topic "orders.new" does not exist`)
+	sub(t, conn, "orders.new", "archive")
+}
+
+func TestAutoCreateNoneImplicitTopics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AutoCreate = AutoCreateNone
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	migrate := func(params ...string) *nsq.Command {
+		cmd := &nsq.Command{Name: []byte("MIGRATE")}
+		for _, param := range params {
+			cmd.Params = append(cmd.Params, []byte(param))
+		}
+		cmd.Body = encodePeerMessages([]*Message{NewMessage(MessageID{}, []byte("test"))})
+		return cmd
+	}
+
+	migrate("payments").WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_TOPIC_NOT_FOUND MIGRATE topic "payments" does not exist`)
+	_, err = nsqd.GetExistingTopic("payments")
+	test.NotNil(t, err)
+
+	topic := nsqd.GetTopic("orders")
+	migrate("orders", "archive").WriteTo(conn)
+	readValidate(t, conn, frameTypeError,
+		`E_CHANNEL_NOT_FOUND MIGRATE channel "archive" of topic "orders" does not exist`)
+
+	err = nsqd.SetRoute(topic, RouteRule{Target: "audit", Field: "id", Op: "exists"})
+	test.Equal(t, errTopicNotFound, err)
+	_, err = nsqd.GetExistingTopic("audit")
+	test.NotNil(t, err)
+
+	// migrated messages are validated against the schema of their topic
+	err = topic.SetSchema([]byte(`{"type": "object"}`), "rejects")
+	test.Nil(t, err)
+	migrate("orders").WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_TOPIC_NOT_FOUND MIGRATE topic "rejects" does not exist`)
+	nsq.Publish("orders", []byte("test")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, `E_TOPIC_NOT_FOUND PUB topic "rejects" does not exist`)
+	test.Equal(t, int64(0), topic.Depth())
+
+	rejects := nsqd.GetTopic("rejects")
+	migrate("orders").WriteTo(conn)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, int64(1), rejects.Depth())
+}
+
+func TestMIGRATEChannelAtomic(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_migrate_atomic")
+	channel := topic.GetChannel("ch")
+	held := NewMessage(topic.GenerateID(), []byte("held"))
+	channel.PutMessageDeferred(held, time.Hour)
+
+	migrate := func(msgs ...*Message) (int32, string) {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		cmd := &nsq.Command{
+			Name:   []byte("MIGRATE"),
+			Params: [][]byte{[]byte("test_migrate_atomic"), []byte("ch")},
+			Body:   encodePeerMessages(msgs),
+		}
+		cmd.WriteTo(conn)
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		return frameType, string(data)
+	}
+
+	// a batch that fails part way through is not applied at all
+	first := NewMessage(topic.GenerateID(), []byte("first"))
+	frameType, data := migrate(first, held)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(data, "E_MIGRATE_FAILED"))
+	test.Equal(t, int64(0), channel.Depth())
+	channel.deferredMutex.Lock()
+	test.Equal(t, 1, len(channel.deferredMessages))
+	channel.deferredMutex.Unlock()
+
+	// and is queued in order once it can be
+	second := NewMessage(topic.GenerateID(), []byte("second"))
+	frameType, data = migrate(first, second)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, "OK", data)
+	test.Equal(t, int64(2), channel.Depth())
+	test.Equal(t, first.ID, (<-channel.memoryMsgChan).ID)
+	test.Equal(t, second.ID, (<-channel.memoryMsgChan).ID)
+}
+
 func TestDPUB(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -604,6 +967,235 @@ func TestDPUB(t *testing.T) {
 	test.Equal(t, "E_INVALID DPUB timeout 3600100 out of range 0-3600000", string(data))
 }
 
+func TestRPC(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_rpc" + strconv.Itoa(int(time.Now().Unix()))
+
+	responder, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer responder.Close()
+	identify(t, responder, nil, frameTypeResponse)
+	sub(t, responder, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(responder)
+	test.Nil(t, err)
+
+	requester, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer requester.Close()
+	identify(t, requester, nil, frameTypeResponse)
+
+	cmd := &nsq.Command{
+		Name:   []byte("RPC"),
+		Params: [][]byte{[]byte(topicName), []byte("1234")},
+		Body:   []byte("request"),
+	}
+	_, err = cmd.WriteTo(requester)
+	test.Nil(t, err)
+	resp, _ := nsq.ReadResponse(requester)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeResponse, frameType)
+	replyTopic := string(data)
+	test.Equal(t, true, strings.HasPrefix(replyTopic, replyTopicPrefix))
+	test.Equal(t, false, strings.HasPrefix(replyTopic, replyTopicPrefix+"1#"))
+	_, err = nsqd.GetExistingTopic(replyTopic)
+	test.Nil(t, err)
+
+	// only the requester may SUB to its reply topic
+	thief, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer thief.Close()
+	identify(t, thief, nil, frameTypeResponse)
+	_, err = nsq.Subscribe(replyTopic, "ch#ephemeral").WriteTo(thief)
+	test.Nil(t, err)
+	resp, _ = nsq.ReadResponse(thief)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(string(data), "E_BAD_TOPIC"))
+
+	sub(t, requester, replyTopic, "ch#ephemeral")
+	_, err = nsq.Ready(1).WriteTo(requester)
+	test.Nil(t, err)
+
+	resp, _ = nsq.ReadResponse(responder)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeMessage, frameType)
+	msg, _ := decodeMessage(data)
+	replyTo, correlationID, body, err := rpc.Decode(msg.Body)
+	test.Nil(t, err)
+	test.Equal(t, replyTopic, replyTo)
+	test.Equal(t, "1234", correlationID)
+	test.Equal(t, []byte("request"), body)
+
+	reply, _ := rpc.Encode("", correlationID, []byte("reply"))
+	_, err = nsq.Publish(replyTo, reply).WriteTo(responder)
+	test.Nil(t, err)
+	readValidate(t, responder, frameTypeResponse, "OK")
+
+	resp, _ = nsq.ReadResponse(requester)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeMessage, frameType)
+	msg, _ = decodeMessage(data)
+	_, correlationID, body, err = rpc.Decode(msg.Body)
+	test.Nil(t, err)
+	test.Equal(t, "1234", correlationID)
+	test.Equal(t, []byte("reply"), body)
+
+	// the reply topic goes away with the connection
+	requester.Close()
+	for i := 0; i < 100; i++ {
+		_, err = nsqd.GetExistingTopic(replyTopic)
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.NotNil(t, err)
+
+	// and a late reply does not recreate it
+	_, err = nsq.Publish(replyTo, reply).WriteTo(responder)
+	test.Nil(t, err)
+	readValidate(t, responder, frameTypeError, fmt.Sprintf(`E_TOPIC_NOT_FOUND PUB topic %q does not exist`, replyTo))
+	_, err = nsqd.GetExistingTopic(replyTopic)
+	test.NotNil(t, err)
+
+	// the envelope can not match the schema of a topic
+	err = nsqd.GetTopic(topicName).SetSchema([]byte(`{"type": "object"}`), "")
+	test.Nil(t, err)
+	_, err = cmd.WriteTo(responder)
+	test.Nil(t, err)
+	readValidate(t, responder, frameTypeError,
+		fmt.Sprintf(`E_BAD_MESSAGE_SCHEMA RPC topic %q has a schema, RPC messages can not match it`, topicName))
+}
+
+func TestDrain(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_drain_v2" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	nsqd.Drain()
+	test.Equal(t, true, nsqd.IsDraining())
+
+	// publishing fails but the connection remains usable
+	nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_PUB_FAILED PUB failed DRAINING - nsqd is draining")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("test body")})
+	cmd.WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_MPUB_FAILED MPUB failed DRAINING - nsqd is draining")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+
+	status := nsqd.GetDrainStatus()
+	test.Equal(t, int64(1), status.InFlightCount)
+	test.Equal(t, int64(1), status.Remaining())
+
+	_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	select {
+	case <-nsqd.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nsqd did not finish draining")
+	}
+	test.Equal(t, int64(0), nsqd.GetDrainStatus().Remaining())
+}
+
+func TestDrainTimeout(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DrainTimeout = 100 * time.Millisecond
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_drain_timeout" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	// a consumer that never sends RDY keeps the message queued
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	nsqd.Drain()
+	test.Equal(t, int64(1), nsqd.GetDrainStatus().Remaining())
+
+	select {
+	case <-nsqd.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nsqd did not time out draining")
+	}
+	test.Equal(t, int64(1), nsqd.GetDrainStatus().Remaining())
+}
+
+func TestResourcesCriticalPUB(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.HeapCriticalBytes = 1
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	nsqd.updateResources()
+	test.Equal(t, ResourceCritical, nsqd.GetResourceStatus().Level)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	// publishing fails but the connection remains usable
+	topicName := "test_resources_critical" + strconv.Itoa(int(time.Now().Unix()))
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.HasPrefix(string(data), "E_PUB_FAILED PUB failed RESOURCES_CRITICAL - nsqd resources are critical"))
+
+	o := *nsqd.getOpts()
+	o.HeapCriticalBytes = 0
+	nsqd.swapOpts(&o)
+	nsqd.updateResources()
+
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+}
+
 func TestTouch(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -1619,6 +2211,7 @@ func testIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetConn) {
 
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = t.TempDir()
 	opts.LogLevel = LOG_DEBUG
 
 	nsqd, err := New(opts)
@@ -1637,6 +2230,7 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(b)
+	opts.DataPath = b.TempDir()
 	nsqd, _ := New(opts)
 	p := &protocolV2{nsqd}
 	c := newClientV2(0, nil, nsqd)
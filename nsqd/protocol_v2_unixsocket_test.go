@@ -1425,6 +1425,7 @@ func testUnixSocketIOLoopReturnsClientErr(t *testing.T, fakeConn test.FakeNetCon
 
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = t.TempDir()
 	opts.LogLevel = LOG_DEBUG
 
 	nsqd, err := New(opts)
@@ -1443,6 +1444,7 @@ func BenchmarkUnixSocketProtocolV2Exec(b *testing.B) {
 	b.StopTimer()
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(b)
+	opts.DataPath = b.TempDir()
 	nsqd, _ := New(opts)
 	p := &protocolV2{nsqd}
 	c := newClientV2(0, nil, nsqd)
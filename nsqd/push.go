@@ -0,0 +1,339 @@
+package nsqd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// PushConfig describes a push subscription, the messages of a channel are POSTed to URL
+type PushConfig struct {
+	URL         string            `json:"url"`
+	Concurrency int               `json:"concurrency"`
+	Timeout     time.Duration     `json:"timeout"`
+	MaxAttempts uint16            `json:"max_attempts"`
+	Backoff     time.Duration     `json:"backoff"`
+	MaxBackoff  time.Duration     `json:"max_backoff"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type PushStats struct {
+	URL           string `json:"url"`
+	Concurrency   int    `json:"concurrency"`
+	MaxAttempts   uint16 `json:"max_attempts"`
+	InFlightCount int64  `json:"in_flight_count"`
+	MessageCount  uint64 `json:"message_count"`
+	FinishCount   uint64 `json:"finish_count"`
+	RequeueCount  uint64 `json:"requeue_count"`
+	ConnectTime   int64  `json:"connect_ts"`
+}
+
+func (s PushStats) String() string {
+	connectTime := time.Unix(s.ConnectTime, 0)
+	duration := time.Since(connectTime).Truncate(time.Second)
+
+	return fmt.Sprintf("[push %s] concurrency: %d inflt: %-4d fin: %-8d re-q: %-8d msgs: %-8d connected: %s",
+		s.URL,
+		s.Concurrency,
+		s.InFlightCount,
+		s.FinishCount,
+		s.RequeueCount,
+		s.MessageCount,
+		duration,
+	)
+}
+
+// pushConsumer is a Consumer that POSTs messages to an HTTP endpoint, it FINs
+// messages on a 2xx response and REQs them (with backoff) otherwise
+type pushConsumer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	InFlightCount int64
+	MessageCount  uint64
+	FinishCount   uint64
+	RequeueCount  uint64
+
+	ID          int64
+	cfg         PushConfig
+	channel     *Channel
+	client      *http.Client
+	ConnectTime time.Time
+
+	paused      int32
+	updateChans []chan struct{}
+
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	waitGroup sync.WaitGroup
+}
+
+func newPushConsumer(c *Channel, cfg PushConfig) *pushConsumer {
+	transport := http_api.NewDeadlineTransport(c.nsqd.getOpts().HTTPClientConnectTimeout, cfg.Timeout)
+	transport.MaxIdleConnsPerHost = cfg.Concurrency
+
+	p := &pushConsumer{
+		ID:      atomic.AddInt64(&c.nsqd.clientIDSequence, 1),
+		cfg:     cfg,
+		channel: c,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+		},
+		ConnectTime: time.Now(),
+	}
+	if c.IsPaused() {
+		p.paused = 1
+	}
+	for i := 0; i < cfg.Concurrency; i++ {
+		p.updateChans = append(p.updateChans, make(chan struct{}, 1))
+	}
+	p.ctx, p.ctxCancel = context.WithCancel(context.Background())
+	return p
+}
+
+// AddPushSubscription starts POSTing the messages of this channel to cfg.URL,
+// replacing an existing subscription for the same URL
+func (c *Channel) AddPushSubscription(cfg PushConfig) error {
+	c.RemovePushSubscription(cfg.URL)
+
+	p := newPushConsumer(c, cfg)
+	err := c.AddClient(p.ID, p)
+	if err != nil {
+		return err
+	}
+
+	c.logf(LOG_INFO, "pushing to %s", cfg.URL)
+
+	for _, updateChan := range p.updateChans {
+		p.waitGroup.Add(1)
+		go func(updateChan chan struct{}) {
+			p.worker(updateChan)
+			p.waitGroup.Done()
+		}(updateChan)
+	}
+	return nil
+}
+
+// RemovePushSubscription stops POSTing the messages of this channel to url, it
+// returns once the requests that were in progress have completed
+func (c *Channel) RemovePushSubscription(url string) error {
+	p := c.getPushConsumer(url)
+	if p == nil {
+		return errors.New("push subscription does not exist")
+	}
+
+	c.logf(LOG_INFO, "no longer pushing to %s", url)
+
+	c.RemoveClient(p.ID)
+	p.Close()
+	p.waitGroup.Wait()
+	return nil
+}
+
+// PushSubscriptions returns the configuration of each push subscription of this channel
+func (c *Channel) PushSubscriptions() []PushConfig {
+	var configs []PushConfig
+	c.RLock()
+	for _, client := range c.clients {
+		if p, ok := client.(*pushConsumer); ok {
+			configs = append(configs, p.cfg)
+		}
+	}
+	c.RUnlock()
+	sort.Slice(configs, func(i, j int) bool { return configs[i].URL < configs[j].URL })
+	return configs
+}
+
+func (c *Channel) getPushConsumer(url string) *pushConsumer {
+	c.RLock()
+	defer c.RUnlock()
+	for _, client := range c.clients {
+		if p, ok := client.(*pushConsumer); ok && p.cfg.URL == url {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *pushConsumer) worker(updateChan chan struct{}) {
+	for {
+		var memoryMsgChan chan *Message
+		var backendMsgChan <-chan []byte
+		if atomic.LoadInt32(&p.paused) == 0 {
+			memoryMsgChan = p.channel.memoryMsgChan
+			backendMsgChan = p.channel.backend.ReadChan()
+		}
+
+		var msg *Message
+		select {
+		case msg = <-memoryMsgChan:
+		case buf := <-backendMsgChan:
+			var err error
+			msg, err = decodeBackendMessage(buf)
+			if err != nil {
+				p.channel.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+				continue
+			}
+		case <-updateChan:
+			continue
+		case <-p.ctx.Done():
+			return
+		}
+
+		p.channel.dequeued(msg)
+		p.deliver(msg)
+	}
+}
+
+func (p *pushConsumer) deliver(msg *Message) {
+	msg.Attempts++
+
+	// leave room for the request to time out before the message does
+	p.channel.StartInFlightTimeout(msg, p.ID, p.cfg.Timeout+time.Second)
+	atomic.AddInt64(&p.InFlightCount, 1)
+	atomic.AddUint64(&p.MessageCount, 1)
+
+	err := p.post(msg)
+	if err == nil {
+		p.finish(msg)
+		return
+	}
+
+	if p.ctx.Err() != nil {
+		// the subscription was removed (or the channel closed) mid-request
+		p.requeue(msg)
+		return
+	}
+
+	if p.cfg.MaxAttempts > 0 && msg.Attempts >= p.cfg.MaxAttempts {
+		p.logf(LOG_WARN, "giving up on msg(%s) after %d attempts - %s", msg.ID, msg.Attempts, err)
+		p.finish(msg)
+		return
+	}
+
+	p.logf(LOG_WARN, "failed to push msg(%s) - %s", msg.ID, err)
+	p.requeue(msg)
+}
+
+func (p *pushConsumer) post(msg *Message) error {
+	var body io.Reader = bytes.NewReader(msg.Body)
+	if msg.isSpilled() {
+		f, err := p.channel.openSpill(msg)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		body = io.LimitReader(f, msg.spilledSize())
+	}
+
+	req, err := http.NewRequestWithContext(p.ctx, "POST", p.cfg.URL, body)
+	if err != nil {
+		return err
+	}
+	if msg.isSpilled() {
+		req.ContentLength = msg.spilledSize()
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", fmt.Sprintf("nsqd/%s", version.Binary))
+	req.Header.Set("X-NSQ-Message-ID", string(msg.ID[:]))
+	req.Header.Set("X-NSQ-Attempts", strconv.Itoa(int(msg.Attempts)))
+	for k, v := range p.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *pushConsumer) finish(msg *Message) {
+	// the message may have timed out in the meantime
+	err := p.channel.FinishMessage(p.ID, msg.ID)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&p.InFlightCount, -1)
+	atomic.AddUint64(&p.FinishCount, 1)
+}
+
+func (p *pushConsumer) requeue(msg *Message) {
+	// exponential backoff, ie. backoff * 2^(attempts-1) up to max_backoff
+	delay := p.cfg.Backoff
+	for i := uint16(1); i < msg.Attempts && delay < p.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.cfg.MaxBackoff {
+		delay = p.cfg.MaxBackoff
+	}
+
+	err := p.channel.RequeueMessage(p.ID, msg.ID, delay)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&p.InFlightCount, -1)
+	atomic.AddUint64(&p.RequeueCount, 1)
+}
+
+func (p *pushConsumer) notify() {
+	for _, updateChan := range p.updateChans {
+		select {
+		case updateChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *pushConsumer) Pause() {
+	atomic.StoreInt32(&p.paused, 1)
+	p.notify()
+}
+
+func (p *pushConsumer) UnPause() {
+	atomic.StoreInt32(&p.paused, 0)
+	p.notify()
+}
+
+// Close stops the workers, requests in progress are cancelled
+func (p *pushConsumer) Close() error {
+	p.ctxCancel()
+	return nil
+}
+
+func (p *pushConsumer) TimedOutMessage() {
+	atomic.AddInt64(&p.InFlightCount, -1)
+}
+
+func (p *pushConsumer) Empty() {
+	atomic.StoreInt64(&p.InFlightCount, 0)
+}
+
+func (p *pushConsumer) Stats(string) ClientStats {
+	return PushStats{
+		URL:           p.cfg.URL,
+		Concurrency:   p.cfg.Concurrency,
+		MaxAttempts:   p.cfg.MaxAttempts,
+		InFlightCount: atomic.LoadInt64(&p.InFlightCount),
+		MessageCount:  atomic.LoadUint64(&p.MessageCount),
+		FinishCount:   atomic.LoadUint64(&p.FinishCount),
+		RequeueCount:  atomic.LoadUint64(&p.RequeueCount),
+		ConnectTime:   p.ConnectTime.Unix(),
+	}
+}
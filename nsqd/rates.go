@@ -0,0 +1,214 @@
+package nsqd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the counters sampled every second for --stats-history
+const (
+	ratePublish = iota
+	rateDeliver
+	rateFinish
+	rateRequeue
+	numRates
+)
+
+// rates are averaged over the last minute of the history
+const rateWindow = 60
+
+// RateStats are the messages per second over the last minute (or less if the
+// history is shorter), a topic reports the sum of its channels for all but publish
+type RateStats struct {
+	Publish float64 `json:"publish"`
+	Deliver float64 `json:"deliver"`
+	Finish  float64 `json:"finish"`
+	Requeue float64 `json:"requeue"`
+
+	History *RateHistory `json:"history,omitempty"`
+}
+
+// RateHistory is the number of messages of each second, oldest first
+type RateHistory struct {
+	Publish []uint32 `json:"publish"`
+	Deliver []uint32 `json:"deliver"`
+	Finish  []uint32 `json:"finish"`
+	Requeue []uint32 `json:"requeue"`
+}
+
+// rateHistory keeps the per-second increase of counters in a ring buffer
+type rateHistory struct {
+	sync.Mutex
+	last    [numRates]uint64
+	primed  bool
+	samples [][numRates]uint32
+	next    int
+	full    bool
+}
+
+// newRateHistory returns nil if the history is disabled
+func newRateHistory(opts *Options) *rateHistory {
+	size := int(opts.StatsHistory / time.Second)
+	if size <= 0 {
+		return nil
+	}
+	return &rateHistory{samples: make([][numRates]uint32, size)}
+}
+
+func (h *rateHistory) sample(counters [numRates]uint64) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if !h.primed {
+		h.last = counters
+		h.primed = true
+		return
+	}
+	var s [numRates]uint32
+	for i, v := range counters {
+		// a topic's counters drop when one of its channels is deleted
+		if v > h.last[i] {
+			s[i] = uint32(v - h.last[i])
+		}
+	}
+	h.last = counters
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// ordered returns the samples oldest first
+func (h *rateHistory) ordered() [][numRates]uint32 {
+	if !h.full {
+		return h.samples[:h.next]
+	}
+	return append(h.samples[h.next:len(h.samples):len(h.samples)], h.samples[:h.next]...)
+}
+
+func (h *rateHistory) stats(withHistory bool) *RateStats {
+	if h == nil {
+		return nil
+	}
+	h.Lock()
+	defer h.Unlock()
+	samples := h.ordered()
+
+	var rates [numRates]float64
+	window := samples
+	if len(window) > rateWindow {
+		window = window[len(window)-rateWindow:]
+	}
+	for _, s := range window {
+		for i, v := range s {
+			rates[i] += float64(v)
+		}
+	}
+	if len(window) > 0 {
+		for i := range rates {
+			rates[i] /= float64(len(window))
+		}
+	}
+	r := &RateStats{
+		Publish: rates[ratePublish],
+		Deliver: rates[rateDeliver],
+		Finish:  rates[rateFinish],
+		Requeue: rates[rateRequeue],
+	}
+
+	if withHistory {
+		var series [numRates][]uint32
+		for i := range series {
+			series[i] = make([]uint32, len(samples))
+		}
+		for j, s := range samples {
+			for i, v := range s {
+				series[i][j] = v
+			}
+		}
+		r.History = &RateHistory{
+			Publish: series[ratePublish],
+			Deliver: series[rateDeliver],
+			Finish:  series[rateFinish],
+			Requeue: series[rateRequeue],
+		}
+	}
+	return r
+}
+
+func (c *Channel) rateCounters() [numRates]uint64 {
+	return [numRates]uint64{
+		ratePublish: atomic.LoadUint64(&c.messageCount),
+		rateDeliver: atomic.LoadUint64(&c.deliverCount),
+		rateFinish:  atomic.LoadUint64(&c.finishCount),
+		rateRequeue: atomic.LoadUint64(&c.requeueCount),
+	}
+}
+
+// sampleRates samples the topic and its channels
+func (t *Topic) sampleRates() {
+	t.RLock()
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.RUnlock()
+
+	counters := [numRates]uint64{ratePublish: atomic.LoadUint64(&t.messageCount)}
+	for _, c := range channels {
+		cc := c.rateCounters()
+		c.rateHistory.sample(cc)
+		for i := rateDeliver; i < numRates; i++ {
+			counters[i] += cc[i]
+		}
+	}
+	t.rateHistory.sample(counters)
+}
+
+func (n *NSQD) rateLoop() {
+	ticker := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			n.RLock()
+			topics := make([]*Topic, 0, len(n.topicMap))
+			for _, t := range n.topicMap {
+				topics = append(topics, t)
+			}
+			n.RUnlock()
+			for _, t := range topics {
+				t.sampleRates()
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logComponentf(LOG_INFO, "RATES", "closing")
+	ticker.Stop()
+}
+
+// addRateHistory adds the history to the rates of the topics and channels in stats
+func (n *NSQD) addRateHistory(topics []TopicStats) {
+	for i := range topics {
+		ts := &topics[i]
+		t, err := n.GetExistingTopic(ts.TopicName)
+		if err != nil {
+			continue
+		}
+		ts.Rates = t.rateHistory.stats(true)
+		for j := range ts.Channels {
+			cs := &ts.Channels[j]
+			c, err := t.GetExistingChannel(cs.ChannelName)
+			if err != nil {
+				continue
+			}
+			cs.Rates = c.rateHistory.stats(true)
+		}
+	}
+}
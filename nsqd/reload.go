@@ -0,0 +1,175 @@
+package nsqd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// reloadableOptions are the flags whose new value takes effect without a restart,
+// the other ones only take effect once nsqd is restarted
+var reloadableOptions = map[string]bool{
+	"log-level":                    true,
+	"lookupd-tcp-address":          true,
+	"auth-http-address":            true,
+	"auth-http-request-method":     true,
+	"msg-timeout":                  true,
+	"max-msg-timeout":              true,
+	"max-body-size":                true,
+	"max-req-timeout":              true,
+	"spill-msg-threshold":          true,
+	"max-spill-msg-size":           true,
+	"auto-create":                  true,
+	"auto-create-topic-regex":      true,
+	"auto-create-channel-regex":    true,
+	"seed-file":                    true,
+	"seed-extra":                   true,
+	"trace-topic":                  true,
+	"trace-sample-rate":            true,
+	"events-topic":                 true,
+	"disk-usage-warn-percent":      true,
+	"disk-usage-critical-percent":  true,
+	"heap-warn-bytes":              true,
+	"heap-critical-bytes":          true,
+	"max-heartbeat-interval":       true,
+	"max-rdy-count":                true,
+	"max-output-buffer-size":       true,
+	"max-output-buffer-timeout":    true,
+	"min-output-buffer-timeout":    true,
+	"output-buffer-timeout":        true,
+	"max-channel-consumers":        true,
+	"statsd-address":               true,
+	"statsd-prefix":                true,
+	"statsd-mem-stats":             true,
+	"statsd-udp-packet-size":       true,
+	"statsd-exclude-ephemeral":     true,
+	"statsd-format":                true,
+	"statsd-topic-regex":           true,
+	"statsd-exclude-metric":        true,
+	"prometheus-exclude-ephemeral": true,
+	"prometheus-exclude-clients":   true,
+	"tls-cert":                     true,
+	"tls-key":                      true,
+	"tls-client-auth-policy":       true,
+	"tls-root-ca-file":             true,
+	"tls-min-version":              true,
+	"deflate":                      true,
+	"max-deflate-level":            true,
+	"snappy":                       true,
+	"upgrade-timeout":              true,
+	"drain-timeout":                true,
+}
+
+// ReloadResult lists the options a Reload changed by flag name
+type ReloadResult struct {
+	Reloaded        []string `json:"reloaded"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// ReloadConfig reloads the options with Options.ConfigLoader (ie. re-reads the
+// --config file) and then reconciles the topics and channels with the --seed-file,
+// the result is nil only if the options were not reloaded
+func (n *NSQD) ReloadConfig() (*ReloadResult, error) {
+	loader := n.getOpts().ConfigLoader
+	if loader == nil {
+		return nil, errors.New("no config to reload")
+	}
+	opts, err := loader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config - %s", err)
+	}
+	result, err := n.Reload(opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, n.Seed()
+}
+
+// Reload validates opts and swaps in the ones that can change while running, the
+// options that changed but require a restart keep their current value. Either all
+// the reloadable options are applied or, if one of them is invalid, none.
+func (n *NSQD) Reload(opts *Options) (*ReloadResult, error) {
+	n.reloadMutex.Lock()
+	defer n.reloadMutex.Unlock()
+
+	cur := n.getOpts()
+	newOpts := *cur
+	configOpts := n.configOpts
+	result := &ReloadResult{
+		Reloaded:        []string{},
+		RestartRequired: []string{},
+	}
+
+	// TLS can be reconfigured but not turned on or off
+	tlsEnabled := opts.TLSCert != "" || opts.TLSKey != ""
+	tlsToggled := tlsEnabled != (n.tlsConfig != nil)
+
+	typ := reflect.TypeOf(*opts)
+	given := reflect.ValueOf(opts).Elem()
+	prev := reflect.ValueOf(&configOpts).Elem()
+	next := reflect.ValueOf(&newOpts).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		flagName := typ.Field(i).Tag.Get("flag")
+		if flagName == "" {
+			continue
+		}
+		v := given.Field(i)
+		if reflect.DeepEqual(prev.Field(i).Interface(), v.Interface()) {
+			continue
+		}
+		if !reloadableOptions[flagName] || (tlsToggled && (flagName == "tls-cert" || flagName == "tls-key")) {
+			result.RestartRequired = append(result.RestartRequired, flagName)
+			continue
+		}
+		next.Field(i).Set(v)
+		prev.Field(i).Set(v)
+		result.Reloaded = append(result.Reloaded, flagName)
+	}
+
+	if newOpts.TLSClientAuthPolicy != "" && newOpts.TLSRequired == TLSNotRequired {
+		newOpts.TLSRequired = TLSRequired
+	}
+	if n.tlsConfig == nil && newOpts.TLSRequired != TLSNotRequired {
+		return nil, errors.New("cannot require TLS client connections without TLS key and cert")
+	}
+
+	err := validateOptions(&newOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	autoCreate, err := newAutoCreatePolicy(&newOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the certificates are read again even if the options did not change so
+	// that the ones renewed in place are picked up
+	var serverTLSConfig *tls.Config
+	if n.tlsConfig != nil {
+		serverTLSConfig, err = buildTLSConfig(&newOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build TLS config - %s", err)
+		}
+	}
+	clientTLSConfig, err := buildClientTLSConfig(&newOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build client TLS config - %s", err)
+	}
+
+	n.configOpts = configOpts
+	n.swapOpts(&newOpts)
+	n.autoCreate.Store(autoCreate)
+	if serverTLSConfig != nil {
+		n.serverTLSConfig.Store(serverTLSConfig)
+	}
+	n.clientTLSConfig.Store(clientTLSConfig)
+	n.triggerOptsNotification()
+
+	n.logComponentf(LOG_INFO, "RELOAD", "reloaded %v", result.Reloaded)
+	if len(result.RestartRequired) > 0 {
+		n.logComponentf(LOG_WARN, "RELOAD", "a restart is required for %v", result.RestartRequired)
+	}
+	return result, nil
+}
@@ -0,0 +1,469 @@
+package nsqd
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Replication
+//
+// An nsqd started with --replica-tcp-address (the primary) streams the messages
+// published to its (non-ephemeral) topics matching --replicate-topic-regex, and the
+// acks (FIN) of their channels, to the nsqd at that address (the replica, started
+// with --replica) as REPL commands:
+//
+//	REPL PING <primary>
+//	REPL PUB <topic_name>\n[ 4-byte size ][ N-byte body (see encodePeerMessages) ]
+//	REPL FIN <topic_name> <channel_name> <message_id>
+//	REPL DROP <topic_name> <message_id> [<message_id> ...]
+//	REPL CHANNEL <topic_name> <channel_name>
+//	REPL DELETE <topic_name> [<channel_name>]
+//
+// In sync mode publishes are not responded to until the replica accepted them, in
+// async mode they are sent in the background. Acks are always sent in the background
+// (an ack that is lost only has the message delivered again after a takeover).
+// Messages that the primary fails to queue after replicating them are dropped from
+// the replica.
+//
+// A replica does not register with nsqlookupd, rejects publishes from clients and
+// holds the messages of its channels until it takes over (including across its
+// restarts, see holdBackend). It does so once it has
+// had no connection from a primary for --replica-takeover-timeout, at which point
+// it registers with nsqlookupd and starts delivering messages to consumers.
+//
+// A replica only accepts REPL commands from connections from one of its
+// --replica-primary-address (and, with auth enabled, authorized for their topic and
+// channel). It only accepts the primary (identified by its broadcast address and TCP
+// port) that first connected to it, and no primary once it has taken over. A primary
+// that the replica refuses is fenced: it rejects publishes but keeps serving its
+// consumers, so that two nsqd never accept the same topics at once.
+//
+// Only messages published while the primary is connected are replicated.
+
+// the REPL errors that fence the primary
+const (
+	replErrNotReplica   = "E_NOT_REPLICA"
+	replErrOtherPrimary = "E_OTHER_PRIMARY"
+	replErrNotAllowed   = "E_PRIMARY_NOT_ALLOWED"
+)
+
+// keeps REPL DROP commands well within the line length a client reader buffers
+const replDropIDsPerCommand = 100
+
+// replicationOp is a command to be sent to the replica
+type replicationOp struct {
+	cmd     *nsq.Command
+	errChan chan error
+}
+
+func replicationCommand(params ...string) *nsq.Command {
+	var cmdParams [][]byte
+	for _, param := range params {
+		cmdParams = append(cmdParams, []byte(param))
+	}
+	return &nsq.Command{Name: []byte("REPL"), Params: cmdParams}
+}
+
+// replicate queues a command for the replica, when wait is true and replication is
+// synchronous it returns once the replica has responded
+func (n *NSQD) replicate(cmd *nsq.Command, wait bool) error {
+	// the topics and channels being loaded are sent when connecting to the replica,
+	// a fenced primary has nowhere to replicate to
+	if n.replicationChan == nil || atomic.LoadInt32(&n.isLoading) == 1 || n.fencedReason() != "" {
+		return nil
+	}
+
+	op := &replicationOp{cmd: cmd}
+	if wait && n.getOpts().ReplicationMode == "sync" {
+		op.errChan = make(chan error, 1)
+	}
+
+	select {
+	case n.replicationChan <- op:
+	case <-n.exitChan:
+		return errors.New("exiting")
+	}
+
+	if op.errChan == nil {
+		return nil
+	}
+	select {
+	case err := <-op.errChan:
+		if err != nil {
+			return fmt.Errorf("replication failed - %s", err)
+		}
+		return nil
+	case <-n.exitChan:
+		return errors.New("exiting")
+	}
+}
+
+// replicatesTopic returns true if the messages of a topic of that name are replicated
+func (n *NSQD) replicatesTopic(topicName string) bool {
+	return n.replicationChan != nil && !strings.HasSuffix(topicName, "#ephemeral") &&
+		matchesAny(topicName, n.replicateTopics)
+}
+
+// replicateMessages is called before the messages are put on the topic (after
+// which they may be modified by being delivered), they are split in batches that
+// stay within --max-body-size
+func (t *Topic) replicateMessages(msgs []*Message) error {
+	if !t.replicated {
+		return nil
+	}
+	batches := peerBatches(msgs, t.nsqd.getOpts().MaxBodySize-4)
+	for i, batch := range batches {
+		cmd := replicationCommand("PUB", t.name)
+		cmd.Body = encodePeerMessages(batch)
+		err := t.nsqd.replicate(cmd, true)
+		if err != nil {
+			for _, sent := range batches[:i] {
+				t.dropReplicated(sent)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// dropReplicated removes messages that were replicated but could not be queued
+func (t *Topic) dropReplicated(msgs []*Message) {
+	if !t.replicated {
+		return
+	}
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > replDropIDsPerCommand {
+			n = replDropIDsPerCommand
+		}
+		params := []string{"DROP", t.name}
+		for _, msg := range msgs[:n] {
+			params = append(params, string(msg.ID[:]))
+		}
+		t.nsqd.replicate(replicationCommand(params...), false)
+		msgs = msgs[n:]
+	}
+}
+
+// replicateFinish does not fail the FIN, the message is gone from this nsqd regardless,
+// nor wait for the replica so that FINs are not serialized by the replicationLoop
+func (c *Channel) replicateFinish(id MessageID) {
+	if !c.replicated {
+		return
+	}
+	err := c.nsqd.replicate(replicationCommand("FIN", c.topicName, c.name, string(id[:])), false)
+	if err != nil {
+		c.logf(LOG_ERROR, "failed to replicate FIN of msg(%s) - %s", id, err)
+	}
+}
+
+// replicationLoop maintains the connection to the replica and sends it
+// the commands queued by replicate()
+func (n *NSQD) replicationLoop() {
+	var conn *peerConn
+	addr := n.getOpts().ReplicaTCPAddress
+
+	connect := func() {
+		var err error
+		conn, err = n.connectReplica(addr)
+		if err != nil {
+			n.logPeerf(LOG_ERROR, "REPLICATION", addr, "failed to connect - %s", err)
+			conn = nil
+			n.maybeFence(err)
+			return
+		}
+		n.logPeerf(LOG_INFO, "REPLICATION", addr, "connected")
+	}
+	disconnect := func(err error) {
+		n.logf(LOG_ERROR, "REPLICATION(%s): %s", addr, err)
+		conn.Close()
+		conn = nil
+		n.maybeFence(err)
+	}
+
+	connect()
+
+	// reconnect, or ping the replica so that it knows the primary is still around
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case op := <-n.replicationChan:
+			err := errors.New("replica not connected")
+			if conn != nil {
+				err = conn.exec(op.cmd)
+				if err != nil {
+					disconnect(err)
+				}
+			}
+			if op.errChan != nil {
+				op.errChan <- err
+			}
+		case <-ticker.C:
+			if n.fencedReason() != "" {
+				continue
+			}
+			if conn == nil {
+				connect()
+				continue
+			}
+			err := conn.exec(replicationCommand("PING", n.primaryID()))
+			if err != nil {
+				disconnect(err)
+			}
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logComponentf(LOG_INFO, "REPLICATION", "closing")
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// connectReplica connects to the replica and sends it the channels
+// created before this connection
+func (n *NSQD) connectReplica(addr string) (*peerConn, error) {
+	conn, err := n.dialPeer(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := []*nsq.Command{replicationCommand("PING", n.primaryID())}
+	n.RLock()
+	for _, topic := range n.topicMap {
+		if !topic.replicated {
+			continue
+		}
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			if channel.ephemeral {
+				continue
+			}
+			commands = append(commands, replicationCommand("CHANNEL", topic.name, channel.name))
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+
+	for _, cmd := range commands {
+		err = conn.exec(cmd)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// primaryID identifies this nsqd to its replica
+func (n *NSQD) primaryID() string {
+	port := 0
+	if addr, ok := n.RealTCPAddr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	return net.JoinHostPort(n.getOpts().BroadcastAddress, strconv.Itoa(port))
+}
+
+// maybeFence stops this primary from accepting publishes if err is the replica
+// refusing it (see replication.go)
+func (n *NSQD) maybeFence(err error) {
+	perr, ok := err.(*peerErr)
+	if !ok || (perr.code != replErrNotReplica && perr.code != replErrOtherPrimary &&
+		perr.code != replErrNotAllowed) {
+		return
+	}
+	if n.fencedReason() != "" {
+		return
+	}
+	n.fenced.Store(perr.msg)
+	n.logComponentf(LOG_ERROR, "REPLICATION", "fenced, rejecting publishes - %s", perr.msg)
+}
+
+// fencedReason returns why the replica refused this primary, empty if it did not
+func (n *NSQD) fencedReason() string {
+	return n.fenced.Load().(string)
+}
+
+// isAllowedPrimary returns true if addr is (one of the addresses of) a --replica-primary-address
+func (n *NSQD) isAllowedPrimary(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, primary := range n.getOpts().ReplicaPrimaryAddresses {
+		if primary == host {
+			return true
+		}
+		ips, err := net.LookupHost(primary)
+		if err != nil {
+			n.logComponentf(LOG_WARN, "REPLICATION", "failed to resolve --replica-primary-address %s - %s", primary, err)
+			continue
+		}
+		for _, ip := range ips {
+			if ip == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptPrimary binds a replica to the first primary that connects to it
+func (n *NSQD) acceptPrimary(id string) bool {
+	n.primaryMutex.Lock()
+	defer n.primaryMutex.Unlock()
+	if n.replicaOf == "" {
+		n.replicaOf = id
+		n.logComponentf(LOG_INFO, "NSQ", "replica of %s", id)
+	}
+	return n.replicaOf == id
+}
+
+// IsReplica returns a boolean indicating if nsqd is a replica that has not taken over
+func (n *NSQD) IsReplica() bool {
+	return atomic.LoadInt32(&n.isReplica) == 1
+}
+
+// Promote makes a replica take over from its primary, it registers with
+// nsqlookupd and starts delivering messages to consumers
+func (n *NSQD) Promote() {
+	if !atomic.CompareAndSwapInt32(&n.isReplica, 1, 0) {
+		return
+	}
+
+	n.logComponentf(LOG_INFO, "NSQ", "taking over from primary")
+
+	select {
+	case n.promoteNotificationChan <- struct{}{}:
+	default:
+	}
+}
+
+func (n *NSQD) addPrimaryConn(delta int32) {
+	atomic.AddInt32(&n.primaryConnCount, delta)
+	select {
+	case n.primaryConnUpdateChan <- struct{}{}:
+	default:
+	}
+}
+
+// replicaLoop promotes a replica once it has been without
+// a connection from a primary for ReplicaTakeoverTimeout
+func (n *NSQD) replicaLoop() {
+	var takeoverChan <-chan time.Time
+	for {
+		select {
+		case <-n.primaryConnUpdateChan:
+			if atomic.LoadInt32(&n.primaryConnCount) > 0 {
+				takeoverChan = nil
+				continue
+			}
+			timeout := n.getOpts().ReplicaTakeoverTimeout
+			n.logComponentf(LOG_WARN, "NSQ", "lost connection to primary, taking over in %s", timeout)
+			takeoverChan = time.After(timeout)
+		case <-takeoverChan:
+			n.Promote()
+			return
+		case <-n.exitChan:
+			return
+		}
+	}
+}
+
+// putReplicated writes messages received from the primary directly to the topic's
+// channels so that the acks that follow on the same connection find them
+func (t *Topic) putReplicated(msgs []*Message) error {
+	t.RLock()
+	channels := make([]*Channel, 0, len(t.channelMap))
+	for _, c := range t.channelMap {
+		channels = append(channels, c)
+	}
+	t.RUnlock()
+
+	if len(channels) == 0 {
+		_, err := t.putMessages(msgs)
+		return err
+	}
+
+	var messageTotalBytes int
+	for _, msg := range msgs {
+		for i, channel := range channels {
+			chanMsg := msg
+			if i > 0 {
+				chanMsg = NewMessage(msg.ID, msg.Body)
+				chanMsg.Timestamp = msg.Timestamp
+				chanMsg.Attempts = msg.Attempts
+				chanMsg.deferred = msg.deferred
+			}
+			if chanMsg.deferred != 0 {
+				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
+				continue
+			}
+			err := channel.PutMessage(chanMsg)
+			if err != nil {
+				return err
+			}
+		}
+		messageTotalBytes += len(msg.Body)
+	}
+
+	atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
+	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
+	return nil
+}
+
+// dropReplicatedIDs removes messages the primary failed to queue from the channels,
+// or from the topic if it has none
+func (t *Topic) dropReplicatedIDs(ids []MessageID) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.channelMap) == 0 {
+		t.abortMessages(ids)
+		return
+	}
+	for _, c := range t.channelMap {
+		for _, id := range ids {
+			c.finishReplicated(id)
+		}
+	}
+}
+
+// finishReplicated removes a message held by a replica
+func (c *Channel) finishReplicated(id MessageID) {
+	item, err := c.popDeferredMessage(id)
+	if err != nil {
+		return
+	}
+	c.deferredMutex.Lock()
+	if item.Index != -1 {
+		heap.Remove(&c.deferredPQ, item.Index)
+	}
+	c.deferredMutex.Unlock()
+}
+
+// holdBackend moves the messages that a replica flushed to the channel's backend
+// when it exited back to the deferred queue, where the acks from the primary find them
+func (c *Channel) holdBackend() error {
+	depth := c.backend.Depth()
+	if depth == 0 {
+		return nil
+	}
+	msgs, err := readBatch(nil, c.backend, depth, math.MaxInt64)
+	for _, msg := range msgs {
+		c.dequeued(msg)
+		c.StartDeferredTimeout(msg, 0)
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func deferredCount(c *Channel) int {
+	c.deferredMutex.Lock()
+	defer c.deferredMutex.Unlock()
+	return len(c.deferredMessages)
+}
+
+func TestReplication(t *testing.T) {
+	ropts := NewOptions()
+	ropts.Logger = test.NewTestLogger(t)
+	ropts.Replica = true
+	ropts.ReplicaPrimaryAddresses = []string{"127.0.0.1"}
+	ropts.ReplicaTakeoverTimeout = 100 * time.Millisecond
+	ropts.QueueScanRefreshInterval = 100 * time.Millisecond
+	rTCPAddr, _, replica := mustStartNSQD(ropts)
+	defer os.RemoveAll(ropts.DataPath)
+	defer replica.Exit()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaTCPAddress = rTCPAddr.String()
+	opts.ReplicateTopicRegexps = []string{"^test_replication"}
+	opts.ReplicationMode = "sync"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_replication" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var ids []MessageID
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test body"))
+		err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		ids = append(ids, msg.ID)
+	}
+
+	// the replica holds the messages
+	rtopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	rchannel, err := rtopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(0), rchannel.Depth())
+	test.Equal(t, 3, deferredCount(rchannel))
+
+	msg := <-channel.memoryMsgChan
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	err = channel.FinishMessage(0, msg.ID)
+	test.Nil(t, err)
+	test.Equal(t, ids[0], msg.ID)
+	// acks are replicated in the background
+	for i := 0; i < 100 && deferredCount(rchannel) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 2, deferredCount(rchannel))
+
+	conn, err := mustConnectNSQD(rTCPAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	readValidate(t, conn, frameTypeError, "E_PUB_FAILED PUB failed REPLICA - nsqd is a replica")
+
+	nsqd.Exit()
+
+	// the replica takes over and delivers the messages that were not finished
+	for i := 0; i < 100 && replica.IsReplica(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, false, replica.IsReplica())
+
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(2).WriteTo(conn)
+	test.Nil(t, err)
+
+	for _, id := range ids[1:] {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, frameTypeMessage, frameType)
+		test.Equal(t, id, msgOut.ID)
+	}
+}
+
+func startReplicaPair(t *testing.T, configure func(*Options)) (*NSQD, *NSQD) {
+	ropts := NewOptions()
+	ropts.Logger = test.NewTestLogger(t)
+	ropts.Replica = true
+	ropts.ReplicaPrimaryAddresses = []string{"127.0.0.1"}
+	ropts.ReplicaTakeoverTimeout = time.Minute
+	configure(ropts)
+	rTCPAddr, _, replica := mustStartNSQD(ropts)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaTCPAddress = rTCPAddr.String()
+	opts.ReplicateTopicRegexps = []string{"^test_"}
+	opts.ReplicationMode = "sync"
+	configure(opts)
+	_, _, nsqd := mustStartNSQD(opts)
+
+	t.Cleanup(func() {
+		nsqd.Exit()
+		replica.Exit()
+		os.RemoveAll(opts.DataPath)
+		os.RemoveAll(ropts.DataPath)
+	})
+	return nsqd, replica
+}
+
+func TestReplicationPrimaryNotAllowed(t *testing.T) {
+	nsqd, _ := startReplicaPair(t, func(opts *Options) {
+		if opts.Replica {
+			opts.ReplicaPrimaryAddresses = []string{"192.0.2.1"}
+		}
+	})
+
+	// the primary is refused before it can change the replica, and fenced
+	topic := nsqd.GetTopic("test_replication_not_allowed")
+	err := topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.Contains(nsqd.fencedReason(), "not a --replica-primary-address"))
+	test.NotNil(t, nsqd.checkPublish())
+}
+
+func TestReplicationBatches(t *testing.T) {
+	nsqd, replica := startReplicaPair(t, func(opts *Options) {
+		opts.MaxMsgSize = 100
+		opts.MaxBodySize = 1024
+	})
+
+	topicName := "test_replication_batches" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	// an MPUB body of 4 + 20 * (4 + 46) bytes is within --max-body-size, the
+	// messages with their framing for the replica are not
+	var msgs []*Message
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, NewMessage(topic.GenerateID(), make([]byte, 46)))
+	}
+	err := topic.PutMessages(msgs)
+	test.Nil(t, err)
+
+	rtopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	rchannel, err := rtopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, 20, deferredCount(rchannel))
+
+	// topics not matching --replicate-topic-regex are not replicated
+	other := nsqd.GetTopic("other")
+	other.GetChannel("ch")
+	err = other.PutMessage(NewMessage(other.GenerateID(), []byte("test body")))
+	test.Nil(t, err)
+	_, err = replica.GetExistingTopic("other")
+	test.NotNil(t, err)
+}
+
+func TestReplicationReplicaRestart(t *testing.T) {
+	ropts := NewOptions()
+	ropts.Logger = test.NewTestLogger(t)
+	ropts.Replica = true
+	ropts.ReplicaPrimaryAddresses = []string{"127.0.0.1"}
+	ropts.ReplicaTakeoverTimeout = time.Minute
+	rTCPAddr, _, replica := mustStartNSQD(ropts)
+	defer os.RemoveAll(ropts.DataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaTCPAddress = rTCPAddr.String()
+	opts.ReplicateTopicRegexps = []string{"^test_replication"}
+	opts.ReplicationMode = "sync"
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_replication_restart" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var ids []MessageID
+	for i := 0; i < 3; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test body"))
+		err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		ids = append(ids, msg.ID)
+	}
+
+	// the replica flushes the messages it holds to disk and holds them again
+	// once restarted (on the same address)
+	replica.Exit()
+	ropts.TCPAddress = rTCPAddr.String()
+	replica, err := New(ropts)
+	test.Nil(t, err)
+	defer replica.Exit()
+	err = replica.LoadMetadata()
+	test.Nil(t, err)
+	go replica.Main()
+
+	rtopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	rchannel, err := rtopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(0), rchannel.Depth())
+	test.Equal(t, 3, deferredCount(rchannel))
+
+	// so that the acks after the restart still remove them
+	for i := 0; i < 500 && atomic.LoadInt32(&replica.primaryConnCount) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg := <-channel.memoryMsgChan
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	err = channel.FinishMessage(0, msg.ID)
+	test.Nil(t, err)
+	test.Equal(t, ids[0], msg.ID)
+	for i := 0; i < 100 && deferredCount(rchannel) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 2, deferredCount(rchannel))
+
+	// and only the messages that were not finished are delivered after the takeover
+	replica.Promote()
+
+	conn, err := mustConnectNSQD(replica.RealTCPAddr())
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(3).WriteTo(conn)
+	test.Nil(t, err)
+
+	// (deferred messages are flushed in no particular order)
+	delivered := make(map[MessageID]bool)
+	for range ids[1:] {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, _ := nsq.UnpackResponse(resp)
+		msgOut, _ := decodeMessage(data)
+		test.Equal(t, frameTypeMessage, frameType)
+		delivered[msgOut.ID] = true
+	}
+	test.Equal(t, map[MessageID]bool{ids[1]: true, ids[2]: true}, delivered)
+	test.Equal(t, 0, deferredCount(rchannel))
+}
+
+func TestReplicationDrop(t *testing.T) {
+	nsqd, replica := startReplicaPair(t, func(opts *Options) {})
+
+	topicName := "test_replication_drop" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+
+	// a message replicated but not queued by the primary is dropped from the replica
+	atomic.StoreInt32(&topic.exitFlag, 1)
+	err := topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	test.NotNil(t, err)
+	atomic.StoreInt32(&topic.exitFlag, 0)
+
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	err = topic.PutMessage(msg)
+	test.Nil(t, err)
+
+	rtopic, err := replica.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	rchannel, err := rtopic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, 1, deferredCount(rchannel))
+	_, ok := rchannel.deferredMessages[msg.ID]
+	test.Equal(t, true, ok)
+}
+
+func TestReplicationFencing(t *testing.T) {
+	nsqd, replica := startReplicaPair(t, func(opts *Options) {})
+	test.Nil(t, nsqd.checkPublish())
+
+	// a second primary is refused by the replica and stops accepting publishes
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ReplicaTCPAddress = replica.RealTCPAddr().String()
+	opts.ReplicateTopicRegexps = []string{"^test_"}
+	_, httpAddr, other := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer other.Exit()
+
+	for i := 0; i < 100 && other.fencedReason() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := other.checkPublish()
+	test.NotNil(t, err)
+	test.Equal(t, true, strings.Contains(err.Error(), "fenced by its replica"))
+	test.Nil(t, nsqd.checkPublish())
+
+	url := fmt.Sprintf("http://%s/pub?topic=test_replication_fencing", httpAddr)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test body"))
+	test.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 503, resp.StatusCode)
+	test.Equal(t, `{"message":"FENCED"}`, string(body))
+
+	// as is the primary once the replica took over
+	replica.Promote()
+	topic := nsqd.GetTopic("test_replication_fencing")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	for i := 0; i < 100 && nsqd.fencedReason() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.NotNil(t, nsqd.checkPublish())
+}
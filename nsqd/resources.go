@@ -0,0 +1,159 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// the levels of a resource, worst last
+const (
+	ResourceOK       = "ok"
+	ResourceWarning  = "warning"
+	ResourceCritical = "critical"
+)
+
+// ResourceStatus is the usage of the disk holding --data-path and of the heap as of
+// the last check. nsqd is not ready from the warning level on and rejects
+// publishes at the critical level.
+type ResourceStatus struct {
+	Level     string   `json:"level"`
+	Reasons   []string `json:"reasons,omitempty"`
+	CheckedAt int64    `json:"checked_at"`
+
+	DiskLevel        string  `json:"disk_level"`
+	DiskUsagePercent float64 `json:"disk_usage_percent"`
+	DiskFreeBytes    uint64  `json:"disk_free_bytes"`
+	DiskError        string  `json:"disk_error,omitempty"`
+
+	HeapLevel      string `json:"heap_level"`
+	HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+}
+
+// resourceLevel returns the level of value, a threshold of 0 is disabled
+func resourceLevel(value float64, warn float64, critical float64) string {
+	switch {
+	case critical > 0 && value >= critical:
+		return ResourceCritical
+	case warn > 0 && value >= warn:
+		return ResourceWarning
+	}
+	return ResourceOK
+}
+
+func worseLevel(a string, b string) string {
+	if a == ResourceCritical || b == ResourceCritical {
+		return ResourceCritical
+	}
+	if a == ResourceWarning || b == ResourceWarning {
+		return ResourceWarning
+	}
+	return ResourceOK
+}
+
+func (n *NSQD) checkResources() ResourceStatus {
+	opts := n.getOpts()
+	s := ResourceStatus{
+		CheckedAt: time.Now().Unix(),
+		DiskLevel: ResourceOK,
+		HeapLevel: ResourceOK,
+	}
+
+	if opts.DiskUsageWarnPercent > 0 || opts.DiskUsageCriticalPercent > 0 {
+		dataPath := opts.DataPath
+		if dataPath == "" {
+			dataPath = "."
+		}
+		total, free, err := diskUsage(dataPath)
+		if err != nil {
+			s.DiskError = err.Error()
+		} else if total > 0 {
+			s.DiskFreeBytes = free
+			s.DiskUsagePercent = float64(total-free) / float64(total) * 100
+			s.DiskLevel = resourceLevel(s.DiskUsagePercent,
+				opts.DiskUsageWarnPercent, opts.DiskUsageCriticalPercent)
+			if s.DiskLevel != ResourceOK {
+				s.Reasons = append(s.Reasons, fmt.Sprintf("disk usage %.1f%% is %s",
+					s.DiskUsagePercent, s.DiskLevel))
+			}
+		}
+	}
+
+	if opts.HeapWarnBytes > 0 || opts.HeapCriticalBytes > 0 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		s.HeapInuseBytes = ms.HeapInuse
+		s.HeapLevel = resourceLevel(float64(ms.HeapInuse),
+			float64(opts.HeapWarnBytes), float64(opts.HeapCriticalBytes))
+		if s.HeapLevel != ResourceOK {
+			s.Reasons = append(s.Reasons, fmt.Sprintf("heap in use %d bytes is %s",
+				s.HeapInuseBytes, s.HeapLevel))
+		}
+	}
+
+	s.Level = worseLevel(s.DiskLevel, s.HeapLevel)
+	return s
+}
+
+// updateResources checks the resources and logs the changes of level
+func (n *NSQD) updateResources() {
+	s := n.checkResources()
+	prev := n.GetResourceStatus()
+	n.resources.Store(&s)
+
+	if s.DiskError != "" && s.DiskError != prev.DiskError {
+		n.logComponentf(LOG_ERROR, "RESOURCES", "failed to check disk usage - %s", s.DiskError)
+	}
+	if s.Level == prev.Level {
+		return
+	}
+	if s.Level == ResourceOK {
+		n.logComponentf(LOG_INFO, "RESOURCES", "back to %s", s.Level)
+		return
+	}
+	n.logComponentf(LOG_WARN, "RESOURCES", "%s - %s", s.Level, strings.Join(s.Reasons, ", "))
+}
+
+// GetResourceStatus returns the result of the last resource check
+func (n *NSQD) GetResourceStatus() ResourceStatus {
+	return *n.resources.Load().(*ResourceStatus)
+}
+
+// resourceError returns an error when the resources are at level or worse
+func (n *NSQD) resourceError(level string) error {
+	s := n.GetResourceStatus()
+	if s.Level == ResourceOK || (level == ResourceCritical && s.Level != ResourceCritical) {
+		return nil
+	}
+	return errors.New("nsqd resources are " + s.Level + " - " + strings.Join(s.Reasons, ", "))
+}
+
+// checkReady returns why nsqd should not be sent traffic, unlike IsHealthy (ie.
+// GET /ping) it also fails while nsqd is merely busy
+func (n *NSQD) checkReady() error {
+	if err := n.GetError(); err != nil {
+		return err
+	}
+	if err := n.checkPublish(); err != nil {
+		return err
+	}
+	return n.resourceError(ResourceWarning)
+}
+
+func (n *NSQD) resourceLoop() {
+	ticker := time.NewTicker(n.getOpts().ResourceCheckInterval)
+	for {
+		select {
+		case <-ticker.C:
+			n.updateResources()
+		case <-n.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	n.logComponentf(LOG_INFO, "RESOURCES", "closing")
+	ticker.Stop()
+}
@@ -0,0 +1,279 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// RouteRule copies the messages published to a topic that match a predicate on one of
+// their JSON fields to the Target topic. Field is a dot separated path (eg.
+// "customer.tier" or "items.0.sku") and Op one of eq, ne, gt, gte, lt, lte or
+// exists, the messages that are not JSON objects never match.
+type RouteRule struct {
+	Target string          `json:"target"`
+	Field  string          `json:"field"`
+	Op     string          `json:"op"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+var errRouteLoop = errors.New("route would form a loop")
+
+// route is a RouteRule ready to be evaluated when messages are put on its topic
+type route struct {
+	RouteRule
+	path  []string
+	value interface{}
+
+	// the target topic is looked up when the route is set and whenever
+	// a topic of that name is created (see NSQD.bindRoutes) so that
+	// publishing does not wait for the NSQD lock
+	target atomic.Value // *Topic
+}
+
+func newRoute(rule RouteRule) (*route, error) {
+	if rule.Field == "" {
+		return nil, errors.New("missing field")
+	}
+	r := &route{
+		RouteRule: rule,
+		path:      strings.Split(rule.Field, "."),
+	}
+	switch rule.Op {
+	case "exists":
+		r.Value = nil
+		return r, nil
+	case "eq", "ne", "gt", "gte", "lt", "lte":
+	default:
+		return nil, fmt.Errorf("invalid op %q", rule.Op)
+	}
+	if len(rule.Value) == 0 {
+		return nil, fmt.Errorf("missing value for op %s", rule.Op)
+	}
+	err := json.Unmarshal(rule.Value, &r.value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value - %s", err)
+	}
+	return r, nil
+}
+
+// match evaluates the predicate of the route on a decoded JSON document
+func (r *route) match(doc interface{}) bool {
+	v, ok := lookupField(doc, r.path)
+	if !ok {
+		return false
+	}
+	switch r.Op {
+	case "exists":
+		return true
+	case "eq":
+		return reflect.DeepEqual(v, r.value)
+	case "ne":
+		return !reflect.DeepEqual(v, r.value)
+	}
+
+	var cmp int
+	switch a := v.(type) {
+	case float64:
+		b, ok := r.value.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	case string:
+		b, ok := r.value.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(a, b)
+	default:
+		return false
+	}
+
+	switch r.Op {
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+func lookupField(v interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			v, ok = node[name]
+			if !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func (t *Topic) getRoutes() []*route {
+	routes, _ := t.routes.Load().([]*route)
+	return routes
+}
+
+// Routes returns the routing rules of this topic, ordered by target
+func (t *Topic) Routes() []RouteRule {
+	var rules []RouteRule
+	for _, r := range t.getRoutes() {
+		rules = append(rules, r.RouteRule)
+	}
+	return rules
+}
+
+// routeMessage puts a copy of a message on the target topic of each route it matches
+func (t *Topic) routeMessage(msg *Message) {
+	routes := t.getRoutes()
+	if len(routes) == 0 {
+		return
+	}
+
+	var doc interface{}
+	if json.Unmarshal(msg.Body, &doc) != nil {
+		return
+	}
+
+	for _, r := range routes {
+		if !r.match(doc) {
+			continue
+		}
+		target := r.target.Load().(*Topic)
+		if target.Exiting() {
+			t.logf(LOG_DEBUG, "not routing msg(%s) to deleted topic %s", msg.ID, r.Target)
+			continue
+		}
+		copyMsg := NewMessage(target.GenerateID(), msg.Body)
+		copyMsg.deferred = msg.deferred
+		err := target.PutMessage(copyMsg)
+		if err != nil {
+			t.logf(LOG_ERROR, "failed to route msg(%s) to %s - %s", msg.ID, r.Target, err)
+		}
+	}
+}
+
+// SetRoute adds a routing rule to a topic, replacing its rule for the same target. It
+// fails with errRouteLoop if the target routes (directly or not) back to the topic and
+// with errTopicNotFound if the target does not exist and the --auto-create policy does
+// not create it.
+func (n *NSQD) SetRoute(t *Topic, rule RouteRule) error {
+	if rule.Target == t.name {
+		return errRouteLoop
+	}
+	r, err := newRoute(rule)
+	if err != nil {
+		return err
+	}
+
+	n.routeMutex.Lock()
+	defer n.routeMutex.Unlock()
+
+	if n.routesTo(rule.Target, t.name) {
+		return errRouteLoop
+	}
+	target, err := n.getOrAutoCreateTopic(rule.Target)
+	if err != nil {
+		return err
+	}
+	r.target.Store(target)
+
+	var routes []*route
+	for _, existing := range t.getRoutes() {
+		if existing.Target != rule.Target {
+			routes = append(routes, existing)
+		}
+	}
+	routes = append(routes, r)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Target < routes[j].Target })
+	t.routes.Store(routes)
+
+	t.logf(LOG_INFO, "routing to %s when %s %s %s", rule.Target, rule.Field, rule.Op, rule.Value)
+	return nil
+}
+
+// RemoveRoute removes the routing rule of a topic for target
+func (n *NSQD) RemoveRoute(t *Topic, target string) error {
+	n.routeMutex.Lock()
+	defer n.routeMutex.Unlock()
+
+	var routes []*route
+	for _, existing := range t.getRoutes() {
+		if existing.Target != target {
+			routes = append(routes, existing)
+		}
+	}
+	if len(routes) == len(t.getRoutes()) {
+		return fmt.Errorf("topic %s has no route to %s", t.name, target)
+	}
+	t.routes.Store(routes)
+
+	t.logf(LOG_INFO, "no longer routing to %s", target)
+	return nil
+}
+
+// routesTo returns true if the messages of topic from are routed (directly or not) to topic to
+func (n *NSQD) routesTo(from string, to string) bool {
+	n.RLock()
+	defer n.RUnlock()
+
+	visited := make(map[string]bool)
+	pending := []string{from}
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if name == to {
+			return true
+		}
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+		t, ok := n.topicMap[name]
+		if !ok {
+			continue
+		}
+		for _, r := range t.getRoutes() {
+			pending = append(pending, r.Target)
+		}
+	}
+	return false
+}
+
+// bindRoutes points the routes to a topic of the name of t to t,
+// this expects the caller to hold the NSQD lock
+func (n *NSQD) bindRoutes(t *Topic) {
+	for _, topic := range n.topicMap {
+		for _, r := range topic.getRoutes() {
+			if r.Target == t.name {
+				r.target.Store(t)
+			}
+		}
+	}
+}
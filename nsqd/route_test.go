@@ -0,0 +1,45 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestRouteMatch(t *testing.T) {
+	doc := `{"total": 250, "customer": {"tier": "gold"}, "items": [{"sku": "a1"}]}`
+	var v interface{}
+	err := json.Unmarshal([]byte(doc), &v)
+	test.Nil(t, err)
+
+	tests := []struct {
+		field string
+		op    string
+		value string
+		match bool
+	}{
+		{"total", "gt", "100", true},
+		{"total", "gte", "250", true},
+		{"total", "lt", "250", false},
+		{"total", "lte", "100", false},
+		{"total", "gt", `"100"`, false},
+		{"customer.tier", "eq", `"gold"`, true},
+		{"customer.tier", "ne", `"gold"`, false},
+		{"customer.tier", "gt", `"bronze"`, true},
+		{"items.0.sku", "eq", `"a1"`, true},
+		{"items.1.sku", "exists", "", false},
+		{"customer", "exists", "", true},
+		{"missing", "ne", "1", false},
+	}
+	for _, tt := range tests {
+		r, err := newRoute(RouteRule{Target: "t", Field: tt.field, Op: tt.op, Value: json.RawMessage(tt.value)})
+		test.Nil(t, err)
+		test.Equal(t, tt.match, r.match(v))
+	}
+
+	_, err = newRoute(RouteRule{Target: "t", Field: "total", Op: "between"})
+	test.NotNil(t, err)
+	_, err = newRoute(RouteRule{Target: "t", Field: "total", Op: "gt"})
+	test.NotNil(t, err)
+}
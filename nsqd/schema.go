@@ -0,0 +1,161 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/jsonschema"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// topicSchema is the JSON Schema the messages published to a topic are validated against
+type topicSchema struct {
+	raw         json.RawMessage
+	schema      *jsonschema.Schema
+	rejectTopic string
+}
+
+// schemaError is returned for a message that does not match the schema of its topic
+type schemaError struct {
+	err error
+}
+
+func (e *schemaError) Error() string {
+	return "message does not match schema - " + e.err.Error()
+}
+
+// SetSchema sets the JSON Schema that messages published to this topic are validated
+// against, invalid messages are routed to rejectTopic, or rejected when it is empty
+func (t *Topic) SetSchema(raw []byte, rejectTopic string) error {
+	schema, err := jsonschema.Compile(raw)
+	if err != nil {
+		return err
+	}
+	if rejectTopic == t.name {
+		return fmt.Errorf("reject topic cannot be %s itself", t.name)
+	}
+
+	t.schema.Store(&topicSchema{
+		raw:         json.RawMessage(raw),
+		schema:      schema,
+		rejectTopic: rejectTopic,
+	})
+	t.logf(LOG_INFO, "schema set")
+	return nil
+}
+
+// RemoveSchema stops the validation of messages published to this topic
+func (t *Topic) RemoveSchema() error {
+	if t.getSchema() == nil {
+		return fmt.Errorf("topic %s has no schema", t.name)
+	}
+	t.schema.Store((*topicSchema)(nil))
+	t.logf(LOG_INFO, "schema removed")
+	return nil
+}
+
+// Schema returns the JSON Schema of this topic (nil if it has none) and its reject topic
+func (t *Topic) Schema() (json.RawMessage, string) {
+	s := t.getSchema()
+	if s == nil {
+		return nil, ""
+	}
+	return s.raw, s.rejectTopic
+}
+
+func (t *Topic) getSchema() *topicSchema {
+	s, _ := t.schema.Load().(*topicSchema)
+	return s
+}
+
+// publishMessages validates the messages published to this topic against its schema
+// and puts them on the topic.
+//
+// When the topic has a reject topic the invalid messages are published to it, along
+// with the valid messages to this topic so that either all of them are queued or
+// none are. Otherwise the first invalid message fails the publish with a *schemaError.
+// A reject topic that does not exist and that the --auto-create policy does not create
+// fails the publish with a *topicNotFoundError.
+func (t *Topic) publishMessages(msgs []*Message) error {
+	s := t.getSchema()
+	if s == nil {
+		return t.PutMessages(msgs)
+	}
+
+	var valid []*Message
+	var rejected []*Message
+	for _, msg := range msgs {
+		err := s.schema.Validate(msg.Body)
+		if err == nil {
+			valid = append(valid, msg)
+			continue
+		}
+		atomic.AddUint64(&t.validationFailureCount, 1)
+		if s.rejectTopic == "" {
+			return &schemaError{err}
+		}
+		t.logf(LOG_DEBUG, "routing msg(%s) to %s - %s", msg.ID, s.rejectTopic, err)
+		rejected = append(rejected, msg)
+	}
+
+	if len(rejected) == 0 {
+		return t.PutMessages(valid)
+	}
+
+	rejectTopic, err := t.nsqd.getOrAutoCreateTopic(s.rejectTopic)
+	if err != nil {
+		return &topicNotFoundError{s.rejectTopic}
+	}
+	for i, msg := range rejected {
+		rejected[i] = NewMessage(rejectTopic.GenerateID(), msg.Body)
+		rejected[i].deferred = msg.deferred
+	}
+	if len(valid) == 0 {
+		return rejectTopic.PutMessages(rejected)
+	}
+	if t.name < rejectTopic.name {
+		return t.nsqd.putMessagesAtomically([]*Topic{t, rejectTopic}, [][]*Message{valid, rejected})
+	}
+	return t.nsqd.putMessagesAtomically([]*Topic{rejectTopic, t}, [][]*Message{rejected, valid})
+}
+
+// checkMessages validates messages against the schema of this topic without routing
+// the invalid ones to the reject topic, the first invalid message is returned as a *schemaError
+func (t *Topic) checkMessages(msgs []*Message) error {
+	s := t.getSchema()
+	if s == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		err := s.schema.Validate(msg.Body)
+		if err != nil {
+			atomic.AddUint64(&t.validationFailureCount, 1)
+			return &schemaError{err}
+		}
+	}
+	return nil
+}
+
+// validationErr returns the client error of a publish that failed validation, messages
+// that do not match the schema of their topic are not fatal to the connection
+func validationErr(cmd string, err error) error {
+	if _, ok := err.(*schemaError); ok {
+		return protocol.NewClientErr(err, "E_BAD_MESSAGE_SCHEMA", cmd+" "+err.Error())
+	}
+	if e, ok := err.(*topicNotFoundError); ok {
+		return topicNotFoundErr(cmd, e.name)
+	}
+	return protocol.NewFatalClientErr(err, "E_"+cmd+"_FAILED", cmd+" failed "+err.Error())
+}
+
+func validationHTTPErr(err error) error {
+	if _, ok := err.(*schemaError); ok {
+		return http_api.Err{400, "BAD_MESSAGE_SCHEMA"}
+	}
+	if _, ok := err.(*topicNotFoundError); ok {
+		return http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+	return http_api.Err{503, "EXITING"}
+}
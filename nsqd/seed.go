@@ -0,0 +1,283 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nsqio/nsq/internal/jsonschema"
+	"github.com/nsqio/nsq/internal/protocol"
+)
+
+// --seed-extra values, ie. what to do with the topics and channels that
+// exist but are not declared in the --seed-file
+const (
+	SeedExtraIgnore = "ignore"
+	SeedExtraReport = "report"
+	SeedExtraDelete = "delete"
+)
+
+// SeedConfig declares the topics and channels an nsqd must have (see --seed-file),
+// it is read from a JSON file or from a TOML file with the same structure, eg.
+//
+//	[[topics]]
+//	name = "orders"
+//	schema = '{"type": "object", "required": ["id"]}'
+//	reject_topic = "orders.invalid"
+//
+//	[[topics.channels]]
+//	name = "archive"
+//	paused = true
+//
+// The settings that are omitted are left as they are. With --seed-extra=delete the
+// reject topics and route targets have to be declared too.
+type SeedConfig struct {
+	Topics []SeedTopic `json:"topics"`
+}
+
+type SeedTopic struct {
+	Name        string          `json:"name"`
+	Paused      *bool           `json:"paused,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	RejectTopic string          `json:"reject_topic,omitempty"`
+	Routes      []RouteRule     `json:"routes,omitempty"`
+	Channels    []SeedChannel   `json:"channels,omitempty"`
+}
+
+type SeedChannel struct {
+	Name   string `json:"name"`
+	Paused *bool  `json:"paused,omitempty"`
+}
+
+// readSeedConfig reads and validates a seed file, TOML documents are converted to
+// JSON so that both formats share the json tags of SeedConfig
+func readSeedConfig(fn string) (*SeedConfig, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(filepath.Ext(fn), ".json") {
+		var doc map[string]interface{}
+		err = toml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, err
+		}
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg SeedConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i := range cfg.Topics {
+		t := &cfg.Topics[i]
+		if !protocol.IsValidTopicName(t.Name) {
+			return nil, fmt.Errorf("invalid topic name %q", t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("topic %s is declared more than once", t.Name)
+		}
+		seen[t.Name] = true
+
+		// the schema can be given as a JSON document in a string (eg. in TOML)
+		var s string
+		if json.Unmarshal(t.Schema, &s) == nil {
+			t.Schema = json.RawMessage(s)
+		}
+		if t.Schema != nil {
+			_, err := jsonschema.Compile(t.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schema for topic %s - %s", t.Name, err)
+			}
+		}
+		for _, rule := range t.Routes {
+			_, err := newRoute(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route from topic %s to %s - %s", t.Name, rule.Target, err)
+			}
+		}
+
+		channels := make(map[string]bool)
+		for _, c := range t.Channels {
+			if !protocol.IsValidChannelName(c.Name) {
+				return nil, fmt.Errorf("invalid channel name %q for topic %s", c.Name, t.Name)
+			}
+			if channels[c.Name] {
+				return nil, fmt.Errorf("channel %s of topic %s is declared more than once", c.Name, t.Name)
+			}
+			channels[c.Name] = true
+		}
+	}
+	return &cfg, nil
+}
+
+// Seed reconciles the topics and channels with the --seed-file, the ones that are
+// missing are created and the ones that are not declared are handled as per
+// --seed-extra. It is called by LoadMetadata and can be called again (eg. on SIGHUP)
+// after the file changed.
+func (n *NSQD) Seed() error {
+	opts := n.getOpts()
+	if opts.SeedFile == "" {
+		return nil
+	}
+
+	cfg, err := readSeedConfig(opts.SeedFile)
+	if err != nil {
+		return fmt.Errorf("failed to read seed file %s - %s", opts.SeedFile, err)
+	}
+
+	n.logComponentf(LOG_INFO, "SEED", "reconciling %d topics with %s", len(cfg.Topics), opts.SeedFile)
+
+	declared := make(map[string]*SeedTopic)
+	for i := range cfg.Topics {
+		t := &cfg.Topics[i]
+		declared[t.Name] = t
+		n.seedTopic(t)
+	}
+
+	// routes are set once all the declared topics exist
+	for _, t := range cfg.Topics {
+		topic, err := n.GetExistingTopic(t.Name)
+		if err != nil {
+			continue
+		}
+		existing := make(map[string]RouteRule)
+		for _, rule := range topic.Routes() {
+			existing[rule.Target] = rule
+		}
+		for _, rule := range t.Routes {
+			if r, ok := existing[rule.Target]; ok && reflect.DeepEqual(r, rule) {
+				continue
+			}
+			err := n.SetRoute(topic, rule)
+			if err != nil {
+				n.logComponentf(LOG_ERROR, "SEED", "failed to route topic %s to %s - %s", t.Name, rule.Target, err)
+			}
+		}
+	}
+
+	n.seedExtra(declared, opts.SeedExtra)
+
+	n.Lock()
+	err = n.PersistMetadata()
+	n.Unlock()
+	return err
+}
+
+func (n *NSQD) seedTopic(t *SeedTopic) {
+	topic, err := n.GetExistingTopic(t.Name)
+	if err != nil {
+		n.logComponentf(LOG_INFO, "SEED", "creating topic %s", t.Name)
+		topic = n.GetTopic(t.Name)
+	}
+
+	if t.Paused != nil && *t.Paused != topic.IsPaused() {
+		n.logComponentf(LOG_INFO, "SEED", "setting topic %s paused=%t", t.Name, *t.Paused)
+		if *t.Paused {
+			topic.Pause()
+		} else {
+			topic.UnPause()
+		}
+	}
+
+	if t.Schema != nil {
+		// the schema set over HTTP is stored as it was given
+		raw, rejectTopic := topic.Schema()
+		var cur, compacted bytes.Buffer
+		json.Compact(&cur, raw)
+		json.Compact(&compacted, t.Schema)
+		if !bytes.Equal(cur.Bytes(), compacted.Bytes()) || rejectTopic != t.RejectTopic {
+			err := topic.SetSchema(compacted.Bytes(), t.RejectTopic)
+			if err != nil {
+				n.logComponentf(LOG_ERROR, "SEED", "failed to set schema of topic %s - %s", t.Name, err)
+			}
+		}
+	}
+
+	for _, c := range t.Channels {
+		channel, err := topic.GetExistingChannel(c.Name)
+		if err != nil {
+			n.logComponentf(LOG_INFO, "SEED", "creating channel %s:%s", t.Name, c.Name)
+			channel = topic.GetChannel(c.Name)
+		}
+		if c.Paused != nil && *c.Paused != channel.IsPaused() {
+			n.logComponentf(LOG_INFO, "SEED", "setting channel %s:%s paused=%t", t.Name, c.Name, *c.Paused)
+			if *c.Paused {
+				channel.Pause()
+			} else {
+				channel.UnPause()
+			}
+		}
+	}
+}
+
+// seedExtra reports or deletes the topics and channels that are not declared
+// in the seed file, ephemeral ones are left alone
+func (n *NSQD) seedExtra(declared map[string]*SeedTopic, extra string) {
+	if extra == SeedExtraIgnore {
+		return
+	}
+
+	n.RLock()
+	topics := make([]*Topic, 0, len(n.topicMap))
+	for _, t := range n.topicMap {
+		topics = append(topics, t)
+	}
+	n.RUnlock()
+
+	for _, topic := range topics {
+		if topic.ephemeral {
+			continue
+		}
+		t, ok := declared[topic.name]
+		if !ok {
+			// nsqd creates the events topic on its own
+			if n.isEventsTopic(topic.name) {
+				continue
+			}
+			if extra == SeedExtraReport {
+				n.logComponentf(LOG_WARN, "SEED", "topic %s is not declared", topic.name)
+				continue
+			}
+			n.logComponentf(LOG_INFO, "SEED", "deleting topic %s", topic.name)
+			n.DeleteExistingTopic(topic.name)
+			continue
+		}
+
+		channels := make(map[string]bool)
+		for _, c := range t.Channels {
+			channels[c.Name] = true
+		}
+		topic.RLock()
+		var undeclared []string
+		for _, channel := range topic.channelMap {
+			if !channel.ephemeral && !channels[channel.name] {
+				undeclared = append(undeclared, channel.name)
+			}
+		}
+		topic.RUnlock()
+
+		for _, name := range undeclared {
+			if extra == SeedExtraReport {
+				n.logComponentf(LOG_WARN, "SEED", "channel %s:%s is not declared", topic.name, name)
+				continue
+			}
+			n.logComponentf(LOG_INFO, "SEED", "deleting channel %s:%s", topic.name, name)
+			topic.DeleteExistingChannel(name)
+		}
+	}
+}
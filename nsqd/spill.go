@@ -0,0 +1,351 @@
+package nsqd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Messages whose body is larger than --spill-msg-threshold are "spilled": their body is
+// streamed to a file in the data path and the message itself only carries a reference to
+// it, so that they neither sit in memory queues nor in client output buffers.
+//
+// The file of a message is written to spill/<topic>/topic/<id> and hard linked to
+// spill/<topic>/channels/<channel>/<id> for each channel when the topic messagePump
+// copies the message to its channels, the link of a channel is removed when the message
+// is finished on it so that the file is gone once the last channel finished it.
+//
+// A spilled message is flagged as such on the Message and in its backend record (see
+// writeMessageToBackend), its body is the 8-byte size of the spill file. Older versions
+// of nsqd cannot read these records, before the first one is written the metadata is
+// persisted with backend_format set to backendFormatSpill, and an nsqd refuses to load
+// metadata of a format it does not know. Queues of a node that spilled messages have
+// to be drained before downgrading it.
+//
+// Spilled messages are streamed to the consumers that IDENTIFY with large_messages and
+// to push subscriptions, a channel without such a consumer holds on to them until one
+// subscribes. The messages of replicated topics and of topics with a schema or routes
+// are never spilled as they have to be in memory to be replicated, validated or routed,
+// and topics with spilled messages queued cannot be migrated to another nsqd.
+
+// spillDelay is how long a spilled message is deferred for when its channel has
+// a consumer that accepts large messages but it is not the one that received it
+const spillDelay = time.Second
+
+var errSpillDisabled = errors.New("spilling is disabled")
+
+// backendFormatSpill is the backend_format of the metadata of an nsqd whose backend
+// queues may hold spilled records
+const backendFormatSpill = 1
+
+// maxSpillMsgSize is the largest --max-spill-msg-size, the size of a message frame
+// has to fit in the (signed) 4-byte size of the frame
+const maxSpillMsgSize = math.MaxInt32 - 4 - minValidMsgLength
+
+func spilledBody(size int64) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(size))
+	return body
+}
+
+// isSpilled returns true if the body of the message is in a spill file
+func (m *Message) isSpilled() bool {
+	return m.spilled
+}
+
+// spilledSize returns the size of the body of a spilled message
+func (m *Message) spilledSize() int64 {
+	return int64(binary.BigEndian.Uint64(m.Body))
+}
+
+// shouldSpill returns true if a message body of size bytes published to a
+// topic must be spilled
+func (n *NSQD) shouldSpill(topicName string, size int64) bool {
+	threshold := n.getOpts().SpillMsgThreshold
+	if threshold <= 0 || size <= threshold {
+		return false
+	}
+	if n.replicatesTopic(topicName) {
+		return false
+	}
+	t, err := n.GetExistingTopic(topicName)
+	if err != nil {
+		return true
+	}
+	return t.getSchema() == nil && len(t.getRoutes()) == 0
+}
+
+func spillDir(dataPath string, topicName string) string {
+	return filepath.Join(dataPath, "spill", topicName)
+}
+
+func (t *Topic) spillDir() string {
+	return filepath.Join(spillDir(t.nsqd.getOpts().DataPath, t.name), "topic")
+}
+
+func (c *Channel) spillDir() string {
+	return filepath.Join(spillDir(c.nsqd.getOpts().DataPath, c.topicName), "channels", c.name)
+}
+
+func spillFileName(id MessageID) string {
+	return string(id[:])
+}
+
+// spillMessage streams a message body of size bytes from r to a spill file and returns
+// the message referencing it
+func (t *Topic) spillMessage(r io.Reader, size int64) (*Message, error) {
+	if t.nsqd.getOpts().SpillMsgThreshold <= 0 {
+		return nil, errSpillDisabled
+	}
+
+	err := t.nsqd.useSpilledRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	id := t.GenerateID()
+	dir := t.spillDir()
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := filepath.Join(dir, spillFileName(id))
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, time.Now().UnixNano())
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.CopyN(f, r, size)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return nil, err
+	}
+
+	t.logf(LOG_DEBUG, "spilled msg(%s) of %d bytes", id, size)
+	msg := NewMessage(id, spilledBody(size))
+	msg.spilled = true
+	return msg, nil
+}
+
+// useSpilledRecords marks the metadata with backendFormatSpill before the first
+// spilled record is written to a backend queue
+func (n *NSQD) useSpilledRecords() error {
+	if atomic.LoadInt32(&n.backendFormat) >= backendFormatSpill {
+		return nil
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if atomic.LoadInt32(&n.backendFormat) >= backendFormatSpill {
+		return nil
+	}
+	atomic.StoreInt32(&n.backendFormat, backendFormatSpill)
+	err := n.PersistMetadata()
+	if err != nil {
+		atomic.StoreInt32(&n.backendFormat, 0)
+	}
+	return err
+}
+
+// acceptsLargeMessages returns true if spilled messages can be delivered to a consumer
+func acceptsLargeMessages(client Consumer) bool {
+	c, ok := client.(interface{ acceptsLargeMessages() bool })
+	return ok && c.acceptsLargeMessages()
+}
+
+func (c *clientV2) acceptsLargeMessages() bool {
+	return atomic.LoadInt32(&c.LargeMessages) == 1
+}
+
+// push subscriptions stream spilled messages in their requests
+func (p *pushConsumer) acceptsLargeMessages() bool {
+	return true
+}
+
+// holdSpill requeues a spilled message received by a consumer that does not accept
+// large messages, it is deferred for the consumers that do or held until one
+// subscribes to the channel
+func (c *Channel) holdSpill(msg *Message) {
+	c.Lock()
+	for _, client := range c.clients {
+		if acceptsLargeMessages(client) {
+			c.Unlock()
+			c.StartDeferredTimeout(msg, spillDelay)
+			return
+		}
+	}
+	c.queueAges.add(msg.Timestamp)
+	c.heldSpills = append(c.heldSpills, msg)
+	atomic.StoreInt64(&c.heldSpillCount, int64(len(c.heldSpills)))
+	c.Unlock()
+}
+
+// releaseSpills requeues the spilled messages that were held for a consumer
+func (c *Channel) releaseSpills(msgs []*Message) {
+	for _, msg := range msgs {
+		c.queueAges.remove(msg.Timestamp)
+		err := c.put(msg)
+		if err != nil {
+			c.logf(LOG_ERROR, "failed to requeue spilled msg(%s) - %s", msg.ID, err)
+		}
+	}
+}
+
+// hasSpills returns true if spilled messages are queued on this topic or its channels
+func (t *Topic) hasSpills() bool {
+	dir := spillDir(t.nsqd.getOpts().DataPath, t.name)
+	entries, _ := os.ReadDir(filepath.Join(dir, "topic"))
+	if len(entries) > 0 {
+		return true
+	}
+	channels, _ := os.ReadDir(filepath.Join(dir, "channels"))
+	for _, c := range channels {
+		entries, _ := os.ReadDir(filepath.Join(dir, "channels", c.Name()))
+		if len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// linkSpill links the spill file of a message to a channel
+func (t *Topic) linkSpill(msg *Message, channel *Channel) error {
+	dir := channel.spillDir()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Link(filepath.Join(t.spillDir(), spillFileName(msg.ID)),
+		filepath.Join(dir, spillFileName(msg.ID)))
+	if os.IsExist(err) {
+		// the message was already copied to this channel before nsqd restarted
+		return nil
+	}
+	return err
+}
+
+// waitLinkSpill links the spill file of a message to a channel, failures are retried
+// every spillDelay so that the message is not lost for the channel (nsqd is unhealthy
+// in the meantime), it returns false if the topic exits first
+func (t *Topic) waitLinkSpill(msg *Message, channel *Channel) bool {
+	failed := false
+	for {
+		err := t.linkSpill(msg, channel)
+		if err == nil {
+			if failed {
+				t.nsqd.SetHealth(nil)
+			}
+			return true
+		}
+		t.logf(LOG_ERROR, "failed to link spilled msg(%s) to channel(%s) - %s",
+			msg.ID, channel.name, err)
+		t.nsqd.SetHealth(err)
+		failed = true
+
+		select {
+		case <-t.exitChan:
+			return false
+		case <-time.After(spillDelay):
+		}
+	}
+}
+
+// removeSpill removes the topic's link to the spill file of a message, once
+// it has been linked to all the channels of the topic or failed to be put on it
+func (t *Topic) removeSpill(msg *Message) {
+	err := os.Remove(filepath.Join(t.spillDir(), spillFileName(msg.ID)))
+	if err != nil && !os.IsNotExist(err) {
+		t.logf(LOG_ERROR, "failed to remove spill file of msg(%s) - %s", msg.ID, err)
+	}
+}
+
+// openSpill opens the spill file of a message in this channel
+func (c *Channel) openSpill(msg *Message) (*os.File, error) {
+	return os.Open(filepath.Join(c.spillDir(), spillFileName(msg.ID)))
+}
+
+// removeSpill removes the channel's link to the spill file of a message
+func (c *Channel) removeSpill(msg *Message) {
+	err := os.Remove(filepath.Join(c.spillDir(), spillFileName(msg.ID)))
+	if err != nil && !os.IsNotExist(err) {
+		c.logf(LOG_ERROR, "failed to remove spill file of msg(%s) - %s", msg.ID, err)
+	}
+}
+
+// SendSpilledMessage streams a spilled message to a client
+func (p *protocolV2) SendSpilledMessage(client *clientV2, msg *Message) error {
+	f, err := client.Channel.openSpill(msg)
+	if os.IsNotExist(err) {
+		// the channel was emptied since, there is nothing left to deliver
+		p.logClientf(LOG_WARN, client, "dropping msg(%s) - spill file is gone", msg.ID)
+		if client.Channel.FinishMessage(client.ID, msg.ID) == nil {
+			client.FinishedMessage()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.logClientf(LOG_DEBUG, client, "writing spilled msg(%s) - %d bytes", msg.ID, msg.spilledSize())
+
+	var header [4 + 4 + minValidMsgLength]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(4+minValidMsgLength+msg.spilledSize()))
+	binary.BigEndian.PutUint32(header[4:], uint32(frameTypeMessage))
+	binary.BigEndian.PutUint64(header[8:], uint64(msg.Timestamp))
+	binary.BigEndian.PutUint16(header[16:], msg.Attempts)
+	copy(header[18:], msg.ID[:])
+
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+
+	w := &deadlineWriter{client: client}
+	_, err = w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+	if n != msg.spilledSize() {
+		// the frame cannot be completed, the connection has to be closed
+		return fmt.Errorf("spill file of msg(%s) is %d bytes, expected %d", msg.ID, n, msg.spilledSize())
+	}
+	return nil
+}
+
+// deadlineWriter extends the write deadline of a client for each write so that
+// streaming a large message does not time out as a whole
+type deadlineWriter struct {
+	client *clientV2
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	var zeroTime time.Time
+	if w.client.HeartbeatInterval > 0 {
+		w.client.SetWriteDeadline(time.Now().Add(w.client.HeartbeatInterval))
+	} else {
+		w.client.SetWriteDeadline(zeroTime)
+	}
+	return w.client.Writer.Write(p)
+}
@@ -1,16 +1,20 @@
 package nsqd
 
 import (
+	"regexp"
 	"runtime"
 	"sort"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/quantile"
 )
 
 type Stats struct {
-	Topics    []TopicStats
-	Producers []ClientStats
+	Topics      []TopicStats
+	Producers   []ClientStats
+	TotalTopics int
 }
 
 type ClientStats interface {
@@ -26,6 +30,10 @@ type TopicStats struct {
 	MessageBytes uint64         `json:"message_bytes"`
 	Paused       bool           `json:"paused"`
 
+	ValidationFailureCount uint64 `json:"validation_failure_count"`
+
+	Rates *RateStats `json:"rates,omitempty"`
+
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
@@ -39,6 +47,10 @@ func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
 		MessageBytes: atomic.LoadUint64(&t.messageBytes),
 		Paused:       t.IsPaused(),
 
+		ValidationFailureCount: atomic.LoadUint64(&t.validationFailureCount),
+
+		Rates: t.rateHistory.stats(false),
+
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
 }
@@ -56,7 +68,29 @@ type ChannelStats struct {
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
 
+	// publish timestamps (in ns) of the oldest queued and in-flight messages, 0 if none
+	OldestMessageTimestamp  int64 `json:"oldest_message_timestamp"`
+	OldestInFlightTimestamp int64 `json:"oldest_in_flight_timestamp"`
+	// age of the oldest message not yet finished
+	LagSeconds float64 `json:"lag_seconds"`
+
+	Rates *RateStats `json:"rates,omitempty"`
+
+	PushSubscriptions []PushStats `json:"push_subscriptions,omitempty"`
+
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
+	// publish to first delivery and delivery to FIN
+	QueueWaitLatency *quantile.Result `json:"queue_wait_latency"`
+	HandlerLatency   *quantile.Result `json:"handler_latency"`
+}
+
+// newLatencyStream returns a quantile of the latencies over the E2E processing
+// latency window, nil if no percentiles are configured
+func newLatencyStream(opts *Options) *quantile.Quantile {
+	if len(opts.E2EProcessingLatencyPercentiles) == 0 {
+		return nil
+	}
+	return quantile.New(opts.E2EProcessingLatencyWindowTime, opts.E2EProcessingLatencyPercentiles)
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) ChannelStats {
@@ -66,6 +100,8 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	c.deferredMutex.Lock()
 	deferred := len(c.deferredMessages)
 	c.deferredMutex.Unlock()
+	oldest := c.queueAges.oldestTimestamp()
+	oldestInFlight := c.oldestInFlightTimestamp()
 
 	return ChannelStats{
 		ChannelName:   c.name,
@@ -80,7 +116,15 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 		Clients:       clients,
 		Paused:        c.IsPaused(),
 
+		OldestMessageTimestamp:  oldest,
+		OldestInFlightTimestamp: oldestInFlight,
+		LagSeconds:              lagSeconds(time.Now(), oldest, oldestInFlight),
+
+		Rates: c.rateHistory.stats(false),
+
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
+		QueueWaitLatency:     c.queueWaitStream.Result(),
+		HandlerLatency:       c.handlerLatencyStream.Result(),
 	}
 }
 
@@ -106,57 +150,163 @@ type ChannelsByName struct {
 
 func (c ChannelsByName) Less(i, j int) bool { return c.Channels[i].name < c.Channels[j].name }
 
+// the orders of StatsFilter.SortBy, depth (of a topic and its channels) and rate
+// (published per second) are descending
+const (
+	SortByName  = "name"
+	SortByDepth = "depth"
+	SortByRate  = "rate"
+)
+
+// StatsFilter selects the topics and channels of GetFilteredStats, a topic is left
+// out when a channel filter is set and none of its channels match
+type StatsFilter struct {
+	Topic         string
+	Channel       string
+	TopicPrefix   string
+	ChannelPrefix string
+	TopicRegexp   *regexp.Regexp
+	ChannelRegexp *regexp.Regexp
+
+	SortBy string
+	Offset int
+	Limit  int // 0 for no limit
+
+	IncludeClients bool
+}
+
+func (f StatsFilter) matchTopic(name string) bool {
+	return (f.Topic == "" || name == f.Topic) &&
+		strings.HasPrefix(name, f.TopicPrefix) &&
+		(f.TopicRegexp == nil || f.TopicRegexp.MatchString(name))
+}
+
+func (f StatsFilter) matchChannel(name string) bool {
+	return (f.Channel == "" || name == f.Channel) &&
+		strings.HasPrefix(name, f.ChannelPrefix) &&
+		(f.ChannelRegexp == nil || f.ChannelRegexp.MatchString(name))
+}
+
+func (f StatsFilter) filtersChannels() bool {
+	return f.Channel != "" || f.ChannelPrefix != "" || f.ChannelRegexp != nil
+}
+
 func (n *NSQD) GetStats(topic string, channel string, includeClients bool) Stats {
+	return n.GetFilteredStats(StatsFilter{Topic: topic, Channel: channel, IncludeClients: includeClients})
+}
+
+// GetFilteredStats returns the stats of the topics selected by f, Stats.TotalTopics
+// is the number of them before the offset and limit are applied
+func (n *NSQD) GetFilteredStats(f StatsFilter) Stats {
 	var stats Stats
+	topic := f.Topic
+	includeClients := f.IncludeClients
 
 	n.RLock()
-	var realTopics []*Topic
+	var candidates []*Topic
 	if topic == "" {
-		realTopics = make([]*Topic, 0, len(n.topicMap))
+		candidates = make([]*Topic, 0, len(n.topicMap))
 		for _, t := range n.topicMap {
-			realTopics = append(realTopics, t)
+			candidates = append(candidates, t)
 		}
 	} else if val, exists := n.topicMap[topic]; exists {
-		realTopics = []*Topic{val}
+		candidates = []*Topic{val}
 	} else {
 		n.RUnlock()
 		return stats
 	}
 	n.RUnlock()
-	sort.Sort(TopicsByName{realTopics})
-
-	topics := make([]TopicStats, 0, len(realTopics))
 
-	for _, t := range realTopics {
+	type selectedTopic struct {
+		*Topic
+		channels []*Channel
+		depth    int64
+		rate     float64
+	}
+	selected := make([]selectedTopic, 0, len(candidates))
+	for _, t := range candidates {
+		if !f.matchTopic(t.name) {
+			continue
+		}
+		st := selectedTopic{Topic: t}
 		t.RLock()
-		var realChannels []*Channel
-		if channel == "" {
-			realChannels = make([]*Channel, 0, len(t.channelMap))
-			for _, c := range t.channelMap {
-				realChannels = append(realChannels, c)
+		for _, c := range t.channelMap {
+			if f.matchChannel(c.name) {
+				st.channels = append(st.channels, c)
 			}
-		} else if val, exists := t.channelMap[channel]; exists {
-			realChannels = []*Channel{val}
-		} else {
-			t.RUnlock()
-			continue
 		}
 		t.RUnlock()
-		sort.Sort(ChannelsByName{realChannels})
+		if len(st.channels) == 0 && f.filtersChannels() {
+			continue
+		}
+		switch f.SortBy {
+		case SortByDepth:
+			st.depth = t.Depth()
+			for _, c := range st.channels {
+				st.depth += c.Depth()
+			}
+		case SortByRate:
+			if r := t.rateHistory.stats(false); r != nil {
+				st.rate = r.Publish
+			}
+		}
+		selected = append(selected, st)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		a, b := selected[i], selected[j]
+		switch {
+		case f.SortBy == SortByDepth && a.depth != b.depth:
+			return a.depth > b.depth
+		case f.SortBy == SortByRate && a.rate != b.rate:
+			return a.rate > b.rate
+		}
+		return a.name < b.name
+	})
+
+	stats.TotalTopics = len(selected)
+	if f.Offset >= len(selected) {
+		selected = nil
+	} else {
+		selected = selected[f.Offset:]
+	}
+	if f.Limit > 0 && f.Limit < len(selected) {
+		selected = selected[:f.Limit]
+	}
+
+	topics := make([]TopicStats, 0, len(selected))
+
+	for _, st := range selected {
+		t := st.Topic
+		realChannels := st.channels
+		sortChannels(realChannels, f.SortBy)
 		channels := make([]ChannelStats, 0, len(realChannels))
 		for _, c := range realChannels {
 			var clients []ClientStats
 			var clientCount int
+			var pushSubscriptions []PushStats
 			c.RLock()
 			if includeClients {
 				clients = make([]ClientStats, 0, len(c.clients))
-				for _, client := range c.clients {
+			}
+			for _, client := range c.clients {
+				// push subscriptions are listed separately
+				if p, ok := client.(*pushConsumer); ok {
+					pushSubscriptions = append(pushSubscriptions, p.Stats(topic).(PushStats))
+					continue
+				}
+				if includeClients {
 					clients = append(clients, client.Stats(topic))
 				}
+				clientCount++
 			}
-			clientCount = len(c.clients)
 			c.RUnlock()
-			channels = append(channels, NewChannelStats(c, clients, clientCount))
+			sort.Slice(pushSubscriptions, func(i, j int) bool {
+				return pushSubscriptions[i].URL < pushSubscriptions[j].URL
+			})
+			channelStats := NewChannelStats(c, clients, clientCount)
+			channelStats.PushSubscriptions = pushSubscriptions
+			channels = append(channels, channelStats)
 		}
 		topics = append(topics, NewTopicStats(t, channels))
 	}
@@ -177,6 +327,40 @@ func (n *NSQD) GetStats(topic string, channel string, includeClients bool) Stats
 	return stats
 }
 
+// sortChannels orders the channels of a topic like the topics
+func sortChannels(channels []*Channel, sortBy string) {
+	switch sortBy {
+	case SortByDepth:
+		depths := make(map[*Channel]int64, len(channels))
+		for _, c := range channels {
+			depths[c] = c.Depth()
+		}
+		sort.Slice(channels, func(i, j int) bool {
+			a, b := channels[i], channels[j]
+			if depths[a] != depths[b] {
+				return depths[a] > depths[b]
+			}
+			return a.name < b.name
+		})
+	case SortByRate:
+		rates := make(map[*Channel]float64, len(channels))
+		for _, c := range channels {
+			if r := c.rateHistory.stats(false); r != nil {
+				rates[c] = r.Publish
+			}
+		}
+		sort.Slice(channels, func(i, j int) bool {
+			a, b := channels[i], channels[j]
+			if rates[a] != rates[b] {
+				return rates[a] > rates[b]
+			}
+			return a.name < b.name
+		})
+	default:
+		sort.Sort(ChannelsByName{channels})
+	}
+}
+
 type memStats struct {
 	HeapObjects       uint64 `json:"heap_objects"`
 	HeapIdleBytes     uint64 `json:"heap_idle_bytes"`
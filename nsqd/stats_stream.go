@@ -0,0 +1,302 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// how many events a GET /stats/stream connection can fall behind before it is dropped
+const statsFeedBuffer = 16
+
+// StatsDelta is what changed since the previous event of a GET /stats/stream
+// connection, the topics only have the channels that changed
+type StatsDelta struct {
+	Health          string           `json:"health,omitempty"`
+	Topics          []TopicStats     `json:"topics,omitempty"`
+	Producers       json.RawMessage  `json:"producers,omitempty"`
+	RemovedTopics   []string         `json:"removed_topics,omitempty"`
+	RemovedChannels []RemovedChannel `json:"removed_channels,omitempty"`
+}
+
+type RemovedChannel struct {
+	TopicName   string `json:"topic_name"`
+	ChannelName string `json:"channel_name"`
+}
+
+// statsStream keeps the stats last sent on a GET /stats/stream feed, as JSON without
+// the fields that change all the time (lag, rates and latencies) so that a change is
+// anything else the client would see differently
+type statsStream struct {
+	health    string
+	topics    map[string][]byte
+	channels  map[string]map[string][]byte
+	producers []byte
+}
+
+func newStatsStream() *statsStream {
+	return &statsStream{
+		topics:   make(map[string][]byte),
+		channels: make(map[string]map[string][]byte),
+	}
+}
+
+// delta returns what changed since the previous call and whether anything did
+func (s *statsStream) delta(stats Stats, health string) (StatsDelta, bool, error) {
+	var d StatsDelta
+	changed := false
+
+	if health != s.health {
+		d.Health = health
+		s.health = health
+		changed = true
+	}
+
+	seen := make(map[string]bool, len(stats.Topics))
+	for _, t := range stats.Topics {
+		seen[t.TopicName] = true
+
+		channels := t.Channels
+		t.Channels = nil
+		data, err := json.Marshal(stableTopicStats(t))
+		if err != nil {
+			return d, false, err
+		}
+		topicChanged := !bytes.Equal(data, s.topics[t.TopicName])
+		s.topics[t.TopicName] = data
+
+		prev := s.channels[t.TopicName]
+		next := make(map[string][]byte, len(channels))
+		for _, c := range channels {
+			data, err := json.Marshal(stableChannelStats(c))
+			if err != nil {
+				return d, false, err
+			}
+			next[c.ChannelName] = data
+			if !bytes.Equal(data, prev[c.ChannelName]) {
+				t.Channels = append(t.Channels, c)
+			}
+		}
+		var removed []string
+		for name := range prev {
+			if _, ok := next[name]; !ok {
+				removed = append(removed, name)
+			}
+		}
+		sort.Strings(removed)
+		for _, name := range removed {
+			d.RemovedChannels = append(d.RemovedChannels, RemovedChannel{t.TopicName, name})
+		}
+		s.channels[t.TopicName] = next
+
+		if topicChanged || len(t.Channels) > 0 {
+			if t.Channels == nil {
+				t.Channels = []ChannelStats{}
+			}
+			d.Topics = append(d.Topics, t)
+		}
+	}
+	for name := range s.topics {
+		if !seen[name] {
+			d.RemovedTopics = append(d.RemovedTopics, name)
+			delete(s.topics, name)
+			delete(s.channels, name)
+		}
+	}
+	sort.Strings(d.RemovedTopics)
+
+	if stats.Producers == nil {
+		stats.Producers = []ClientStats{}
+	}
+	producers, err := json.Marshal(stats.Producers)
+	if err != nil {
+		return d, false, err
+	}
+	if !bytes.Equal(producers, s.producers) {
+		d.Producers = producers
+		s.producers = producers
+	}
+
+	changed = changed || len(d.Topics) > 0 || d.Producers != nil ||
+		len(d.RemovedTopics) > 0 || len(d.RemovedChannels) > 0
+	return d, changed, nil
+}
+
+// stableTopicStats returns t without the fields that change on every interval
+func stableTopicStats(t TopicStats) TopicStats {
+	t.Rates = nil
+	t.E2eProcessingLatency = nil
+	return t
+}
+
+// stableChannelStats returns c without the fields that change on every interval
+func stableChannelStats(c ChannelStats) ChannelStats {
+	c.LagSeconds = 0
+	c.Rates = nil
+	c.E2eProcessingLatency = nil
+	c.QueueWaitLatency = nil
+	c.HandlerLatency = nil
+	return c
+}
+
+// statsFeed computes the deltas of a GET /stats/stream filter and interval once per
+// interval and sends them to all the connections that asked for the same
+type statsFeed struct {
+	nsqd     *NSQD
+	key      string
+	filter   StatsFilter
+	interval time.Duration
+	exitChan chan struct{}
+
+	sync.Mutex
+	stream      *statsStream
+	stats       Stats
+	health      string
+	subscribers map[chan []byte]struct{}
+}
+
+// subscribeStats returns the feed for key (created if there is none), the "snapshot"
+// event to start a connection with and a channel of the events that follow it,
+// closed if the connection falls behind
+func (n *NSQD) subscribeStats(key string, filter StatsFilter, interval time.Duration) (*statsFeed, []byte, chan []byte, error) {
+	n.statsFeedsMutex.Lock()
+	defer n.statsFeedsMutex.Unlock()
+
+	f, ok := n.statsFeeds[key]
+	if !ok {
+		f = &statsFeed{
+			nsqd:        n,
+			key:         key,
+			filter:      filter,
+			interval:    interval,
+			exitChan:    make(chan struct{}),
+			stream:      newStatsStream(),
+			stats:       n.GetFilteredStats(filter),
+			health:      n.GetHealth(),
+			subscribers: make(map[chan []byte]struct{}),
+		}
+		if _, _, err := f.stream.delta(f.stats, f.health); err != nil {
+			return nil, nil, nil, err
+		}
+		n.statsFeeds[key] = f
+		n.waitGroup.Wrap(f.loop)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	snapshot, err := encodeStatsEvent("snapshot", struct {
+		Version     string        `json:"version"`
+		Health      string        `json:"health"`
+		StartTime   int64         `json:"start_time"`
+		Topics      []TopicStats  `json:"topics"`
+		Producers   []ClientStats `json:"producers"`
+		TotalTopics int           `json:"total_topics"`
+	}{version.Binary, f.health, n.GetStartTime().Unix(), f.stats.Topics, f.stats.Producers, f.stats.TotalTopics})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	events := make(chan []byte, statsFeedBuffer)
+	f.subscribers[events] = struct{}{}
+	return f, snapshot, events, nil
+}
+
+// unsubscribeStats stops sending the events of f to events, and stops f with its
+// last subscriber
+func (n *NSQD) unsubscribeStats(f *statsFeed, events chan []byte) {
+	n.statsFeedsMutex.Lock()
+	defer n.statsFeedsMutex.Unlock()
+
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.subscribers[events]; ok {
+		delete(f.subscribers, events)
+		close(events)
+	}
+	if len(f.subscribers) == 0 && n.statsFeeds[f.key] == f {
+		delete(n.statsFeeds, f.key)
+		close(f.exitChan)
+	}
+}
+
+func (f *statsFeed) loop() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.exitChan:
+			return
+		case <-f.nsqd.exitChan:
+			return
+		}
+
+		if err := f.tick(); err != nil {
+			f.nsqd.logf(LOG_ERROR, "failed to compute stats delta - %s", err)
+			f.stop()
+			return
+		}
+	}
+}
+
+// stop removes a feed that failed, its subscribers get a new one if they come back
+func (f *statsFeed) stop() {
+	n := f.nsqd
+	n.statsFeedsMutex.Lock()
+	defer n.statsFeedsMutex.Unlock()
+	if n.statsFeeds[f.key] == f {
+		delete(n.statsFeeds, f.key)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for events := range f.subscribers {
+		delete(f.subscribers, events)
+		close(events)
+	}
+}
+
+func (f *statsFeed) tick() error {
+	f.Lock()
+	defer f.Unlock()
+
+	stats := f.nsqd.GetFilteredStats(f.filter)
+	health := f.nsqd.GetHealth()
+	d, changed, err := f.stream.delta(stats, health)
+	if err != nil {
+		return err
+	}
+	f.stats = stats
+	f.health = health
+
+	// a comment, so that a connection that went away is noticed
+	event := []byte(":\n\n")
+	if changed {
+		event, err = encodeStatsEvent("delta", d)
+		if err != nil {
+			return err
+		}
+	}
+	for events := range f.subscribers {
+		select {
+		case events <- event:
+		default:
+			// too far behind, it has to start over with a new snapshot
+			delete(f.subscribers, events)
+			close(events)
+		}
+	}
+	return nil
+}
+
+func encodeStatsEvent(event string, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)), nil
+}
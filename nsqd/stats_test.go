@@ -1,16 +1,23 @@
 package nsqd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/snappy"
+	"github.com/nsqio/go-nsq"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/statsd"
 	"github.com/nsqio/nsq/internal/test"
 )
 
@@ -158,3 +165,378 @@ func TestStatsChannelLocking(t *testing.T) {
 	test.Equal(t, 1, len(stats[0].Channels))
 	test.Equal(t, 25, stats[0].Channels[0].InFlightCount)
 }
+
+func TestChannelLag(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_lag" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	channelStats := func() ChannelStats {
+		return nsqd.GetStats(topicName, "ch", false).Topics[0].Channels[0]
+	}
+
+	cs := channelStats()
+	test.Equal(t, int64(0), cs.OldestMessageTimestamp)
+	test.Equal(t, 0.0, cs.LagSeconds)
+
+	old := time.Now().Add(-time.Minute)
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	msg.Timestamp = old.UnixNano()
+	channel.PutMessage(msg)
+	msg = NewMessage(topic.GenerateID(), []byte("test body"))
+	channel.PutMessage(msg)
+
+	cs = channelStats()
+	test.Equal(t, old.Unix()*int64(time.Second), cs.OldestMessageTimestamp)
+	test.Equal(t, int64(0), cs.OldestInFlightTimestamp)
+	test.Equal(t, true, cs.LagSeconds >= 60)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, _ := nsq.ReadResponse(conn)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, old.UnixNano(), msgOut.Timestamp)
+
+	// the oldest message is now in flight
+	cs = channelStats()
+	test.Equal(t, msg.Timestamp/int64(time.Second)*int64(time.Second), cs.OldestMessageTimestamp)
+	test.Equal(t, old.UnixNano(), cs.OldestInFlightTimestamp)
+	test.Equal(t, true, cs.LagSeconds >= 60)
+
+	_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+	test.Nil(t, err)
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+	resp, _ = nsq.ReadResponse(conn)
+	_, data, _ = nsq.UnpackResponse(resp)
+	msgOut, _ = decodeMessage(data)
+	_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		cs = channelStats()
+		if cs.InFlightCount == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), cs.OldestMessageTimestamp)
+	test.Equal(t, int64(0), cs.OldestInFlightTimestamp)
+	test.Equal(t, 0.0, cs.LagSeconds)
+}
+
+func TestQueueAgesUnknown(t *testing.T) {
+	// two messages were in the backend at startup
+	q := newQueueAges(2)
+	test.Equal(t, int64(0), q.oldestTimestamp())
+
+	now := time.Now().UnixNano()
+	q.add(now)
+	q.remove(now - int64(time.Hour))
+	test.Equal(t, now-int64(time.Hour), q.oldestTimestamp())
+	q.remove(now - int64(time.Hour) + 1)
+	test.Equal(t, now/int64(time.Second)*int64(time.Second), q.oldestTimestamp())
+	q.remove(now)
+	test.Equal(t, int64(0), q.oldestTimestamp())
+}
+
+func TestChannelLatency(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.E2EProcessingLatencyPercentiles = []float64{0.5}
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_latency" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	msg.Timestamp = time.Now().Add(-2 * time.Second).UnixNano()
+	topic.GetChannel("ch").PutMessage(msg)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, _ := nsq.ReadResponse(conn)
+	_, data, _ := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	time.Sleep(50 * time.Millisecond)
+	_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+	test.Nil(t, err)
+
+	var cs ChannelStats
+	for i := 0; i < 100; i++ {
+		cs = nsqd.GetStats(topicName, "ch", true).Topics[0].Channels[0]
+		if cs.HandlerLatency.Count == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 1, cs.QueueWaitLatency.Count)
+	test.Equal(t, 1, cs.HandlerLatency.Count)
+	queueWait := cs.QueueWaitLatency.Percentiles[0]["value"]
+	handler := cs.HandlerLatency.Percentiles[0]["value"]
+	test.Equal(t, true, queueWait >= float64(2*time.Second))
+	test.Equal(t, true, handler >= float64(50*time.Millisecond) && handler < float64(2*time.Second))
+
+	client := cs.Clients[0].(ClientV2Stats)
+	test.Equal(t, 1, client.QueueWaitLatency.Count)
+	test.Equal(t, 1, client.HandlerLatency.Count)
+	test.Equal(t, true, client.QueueWaitLatency.Percentiles[0]["value"] >= float64(2*time.Second))
+	test.Equal(t, true, client.HandlerLatency.Percentiles[0]["value"] >= float64(50*time.Millisecond))
+}
+
+func TestStatsFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// without channels the messages stay queued at the topics
+	for name, depth := range map[string]int{"filter_a.1": 1, "filter_a.2": 3, "filter_b": 2} {
+		topic := nsqd.GetTopic(name)
+		for i := 0; i < depth; i++ {
+			topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+		}
+	}
+	topic := nsqd.GetTopic("filter_c")
+	topic.GetChannel("keep")
+	topic.GetChannel("drop")
+
+	names := func(stats Stats) []string {
+		var names []string
+		for _, ts := range stats.Topics {
+			names = append(names, ts.TopicName)
+		}
+		return names
+	}
+
+	stats := nsqd.GetFilteredStats(StatsFilter{TopicPrefix: "filter_a"})
+	test.Equal(t, []string{"filter_a.1", "filter_a.2"}, names(stats))
+	test.Equal(t, 2, stats.TotalTopics)
+
+	stats = nsqd.GetFilteredStats(StatsFilter{TopicRegexp: regexp.MustCompile(`^filter_(a\.2|b)$`)})
+	test.Equal(t, []string{"filter_a.2", "filter_b"}, names(stats))
+
+	stats = nsqd.GetFilteredStats(StatsFilter{SortBy: SortByDepth})
+	test.Equal(t, []string{"filter_a.2", "filter_b", "filter_a.1", "filter_c"}, names(stats))
+
+	stats = nsqd.GetFilteredStats(StatsFilter{SortBy: SortByDepth, Offset: 1, Limit: 2})
+	test.Equal(t, []string{"filter_b", "filter_a.1"}, names(stats))
+	test.Equal(t, 4, stats.TotalTopics)
+
+	stats = nsqd.GetFilteredStats(StatsFilter{Offset: 10})
+	test.Equal(t, 0, len(stats.Topics))
+	test.Equal(t, 4, stats.TotalTopics)
+
+	stats = nsqd.GetFilteredStats(StatsFilter{ChannelPrefix: "ke"})
+	test.Equal(t, []string{"filter_c"}, names(stats))
+	test.Equal(t, 1, len(stats.Topics[0].Channels))
+	test.Equal(t, "keep", stats.Topics[0].Channels[0].ChannelName)
+
+	var resp struct {
+		Topics      []TopicStats `json:"topics"`
+		TotalTopics int          `json:"total_topics"`
+	}
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	err := client.GETV1(fmt.Sprintf("http://%s/stats?format=json&top=1", httpAddr), &resp)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(resp.Topics))
+	test.Equal(t, "filter_a.2", resp.Topics[0].TopicName)
+	test.Equal(t, 4, resp.TotalTopics)
+
+	err = client.GETV1(fmt.Sprintf("http://%s/stats?format=json&sort=size", httpAddr), &resp)
+	test.NotNil(t, err)
+	err = client.GETV1(fmt.Sprintf("http://%s/stats?format=json&topic_regex=(", httpAddr), &resp)
+	test.NotNil(t, err)
+}
+
+func TestStatsStreamDelta(t *testing.T) {
+	stream := newStatsStream()
+	stats := Stats{Topics: []TopicStats{{
+		TopicName: "t",
+		Channels:  []ChannelStats{{ChannelName: "c"}},
+	}}}
+	_, changed, err := stream.delta(stats, "OK")
+	test.Nil(t, err)
+	test.Equal(t, true, changed)
+
+	// lag, rates and latencies change all the time, they are not a change on their own
+	stats.Topics[0].Rates = &RateStats{Publish: 10}
+	stats.Topics[0].Channels = []ChannelStats{{
+		ChannelName: "c",
+		LagSeconds:  1.5,
+		Rates:       &RateStats{Deliver: 10},
+	}}
+	_, changed, err = stream.delta(stats, "OK")
+	test.Nil(t, err)
+	test.Equal(t, false, changed)
+
+	stats.Topics[0].Channels[0].Depth = 1
+	d, changed, err := stream.delta(stats, "OK")
+	test.Nil(t, err)
+	test.Equal(t, true, changed)
+	test.Equal(t, 1, len(d.Topics))
+	test.Equal(t, 1.5, d.Topics[0].Channels[0].LagSeconds)
+}
+
+func TestStatsdFormats(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer udpConn.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer tcpListener.Close()
+
+	// readLines returns the lines of the first push with a channel depth
+	readLines := func(format string) []string {
+		var buf bytes.Buffer
+		if format == statsd.FormatGraphite {
+			conn, err := tcpListener.Accept()
+			test.Nil(t, err)
+			defer conn.Close()
+			io.Copy(&buf, conn)
+		} else {
+			b := make([]byte, 65536)
+			udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for !strings.Contains(buf.String(), "channel") || !strings.HasSuffix(buf.String(), "\n") {
+				n, _, err := udpConn.ReadFrom(b)
+				test.Nil(t, err)
+				buf.Write(b[:n])
+			}
+		}
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+
+	for _, format := range []string{statsd.FormatDogStatsd, statsd.FormatGraphite} {
+		opts := NewOptions()
+		opts.Logger = test.NewTestLogger(t)
+		opts.StatsdAddress = udpConn.LocalAddr().String()
+		if format == statsd.FormatGraphite {
+			opts.StatsdAddress = tcpListener.Addr().String()
+		}
+		opts.StatsdFormat = format
+		opts.StatsdPrefix = "nsq."
+		// UDP packets are spread over the interval less a second
+		opts.StatsdInterval = 1100 * time.Millisecond
+		if format == statsd.FormatGraphite {
+			opts.StatsdInterval = 100 * time.Millisecond
+		}
+		opts.StatsdMemStats = false
+		opts.StatsdTopicRegexps = []string{"^keep"}
+		opts.StatsdExcludeMetrics = []string{"channel.e2e_processing_latency"}
+		opts.E2EProcessingLatencyPercentiles = []float64{0.99}
+		_, _, nsqd := mustStartNSQD(opts)
+
+		nsqd.GetTopic("keep_topic").GetChannel("ch")
+		nsqd.GetTopic("drop_topic").GetChannel("ch")
+
+		lines := readLines(format)
+		nsqd.Exit()
+		os.RemoveAll(opts.DataPath)
+
+		node := net.JoinHostPort(nsqd.getOpts().BroadcastAddress, strconv.Itoa(nsqd.getOpts().BroadcastHTTPPort))
+		var found bool
+		for _, line := range lines {
+			test.Equal(t, false, strings.Contains(line, "drop_topic"))
+			test.Equal(t, false, strings.Contains(line, "e2e_processing_latency") && strings.Contains(line, "channel"))
+			switch format {
+			case statsd.FormatDogStatsd:
+				if line == "nsq.channel.depth:0|g|#node:"+node+",topic:keep_topic,channel:ch" {
+					found = true
+				}
+			case statsd.FormatGraphite:
+				if strings.HasPrefix(line, "nsq.topic.keep_topic.channel.ch.depth 0 ") {
+					found = true
+				}
+			}
+		}
+		test.Equal(t, true, found)
+	}
+}
+
+func TestStatsdReload(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.Nil(t, err)
+	defer tcpListener.Close()
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.StatsdFormat = statsd.FormatGraphite
+	opts.StatsdInterval = 100 * time.Millisecond
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// the stats are pushed once an address is set
+	newOpts := nsqd.configOpts
+	newOpts.StatsdAddress = tcpListener.Addr().String()
+	result, err := nsqd.Reload(&newOpts)
+	test.Nil(t, err)
+	test.Equal(t, []string{"statsd-address"}, result.Reloaded)
+
+	tcpListener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := tcpListener.Accept()
+	test.Nil(t, err)
+	conn.Close()
+
+	// and no longer once it is unset
+	newOpts.StatsdAddress = ""
+	_, err = nsqd.Reload(&newOpts)
+	test.Nil(t, err)
+	// pushes can be under way or waiting to be accepted
+	time.Sleep(200 * time.Millisecond)
+	for {
+		tcpListener.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Millisecond))
+		conn, err := tcpListener.Accept()
+		if err != nil {
+			break
+		}
+		conn.Close()
+	}
+	tcpListener.(*net.TCPListener).SetDeadline(time.Now().Add(500 * time.Millisecond))
+	_, err = tcpListener.Accept()
+	test.NotNil(t, err)
+}
+
+func TestStatsFeedStop(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	f, _, events, err := nsqd.subscribeStats("key", StatsFilter{}, time.Second)
+	test.Nil(t, err)
+
+	// a feed that failed is not joined by the next subscribers
+	f.stop()
+	_, ok := <-events
+	test.Equal(t, false, ok)
+	nsqd.unsubscribeStats(f, events)
+
+	f2, _, events, err := nsqd.subscribeStats("key", StatsFilter{}, time.Second)
+	test.Nil(t, err)
+	test.Equal(t, true, f2 != f)
+	nsqd.unsubscribeStats(f2, events)
+	test.Equal(t, 0, len(nsqd.statsFeeds))
+}
@@ -1,12 +1,17 @@
 package nsqd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"math"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/statsd"
 	"github.com/nsqio/nsq/internal/writers"
 )
@@ -25,6 +30,64 @@ func (s Uint64Slice) Less(i, j int) bool {
 	return s[i] < s[j]
 }
 
+// statsdMetrics names the metrics of one push for --statsd-format, the topic and
+// channel are part of the key with statsd and graphite and tags with dogstatsd
+type statsdMetrics struct {
+	client  *statsd.Client
+	tagged  bool
+	node    string
+	exclude []string
+}
+
+// key returns the key and tags of a metric, name is the metric without the topic and
+// channel (eg. channel.depth) and is what --statsd-exclude-metric matches
+func (m *statsdMetrics) key(name string, topic string, channel string) (string, []statsd.Tag, bool) {
+	for _, prefix := range m.exclude {
+		if strings.HasPrefix(name, prefix) {
+			return "", nil, false
+		}
+	}
+	if m.tagged {
+		tags := []statsd.Tag{{Key: "node", Value: m.node}}
+		if topic != "" {
+			tags = append(tags, statsd.Tag{Key: "topic", Value: topic})
+		}
+		if channel != "" {
+			tags = append(tags, statsd.Tag{Key: "channel", Value: channel})
+		}
+		return name, tags, true
+	}
+	switch {
+	case channel != "":
+		return fmt.Sprintf("topic.%s.channel.%s.%s", topic, channel, strings.TrimPrefix(name, "channel.")), nil, true
+	case topic != "":
+		return fmt.Sprintf("topic.%s.%s", topic, strings.TrimPrefix(name, "topic.")), nil, true
+	}
+	return name, nil, true
+}
+
+func (m *statsdMetrics) gauge(name string, topic string, channel string, value int64) {
+	if key, tags, ok := m.key(name, topic, channel); ok {
+		m.client.Gauge(key, value, tags...)
+	}
+}
+
+func (m *statsdMetrics) incr(name string, topic string, channel string, count int64) {
+	if key, tags, ok := m.key(name, topic, channel); ok {
+		m.client.Incr(key, count, tags...)
+	}
+}
+
+func (m *statsdMetrics) percentiles(name string, topic string, channel string, r *quantile.Result) {
+	for _, item := range r.Percentiles {
+		// We can cast the value to int64 since a value of 1 is the
+		// minimum resolution we will have, so there is no loss of
+		// accuracy
+		m.gauge(fmt.Sprintf("%s_%.0f", name, item["quantile"]*100.0), topic, channel, int64(item["value"]))
+	}
+}
+
+// statsdLoop runs even without a --statsd-address so that one can be set by Reload
 func (n *NSQD) statsdLoop() {
 	var lastMemStats memStats
 	var lastStats Stats
@@ -35,25 +98,64 @@ func (n *NSQD) statsdLoop() {
 		case <-n.exitChan:
 			goto exit
 		case <-ticker.C:
-			addr := n.getOpts().StatsdAddress
-			prefix := n.getOpts().StatsdPrefix
-			excludeEphemeral := n.getOpts().StatsdExcludeEphemeral
-			conn, err := net.DialTimeout("udp", addr, time.Second)
-			if err != nil {
-				n.logf(LOG_ERROR, "failed to create UDP socket to statsd(%s)", addr)
+			opts := n.getOpts()
+			addr := opts.StatsdAddress
+			if addr == "" {
+				// the counts start over if it is set again
+				lastStats = Stats{}
+				lastMemStats = memStats{}
 				continue
 			}
-			sw := writers.NewSpreadWriter(conn, interval-time.Second, n.exitChan)
-			bw := writers.NewBoundaryBufferedWriter(sw, n.getOpts().StatsdUDPPacketSize)
-			client := statsd.NewClient(bw, prefix)
+			format := opts.StatsdFormat
+			excludeEphemeral := opts.StatsdExcludeEphemeral
+			// validated with the options
+			topicRegexps, _ := compileRegexps(opts.StatsdTopicRegexps)
+
+			var w io.Writer
+			var flush func()
+			var conn net.Conn
+			var err error
+			if format == statsd.FormatGraphite {
+				conn, err = net.DialTimeout("tcp", addr, time.Second)
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to connect to graphite(%s) - %s", addr, err)
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(interval))
+				bw := bufio.NewWriter(conn)
+				w = bw
+				flush = func() { bw.Flush() }
+			} else {
+				conn, err = net.DialTimeout("udp", addr, time.Second)
+				if err != nil {
+					n.logf(LOG_ERROR, "failed to create UDP socket to statsd(%s)", addr)
+					continue
+				}
+				sw := writers.NewSpreadWriter(conn, interval-time.Second, n.exitChan)
+				bw := writers.NewBoundaryBufferedWriter(sw, opts.StatsdUDPPacketSize)
+				w = bw
+				flush = func() {
+					bw.Flush()
+					sw.Flush()
+				}
+			}
+			m := &statsdMetrics{
+				client:  statsd.NewFormatClient(w, opts.StatsdPrefix, format),
+				tagged:  format == statsd.FormatDogStatsd,
+				node:    net.JoinHostPort(opts.BroadcastAddress, strconv.Itoa(opts.BroadcastHTTPPort)),
+				exclude: opts.StatsdExcludeMetrics,
+			}
 
-			n.logf(LOG_INFO, "STATSD: pushing stats to %s", addr)
+			n.logComponentf(LOG_INFO, "STATSD", "pushing stats to %s", addr)
 
 			stats := n.GetStats("", "", false)
 			for _, topic := range stats.Topics {
 				if excludeEphemeral && strings.HasSuffix(topic.TopicName, "#ephemeral") {
 					continue
 				}
+				if len(topicRegexps) > 0 && !matchesAny(topic.TopicName, topicRegexps) {
+					continue
+				}
 
 				// try to find the topic in the last collection
 				lastTopic := TopicStats{}
@@ -63,27 +165,12 @@ func (n *NSQD) statsdLoop() {
 						break
 					}
 				}
-				diff := topic.MessageCount - lastTopic.MessageCount
-				stat := fmt.Sprintf("topic.%s.message_count", topic.TopicName)
-				client.Incr(stat, int64(diff))
-
-				diff = topic.MessageBytes - lastTopic.MessageBytes
-				stat = fmt.Sprintf("topic.%s.message_bytes", topic.TopicName)
-				client.Incr(stat, int64(diff))
-
-				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
-				client.Gauge(stat, topic.Depth)
-
-				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
-				client.Gauge(stat, topic.BackendDepth)
-
-				for _, item := range topic.E2eProcessingLatency.Percentiles {
-					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
-					// We can cast the value to int64 since a value of 1 is the
-					// minimum resolution we will have, so there is no loss of
-					// accuracy
-					client.Gauge(stat, int64(item["value"]))
-				}
+				t := topic.TopicName
+				m.incr("topic.message_count", t, "", int64(topic.MessageCount-lastTopic.MessageCount))
+				m.incr("topic.message_bytes", t, "", int64(topic.MessageBytes-lastTopic.MessageBytes))
+				m.gauge("topic.depth", t, "", topic.Depth)
+				m.gauge("topic.backend_depth", t, "", topic.BackendDepth)
+				m.percentiles("topic.e2e_processing_latency", t, "", topic.E2eProcessingLatency)
 
 				for _, channel := range topic.Channels {
 					if excludeEphemeral && strings.HasSuffix(channel.ChannelName, "#ephemeral") {
@@ -98,66 +185,56 @@ func (n *NSQD) statsdLoop() {
 							break
 						}
 					}
-					diff := channel.MessageCount - lastChannel.MessageCount
-					stat := fmt.Sprintf("topic.%s.channel.%s.message_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
-
-					stat = fmt.Sprintf("topic.%s.channel.%s.depth", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, channel.Depth)
-
-					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, channel.BackendDepth)
-
-					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.InFlightCount))
-
-					stat = fmt.Sprintf("topic.%s.channel.%s.deferred_count", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.DeferredCount))
-
-					diff = channel.RequeueCount - lastChannel.RequeueCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.requeue_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
-
-					diff = channel.TimeoutCount - lastChannel.TimeoutCount
-					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
-					client.Incr(stat, int64(diff))
-
-					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
-					client.Gauge(stat, int64(channel.ClientCount))
-
-					for _, item := range channel.E2eProcessingLatency.Percentiles {
-						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", topic.TopicName, channel.ChannelName, item["quantile"]*100.0)
-						client.Gauge(stat, int64(item["value"]))
-					}
+					c := channel.ChannelName
+					m.incr("channel.message_count", t, c, int64(channel.MessageCount-lastChannel.MessageCount))
+					m.gauge("channel.depth", t, c, channel.Depth)
+					m.gauge("channel.backend_depth", t, c, channel.BackendDepth)
+					m.gauge("channel.in_flight_count", t, c, int64(channel.InFlightCount))
+					m.gauge("channel.deferred_count", t, c, int64(channel.DeferredCount))
+					m.incr("channel.requeue_count", t, c, int64(channel.RequeueCount-lastChannel.RequeueCount))
+					m.incr("channel.timeout_count", t, c, int64(channel.TimeoutCount-lastChannel.TimeoutCount))
+					m.gauge("channel.clients", t, c, int64(channel.ClientCount))
+					m.gauge("channel.lag_seconds", t, c, int64(channel.LagSeconds))
+					m.percentiles("channel.e2e_processing_latency", t, c, channel.E2eProcessingLatency)
+					m.percentiles("channel.queue_wait_latency", t, c, channel.QueueWaitLatency)
+					m.percentiles("channel.handler_latency", t, c, channel.HandlerLatency)
 				}
 			}
 			lastStats = stats
 
-			if n.getOpts().StatsdMemStats {
+			if opts.StatsdMemStats {
 				ms := getMemStats()
 
-				client.Gauge("mem.heap_objects", int64(ms.HeapObjects))
-				client.Gauge("mem.heap_idle_bytes", int64(ms.HeapIdleBytes))
-				client.Gauge("mem.heap_in_use_bytes", int64(ms.HeapInUseBytes))
-				client.Gauge("mem.heap_released_bytes", int64(ms.HeapReleasedBytes))
-				client.Gauge("mem.gc_pause_usec_100", int64(ms.GCPauseUsec100))
-				client.Gauge("mem.gc_pause_usec_99", int64(ms.GCPauseUsec99))
-				client.Gauge("mem.gc_pause_usec_95", int64(ms.GCPauseUsec95))
-				client.Gauge("mem.next_gc_bytes", int64(ms.NextGCBytes))
-				client.Incr("mem.gc_runs", int64(ms.GCTotalRuns-lastMemStats.GCTotalRuns))
+				m.gauge("mem.heap_objects", "", "", int64(ms.HeapObjects))
+				m.gauge("mem.heap_idle_bytes", "", "", int64(ms.HeapIdleBytes))
+				m.gauge("mem.heap_in_use_bytes", "", "", int64(ms.HeapInUseBytes))
+				m.gauge("mem.heap_released_bytes", "", "", int64(ms.HeapReleasedBytes))
+				m.gauge("mem.gc_pause_usec_100", "", "", int64(ms.GCPauseUsec100))
+				m.gauge("mem.gc_pause_usec_99", "", "", int64(ms.GCPauseUsec99))
+				m.gauge("mem.gc_pause_usec_95", "", "", int64(ms.GCPauseUsec95))
+				m.gauge("mem.next_gc_bytes", "", "", int64(ms.NextGCBytes))
+				m.incr("mem.gc_runs", "", "", int64(ms.GCTotalRuns-lastMemStats.GCTotalRuns))
 
 				lastMemStats = ms
 			}
 
-			bw.Flush()
-			sw.Flush()
+			flush()
 			conn.Close()
 		}
 	}
 
 exit:
 	ticker.Stop()
-	n.logf(LOG_INFO, "STATSD: closing")
+	n.logComponentf(LOG_INFO, "STATSD", "closing")
+}
+
+func matchesAny(name string, regexps []*regexp.Regexp) bool {
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
 }
 
 func percentile(perc float64, arr []uint64, length int) uint64 {
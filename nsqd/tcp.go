@@ -5,6 +5,7 @@ import (
 	"net"
 	"sync"
 
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/protocol"
 )
 
@@ -24,7 +25,10 @@ type tcpServer struct {
 }
 
 func (p *tcpServer) Handle(conn net.Conn) {
-	p.nsqd.logf(LOG_INFO, "TCP: new client(%s)", conn.RemoteAddr())
+	addr := conn.RemoteAddr().String()
+	fields := lg.Fields{Component: "CLIENT", Client: addr, RemoteAddress: addr}
+	p.nsqd.logFields(LOG_INFO, lg.Fields{Component: "TCP", Client: addr, RemoteAddress: addr},
+		"TCP: new client(%s)", addr)
 
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
@@ -32,14 +36,13 @@ func (p *tcpServer) Handle(conn net.Conn) {
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		p.nsqd.logf(LOG_ERROR, "failed to read protocol version - %s", err)
+		p.nsqd.logFields(LOG_ERROR, fields, "failed to read protocol version - %s", err)
 		conn.Close()
 		return
 	}
 	protocolMagic := string(buf)
 
-	p.nsqd.logf(LOG_INFO, "CLIENT(%s): desired protocol magic '%s'",
-		conn.RemoteAddr(), protocolMagic)
+	p.nsqd.logFields(LOG_INFO, fields, "CLIENT(%s): desired protocol magic '%s'", addr, protocolMagic)
 
 	var prot protocol.Protocol
 	switch protocolMagic {
@@ -48,8 +51,7 @@ func (p *tcpServer) Handle(conn net.Conn) {
 	default:
 		protocol.SendFramedResponse(conn, frameTypeError, []byte("E_BAD_PROTOCOL"))
 		conn.Close()
-		p.nsqd.logf(LOG_ERROR, "client(%s) bad protocol magic '%s'",
-			conn.RemoteAddr(), protocolMagic)
+		p.nsqd.logFields(LOG_ERROR, fields, "client(%s) bad protocol magic '%s'", addr, protocolMagic)
 		return
 	}
 
@@ -58,7 +60,7 @@ func (p *tcpServer) Handle(conn net.Conn) {
 
 	err = prot.IOLoop(client)
 	if err != nil {
-		p.nsqd.logf(LOG_ERROR, "client(%s) - %s", conn.RemoteAddr(), err)
+		p.nsqd.logFields(LOG_ERROR, fields, "client(%s) - %s", addr, err)
 	}
 
 	p.conns.Delete(conn.RemoteAddr())
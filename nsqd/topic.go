@@ -2,21 +2,25 @@ package nsqd
 
 import (
 	"errors"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/nsqio/go-diskqueue"
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/util"
 )
 
 type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	messageCount uint64
-	messageBytes uint64
+	messageCount           uint64
+	messageBytes           uint64
+	validationFailureCount uint64
+
+	// time (in ns) of the last publish or channel deletion (see idle.go)
+	lastActivity int64
 
 	sync.RWMutex
 
@@ -30,14 +34,26 @@ type Topic struct {
 	waitGroup         util.WaitGroupWrapper
 	exitFlag          int32
 	idFactory         *guidFactory
+	rateHistory       *rateHistory
 
 	ephemeral      bool
+	replicated     bool // matches --replicate-topic-regex (see replication.go)
 	deleteCallback func(*Topic)
 	deleter        sync.Once
 
 	paused    int32
 	pauseChan chan int
 
+	schema atomic.Value // *topicSchema
+	routes atomic.Value // []*route
+
+	// messages of a failed multi-topic publish (see PutMultiTopicMessages)
+	abortedMutex sync.Mutex
+	abortedMsgs  map[MessageID]struct{}
+	abortedCount int32
+	// multi-topic publishes holding or waiting for the lock
+	pendingMTPUBs int32
+
 	nsqd *NSQD
 }
 
@@ -55,15 +71,16 @@ func NewTopic(topicName string, nsqd *NSQD, deleteCallback func(*Topic)) *Topic
 		pauseChan:         make(chan int),
 		deleteCallback:    deleteCallback,
 		idFactory:         NewGUIDFactory(nsqd.getOpts().ID),
+		abortedMsgs:       make(map[MessageID]struct{}),
+		lastActivity:      time.Now().UnixNano(),
+		rateHistory:       newRateHistory(nsqd.getOpts()),
 	}
 	if strings.HasSuffix(topicName, "#ephemeral") {
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
+		dqLogf := nsqd.diskQueueLogf(topicName, "")
+		t.replicated = nsqd.replicatesTopic(topicName)
 		t.backend = diskqueue.New(
 			topicName,
 			nsqd.getOpts().DataPath,
@@ -109,6 +126,9 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 		case t.channelUpdateChan <- 1:
 		case <-t.exitChan:
 		}
+		if channel.replicated {
+			t.nsqd.replicate(replicationCommand("CHANNEL", t.name, channelName), false)
+		}
 	}
 
 	return channel
@@ -122,8 +142,9 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel = NewChannel(t.name, channelName, t.nsqd, deleteCallback)
+		channel.replicated = t.replicated && !channel.ephemeral
 		t.channelMap[channelName] = channel
-		t.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
+		t.logf(LOG_INFO, "new channel(%s)", channel.name)
 		return channel, true
 	}
 	return channel, false
@@ -141,6 +162,21 @@ func (t *Topic) GetExistingChannel(channelName string) (*Channel, error) {
 
 // DeleteExistingChannel removes a channel from the topic only if it exists
 func (t *Topic) DeleteExistingChannel(channelName string) error {
+	return t.deleteExistingChannel(channelName, func(c *Channel) error {
+		t.logf(LOG_INFO, "deleting channel %s", c.name)
+		return c.Delete()
+	})
+}
+
+// deleteIdleChannel removes a channel from the topic only if it exists and is
+// still idle for at least ttl, errNotIdle otherwise
+func (t *Topic) deleteIdleChannel(channelName string, ttl time.Duration) error {
+	return t.deleteExistingChannel(channelName, func(c *Channel) error {
+		return c.deleteIfIdle(ttl)
+	})
+}
+
+func (t *Topic) deleteExistingChannel(channelName string, del func(*Channel) error) error {
 	t.RLock()
 	channel, ok := t.channelMap[channelName]
 	t.RUnlock()
@@ -148,20 +184,21 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 		return errors.New("channel does not exist")
 	}
 
-	t.nsqd.logf(LOG_INFO, "TOPIC(%s): deleting channel %s", t.name, channel.name)
-
 	// delete empties the channel before closing
 	// (so that we dont leave any messages around)
 	//
 	// we do this before removing the channel from map below (with no lock)
 	// so that any incoming subs will error and not create a new channel
 	// to enforce ordering
-	channel.Delete()
+	if err := del(channel); err == errNotIdle {
+		return err
+	}
 
 	t.Lock()
 	delete(t.channelMap, channelName)
 	numChannels := len(t.channelMap)
 	t.Unlock()
+	t.touch()
 
 	// update messagePump state
 	select {
@@ -169,6 +206,10 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	case <-t.exitChan:
 	}
 
+	if channel.replicated {
+		t.nsqd.replicate(replicationCommand("DELETE", t.name, channelName), false)
+	}
+
 	if numChannels == 0 && t.ephemeral {
 		go t.deleter.Do(func() { t.deleteCallback(t) })
 	}
@@ -176,15 +217,31 @@ func (t *Topic) DeleteExistingChannel(channelName string) error {
 	return nil
 }
 
-// PutMessage writes a Message to the queue
+// PutMessage writes a Message to the queue and routes it (see RouteRule)
 func (t *Topic) PutMessage(m *Message) error {
+	err := t.putMessage(m)
+	if err != nil {
+		return err
+	}
+	t.routeMessage(m)
+	return nil
+}
+
+func (t *Topic) putMessage(m *Message) error {
+	err := t.replicateMessages([]*Message{m})
+	if err != nil {
+		return err
+	}
+
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
+		t.dropReplicated([]*Message{m})
 		return errors.New("exiting")
 	}
-	err := t.put(m)
+	err = t.put(m)
 	if err != nil {
+		t.dropReplicated([]*Message{m})
 		return err
 	}
 	atomic.AddUint64(&t.messageCount, 1)
@@ -192,12 +249,29 @@ func (t *Topic) PutMessage(m *Message) error {
 	return nil
 }
 
-// PutMessages writes multiple Messages to the queue
+// PutMessages writes multiple Messages to the queue and routes the ones written
 func (t *Topic) PutMessages(msgs []*Message) error {
+	n, err := t.putMessages(msgs)
+	for _, m := range msgs[:n] {
+		t.routeMessage(m)
+	}
+	return err
+}
+
+// putMessages writes multiple Messages to the queue without routing them (eg. the
+// messages of a peer, which were routed when first published), it returns the
+// number of messages written
+func (t *Topic) putMessages(msgs []*Message) (int, error) {
+	err := t.replicateMessages(msgs)
+	if err != nil {
+		return 0, err
+	}
+
 	t.RLock()
 	defer t.RUnlock()
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
-		return errors.New("exiting")
+		t.dropReplicated(msgs)
+		return 0, errors.New("exiting")
 	}
 
 	messageTotalBytes := 0
@@ -205,25 +279,30 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	for i, m := range msgs {
 		err := t.put(m)
 		if err != nil {
+			t.dropReplicated(msgs[i:])
 			atomic.AddUint64(&t.messageCount, uint64(i))
 			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
-			return err
+			return i, err
 		}
 		messageTotalBytes += len(m.Body)
 	}
 
 	atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 	atomic.AddUint64(&t.messageCount, uint64(len(msgs)))
-	return nil
+	return len(msgs), nil
 }
 
 func (t *Topic) put(m *Message) error {
+	t.touch()
+	id, attempts := m.ID, m.Attempts
+
 	// If mem-queue-size == 0, avoid memory chan, for more consistent ordering,
 	// but try to use memory chan for deferred messages (they lose deferred timer
 	// in backend queue) or if topic is ephemeral (there is no backend queue).
 	if cap(t.memoryMsgChan) > 0 || t.ephemeral || m.deferred != 0 {
 		select {
 		case t.memoryMsgChan <- m:
+			t.nsqd.trace(TracePublish, t.name, "", "", id, attempts)
 			return nil
 		default:
 			break // write to backend
@@ -232,11 +311,10 @@ func (t *Topic) put(m *Message) error {
 	err := writeMessageToBackend(m, t.backend)
 	t.nsqd.SetHealth(err)
 	if err != nil {
-		t.nsqd.logf(LOG_ERROR,
-			"TOPIC(%s) ERROR: failed to write message to backend - %s",
-			t.name, err)
+		t.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 		return err
 	}
+	t.nsqd.trace(TracePublish, t.name, "", "", id, attempts)
 	return nil
 }
 
@@ -282,7 +360,7 @@ func (t *Topic) messagePump() {
 		select {
 		case msg = <-memoryMsgChan:
 		case buf = <-backendChan:
-			msg, err = decodeMessage(buf)
+			msg, err = decodeBackendMessage(buf)
 			if err != nil {
 				t.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
 				continue
@@ -315,6 +393,11 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
+		if t.dropAborted(msg) {
+			continue
+		}
+
+		spilled := msg.isSpilled()
 		for i, channel := range chans {
 			chanMsg := msg
 			// copy the message because each channel
@@ -325,6 +408,15 @@ func (t *Topic) messagePump() {
 				chanMsg = NewMessage(msg.ID, msg.Body)
 				chanMsg.Timestamp = msg.Timestamp
 				chanMsg.deferred = msg.deferred
+				chanMsg.spilled = msg.spilled
+			}
+			if spilled && !t.waitLinkSpill(msg, channel) {
+				// exiting, the message is copied to its channels again after a restart
+				err := writeMessageToBackend(msg, t.backend)
+				if err != nil {
+					t.logf(LOG_ERROR, "failed to write spilled msg(%s) to backend - %s", msg.ID, err)
+				}
+				goto exit
 			}
 			if chanMsg.deferred != 0 {
 				channel.PutMessageDeferred(chanMsg, chanMsg.deferred)
@@ -332,15 +424,17 @@ func (t *Topic) messagePump() {
 			}
 			err := channel.PutMessage(chanMsg)
 			if err != nil {
-				t.nsqd.logf(LOG_ERROR,
-					"TOPIC(%s) ERROR: failed to put msg(%s) to channel(%s) - %s",
-					t.name, msg.ID, channel.name, err)
+				t.logf(LOG_ERROR, "failed to put msg(%s) to channel(%s) - %s",
+					msg.ID, channel.name, err)
 			}
 		}
+		if spilled {
+			t.removeSpill(msg)
+		}
 	}
 
 exit:
-	t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing ... messagePump", t.name)
+	t.logf(LOG_INFO, "closing ... messagePump")
 }
 
 // Delete empties the topic and all its channels and closes
@@ -353,19 +447,42 @@ func (t *Topic) Close() error {
 	return t.exit(false)
 }
 
+// deleteIfIdle deletes the topic only if it has been idle (see idleFor) for at
+// least ttl, the exit flag is set under the lock that publishes and new channels
+// take so that none can come in between
+func (t *Topic) deleteIfIdle(ttl time.Duration) error {
+	t.Lock()
+	numChannels := len(t.channelMap)
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+	if numChannels > 0 || idle < ttl {
+		t.Unlock()
+		return errNotIdle
+	}
+	exiting := !atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1)
+	t.Unlock()
+	if exiting {
+		return errors.New("exiting")
+	}
+	return t.exited(true)
+}
+
 func (t *Topic) exit(deleted bool) error {
 	if !atomic.CompareAndSwapInt32(&t.exitFlag, 0, 1) {
 		return errors.New("exiting")
 	}
+	return t.exited(deleted)
+}
 
+// exited closes or deletes the topic once its exit flag is set
+func (t *Topic) exited(deleted bool) error {
 	if deleted {
-		t.nsqd.logf(LOG_INFO, "TOPIC(%s): deleting", t.name)
+		t.logf(LOG_INFO, "deleting")
 
 		// since we are explicitly deleting a topic (not just at system exit time)
 		// de-register this from the lookupd
 		t.nsqd.Notify(t, !t.ephemeral)
 	} else {
-		t.nsqd.logf(LOG_INFO, "TOPIC(%s): closing", t.name)
+		t.logf(LOG_INFO, "closing")
 	}
 
 	close(t.exitChan)
@@ -383,6 +500,7 @@ func (t *Topic) exit(deleted bool) error {
 
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
+		os.RemoveAll(spillDir(t.nsqd.getOpts().DataPath, t.name))
 		return t.backend.Delete()
 	}
 
@@ -412,23 +530,28 @@ func (t *Topic) Empty() error {
 	}
 
 finish:
+	t.abortedMutex.Lock()
+	t.abortedMsgs = make(map[MessageID]struct{})
+	atomic.StoreInt32(&t.abortedCount, 0)
+	t.abortedMutex.Unlock()
+	os.RemoveAll(t.spillDir())
 	return t.backend.Empty()
 }
 
 func (t *Topic) flush() error {
 	if len(t.memoryMsgChan) > 0 {
-		t.nsqd.logf(LOG_INFO,
-			"TOPIC(%s): flushing %d memory messages to backend",
-			t.name, len(t.memoryMsgChan))
+		t.logf(LOG_INFO, "flushing %d memory messages to backend", len(t.memoryMsgChan))
 	}
 
 	for {
 		select {
 		case msg := <-t.memoryMsgChan:
+			if t.dropAborted(msg) {
+				continue
+			}
 			err := writeMessageToBackend(msg, t.backend)
 			if err != nil {
-				t.nsqd.logf(LOG_ERROR,
-					"ERROR: failed to write message to backend - %s", err)
+				t.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 			}
 		default:
 			goto finish
@@ -472,8 +595,10 @@ func (t *Topic) UnPause() error {
 func (t *Topic) doPause(pause bool) error {
 	if pause {
 		atomic.StoreInt32(&t.paused, 1)
+		t.nsqd.emitEvent(SystemEvent{Type: EventTopicPaused, Topic: t.name})
 	} else {
 		atomic.StoreInt32(&t.paused, 0)
+		t.nsqd.emitEvent(SystemEvent{Type: EventTopicUnpaused, Topic: t.name})
 	}
 
 	select {
@@ -496,7 +621,7 @@ func (t *Topic) GenerateID() MessageID {
 			return id.Hex()
 		}
 		if i%10000 == 0 {
-			t.nsqd.logf(LOG_ERROR, "TOPIC(%s): failed to create guid - %s", t.name, err)
+			t.logf(LOG_ERROR, "failed to create guid - %s", err)
 		}
 		time.Sleep(time.Millisecond)
 		i++
@@ -8,6 +8,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -114,6 +115,116 @@ func TestHealth(t *testing.T) {
 	test.Equal(t, "OK", string(body))
 }
 
+func TestPutMultiTopicMessagesRollback(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicA := nsqd.GetTopic("test_mtpub_a")
+	channel := topicA.GetChannel("ch")
+	topicB := nsqd.GetTopic("test_mtpub_b")
+	topicB.backend = &errorBackendQueue{}
+
+	body := []byte("test body")
+	err := nsqd.PutMultiTopicMessages(map[string][][]byte{
+		"test_mtpub_a": {body},
+		"test_mtpub_b": {body, body, body},
+	})
+	test.NotNil(t, err)
+
+	// the message put on topic a is dropped instead of being delivered to the channel
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, int64(0), topicA.Depth())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(0), atomic.LoadUint64(&topicA.messageCount))
+
+	topicB.Empty()
+	topicB.backend = &errorRecoveredBackendQueue{}
+
+	err = nsqd.PutMultiTopicMessages(map[string][][]byte{
+		"test_mtpub_a": {body},
+		"test_mtpub_b": {body},
+	})
+	test.Nil(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&topicA.messageCount))
+}
+
+func TestPutMultiTopicMessagesRollbackRestart(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	// without channels the message stays in the backend of topic a
+	topicA := nsqd.GetTopic("test_mtpub_a")
+	topicB := nsqd.GetTopic("test_mtpub_b")
+	topicB.backend = &errorBackendQueue{}
+
+	body := []byte("test body")
+	err := nsqd.PutMultiTopicMessages(map[string][][]byte{
+		"test_mtpub_a": {body},
+		"test_mtpub_b": {body},
+	})
+	test.NotNil(t, err)
+	// the put to topic a is synchronous, the message is in its backend
+	test.Equal(t, int64(1), topicA.backend.Depth())
+	aborted := make(map[string]int)
+	for _, topic := range nsqd.GetMetadata(false).Topics {
+		aborted[topic.Name] = len(topic.Aborted)
+	}
+	test.Equal(t, map[string]int{"test_mtpub_a": 1, "test_mtpub_b": 0}, aborted)
+	nsqd.Exit()
+
+	// the rollback survives the restart
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+	err = nsqd.LoadMetadata()
+	test.Nil(t, err)
+
+	topicA, err = nsqd.GetExistingTopic("test_mtpub_a")
+	test.Nil(t, err)
+	channel := topicA.GetChannel("ch")
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, int64(0), topicA.Depth())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, 0, len(topicA.abortedIDs()))
+}
+
+func TestPublishMessagesRejectRollback(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_schema")
+	channel := topic.GetChannel("ch")
+	err := topic.SetSchema([]byte(`{"type": "object"}`), "test_schema_rejects")
+	test.Nil(t, err)
+	rejectTopic := nsqd.GetTopic("test_schema_rejects")
+	rejectTopic.backend = &errorBackendQueue{}
+
+	// the valid message is rolled back when the invalid one can't be rejected
+	err = topic.publishMessages([]*Message{
+		NewMessage(topic.GenerateID(), []byte(`{}`)),
+		NewMessage(topic.GenerateID(), []byte(`[]`)),
+	})
+	test.NotNil(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	test.Equal(t, int64(0), topic.Depth())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(0), atomic.LoadUint64(&topic.messageCount))
+}
+
 func TestDeletes(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -239,3 +350,78 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+type recordingBackendQueue struct {
+	errorBackendQueue
+	records [][]byte
+}
+
+func (d *recordingBackendQueue) Put(b []byte) error {
+	d.records = append(d.records, append([]byte(nil), b...))
+	return nil
+}
+
+func TestSpilledBackendRecords(t *testing.T) {
+	backend := &recordingBackendQueue{}
+
+	var id MessageID
+	copy(id[:], "0123456789abcdef")
+	msg := NewMessage(id, []byte("test body"))
+	err := writeMessageToBackend(msg, backend)
+	test.Nil(t, err)
+	spilled := NewMessage(id, spilledBody(4096))
+	spilled.spilled = true
+	err = writeMessageToBackend(spilled, backend)
+	test.Nil(t, err)
+
+	// records of messages that are not spilled are unchanged
+	plain, err := decodeMessage(backend.records[0])
+	test.Nil(t, err)
+	test.Equal(t, msg.Body, plain.Body)
+	test.Equal(t, byte(spilledRecord), backend.records[1][0])
+
+	decoded, err := decodeBackendMessage(backend.records[0])
+	test.Nil(t, err)
+	test.Equal(t, false, decoded.isSpilled())
+	test.Equal(t, msg.ID, decoded.ID)
+	test.Equal(t, msg.Timestamp, decoded.Timestamp)
+	test.Equal(t, msg.Body, decoded.Body)
+
+	decoded, err = decodeBackendMessage(backend.records[1])
+	test.Nil(t, err)
+	test.Equal(t, true, decoded.isSpilled())
+	test.Equal(t, spilled.ID, decoded.ID)
+	test.Equal(t, spilled.Timestamp, decoded.Timestamp)
+	test.Equal(t, int64(4096), decoded.spilledSize())
+}
+
+func TestShouldSpill(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.DataPath = t.TempDir()
+	opts.SpillMsgThreshold = 1024
+	opts.ReplicaTCPAddress = "127.0.0.1:0"
+	opts.ReplicateTopicRegexps = []string{`^replicated$`}
+	nsqd, err := New(opts)
+	test.Nil(t, err)
+	defer nsqd.Exit()
+
+	test.Equal(t, false, nsqd.shouldSpill("plain", 1024))
+	test.Equal(t, true, nsqd.shouldSpill("plain", 1025))
+	test.Equal(t, true, nsqd.shouldSpill("not_created_yet", 1025))
+
+	// replicated topics, topics with a schema and topics with routes need bodies in memory
+	test.Equal(t, false, nsqd.shouldSpill("replicated", 1025))
+	test.Equal(t, true, nsqd.shouldSpill("replicated#ephemeral", 1025))
+
+	err = nsqd.GetTopic("validated").SetSchema([]byte(`{"type": "object"}`), "")
+	test.Nil(t, err)
+	test.Equal(t, false, nsqd.shouldSpill("validated", 1025))
+
+	err = nsqd.SetRoute(nsqd.GetTopic("routed"), RouteRule{Target: "copies", Field: "id", Op: "exists"})
+	test.Nil(t, err)
+	test.Equal(t, false, nsqd.shouldSpill("routed", 1025))
+	test.Equal(t, true, nsqd.shouldSpill("copies", 1025))
+}
@@ -0,0 +1,168 @@
+package nsqd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// message lifecycle events recorded for the traced messages (see --trace-topic
+// and --trace-sample-rate)
+const (
+	TracePublish    = "publish"
+	TraceChannelPut = "channel_put"
+	TraceDeliver    = "deliver"
+	TraceTouch      = "touch"
+	TraceRequeue    = "requeue"
+	TraceTimeout    = "timeout"
+	TraceFinish     = "fin"
+)
+
+type TraceEvent struct {
+	Time     int64  `json:"time"`
+	Event    string `json:"event"`
+	ID       string `json:"id"`
+	Topic    string `json:"topic"`
+	Channel  string `json:"channel,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Attempts uint16 `json:"attempts"`
+}
+
+// tracer keeps the most recent trace events in a ring buffer and passes them on
+// to the subscribers of GET /trace?topic=
+type tracer struct {
+	sync.Mutex
+	events []TraceEvent
+	next   int
+	full   bool
+	subs   map[chan TraceEvent]string
+}
+
+func newTracer(size int) *tracer {
+	return &tracer{
+		events: make([]TraceEvent, size),
+		subs:   make(map[chan TraceEvent]string),
+	}
+}
+
+func (t *tracer) add(e TraceEvent) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.events) > 0 {
+		t.events[t.next] = e
+		t.next = (t.next + 1) % len(t.events)
+		if t.next == 0 {
+			t.full = true
+		}
+	}
+	for ch, topic := range t.subs {
+		if topic != e.Topic {
+			continue
+		}
+		// slow subscribers miss events rather than slow down the messages
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// find returns the buffered events matching f, oldest first
+func (t *tracer) find(f func(e *TraceEvent) bool) []TraceEvent {
+	events := []TraceEvent{}
+	start := 0
+	if t.full {
+		start = t.next
+	}
+	for i := 0; i < len(t.events); i++ {
+		idx := (start + i) % len(t.events)
+		if !t.full && idx >= t.next {
+			break
+		}
+		if f(&t.events[idx]) {
+			events = append(events, t.events[idx])
+		}
+	}
+	return events
+}
+
+// messageEvents returns the buffered events of the message id, IDs are only unique
+// per topic so they are limited to topicName unless it is empty
+func (t *tracer) messageEvents(id string, topicName string) []TraceEvent {
+	t.Lock()
+	defer t.Unlock()
+	return t.find(func(e *TraceEvent) bool {
+		return e.ID == id && (topicName == "" || e.Topic == topicName)
+	})
+}
+
+// subscribe returns the buffered events of topic and a channel for the next ones,
+// the channel must be passed to unsubscribe
+func (t *tracer) subscribe(topic string) ([]TraceEvent, chan TraceEvent) {
+	t.Lock()
+	defer t.Unlock()
+	ch := make(chan TraceEvent, 1024)
+	t.subs[ch] = topic
+	return t.find(func(e *TraceEvent) bool { return e.Topic == topic }), ch
+}
+
+func (t *tracer) unsubscribe(ch chan TraceEvent) {
+	t.Lock()
+	delete(t.subs, ch)
+	t.Unlock()
+}
+
+// isTraced returns whether the message is traced, the sampling is based on the ID
+// so that all the events of a sampled message are recorded
+func (n *NSQD) isTraced(topicName string, id MessageID) bool {
+	opts := n.getOpts()
+	for _, name := range opts.TraceTopics {
+		if name == topicName {
+			return true
+		}
+	}
+	if opts.TraceSampleRate <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write(id[:])
+	return float64(h.Sum32()) < opts.TraceSampleRate*math.MaxUint32
+}
+
+// trace takes the ID and attempts rather than the message as it may already be
+// in the hands of another goroutine
+func (n *NSQD) trace(event string, topicName string, channelName string, client string, id MessageID, attempts uint16) {
+	if !n.isTraced(topicName, id) {
+		return
+	}
+	n.tracer.add(TraceEvent{
+		Time:     time.Now().UnixNano(),
+		Event:    event,
+		ID:       string(id[:]),
+		Topic:    topicName,
+		Channel:  channelName,
+		Client:   client,
+		Attempts: attempts,
+	})
+}
+
+// trace records an event of a message of the channel, with the client it concerns if any
+func (c *Channel) trace(event string, clientID int64, id MessageID, attempts uint16) {
+	if !c.nsqd.isTraced(c.topicName, id) {
+		return
+	}
+	var client string
+	if clientID != 0 {
+		c.RLock()
+		consumer, ok := c.clients[clientID]
+		c.RUnlock()
+		if s, isStringer := consumer.(fmt.Stringer); ok && isStringer {
+			client = s.String()
+		} else {
+			client = fmt.Sprint(clientID)
+		}
+	}
+	c.nsqd.trace(event, c.topicName, c.name, client, id, attempts)
+}
@@ -0,0 +1,187 @@
+package nsqd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nsqio/nsq/internal/dirlock"
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/util"
+)
+
+// upgradeEnv is set for the nsqd exec'd by Upgrade, it lists the names of the
+// listeners it inherits starting at upgradeListenerFd
+const upgradeEnv = "NSQD_UPGRADE_LISTENERS"
+
+// upgradePidEnv is set for the nsqd exec'd by Upgrade to the pid of the previous one
+const upgradePidEnv = "NSQD_UPGRADE_PID"
+
+const (
+	// the pipe the new nsqd writes to once it is ready to take over
+	upgradeReadyFd = 3
+	// the first inherited listener
+	upgradeListenerFd = 4
+)
+
+// upgrade holds what an nsqd exec'd by Upgrade inherits from the previous one
+type upgrade struct {
+	listeners map[string]net.Listener
+	ready     *os.File
+	pid       int
+}
+
+// inheritUpgrade returns the listeners passed by the nsqd that exec'd this one,
+// nil if this nsqd was not started by Upgrade
+func inheritUpgrade() (*upgrade, error) {
+	names, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	pid, err := strconv.Atoi(os.Getenv(upgradePidEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s - %s", upgradePidEnv, err)
+	}
+	os.Unsetenv(upgradePidEnv)
+
+	u := &upgrade{
+		listeners: make(map[string]net.Listener),
+		ready:     os.NewFile(upgradeReadyFd, "upgrade-ready"),
+		pid:       pid,
+	}
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(upgradeListenerFd+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit %s listener - %s", name, err)
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		u.listeners[name] = l
+	}
+	return u, nil
+}
+
+// listen returns the inherited listener for name if any, a new one otherwise
+func (u *upgrade) listen(name string, addr string) (net.Listener, error) {
+	if u != nil {
+		if l, ok := u.listeners[name]; ok {
+			delete(u.listeners, name)
+			return l, nil
+		}
+	}
+	return net.Listen(util.TypeOfAddr(addr), addr)
+}
+
+// takeOver tells the previous nsqd to exit and waits for it to release the data path,
+// for as long as it is running: the data can not be loaded before it is done with it.
+// It warns every timeout that the previous nsqd is still running.
+func (u *upgrade) takeOver(dl *dirlock.DirLock, timeout time.Duration, logf lg.AppLogFunc) error {
+	// the listeners that are no longer configured
+	for _, l := range u.listeners {
+		l.Close()
+	}
+	u.ready.Write([]byte{1})
+	u.ready.Close()
+
+	warn := time.Now().Add(timeout)
+	for {
+		running := processRunning(u.pid)
+		err := dl.Lock()
+		if err == nil || !running {
+			// it released the lock when it exited, something else has it
+			return err
+		}
+		if time.Now().After(warn) {
+			logf(LOG_WARN, "previous nsqd (pid %d) is still running, waiting for it to exit", u.pid)
+			warn = time.Now().Add(timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Upgrade execs the nsqd binary at the same path with the same arguments and hands
+// it the TCP, HTTP and HTTPS listeners. It returns once the new nsqd is ready, the
+// caller must then Exit() so that the new one can lock the data path and load the
+// metadata, the connections accepted in the meantime wait in the listen backlog.
+func (n *NSQD) Upgrade() error {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return fmt.Errorf("failed to find nsqd binary - %s", err)
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range []struct {
+		name     string
+		listener net.Listener
+	}{
+		{"tcp", n.tcpListener},
+		{"http", n.httpListener},
+		{"https", n.httpsListener},
+	} {
+		if l.listener == nil {
+			continue
+		}
+		f, err := listenerFile(l.name, l.listener)
+		if err != nil {
+			return fmt.Errorf("failed to get %s listener file - %s", l.name, err)
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		upgradeEnv+"="+strings.Join(names, ","),
+		upgradePidEnv+"="+strconv.Itoa(os.Getpid()))
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to exec %s - %s", path, err)
+	}
+	pid := cmd.Process.Pid
+	n.logComponentf(LOG_INFO, "UPGRADE", "started %s (pid %d)", path, pid)
+
+	// the pipe is closed without a write if the new nsqd fails to start
+	r.SetReadDeadline(time.Now().Add(n.getOpts().UpgradeTimeout))
+	_, err = r.Read(make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new nsqd (pid %d) failed to start - %s", pid, err)
+	}
+	cmd.Process.Release()
+
+	// the unix sockets now belong to the new nsqd
+	for _, l := range []net.Listener{n.tcpListener, n.httpListener} {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	n.logComponentf(LOG_INFO, "UPGRADE", "new nsqd (pid %d) is ready", pid)
+	return nil
+}
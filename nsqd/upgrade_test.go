@@ -0,0 +1,132 @@
+package nsqd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/internal/dirlock"
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestMain(m *testing.M) {
+	// TestUpgrade execs the test binary as the new nsqd
+	if os.Getenv(upgradeEnv) != "" {
+		runUpgradedNSQD()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runUpgradedNSQD() {
+	opts := NewOptions()
+	opts.DataPath = os.Getenv("NSQD_TEST_DATA_PATH")
+	nsqd, err := New(opts)
+	if err != nil {
+		panic(err)
+	}
+	err = nsqd.LoadMetadata()
+	if err != nil {
+		panic(err)
+	}
+	go nsqd.Main()
+
+	// run until TestUpgrade creates the exit topic
+	for start := time.Now(); time.Since(start) < 10*time.Second; {
+		if _, err := nsqd.GetExistingTopic("upgrade_exit"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nsqd.Exit()
+}
+
+func TestUpgrade(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topic := nsqd.GetTopic("upgrade")
+	topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test body"))
+	topic.PutMessage(msg)
+
+	t.Setenv("NSQD_TEST_DATA_PATH", opts.DataPath)
+	err := nsqd.Upgrade()
+	test.Nil(t, err)
+	nsqd.Exit()
+
+	// the message is now served by the new nsqd on the same address
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, "upgrade", "ch")
+
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	msgOut, _ := decodeMessage(data)
+	test.Equal(t, frameTypeMessage, frameType)
+	test.Equal(t, msg.ID, msgOut.ID)
+	test.Equal(t, msg.Body, msgOut.Body)
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=upgrade_exit", httpAddr)
+	resp2, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp2.Body.Close()
+	test.Equal(t, 200, resp2.StatusCode)
+}
+
+func TestUpgradeTakeOverWaitsForExit(t *testing.T) {
+	dataPath, err := os.MkdirTemp("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	newUpgrade := func(pid int) *upgrade {
+		r, w, err := os.Pipe()
+		test.Nil(t, err)
+		t.Cleanup(func() { r.Close() })
+		return &upgrade{ready: w, pid: pid}
+	}
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		t.Logf(f, args...)
+	}
+
+	held := dirlock.New(dataPath)
+	test.Nil(t, held.Lock())
+
+	// the previous nsqd is still running, past the timeout
+	dl := dirlock.New(dataPath)
+	done := make(chan error)
+	go func() {
+		done <- newUpgrade(os.Getpid()).takeOver(dl, 10*time.Millisecond, logf)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("took over a locked data path - %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	held.Unlock()
+	test.Nil(t, <-done)
+	dl.Unlock()
+
+	// a process that exited can not be holding the lock
+	held = dirlock.New(dataPath)
+	test.Nil(t, held.Lock())
+	defer held.Unlock()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	test.Nil(t, cmd.Run())
+	err = newUpgrade(cmd.Process.Pid).takeOver(dirlock.New(dataPath), time.Minute, logf)
+	test.NotNil(t, err)
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package nsqd
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenerFile dups the listener's socket for the new nsqd, unlike the File method
+// of the listener it leaves the socket in non-blocking mode so that Exit can still
+// close the listener
+func listenerFile(name string, l net.Listener) (*os.File, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	err = rc.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		fd, dupErr = syscall.Dup(int(s))
+		if dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+		syscall.ForkLock.RUnlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// processRunning returns whether the process pid exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package nsqd
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func listenerFile(name string, l net.Listener) (*os.File, error) {
+	return nil, errors.New("upgrade is not supported on windows")
+}
+
+func processRunning(pid int) bool {
+	return false
+}
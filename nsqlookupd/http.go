@@ -8,6 +8,7 @@ import (
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -142,7 +143,7 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, "INVALID_ARG_TOPIC"}
 	}
 
-	s.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
+	s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName}, "DB: adding topic(%s)", topicName)
 	key := Registration{"topic", topicName, ""}
 	s.nsqlookupd.DB.AddRegistration(key)
 
@@ -162,13 +163,14 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 
 	registrations := s.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	for _, registration := range registrations {
-		s.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
+		s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName, Channel: registration.SubKey},
+			"DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
 		s.nsqlookupd.DB.RemoveRegistration(registration)
 	}
 
 	registrations = s.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 	for _, registration := range registrations {
-		s.nsqlookupd.logf(LOG_INFO, "DB: removing topic(%s)", topicName)
+		s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName}, "DB: removing topic(%s)", topicName)
 		s.nsqlookupd.DB.RemoveRegistration(registration)
 	}
 
@@ -191,7 +193,8 @@ func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.R
 		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
 	}
 
-	s.nsqlookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
+	s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName},
+		"DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
 	producers := s.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	for _, p := range producers {
 		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
@@ -214,11 +217,12 @@ func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, p
 		return nil, http_api.Err{400, err.Error()}
 	}
 
-	s.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
+	s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName, Channel: channelName},
+		"DB: adding channel(%s) in topic(%s)", channelName, topicName)
 	key := Registration{"channel", topicName, channelName}
 	s.nsqlookupd.DB.AddRegistration(key)
 
-	s.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
+	s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName}, "DB: adding topic(%s)", topicName)
 	key = Registration{"topic", topicName, ""}
 	s.nsqlookupd.DB.AddRegistration(key)
 
@@ -241,7 +245,8 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
 	}
 
-	s.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", channelName, topicName)
+	s.nsqlookupd.logFields(LOG_INFO, lg.Fields{Component: "DB", Topic: topicName, Channel: channelName},
+		"DB: removing channel(%s) from topic(%s)", channelName, topicName)
 	for _, registration := range registrations {
 		s.nsqlookupd.DB.RemoveRegistration(registration)
 	}
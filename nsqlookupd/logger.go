@@ -17,3 +17,22 @@ const (
 func (n *NSQLookupd) logf(level lg.LogLevel, f string, args ...interface{}) {
 	lg.Logf(n.opts.Logger, n.opts.LogLevel, level, f, args...)
 }
+
+// logFields logs a message along with the component, topic, channel or client it is
+// about, the message itself is expected to carry that context for the text log format
+func (n *NSQLookupd) logFields(level lg.LogLevel, fields lg.Fields, f string, args ...interface{}) {
+	lg.LogFieldsf(n.opts.Logger, n.opts.LogLevel, level, fields, f, args...)
+}
+
+// componentLogf returns the lg.AppLogFunc of the servers shared with the other apps
+// (see protocol.TCPServer and http_api.Serve)
+func (n *NSQLookupd) componentLogf(component string) lg.AppLogFunc {
+	return func(level lg.LogLevel, f string, args ...interface{}) {
+		n.logFields(level, lg.Fields{Component: component}, f, args...)
+	}
+}
+
+// clientFields returns the Fields of a message of component about the client at addr
+func clientFields(component string, addr string) lg.Fields {
+	return lg.Fields{Component: component, Client: addr, RemoteAddress: addr}
+}
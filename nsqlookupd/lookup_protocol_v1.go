@@ -48,11 +48,11 @@ func (p *LookupProtocolV1) IOLoop(c protocol.Client) error {
 			if parentErr := err.(protocol.ChildErr).Parent(); parentErr != nil {
 				ctx = " - " + parentErr.Error()
 			}
-			p.nsqlookupd.logf(LOG_ERROR, "[%s] - %s%s", client, err, ctx)
+			p.nsqlookupd.logFields(LOG_ERROR, clientFields("PROTOCOL", client.String()), "[%s] - %s%s", client, err, ctx)
 
 			_, sendErr := protocol.SendResponse(client, []byte(err.Error()))
 			if sendErr != nil {
-				p.nsqlookupd.logf(LOG_ERROR, "[%s] - %s%s", client, sendErr, ctx)
+				p.nsqlookupd.logFields(LOG_ERROR, clientFields("PROTOCOL", client.String()), "[%s] - %s%s", client, sendErr, ctx)
 				break
 			}
 
@@ -71,13 +71,13 @@ func (p *LookupProtocolV1) IOLoop(c protocol.Client) error {
 		}
 	}
 
-	p.nsqlookupd.logf(LOG_INFO, "PROTOCOL(V1): [%s] exiting ioloop", client)
+	p.nsqlookupd.logFields(LOG_INFO, clientFields("PROTOCOL", client.String()), "PROTOCOL(V1): [%s] exiting ioloop", client)
 
 	if client.peerInfo != nil {
 		registrations := p.nsqlookupd.DB.LookupRegistrations(client.peerInfo.id)
 		for _, r := range registrations {
 			if removed, _ := p.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
-				p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+				p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 					client, r.Category, r.Key, r.SubKey)
 			}
 		}
@@ -135,13 +135,13 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
 		if p.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
-			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
+			p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
 		}
 	}
 	key := Registration{"topic", topic, ""}
 	if p.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
-		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
+		p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 			client, "topic", topic, "")
 	}
 
@@ -162,7 +162,7 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		key := Registration{"channel", topic, channel}
 		removed, left := p.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id)
 		if removed {
-			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+			p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
 		}
 		// for ephemeral channels, remove the channel as well if it has no producers
@@ -178,7 +178,7 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		for _, r := range registrations {
 			removed, _ := p.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id)
 			if removed {
-				p.nsqlookupd.logf(LOG_WARN, "client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s",
+				p.nsqlookupd.logFields(LOG_WARN, clientFields("DB", client.String()), "client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s",
 					client, "channel", topic, r.SubKey)
 			}
 		}
@@ -186,7 +186,7 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		key := Registration{"topic", topic, ""}
 		removed, left := p.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id)
 		if removed {
-			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+			p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
 				client, "topic", topic, "")
 		}
 		if left == 0 && strings.HasSuffix(topic, "#ephemeral") {
@@ -232,12 +232,12 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
 
-	p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
+	p.nsqlookupd.logFields(LOG_INFO, clientFields("CLIENT", client.String()), "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
 		client, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version)
 
 	client.peerInfo = &peerInfo
 	if p.nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: client.peerInfo}) {
-		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
+		p.nsqlookupd.logFields(LOG_INFO, clientFields("DB", client.String()), "DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
 	}
 
 	// build a response
@@ -265,8 +265,8 @@ func (p *LookupProtocolV1) PING(client *ClientV1, params []string) ([]byte, erro
 		// we could get a PING before other commands on the same client connection
 		cur := time.Unix(0, atomic.LoadInt64(&client.peerInfo.lastUpdate))
 		now := time.Now()
-		p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): pinged (last ping %s)", client.peerInfo.id,
-			now.Sub(cur))
+		p.nsqlookupd.logFields(LOG_INFO, clientFields("CLIENT", client.peerInfo.id),
+			"CLIENT(%s): pinged (last ping %s)", client.peerInfo.id, now.Sub(cur))
 		atomic.StoreInt64(&client.peerInfo.lastUpdate, now.UnixNano())
 	}
 	return []byte("OK"), nil
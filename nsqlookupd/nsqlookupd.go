@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
@@ -26,8 +27,15 @@ type NSQLookupd struct {
 func New(opts *Options) (*NSQLookupd, error) {
 	var err error
 
+	if err := lg.ValidateFormat(opts.LogFormat); err != nil {
+		return nil, err
+	}
 	if opts.Logger == nil {
-		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		if opts.LogFormat == lg.JSONFormat {
+			opts.Logger = lg.NewJSONLogger(os.Stderr, "nsqlookupd")
+		} else {
+			opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
+		}
 	}
 	l := &NSQLookupd{
 		opts: opts,
@@ -64,11 +72,11 @@ func (l *NSQLookupd) Main() error {
 	}
 
 	l.waitGroup.Wrap(func() {
-		exitFunc(protocol.TCPServer(l.tcpListener, l.tcpServer, l.logf))
+		exitFunc(protocol.TCPServer(l.tcpListener, l.tcpServer, l.componentLogf("TCP")))
 	})
 	httpServer := newHTTPServer(l)
 	l.waitGroup.Wrap(func() {
-		exitFunc(http_api.Serve(l.httpListener, httpServer, "HTTP", l.logf))
+		exitFunc(http_api.Serve(l.httpListener, httpServer, "HTTP", l.componentLogf("HTTP")))
 	})
 
 	err := <-exitCh
@@ -11,6 +11,7 @@ import (
 type Options struct {
 	LogLevel  lg.LogLevel `flag:"log-level"`
 	LogPrefix string      `flag:"log-prefix"`
+	LogFormat string      `flag:"log-format"`
 	Logger    Logger
 
 	TCPAddress       string `flag:"tcp-address"`
@@ -30,6 +31,7 @@ func NewOptions() *Options {
 	return &Options{
 		LogPrefix:        "[nsqlookupd] ",
 		LogLevel:         lg.INFO,
+		LogFormat:        lg.TextFormat,
 		TCPAddress:       "0.0.0.0:4160",
 		HTTPAddress:      "0.0.0.0:4161",
 		BroadcastAddress: hostname,
@@ -14,7 +14,9 @@ type tcpServer struct {
 }
 
 func (p *tcpServer) Handle(conn net.Conn) {
-	p.nsqlookupd.logf(LOG_INFO, "TCP: new client(%s)", conn.RemoteAddr())
+	addr := conn.RemoteAddr().String()
+	fields := clientFields("CLIENT", addr)
+	p.nsqlookupd.logFields(LOG_INFO, clientFields("TCP", addr), "TCP: new client(%s)", addr)
 
 	// The client should initialize itself by sending a 4 byte sequence indicating
 	// the version of the protocol that it intends to communicate, this will allow us
@@ -22,14 +24,13 @@ func (p *tcpServer) Handle(conn net.Conn) {
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
-		p.nsqlookupd.logf(LOG_ERROR, "failed to read protocol version - %s", err)
+		p.nsqlookupd.logFields(LOG_ERROR, fields, "failed to read protocol version - %s", err)
 		conn.Close()
 		return
 	}
 	protocolMagic := string(buf)
 
-	p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): desired protocol magic '%s'",
-		conn.RemoteAddr(), protocolMagic)
+	p.nsqlookupd.logFields(LOG_INFO, fields, "CLIENT(%s): desired protocol magic '%s'", addr, protocolMagic)
 
 	var prot protocol.Protocol
 	switch protocolMagic {
@@ -38,8 +39,7 @@ func (p *tcpServer) Handle(conn net.Conn) {
 	default:
 		protocol.SendResponse(conn, []byte("E_BAD_PROTOCOL"))
 		conn.Close()
-		p.nsqlookupd.logf(LOG_ERROR, "client(%s) bad protocol magic '%s'",
-			conn.RemoteAddr(), protocolMagic)
+		p.nsqlookupd.logFields(LOG_ERROR, fields, "client(%s) bad protocol magic '%s'", addr, protocolMagic)
 		return
 	}
 
@@ -48,7 +48,7 @@ func (p *tcpServer) Handle(conn net.Conn) {
 
 	err = prot.IOLoop(client)
 	if err != nil {
-		p.nsqlookupd.logf(LOG_ERROR, "client(%s) - %s", conn.RemoteAddr(), err)
+		p.nsqlookupd.logFields(LOG_ERROR, fields, "client(%s) - %s", addr, err)
 	}
 
 	p.conns.Delete(conn.RemoteAddr())